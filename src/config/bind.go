@@ -12,10 +12,23 @@ func (c *Config) BindFlags(cmd *cobra.Command) {
 	cmd.Flags().UintVar(&c.Queue.Mark, "mark", c.Queue.Mark, "Packet mark value (default 32768)")
 	cmd.Flags().BoolVar(&c.Queue.IPv4Enabled, "ipv4", c.Queue.IPv4Enabled, "Enable IPv4 processing")
 	cmd.Flags().BoolVar(&c.Queue.IPv6Enabled, "ipv6", c.Queue.IPv6Enabled, "Enable IPv6 processing")
+	cmd.Flags().IntVar(&c.Queue.ReassemblyTimeout, "reassembly-timeout", c.Queue.ReassemblyTimeout, "Milliseconds to hold a ClientHello split across segments (0 disables)")
+	cmd.Flags().StringVar(&c.Queue.VerdictMode, "verdict-mode", c.Queue.VerdictMode, "How modified packets leave the queue: reinject (raw socket) or modify (first segment in the accept verdict)")
+	cmd.Flags().IntVar(&c.Queue.InjectWorkers, "inject-workers", c.Queue.InjectWorkers, "Number of packet injection workers per queue")
+	cmd.Flags().IntVar(&c.Queue.InjectQueueSize, "inject-queue-size", c.Queue.InjectQueueSize, "Matched packets waiting for injection per queue before new ones pass unmodified")
 
 	// System configuration
-	cmd.Flags().IntVar(&c.System.Tables.MonitorInterval, "tables-monitor-interval", c.System.Tables.MonitorInterval, "Tables monitor interval in seconds (default 10, 0 to disable)")
+	cmd.Flags().IntVar(&c.System.Tables.MonitorInterval, "tables-monitor-interval", c.System.Tables.MonitorInterval, "Tables monitor fallback polling interval in seconds, nftables changes are handled as they happen (default 10, 0 to disable)")
 	cmd.Flags().BoolVar(&c.System.Tables.SkipSetup, "skip-tables", c.System.Tables.SkipSetup, "Skip iptables/nftables setup on startup")
+	cmd.Flags().StringVar(&c.System.Tables.Integration, "tables-integration", c.System.Tables.Integration, "Let the system firewall own the rules: none, auto, fw4 (OpenWrt include file) or firewalld (direct rules)")
+	cmd.Flags().BoolVar(&c.System.Transparent.Enabled, "transparent-proxy", c.System.Transparent.Enabled, "Redirect TCP connections to a local proxy instead of the netfilter queue, for systems without NFQUEUE")
+	cmd.Flags().IntVar(&c.System.Transparent.Port, "transparent-port", c.System.Transparent.Port, "Port of the transparent proxy listener")
+	cmd.Flags().StringVar(&c.System.Transparent.Mode, "transparent-mode", c.System.Transparent.Mode, "How connections reach the transparent proxy: redirect (local and forwarded traffic) or tproxy (forwarded traffic only)")
+	cmd.Flags().BoolVar(&c.System.Proxy.Enabled, "proxy", c.System.Proxy.Enabled, "Run a SOCKS5 and HTTP CONNECT proxy applying the set strategies to its connections")
+	cmd.Flags().StringVar(&c.System.Proxy.Address, "proxy-address", c.System.Proxy.Address, "Listen address of the SOCKS5 and HTTP CONNECT proxy")
+	cmd.Flags().StringVar(&c.System.Proxy.Username, "proxy-user", c.System.Proxy.Username, "Username the proxy clients must authenticate with (empty for no auth)")
+	cmd.Flags().StringVar(&c.System.Proxy.Password, "proxy-password", c.System.Proxy.Password, "Password the proxy clients must authenticate with")
+	cmd.Flags().BoolVar(&c.System.Tables.KernelSets, "kernel-sets", c.System.Tables.KernelSets, "Keep target IPs in nftables sets / ipsets and queue only traffic to them where no set needs SNI matching")
 
 	// Logging configuration
 	cmd.Flags().BoolVarP(&c.System.Logging.Instaflush, "instaflush", "i", c.System.Logging.Instaflush, "Flush logs immediately")
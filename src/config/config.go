@@ -36,12 +36,23 @@ var DefaultSetConfig = SetConfig{
 		Seg2Delay:      0,
 	},
 
+	HTTP: HTTPConfig{
+		Enabled:     false,
+		HostSplit:   true,
+		HostCase:    false,
+		DomainCase:  false,
+		HostNoSpace: false,
+		FakeRequest: false,
+		FakeHost:    "www.google.com",
+	},
+
 	TCP: TCPConfig{
 		ConnBytesLimit: 19,
 		Seg2Delay:      0,
 		SynFake:        false,
 		SynFakeLen:     0,
 		SynTTL:         7,
+		DPortFilter:    "",
 
 		DropSACK: false,
 
@@ -65,12 +76,48 @@ var DefaultSetConfig = SetConfig{
 			FakeCount: 3,
 			Strategy:  "badsum",
 		},
+
+		Forged: ForgedConfig{
+			Enabled:      false,
+			TTLTolerance: 2,
+			Window:       true,
+		},
+
+		SynAck: SynAckConfig{
+			Enabled: false,
+			Window:  1,
+			WScale:  -1,
+			MSS:     0,
+			Packets: 1,
+		},
 	},
 
 	DNS: DNSConfig{
 		Enabled:       false,
 		FragmentQuery: false,
 		TargetDNS:     "",
+		Upstream:      "",
+		Bootstrap:     []string{},
+		PlainFallback: false,
+		LearnIPs:      false,
+		FilterForged:  false,
+		HoldMs:        200,
+		BogusIPs: []string{
+			"0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+			"::/128", "::1/128", "fc00::/7",
+		},
+		Hosts: map[string][]string{},
+	},
+
+	Pipeline: "",
+
+	Fallback: FallbackConfig{
+		Enabled:    false,
+		Strategies: []string{},
+		Failures:   2,
+		Timeout:    3000,
+		Decay:      3600,
+		Expire:     604800,
 	},
 
 	Fragmentation: FragmentationConfig{
@@ -85,6 +132,8 @@ var DefaultSetConfig = SetConfig{
 		SeqOverlapBytes:   []byte{},
 		SeqOverlapPattern: []string{},
 
+		SplitPositions: []string{},
+
 		Combo: ComboFragConfig{
 			FirstByteSplit: true,
 			ExtensionSplit: true,
@@ -122,6 +171,13 @@ var DefaultSetConfig = SetConfig{
 			FakeExtCount: 5,
 			FakeSNIs:     []string{"ya.ru", "vk.com", "max.ru"},
 		},
+
+		AutoTTL: AutoTTLConfig{
+			Enabled: false,
+			Delta:   1,
+			Min:     3,
+			Max:     20,
+		},
 	},
 
 	Targets: TargetsConfig{
@@ -148,6 +204,10 @@ var DefaultConfig = Config{
 			WhiteIsBlack: false,
 			Mac:          []string{},
 		},
+		ReassemblyTimeout: 200,
+		VerdictMode:       VerdictReinject,
+		InjectWorkers:     4,
+		InjectQueueSize:   256,
 	},
 
 	Sets: []*SetConfig{},
@@ -165,6 +225,19 @@ var DefaultConfig = Config{
 		Tables: TablesConfig{
 			MonitorInterval: 10,
 			SkipSetup:       false,
+			KernelSets:      false,
+			Integration:     IntegrationNone,
+		},
+
+		Transparent: TransparentConfig{
+			Enabled: false,
+			Port:    10443,
+			Mode:    TransparentRedirect,
+		},
+
+		Proxy: ProxyConfig{
+			Enabled: false,
+			Address: "127.0.0.1:1080",
 		},
 
 		WebServer: WebServerConfig{
@@ -204,7 +277,12 @@ func NewSetConfig() SetConfig {
 	cfg.Targets.GeoIpCategories = append(make([]string, 0), DefaultSetConfig.Targets.GeoIpCategories...)
 	cfg.Fragmentation.Combo.DecoySNIs = append(make([]string, 0), DefaultSetConfig.Fragmentation.Combo.DecoySNIs...)
 	cfg.Fragmentation.SeqOverlapPattern = append(make([]string, 0), DefaultSetConfig.Fragmentation.SeqOverlapPattern...)
+	cfg.Fragmentation.SplitPositions = append(make([]string, 0), DefaultSetConfig.Fragmentation.SplitPositions...)
+	cfg.Fallback.Strategies = append(make([]string, 0), DefaultSetConfig.Fallback.Strategies...)
 	cfg.Faking.TLSMod = append(make([]string, 0), DefaultSetConfig.Faking.TLSMod...)
+	cfg.DNS.Bootstrap = append(make([]string, 0), DefaultSetConfig.DNS.Bootstrap...)
+	cfg.DNS.BogusIPs = append(make([]string, 0), DefaultSetConfig.DNS.BogusIPs...)
+	cfg.DNS.Hosts = make(map[string][]string)
 
 	return cfg
 }
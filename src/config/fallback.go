@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var fragmentationStrategies = []string{"tcp", "ip", "tls", "oob", "disorder", "extsplit", "firstbyte", "combo", "hybrid", ConfigNone}
+
+// FallbackLevel is one parsed entry of a set's fallback list: either a
+// fragmentation strategy name or a strategy pipeline.
+type FallbackLevel struct {
+	Strategy string
+	Pipeline []PipelineStep
+}
+
+// ParseFallbackLevels parses the fallback list of a set. Entries naming a
+// fragmentation strategy ("tls", "disorder", ...) swap the strategy, anything
+// else is parsed as a pipeline expression.
+func ParseFallbackLevels(entries []string) ([]FallbackLevel, error) {
+	var levels []FallbackLevel
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if name := strings.ToLower(entry); slices.Contains(fragmentationStrategies, name) {
+			levels = append(levels, FallbackLevel{Strategy: name})
+			continue
+		}
+
+		steps, err := ParsePipeline(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		levels = append(levels, FallbackLevel{Strategy: entry, Pipeline: steps})
+	}
+	return levels, nil
+}
@@ -0,0 +1,26 @@
+package config
+
+import "testing"
+
+func TestParseFallbackLevels(t *testing.T) {
+	levels, err := ParseFallbackLevels([]string{"TLS", " ", "disorder", "fake(ttl=4); split(at=sni)"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(levels) != 3 {
+		t.Fatalf("expected 3 levels, got %d", len(levels))
+	}
+	if levels[0].Strategy != "tls" || levels[0].Pipeline != nil {
+		t.Errorf("expected plain tls strategy, got %+v", levels[0])
+	}
+	if levels[1].Strategy != "disorder" || levels[1].Pipeline != nil {
+		t.Errorf("strategy names should win over pipeline actions, got %+v", levels[1])
+	}
+	if len(levels[2].Pipeline) != 2 {
+		t.Errorf("expected a 2-step pipeline, got %+v", levels[2])
+	}
+
+	if _, err := ParseFallbackLevels([]string{"tcp", "bogus"}); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -111,6 +113,80 @@ func (c *Config) Validate() error {
 
 	for _, set := range c.Sets {
 
+		steps, err := ParsePipeline(set.Pipeline)
+		if err != nil {
+			return fmt.Errorf("set '%s': invalid pipeline: %w", set.Name, err)
+		}
+		set.PipelineSteps = steps
+
+		points, err := ParseSplitPositions(set.Fragmentation.SplitPositions)
+		if err != nil {
+			return fmt.Errorf("set '%s': invalid split position: %w", set.Name, err)
+		}
+		set.Fragmentation.SplitPoints = points
+
+		if at := set.Faking.AutoTTL; at.Max > 0 && at.Min > at.Max {
+			return fmt.Errorf("set '%s': auto TTL min %d exceeds max %d", set.Name, at.Min, at.Max)
+		}
+
+		if sa := set.TCP.SynAck; sa.Enabled && (sa.Window == 0 || sa.WScale < -1 || sa.WScale > 14) {
+			return fmt.Errorf("set '%s': SYN-ACK window must be positive and wscale between -1 and 14", set.Name)
+		}
+
+		if up := set.DNS.Upstream; up != "" {
+			u, err := url.Parse(up)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "tls") || u.Hostname() == "" {
+				return fmt.Errorf("set '%s': DNS upstream must be an https:// or tls:// URL", set.Name)
+			}
+		}
+		for _, ip := range set.DNS.Bootstrap {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("set '%s': invalid DNS bootstrap address %q", set.Name, ip)
+			}
+		}
+		if set.DNS.FilterForged && (set.DNS.HoldMs < 0 || set.DNS.HoldMs > 2000) {
+			return fmt.Errorf("set '%s': DNS hold time must be between 0 and 2000 ms", set.Name)
+		}
+		set.DNS.BogusNets = nil
+		for _, b := range set.DNS.BogusIPs {
+			cidr := b
+			if !strings.Contains(b, "/") {
+				if ip := net.ParseIP(b); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("set '%s': invalid bogus DNS address %q", set.Name, b)
+			}
+			set.DNS.BogusNets = append(set.DNS.BogusNets, n)
+		}
+		set.DNS.HostIPs = make(map[string][]net.IP, len(set.DNS.Hosts))
+		for name, addrs := range set.DNS.Hosts {
+			host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+			if strings.TrimPrefix(host, "*.") == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return fmt.Errorf("set '%s': invalid DNS host %q", set.Name, name)
+			}
+			if len(addrs) == 0 {
+				return fmt.Errorf("set '%s': DNS host %q has no addresses", set.Name, name)
+			}
+			for _, a := range addrs {
+				ip := net.ParseIP(strings.TrimSpace(a))
+				if ip == nil {
+					return fmt.Errorf("set '%s': invalid address %q for DNS host %q", set.Name, a, name)
+				}
+				set.DNS.HostIPs[host] = append(set.DNS.HostIPs[host], ip)
+			}
+		}
+
+		levels, err := ParseFallbackLevels(set.Fallback.Strategies)
+		if err != nil {
+			return fmt.Errorf("set '%s': invalid fallback strategy %w", set.Name, err)
+		}
+		set.Fallback.Levels = levels
+
 		if len(set.Fragmentation.SeqOverlapPattern) > 0 {
 			set.Fragmentation.SeqOverlapBytes = make([]byte, len(set.Fragmentation.SeqOverlapPattern))
 			for i, s := range set.Fragmentation.SeqOverlapPattern {
@@ -119,17 +195,6 @@ func (c *Config) Validate() error {
 				set.Fragmentation.SeqOverlapBytes[i] = byte(b)
 			}
 		}
-
-		if set.Id == MAIN_SET_ID {
-			continue
-		}
-		if set.TCP.ConnBytesLimit > c.MainSet.TCP.ConnBytesLimit {
-			set.TCP.ConnBytesLimit = c.MainSet.TCP.ConnBytesLimit
-		}
-		if set.UDP.ConnBytesLimit > c.MainSet.UDP.ConnBytesLimit {
-			set.UDP.ConnBytesLimit = c.MainSet.UDP.ConnBytesLimit
-		}
-
 	}
 
 	if len(c.MainSet.Targets.GeoSiteCategories) > 0 && c.System.Geo.GeoSitePath == "" {
@@ -148,6 +213,55 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("queue-num must be between 0 and 65535")
 	}
 
+	if c.Queue.InjectWorkers < 1 {
+		return fmt.Errorf("inject-workers must be at least 1")
+	}
+
+	if c.Queue.InjectQueueSize < 1 {
+		return fmt.Errorf("inject-queue-size must be at least 1")
+	}
+
+	switch c.Queue.VerdictMode {
+	case "":
+		c.Queue.VerdictMode = VerdictReinject
+	case VerdictReinject, VerdictModify:
+	default:
+		return fmt.Errorf("verdict-mode must be %q or %q", VerdictReinject, VerdictModify)
+	}
+
+	switch c.System.Tables.Integration {
+	case "":
+		c.System.Tables.Integration = IntegrationNone
+	case IntegrationNone, IntegrationAuto, IntegrationFW4, IntegrationFirewalld:
+	default:
+		return fmt.Errorf("tables-integration must be one of %q, %q, %q or %q",
+			IntegrationNone, IntegrationAuto, IntegrationFW4, IntegrationFirewalld)
+	}
+
+	switch c.System.Transparent.Mode {
+	case "":
+		c.System.Transparent.Mode = TransparentRedirect
+	case TransparentRedirect, TransparentTProxy:
+	default:
+		return fmt.Errorf("transparent-mode must be %q or %q", TransparentRedirect, TransparentTProxy)
+	}
+	if c.System.Transparent.Enabled && (c.System.Transparent.Port < 1 || c.System.Transparent.Port > 65535) {
+		return fmt.Errorf("transparent-port must be between 1 and 65535")
+	}
+
+	if c.System.Proxy.Enabled {
+		_, port, err := net.SplitHostPort(c.System.Proxy.Address)
+		if err != nil {
+			return fmt.Errorf("proxy-address must be host:port: %w", err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("proxy-address port must be between 1 and 65535")
+		}
+	}
+	if c.System.Proxy.Username == "" && c.System.Proxy.Password != "" {
+		return fmt.Errorf("proxy-password needs proxy-user")
+	}
+
 	if len(c.Sets) >= 1 {
 		for _, set := range c.Sets {
 			if set.Id == "" {
@@ -156,10 +270,12 @@ func (c *Config) Validate() error {
 
 			if set.Id == MAIN_SET_ID {
 				set.UDP.DPortFilter = utils.ValidatePorts(set.UDP.DPortFilter)
+				set.TCP.DPortFilter = utils.ValidatePorts(set.TCP.DPortFilter)
 				continue
 			}
 
 			set.UDP.DPortFilter = utils.ValidatePorts(set.UDP.DPortFilter)
+			set.TCP.DPortFilter = utils.ValidatePorts(set.TCP.DPortFilter)
 		}
 	}
 
@@ -296,9 +412,23 @@ func (set *SetConfig) ResetToDefaults() {
 	set.Fragmentation.SeqOverlapPattern = make([]string, len(defaultSet.Fragmentation.SeqOverlapPattern))
 	copy(set.Fragmentation.SeqOverlapPattern, defaultSet.Fragmentation.SeqOverlapPattern)
 
+	set.Fragmentation.SplitPositions = make([]string, len(defaultSet.Fragmentation.SplitPositions))
+	copy(set.Fragmentation.SplitPositions, defaultSet.Fragmentation.SplitPositions)
+
+	set.Fallback.Strategies = make([]string, len(defaultSet.Fallback.Strategies))
+	copy(set.Fallback.Strategies, defaultSet.Fallback.Strategies)
+
 	set.Faking.TLSMod = make([]string, len(defaultSet.Faking.TLSMod))
 	copy(set.Faking.TLSMod, defaultSet.Faking.TLSMod)
 
+	set.DNS.Bootstrap = make([]string, len(defaultSet.DNS.Bootstrap))
+	copy(set.DNS.Bootstrap, defaultSet.DNS.Bootstrap)
+
+	set.DNS.BogusIPs = make([]string, len(defaultSet.DNS.BogusIPs))
+	copy(set.DNS.BogusIPs, defaultSet.DNS.BogusIPs)
+
+	set.DNS.Hosts = make(map[string][]string)
+
 }
 
 func (t *TargetsConfig) AppendIP(ip []string) error {
@@ -349,14 +479,46 @@ func (t *TargetsConfig) AppendSNI(sni string) error {
 }
 
 func (cfg *Config) CollectUDPPorts() []string {
+	return collectPorts(cfg.Sets, udpPortFilter)
+}
+
+// CollectTCPPorts returns the merged list of TCP destination ports that must be
+// queued: 443 plus every port from enabled sets' TCP port filters, and 80 for
+// sets inspecting plain HTTP.
+func (cfg *Config) CollectTCPPorts() []string {
+	return collectPorts(cfg.Sets, tcpPortFilter)
+}
+
+// TCPPorts returns the TCP destination ports the set is applied to.
+func (set *SetConfig) TCPPorts() []string {
+	return collectPorts([]*SetConfig{set}, tcpPortFilter)
+}
+
+// UDPPorts returns the UDP destination ports the set is applied to.
+func (set *SetConfig) UDPPorts() []string {
+	return collectPorts([]*SetConfig{set}, udpPortFilter)
+}
+
+func tcpPortFilter(set *SetConfig) string {
+	if set.HTTP.Enabled {
+		return set.TCP.DPortFilter + ",80"
+	}
+	return set.TCP.DPortFilter
+}
+
+func udpPortFilter(set *SetConfig) string {
+	return set.UDP.DPortFilter
+}
+
+func collectPorts(sets []*SetConfig, filter func(*SetConfig) string) []string {
 	portSet := make(map[string]bool)
 	portSet["443"] = true
 
-	for _, set := range cfg.Sets {
-		if !set.Enabled || set.UDP.DPortFilter == "" {
+	for _, set := range sets {
+		if !set.Enabled || filter(set) == "" {
 			continue
 		}
-		for _, p := range strings.Split(set.UDP.DPortFilter, ",") {
+		for _, p := range strings.Split(filter(set), ",") {
 			p = strings.TrimSpace(p)
 			if p != "" {
 				portSet[p] = true
@@ -472,3 +634,19 @@ func mergeAndNormalizePorts(ports []string) []string {
 	}
 	return result
 }
+
+// LookupHost returns the addresses configured for domain, from an entry
+// for the name itself or else from the closest wildcard covering it.
+func (d *DNSConfig) LookupHost(domain string) []net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ips, ok := d.HostIPs[domain]; ok {
+		return ips
+	}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		if ips, ok := d.HostIPs["*."+domain]; ok {
+			return ips
+		}
+	}
+	return nil
+}
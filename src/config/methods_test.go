@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -174,41 +175,29 @@ func TestValidate(t *testing.T) {
 		}
 	})
 
-	t.Run("set TCP ConnBytesLimit > main gets capped", func(t *testing.T) {
+	t.Run("set ConnBytesLimit above main is kept", func(t *testing.T) {
 		cfg := NewConfig()
 		cfg.Validate()
 
 		secondSet := NewSetConfig()
 		secondSet.Id = "second"
 		secondSet.TCP.ConnBytesLimit = cfg.MainSet.TCP.ConnBytesLimit + 10
-		cfg.Sets = append(cfg.Sets, &secondSet)
-
-		if err := cfg.Validate(); err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if secondSet.TCP.ConnBytesLimit != cfg.MainSet.TCP.ConnBytesLimit {
-			t.Errorf("expected TCP ConnBytesLimit to be capped to %d, got %d",
-				cfg.MainSet.TCP.ConnBytesLimit, secondSet.TCP.ConnBytesLimit)
-		}
-	})
-
-	t.Run("set UDP ConnBytesLimit > main gets capped", func(t *testing.T) {
-		cfg := NewConfig()
-		cfg.Validate()
-
-		secondSet := NewSetConfig()
-		secondSet.Id = "second"
 		secondSet.UDP.ConnBytesLimit = cfg.MainSet.UDP.ConnBytesLimit + 10
 		cfg.Sets = append(cfg.Sets, &secondSet)
 
 		if err := cfg.Validate(); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if secondSet.UDP.ConnBytesLimit != cfg.MainSet.UDP.ConnBytesLimit {
-			t.Errorf("expected UDP ConnBytesLimit to be capped to %d, got %d",
-				cfg.MainSet.UDP.ConnBytesLimit, secondSet.UDP.ConnBytesLimit)
+		if secondSet.TCP.ConnBytesLimit != cfg.MainSet.TCP.ConnBytesLimit+10 {
+			t.Errorf("expected TCP ConnBytesLimit %d, got %d",
+				cfg.MainSet.TCP.ConnBytesLimit+10, secondSet.TCP.ConnBytesLimit)
+		}
+		if secondSet.UDP.ConnBytesLimit != cfg.MainSet.UDP.ConnBytesLimit+10 {
+			t.Errorf("expected UDP ConnBytesLimit %d, got %d",
+				cfg.MainSet.UDP.ConnBytesLimit+10, secondSet.UDP.ConnBytesLimit)
 		}
 	})
+
 	t.Run("set without id fails", func(t *testing.T) {
 		cfg := NewConfig()
 		cfg.Validate()
@@ -457,3 +446,216 @@ func TestResetToDefaults(t *testing.T) {
 			DefaultSetConfig.Fragmentation.SNIPosition, set.Fragmentation.SNIPosition)
 	}
 }
+
+func TestCollectTCPPorts(t *testing.T) {
+	cfg := NewConfig()
+	if got := cfg.CollectTCPPorts(); len(got) != 1 || got[0] != "443" {
+		t.Fatalf("expected only 443 by default, got %v", got)
+	}
+
+	a := NewSetConfig()
+	a.TCP.DPortFilter = "8443,2053"
+	b := NewSetConfig()
+	b.TCP.DPortFilter = "6000-6100,6050"
+	disabled := NewSetConfig()
+	disabled.Enabled = false
+	disabled.TCP.DPortFilter = "9000"
+	cfg.Sets = []*SetConfig{&a, &b, &disabled}
+
+	got := strings.Join(cfg.CollectTCPPorts(), ",")
+	if got != "443,2053,6000-6100,8443" {
+		t.Errorf("unexpected ports: %s", got)
+	}
+
+	b.HTTP.Enabled = true
+	got = strings.Join(cfg.CollectTCPPorts(), ",")
+	if got != "80,443,2053,6000-6100,8443" {
+		t.Errorf("expected port 80 for HTTP-enabled set, got %s", got)
+	}
+}
+
+func TestValidate_AutoTTLBounds(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "custom"
+	set.Faking.AutoTTL = AutoTTLConfig{Enabled: true, Delta: 1, Min: 10, Max: 5}
+	cfg.Sets = []*SetConfig{&set}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error when auto TTL min exceeds max")
+	}
+
+	set.Faking.AutoTTL.Max = 0
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("max 0 should mean unbounded, got %v", err)
+	}
+}
+
+func TestValidate_SynAckWindow(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "custom"
+	set.TCP.SynAck.Enabled = true
+	set.TCP.SynAck.WScale = 15
+	cfg.Sets = []*SetConfig{&set}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for wscale above 14")
+	}
+
+	set.TCP.SynAck.WScale = -1
+	set.TCP.SynAck.Window = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for a zero window")
+	}
+
+	set.TCP.SynAck.Window = 1
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate_TablesIntegration(t *testing.T) {
+	cfg := NewConfig()
+	cfg.System.Tables.Integration = ""
+	if err := cfg.Validate(); err != nil || cfg.System.Tables.Integration != IntegrationNone {
+		t.Errorf("expected empty integration to default to none, got %q (%v)", cfg.System.Tables.Integration, err)
+	}
+
+	cfg.System.Tables.Integration = "ufw"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for unknown integration")
+	}
+}
+
+func TestValidate_Transparent(t *testing.T) {
+	cfg := NewConfig()
+	cfg.System.Transparent.Mode = ""
+	if err := cfg.Validate(); err != nil || cfg.System.Transparent.Mode != TransparentRedirect {
+		t.Errorf("expected empty mode to default to redirect, got %q (%v)", cfg.System.Transparent.Mode, err)
+	}
+
+	cfg.System.Transparent.Mode = "divert"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for unknown transparent mode")
+	}
+
+	cfg.System.Transparent.Mode = TransparentTProxy
+	cfg.System.Transparent.Enabled = true
+	cfg.System.Transparent.Port = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for missing transparent proxy port")
+	}
+}
+
+func TestValidate_Proxy(t *testing.T) {
+	cfg := NewConfig()
+	cfg.System.Proxy.Enabled = true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected default proxy address to be valid: %v", err)
+	}
+
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:0", "127.0.0.1:http"} {
+		cfg.System.Proxy.Address = addr
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected validation error for proxy address %q", addr)
+		}
+	}
+
+	cfg.System.Proxy.Address = ":1080"
+	cfg.System.Proxy.Password = "secret"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for password without user")
+	}
+}
+
+func TestValidate_DNSUpstream(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	cfg.Sets = []*SetConfig{&set}
+
+	for _, up := range []string{"https://dns.google/dns-query", "tls://1.1.1.1", "tls://dns.quad9.net:853"} {
+		set.DNS.Upstream = up
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected upstream %q to be valid: %v", up, err)
+		}
+	}
+
+	for _, up := range []string{"1.1.1.1", "udp://1.1.1.1", "https:///dns-query"} {
+		set.DNS.Upstream = up
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected validation error for upstream %q", up)
+		}
+	}
+
+	set.DNS.Upstream = "tls://dns.google"
+	set.DNS.Bootstrap = []string{"8.8.8.8", "dns.google"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for a bootstrap host name")
+	}
+}
+
+func TestValidate_DNSBogusIPs(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	cfg.Sets = []*SetConfig{&set}
+
+	set.DNS.BogusIPs = []string{"10.0.0.0/8", "195.208.4.1", "::1"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected bogus addresses to be valid: %v", err)
+	}
+	if len(set.DNS.BogusNets) != 3 || set.DNS.BogusNets[1].String() != "195.208.4.1/32" {
+		t.Errorf("unexpected parsed networks: %v", set.DNS.BogusNets)
+	}
+
+	set.DNS.BogusIPs = []string{"blockpage.example"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for a host name")
+	}
+
+	set.DNS.BogusIPs = nil
+	set.DNS.FilterForged = true
+	set.DNS.HoldMs = 5000
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for a hold time above 2000 ms")
+	}
+}
+
+func TestValidate_DNSHosts(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	cfg.Sets = []*SetConfig{&set}
+
+	set.DNS.Hosts = map[string][]string{
+		"Example.com.":      {"203.0.113.5"},
+		"*.example.com":     {"203.0.113.6", "2001:db8::6"},
+		"*.cdn.example.com": {"203.0.113.7"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected hosts to be valid: %v", err)
+	}
+	for domain, want := range map[string]string{
+		"example.com":         "203.0.113.5",
+		"www.example.com":     "203.0.113.6",
+		"img.cdn.example.com": "203.0.113.7",
+	} {
+		if ips := set.DNS.LookupHost(domain); len(ips) == 0 || ips[0].String() != want {
+			t.Errorf("%s resolves to %v, want %s", domain, ips, want)
+		}
+	}
+	if ips := set.DNS.LookupHost("example.org"); ips != nil {
+		t.Errorf("unlisted domain resolves to %v", ips)
+	}
+
+	for _, hosts := range []map[string][]string{
+		{"example.com": {"blockpage.example"}},
+		{"example.com": {}},
+		{"*": {"203.0.113.5"}},
+		{"www.*.com": {"203.0.113.5"}},
+	} {
+		set.DNS.Hosts = hosts
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected validation error for %v", hosts)
+		}
+	}
+}
@@ -32,6 +32,208 @@ var migrationRegistry = map[int]MigrationFunc{
 	13: migrateV13to14,
 	14: migrateV14to15, // Flatten TCP desync settings into nested struct
 	15: migrateV15to16, // Add TCP Incoming config
+	16: migrateV16to17, // Add TCP destination port filter
+	17: migrateV17to18, // Add plain HTTP config
+	18: migrateV18to19, // Add ClientHello reassembly timeout
+	19: migrateV19to20, // Add strategy pipeline
+	20: migrateV20to21, // Add symbolic split positions
+	21: migrateV21to22, // Add auto TTL
+	22: migrateV22to23, // Add adaptive strategy fallback
+	23: migrateV23to24, // Add forged packet filter
+	24: migrateV24to25, // Add SYN-ACK window rewrite
+	25: migrateV25to26, // Add queue verdict mode
+	26: migrateV26to27, // Add injection worker pool
+	27: migrateV27to28, // Add kernel-side target sets
+	28: migrateV28to29, // Add firewall integration
+	29: migrateV29to30, // Add transparent proxy
+	30: migrateV30to31, // Add SOCKS5 and HTTP CONNECT proxy
+	31: migrateV31to32, // Add encrypted DNS upstreams
+	32: migrateV32to33, // Add learning target IPs from DNS answers
+	33: migrateV33to34, // Add forged DNS answer filter
+	34: migrateV34to35, // Add static DNS answers
+	35: migrateV35to36, // Add fallback state expiry
+	36: migrateV36to37, // Add forged packet window check
+}
+
+func migrateV36to37(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v36->v37: Adding forged packet window check")
+
+	for _, set := range c.Sets {
+		set.TCP.Forged.Window = DefaultSetConfig.TCP.Forged.Window
+	}
+	return nil
+}
+
+func migrateV35to36(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v35->v36: Adding fallback state expiry")
+
+	for _, set := range c.Sets {
+		set.Fallback.Expire = DefaultSetConfig.Fallback.Expire
+	}
+	return nil
+}
+
+func migrateV34to35(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v34->v35: Adding static DNS answers")
+
+	for _, set := range c.Sets {
+		set.DNS.Hosts = make(map[string][]string)
+	}
+	return nil
+}
+
+func migrateV33to34(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v33->v34: Adding forged DNS answer filter")
+
+	for _, set := range c.Sets {
+		set.DNS.FilterForged = DefaultSetConfig.DNS.FilterForged
+		set.DNS.HoldMs = DefaultSetConfig.DNS.HoldMs
+		set.DNS.BogusIPs = append([]string{}, DefaultSetConfig.DNS.BogusIPs...)
+	}
+	return nil
+}
+
+func migrateV32to33(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v32->v33: Adding learning target IPs from DNS answers")
+
+	for _, set := range c.Sets {
+		set.DNS.LearnIPs = DefaultSetConfig.DNS.LearnIPs
+	}
+	return nil
+}
+
+func migrateV31to32(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v31->v32: Adding encrypted DNS upstreams")
+
+	for _, set := range c.Sets {
+		set.DNS.Upstream = DefaultSetConfig.DNS.Upstream
+		set.DNS.Bootstrap = []string{}
+		set.DNS.PlainFallback = DefaultSetConfig.DNS.PlainFallback
+	}
+	return nil
+}
+
+func migrateV30to31(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v30->v31: Adding SOCKS5 and HTTP CONNECT proxy")
+
+	c.System.Proxy = DefaultConfig.System.Proxy
+	return nil
+}
+
+func migrateV29to30(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v29->v30: Adding transparent proxy")
+
+	c.System.Transparent = DefaultConfig.System.Transparent
+	return nil
+}
+
+func migrateV28to29(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v28->v29: Adding firewall integration")
+
+	c.System.Tables.Integration = DefaultConfig.System.Tables.Integration
+	return nil
+}
+
+func migrateV27to28(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v27->v28: Adding kernel-side target sets")
+
+	c.System.Tables.KernelSets = DefaultConfig.System.Tables.KernelSets
+	return nil
+}
+
+func migrateV26to27(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v26->v27: Adding injection worker pool")
+
+	c.Queue.InjectWorkers = DefaultConfig.Queue.InjectWorkers
+	c.Queue.InjectQueueSize = DefaultConfig.Queue.InjectQueueSize
+	return nil
+}
+
+func migrateV25to26(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v25->v26: Adding queue verdict mode")
+
+	c.Queue.VerdictMode = DefaultConfig.Queue.VerdictMode
+	return nil
+}
+
+func migrateV24to25(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v24->v25: Adding SYN-ACK window rewrite")
+
+	for _, set := range c.Sets {
+		set.TCP.SynAck = DefaultSetConfig.TCP.SynAck
+	}
+	return nil
+}
+
+func migrateV23to24(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v23->v24: Adding forged packet filter")
+
+	for _, set := range c.Sets {
+		set.TCP.Forged = DefaultSetConfig.TCP.Forged
+	}
+	return nil
+}
+
+func migrateV22to23(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v22->v23: Adding adaptive strategy fallback")
+
+	for _, set := range c.Sets {
+		set.Fallback = DefaultSetConfig.Fallback
+		set.Fallback.Strategies = []string{}
+	}
+	return nil
+}
+
+func migrateV21to22(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v21->v22: Adding auto TTL")
+
+	for _, set := range c.Sets {
+		set.Faking.AutoTTL = DefaultSetConfig.Faking.AutoTTL
+	}
+	return nil
+}
+
+func migrateV20to21(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v20->v21: Adding symbolic split positions")
+
+	for _, set := range c.Sets {
+		set.Fragmentation.SplitPositions = append([]string{}, DefaultSetConfig.Fragmentation.SplitPositions...)
+	}
+	return nil
+}
+
+func migrateV19to20(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v19->v20: Adding strategy pipeline")
+
+	for _, set := range c.Sets {
+		set.Pipeline = DefaultSetConfig.Pipeline
+	}
+	return nil
+}
+
+func migrateV18to19(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v18->v19: Adding ClientHello reassembly timeout")
+
+	c.Queue.ReassemblyTimeout = DefaultConfig.Queue.ReassemblyTimeout
+	return nil
+}
+
+func migrateV17to18(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v17->v18: Adding plain HTTP config")
+
+	for _, set := range c.Sets {
+		set.HTTP = DefaultSetConfig.HTTP
+	}
+	return nil
+}
+
+func migrateV16to17(c *Config, _ map[string]interface{}) error {
+	log.Tracef("Migration v16->v17: Adding TCP destination port filter")
+
+	for _, set := range c.Sets {
+		set.TCP.DPortFilter = DefaultSetConfig.TCP.DPortFilter
+	}
+	return nil
 }
 
 func migrateV15to16(c *Config, _ map[string]interface{}) error {
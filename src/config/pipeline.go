@@ -0,0 +1,293 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pipeline actions. A pipeline is an ordered, ";"-separated list of actions,
+// e.g. "fake(ttl=5,payload=generated); split(at=sni+1); delay(20ms); disorder; oob(pos=2)".
+const (
+	ActionFake     = "fake"     // send decoy packets: ttl, payload, strategy, count, sni
+	ActionSplit    = "split"    // split the payload: at (repeatable)
+	ActionDisorder = "disorder" // send the split segments in reverse order
+	ActionOOB      = "oob"      // split at pos and inject an urgent decoy byte: pos, char
+	ActionDelay    = "delay"    // pause; after a split it sets the gap between segments
+	ActionDesync   = "desync"   // inject desync packets: mode
+)
+
+// pipelineArgs lists the arguments accepted by each action, the first one is
+// used for positional values, e.g. delay(20ms) or split(sni+1).
+var pipelineArgs = map[string][]string{
+	ActionFake:     {"payload", "ttl", "strategy", "count", "sni"},
+	ActionSplit:    {"at"},
+	ActionDisorder: {},
+	ActionOOB:      {"pos", "char"},
+	ActionDelay:    {"ms"},
+	ActionDesync:   {"mode"},
+}
+
+var (
+	pipelineFakePayloads   = []string{"set", "default1", "default2", "random", "generated"}
+	pipelineFakeStrategies = []string{"ttl", "pastseq", "randseq", "tcp_check"}
+	pipelineDesyncModes    = []string{"rst", "fin", "ack", "combo", "full"}
+)
+
+// PipelineStep is one parsed action of a set pipeline.
+type PipelineStep struct {
+	Action string
+
+	// fake
+	Payload  string
+	TTL      uint8
+	Strategy string
+	Count    int
+	SNI      string
+
+	// split, oob
+	At   []SplitPosition
+	Char byte
+
+	// delay
+	Delay time.Duration
+
+	// desync
+	Mode string
+}
+
+// SplitPosition is a payload offset relative to a landmark of the request.
+// An empty Marker means an absolute offset, counted from the payload end
+// when negative.
+type SplitPosition struct {
+	Marker string
+	Offset int
+}
+
+// splitMarkers are the request landmarks a position can refer to. The sni
+// and host families both address the TLS SNI or the HTTP Host value, sld the
+// second-level label of that name and extensions the ClientHello extensions.
+var splitMarkers = []string{
+	"sni", "midsni", "endsni",
+	"host", "midhost", "endhost",
+	"sld", "midsld", "endsld",
+	"extensions",
+}
+
+// ParseSplitPosition parses expressions like "1", "-10", "sni", "sni+1" or "midsld-2".
+func ParseSplitPosition(expr string) (SplitPosition, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if expr == "" {
+		return SplitPosition{}, fmt.Errorf("empty position")
+	}
+
+	if n, err := strconv.Atoi(expr); err == nil {
+		if n == 0 {
+			return SplitPosition{}, fmt.Errorf("position must not be 0")
+		}
+		return SplitPosition{Offset: n}, nil
+	}
+
+	marker, offset := expr, 0
+	if i := strings.IndexAny(expr, "+-"); i > 0 {
+		marker = expr[:i]
+		n, err := strconv.Atoi(expr[i:])
+		if err != nil {
+			return SplitPosition{}, fmt.Errorf("invalid offset in %q", expr)
+		}
+		offset = n
+	}
+
+	if !slices.Contains(splitMarkers, marker) {
+		return SplitPosition{}, fmt.Errorf("unknown marker %q", marker)
+	}
+	return SplitPosition{Marker: marker, Offset: offset}, nil
+}
+
+// ParsePipeline parses and validates a pipeline expression. An empty
+// expression yields no steps and keeps the legacy strategy behavior.
+func ParsePipeline(expr string) ([]PipelineStep, error) {
+	var steps []PipelineStep
+
+	for _, raw := range strings.Split(expr, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		name, args, err := splitPipelineCall(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		allowed, ok := pipelineArgs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown action %q", name)
+		}
+
+		step := PipelineStep{Action: name}
+		for i, arg := range args {
+			key, value, found := strings.Cut(arg, "=")
+			if !found {
+				if i > 0 || len(allowed) == 0 {
+					return nil, fmt.Errorf("%s: unexpected argument %q", name, arg)
+				}
+				key, value = allowed[0], arg
+			}
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.TrimSpace(value)
+
+			if !slices.Contains(allowed, key) {
+				return nil, fmt.Errorf("%s: unknown argument %q", name, key)
+			}
+			if err := step.setArg(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// ParseSplitPositions parses a list of position expressions.
+func ParseSplitPositions(exprs []string) ([]SplitPosition, error) {
+	var positions []SplitPosition
+	for _, expr := range exprs {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		pos, err := ParseSplitPosition(expr)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+func splitPipelineCall(raw string) (string, []string, error) {
+	open := strings.IndexByte(raw, '(')
+	if open < 0 {
+		return strings.ToLower(raw), nil, nil
+	}
+	if !strings.HasSuffix(raw, ")") {
+		return "", nil, fmt.Errorf("missing ')' in %q", raw)
+	}
+
+	name := strings.ToLower(strings.TrimSpace(raw[:open]))
+	inner := strings.TrimSpace(raw[open+1 : len(raw)-1])
+	if inner == "" {
+		return name, nil, nil
+	}
+	return name, strings.Split(inner, ","), nil
+}
+
+func (s *PipelineStep) setArg(key, value string) error {
+	switch key {
+	case "payload":
+		if !slices.Contains(pipelineFakePayloads, value) {
+			return fmt.Errorf("payload must be one of %s", strings.Join(pipelineFakePayloads, ", "))
+		}
+		s.Payload = value
+	case "ttl":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 255 {
+			return fmt.Errorf("ttl must be 1-255")
+		}
+		s.TTL = uint8(n)
+	case "strategy":
+		if !slices.Contains(pipelineFakeStrategies, value) {
+			return fmt.Errorf("strategy must be one of %s", strings.Join(pipelineFakeStrategies, ", "))
+		}
+		s.Strategy = value
+	case "count":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 20 {
+			return fmt.Errorf("count must be 1-20")
+		}
+		s.Count = n
+	case "sni":
+		s.SNI = value
+	case "at", "pos":
+		pos, err := ParseSplitPosition(value)
+		if err != nil {
+			return err
+		}
+		s.At = append(s.At, pos)
+	case "char":
+		if len(value) != 1 {
+			return fmt.Errorf("char must be a single character")
+		}
+		s.Char = value[0]
+	case "ms":
+		d, err := parsePipelineDelay(value)
+		if err != nil {
+			return err
+		}
+		s.Delay = d
+	case "mode":
+		if !slices.Contains(pipelineDesyncModes, value) {
+			return fmt.Errorf("mode must be one of %s", strings.Join(pipelineDesyncModes, ", "))
+		}
+		s.Mode = value
+	}
+	return nil
+}
+
+func (s *PipelineStep) validate() error {
+	switch s.Action {
+	case ActionSplit:
+		if len(s.At) == 0 {
+			return fmt.Errorf("at least one position is required")
+		}
+	case ActionOOB:
+		if len(s.At) == 0 {
+			s.At = []SplitPosition{{Offset: 1}}
+		}
+		if s.Char == 0 {
+			s.Char = 'x'
+		}
+	case ActionDelay:
+		if s.Delay <= 0 {
+			return fmt.Errorf("duration is required")
+		}
+	case ActionDesync:
+		if s.Mode == "" {
+			s.Mode = "rst"
+		}
+	case ActionFake:
+		if s.Count == 0 {
+			s.Count = 1
+		}
+		if s.Payload == "" {
+			s.Payload = "set"
+		}
+		if s.SNI != "" && s.Payload != "generated" {
+			return fmt.Errorf("sni only applies to payload=generated")
+		}
+	}
+	return nil
+}
+
+// parsePipelineDelay accepts plain milliseconds ("20") or a Go duration ("20ms").
+func parsePipelineDelay(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		n, nerr := strconv.Atoi(value)
+		if nerr != nil {
+			return 0, fmt.Errorf("invalid delay %q", value)
+		}
+		d = time.Duration(n) * time.Millisecond
+	}
+	if d <= 0 || d > 5*time.Second {
+		return 0, fmt.Errorf("delay must be between 1ms and 5s")
+	}
+	return d, nil
+}
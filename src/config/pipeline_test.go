@@ -0,0 +1,153 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePipeline(t *testing.T) {
+	steps, err := ParsePipeline("fake(ttl=5,payload=generated); split(at=sni+1); delay(20ms); disorder; oob(pos=2)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(steps) != 5 {
+		t.Fatalf("expected 5 steps, got %d", len(steps))
+	}
+
+	fake := steps[0]
+	if fake.Action != ActionFake || fake.TTL != 5 || fake.Payload != "generated" || fake.Count != 1 {
+		t.Errorf("unexpected fake step: %+v", fake)
+	}
+
+	split := steps[1]
+	if len(split.At) != 1 || split.At[0] != (SplitPosition{Marker: "sni", Offset: 1}) {
+		t.Errorf("unexpected split step: %+v", split)
+	}
+
+	if steps[2].Delay != 20*time.Millisecond {
+		t.Errorf("expected 20ms delay, got %v", steps[2].Delay)
+	}
+
+	oob := steps[4]
+	if len(oob.At) != 1 || oob.At[0].Offset != 2 || oob.Char != 'x' {
+		t.Errorf("unexpected oob step: %+v", oob)
+	}
+}
+
+func TestParsePipeline_Positional(t *testing.T) {
+	steps, err := ParsePipeline("split(1,at=midsni-2);delay(15)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(steps[0].At) != 2 || steps[0].At[1] != (SplitPosition{Marker: "midsni", Offset: -2}) {
+		t.Errorf("unexpected split positions: %+v", steps[0].At)
+	}
+	if steps[1].Delay != 15*time.Millisecond {
+		t.Errorf("expected plain number to mean ms, got %v", steps[1].Delay)
+	}
+}
+
+func TestParsePipeline_Empty(t *testing.T) {
+	steps, err := ParsePipeline("  ")
+	if err != nil || steps != nil {
+		t.Errorf("expected no steps for empty pipeline, got %v, %v", steps, err)
+	}
+}
+
+func TestParsePipeline_Invalid(t *testing.T) {
+	cases := []string{
+		"explode",
+		"split",
+		"split(at=nowhere)",
+		"fake(ttl=0)",
+		"fake(payload=bogus)",
+		"delay(10s)",
+		"disorder(1)",
+		"oob(pos=2",
+		"desync(mode=fast)",
+		"fake(sni=example.org)",
+		"fake(payload=random,sni=example.org)",
+	}
+	for _, expr := range cases {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParsePipeline(expr); err == nil {
+				t.Errorf("expected error for %q", expr)
+			}
+		})
+	}
+}
+
+func TestValidate_InvalidPipeline(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "custom"
+	set.Pipeline = "split(at=bogus)"
+	cfg.Sets = []*SetConfig{&set}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for invalid pipeline")
+	}
+
+	set.Pipeline = "split(at=sni)"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(set.PipelineSteps) != 1 {
+		t.Errorf("expected parsed pipeline steps, got %d", len(set.PipelineSteps))
+	}
+}
+
+func TestParseSplitPosition(t *testing.T) {
+	cases := map[string]SplitPosition{
+		"-10":          {Offset: -10},
+		"midsld":       {Marker: "midsld"},
+		"extensions+2": {Marker: "extensions", Offset: 2},
+		"host-1":       {Marker: "host", Offset: -1},
+	}
+	for expr, want := range cases {
+		got, err := ParseSplitPosition(expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", expr, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %+v, want %+v", expr, got, want)
+		}
+	}
+
+	for _, expr := range []string{"0", "tld", "sni+x"} {
+		if _, err := ParseSplitPosition(expr); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestValidate_SplitPositions(t *testing.T) {
+	cfg := NewConfig()
+	set := NewSetConfig()
+	set.Id = "custom"
+	set.Fragmentation.SplitPositions = []string{"sni+1", "bogus"}
+	cfg.Sets = []*SetConfig{&set}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected validation error for invalid split position")
+	}
+
+	set.Fragmentation.SplitPositions = []string{"sni+1", "", "midsld", "-4"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(set.Fragmentation.SplitPoints) != 3 {
+		t.Errorf("expected 3 parsed split points, got %d", len(set.Fragmentation.SplitPoints))
+	}
+}
+
+func TestParsePipeline_GeneratedFakeSNI(t *testing.T) {
+	steps, err := ParsePipeline("fake(payload=generated,sni=example.org)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if steps[0].SNI != "example.org" {
+		t.Errorf("expected sni example.org, got %q", steps[0].SNI)
+	}
+}
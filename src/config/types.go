@@ -1,12 +1,35 @@
 package config
 
-import "github.com/daniellavrushin/b4/log"
+import (
+	"net"
+
+	"github.com/daniellavrushin/b4/log"
+)
 
 const (
 	ConfigOff  = "off"
 	ConfigNone = "none"
 )
 
+const (
+	VerdictReinject = "reinject"
+	VerdictModify   = "modify"
+)
+
+// Firewall integrations, how the rules get installed.
+const (
+	IntegrationNone      = "none"      // b4 inserts the rules itself
+	IntegrationAuto      = "auto"      // fw4 or firewalld when running, otherwise none
+	IntegrationFW4       = "fw4"       // nft include file loaded by OpenWrt fw4
+	IntegrationFirewalld = "firewalld" // firewalld direct rules
+)
+
+// Transparent proxy modes, how connections reach the local listener.
+const (
+	TransparentRedirect = "redirect" // nat REDIRECT, local and forwarded traffic
+	TransparentTProxy   = "tproxy"   // mangle TPROXY with policy routing, forwarded traffic only
+)
+
 const (
 	FakePayloadRandom = iota
 	FakePayloadCustom
@@ -20,13 +43,17 @@ type ApiConfig struct {
 }
 
 type QueueConfig struct {
-	StartNum    int           `json:"start_num" bson:"start_num"`
-	Threads     int           `json:"threads" bson:"threads"`
-	Mark        uint          `json:"mark" bson:"mark"`
-	IPv4Enabled bool          `json:"ipv4" bson:"ipv4"`
-	IPv6Enabled bool          `json:"ipv6" bson:"ipv6"`
-	Interfaces  []string      `json:"interfaces" bson:"interfaces"`
-	Devices     DevicesConfig `json:"devices" bson:"devices"`
+	StartNum          int           `json:"start_num" bson:"start_num"`
+	Threads           int           `json:"threads" bson:"threads"`
+	Mark              uint          `json:"mark" bson:"mark"`
+	IPv4Enabled       bool          `json:"ipv4" bson:"ipv4"`
+	IPv6Enabled       bool          `json:"ipv6" bson:"ipv6"`
+	Interfaces        []string      `json:"interfaces" bson:"interfaces"`
+	Devices           DevicesConfig `json:"devices" bson:"devices"`
+	ReassemblyTimeout int           `json:"reassembly_timeout" bson:"reassembly_timeout"` // ms to hold a split ClientHello, 0 disables reassembly
+	VerdictMode       string        `json:"verdict_mode" bson:"verdict_mode"`             // reinject: drop and resend everything, modify: return the first segment in the verdict
+	InjectWorkers     int           `json:"inject_workers" bson:"inject_workers"`         // goroutines running strategies per queue
+	InjectQueueSize   int           `json:"inject_queue_size" bson:"inject_queue_size"`   // matched packets waiting per queue before they pass unmodified
 }
 
 type DevicesConfig struct {
@@ -36,16 +63,37 @@ type DevicesConfig struct {
 }
 
 type TCPConfig struct {
-	ConnBytesLimit int   `json:"conn_bytes_limit" bson:"conn_bytes_limit"`
-	Seg2Delay      int   `json:"seg2delay" bson:"seg2delay"`
-	SynFake        bool  `json:"syn_fake" bson:"syn_fake"`
-	SynFakeLen     int   `json:"syn_fake_len" bson:"syn_fake_len"`
-	SynTTL         uint8 `json:"syn_ttl" bson:"syn_ttl"`
-	DropSACK       bool  `json:"drop_sack" bson:"drop_sack"`
+	ConnBytesLimit int    `json:"conn_bytes_limit" bson:"conn_bytes_limit"`
+	Seg2Delay      int    `json:"seg2delay" bson:"seg2delay"`
+	SynFake        bool   `json:"syn_fake" bson:"syn_fake"`
+	SynFakeLen     int    `json:"syn_fake_len" bson:"syn_fake_len"`
+	SynTTL         uint8  `json:"syn_ttl" bson:"syn_ttl"`
+	DropSACK       bool   `json:"drop_sack" bson:"drop_sack"`
+	DPortFilter    string `json:"dport_filter" bson:"dport_filter"` // extra TLS ports besides 443, e.g. "8443,2053,5223,6000-6100"
 
 	Incoming IncomingConfig `json:"incoming" bson:"incoming"`
 	Desync   DesyncConfig   `json:"desync" bson:"desync"`
 	Win      WinConfig      `json:"win" bson:"win"`
+	Forged   ForgedConfig   `json:"forged" bson:"forged"`
+	SynAck   SynAckConfig   `json:"synack" bson:"synack"`
+}
+
+// SynAckConfig shrinks the window advertised to the client in SYN-ACKs of
+// IP-matched flows, so the client OS sends its first data in small segments.
+type SynAckConfig struct {
+	Enabled bool   `json:"enabled" bson:"enabled"`
+	Window  uint16 `json:"window" bson:"window"`   // window advertised until the client sent Packets data packets
+	WScale  int    `json:"wscale" bson:"wscale"`   // window scale to advertise, -1 keeps the server's
+	MSS     uint16 `json:"mss" bson:"mss"`         // MSS to advertise, 0 keeps the server's
+	Packets int    `json:"packets" bson:"packets"` // client data packets before server windows pass untouched
+}
+
+// ForgedConfig drops incoming RST/FIN packets and HTTP responses that do not
+// look like they came from the server the flow's SYN-ACK came from.
+type ForgedConfig struct {
+	Enabled      bool  `json:"enabled" bson:"enabled"`
+	TTLTolerance uint8 `json:"ttl_tolerance" bson:"ttl_tolerance"` // allowed TTL deviation from the SYN-ACK
+	Window       bool  `json:"window" bson:"window"`               // also compare the TCP window with the SYN-ACK's
 }
 
 type WinConfig struct {
@@ -81,6 +129,16 @@ type UDPConfig struct {
 	Seg2Delay      int    `json:"seg2delay" bson:"seg2delay"`
 }
 
+type HTTPConfig struct {
+	Enabled     bool   `json:"enabled" bson:"enabled"`           // inspect plain HTTP requests on port 80
+	HostSplit   bool   `json:"host_split" bson:"host_split"`     // split the request in the middle of the Host value
+	HostCase    bool   `json:"host_case" bson:"host_case"`       // "Host:" -> "hOsT:"
+	DomainCase  bool   `json:"domain_case" bson:"domain_case"`   // mix the case of the Host value
+	HostNoSpace bool   `json:"host_nospace" bson:"host_nospace"` // drop the space after "Host:", moved behind the value to keep the length
+	FakeRequest bool   `json:"fake_request" bson:"fake_request"` // send fake GET requests with a decoy Host first
+	FakeHost    string `json:"fake_host" bson:"fake_host"`
+}
+
 type FragmentationConfig struct {
 	Strategy     string `json:"strategy" bson:"strategy"` // Values: "tcp", "ip", "oob", "tls", "disorder",  "extsplit", "firstbyte", "combo", "none"
 	ReverseOrder bool   `json:"reverse_order" bson:"reverse_order"`
@@ -96,6 +154,9 @@ type FragmentationConfig struct {
 	SeqOverlapPattern []string `json:"seq_overlap_pattern" bson:"seq_overlap_pattern"`
 	SeqOverlapBytes   []byte   `json:"-" bson:"-"`
 
+	SplitPositions []string        `json:"split_positions" bson:"split_positions"` // e.g. "sni+1", "midsld", "-10"; overrides the strategy's own split points
+	SplitPoints    []SplitPosition `json:"-" bson:"-"`
+
 	Combo    ComboFragConfig    `json:"combo" bson:"combo"`
 	Disorder DisorderFragConfig `json:"disorder" bson:"disorder"`
 }
@@ -114,6 +175,16 @@ type FakingConfig struct {
 
 	SNIMutation SNIMutationConfig `json:"sni_mutation" bson:"sni_mutation"`
 	TCPMD5      bool              `json:"tcp_md5" bson:"tcp_md5"` // Enable TCP MD5 option insertion
+	AutoTTL     AutoTTLConfig     `json:"auto_ttl" bson:"auto_ttl"`
+}
+
+// AutoTTLConfig derives fake packet TTLs from the hop count observed in the
+// server's SYN-ACK. Until a destination has been seen the static TTLs apply.
+type AutoTTLConfig struct {
+	Enabled bool  `json:"enabled" bson:"enabled"`
+	Delta   uint8 `json:"delta" bson:"delta"` // subtracted from the hop count
+	Min     uint8 `json:"min" bson:"min"`
+	Max     uint8 `json:"max" bson:"max"`
 }
 
 type SNIMutationConfig struct {
@@ -140,11 +211,33 @@ type SystemConfig struct {
 	Checker   DiscoveryConfig `json:"checker" bson:"checker"`
 	Geo       GeoDatConfig    `json:"geo" bson:"geo"`
 	API       ApiConfig       `json:"api" bson:"api"`
+
+	Transparent TransparentConfig `json:"transparent" bson:"transparent"`
+	Proxy       ProxyConfig       `json:"proxy" bson:"proxy"`
 }
 
 type TablesConfig struct {
-	MonitorInterval int  `json:"monitor_interval" bson:"monitor_interval"`
-	SkipSetup       bool `json:"skip_setup" bson:"skip_setup"`
+	MonitorInterval int    `json:"monitor_interval" bson:"monitor_interval"`
+	SkipSetup       bool   `json:"skip_setup" bson:"skip_setup"`
+	KernelSets      bool   `json:"kernel_sets" bson:"kernel_sets"` // queue only traffic to target IPs kept in nftables sets / ipsets
+	Integration     string `json:"integration" bson:"integration"` // none, auto, fw4 or firewalld
+}
+
+// TransparentConfig replaces the netfilter queue with a local proxy the
+// firewall redirects TCP connections to, for systems without NFQUEUE.
+type TransparentConfig struct {
+	Enabled bool   `json:"enabled" bson:"enabled"`
+	Port    int    `json:"port" bson:"port"`
+	Mode    string `json:"mode" bson:"mode"` // redirect or tproxy
+}
+
+// ProxyConfig is the SOCKS5 and HTTP CONNECT listener applications can opt
+// in to without any firewall rules. Auth is required when Username is set.
+type ProxyConfig struct {
+	Enabled  bool   `json:"enabled" bson:"enabled"`
+	Address  string `json:"address" bson:"address"` // host:port, both protocols share it
+	Username string `json:"username" bson:"username"`
+	Password string `json:"password" bson:"password"`
 }
 
 type WebServerConfig struct {
@@ -173,11 +266,29 @@ type SetConfig struct {
 	Name          string              `json:"name" bson:"name"`
 	TCP           TCPConfig           `json:"tcp" bson:"tcp"`
 	UDP           UDPConfig           `json:"udp" bson:"udp"`
+	HTTP          HTTPConfig          `json:"http" bson:"http"`
 	Fragmentation FragmentationConfig `json:"fragmentation" bson:"fragmentation"`
 	Faking        FakingConfig        `json:"faking" bson:"faking"`
 	Targets       TargetsConfig       `json:"targets" bson:"targets"`
 	Enabled       bool                `json:"enabled" bson:"enabled"`
 	DNS           DNSConfig           `json:"dns" bson:"dns"`
+	Pipeline      string              `json:"pipeline" bson:"pipeline"` // ordered actions replacing the fixed strategy, see ParsePipeline
+	Fallback      FallbackConfig      `json:"fallback" bson:"fallback"`
+
+	PipelineSteps []PipelineStep `json:"-" bson:"-"`
+}
+
+// FallbackConfig moves a domain to the next strategy of the list when the
+// current one keeps failing, and back to the set's own strategy after Decay.
+type FallbackConfig struct {
+	Enabled    bool     `json:"enabled" bson:"enabled"`
+	Strategies []string `json:"strategies" bson:"strategies"` // strategy names or pipeline expressions, tried in order
+	Failures   int      `json:"failures" bson:"failures"`     // consecutive failures before falling back
+	Timeout    int      `json:"timeout" bson:"timeout"`       // ms to wait for the ServerHello
+	Decay      int      `json:"decay" bson:"decay"`           // seconds before the preferred strategy is retried
+	Expire     int      `json:"expire" bson:"expire"`         // seconds without flows before a domain's state is forgotten, 0 keeps it
+
+	Levels []FallbackLevel `json:"-" bson:"-"`
 }
 
 type GeoDatConfig struct {
@@ -204,7 +315,18 @@ type DisorderFragConfig struct {
 }
 
 type DNSConfig struct {
-	Enabled       bool   `json:"enabled" bson:"enabled"`
-	TargetDNS     string `json:"target_dns" bson:"target_dns"`
-	FragmentQuery bool   `json:"fragment_query" bson:"fragment_query"`
+	Enabled       bool                `json:"enabled" bson:"enabled"`
+	TargetDNS     string              `json:"target_dns" bson:"target_dns"`
+	FragmentQuery bool                `json:"fragment_query" bson:"fragment_query"`
+	Upstream      string              `json:"upstream" bson:"upstream"`             // https:// DoH URL or tls:// DoT address, answers queries instead of TargetDNS
+	Bootstrap     []string            `json:"bootstrap" bson:"bootstrap"`           // IPs of the upstream host, the system resolver is used when empty
+	PlainFallback bool                `json:"plain_fallback" bson:"plain_fallback"` // ask TargetDNS or the original server over UDP when the upstream fails
+	LearnIPs      bool                `json:"learn_ips" bson:"learn_ips"`           // match the addresses of DNS answers for the set's domains
+	FilterForged  bool                `json:"filter_forged" bson:"filter_forged"`   // drop forged answers for the set's domains
+	HoldMs        int                 `json:"hold_ms" bson:"hold_ms"`               // how long an answer waits for a later, genuine one
+	BogusIPs      []string            `json:"bogus_ips" bson:"bogus_ips"`           // addresses and CIDRs only forged answers point to
+	Hosts         map[string][]string `json:"hosts" bson:"hosts"`                   // domain or *.domain to the addresses answered for it directly
+
+	BogusNets []*net.IPNet        `json:"-" bson:"-"`
+	HostIPs   map[string][]net.IP `json:"-" bson:"-"`
 }
@@ -21,6 +21,8 @@ type FailureMode string
 
 const (
 	FailureRSTImmediate FailureMode = "rst_immediate"
+	FailureRSTInjected  FailureMode = "rst_injected" // RST forged by a middlebox
+	FailureRSTServer    FailureMode = "rst_server"   // RST sent by the server itself
 	FailureTimeout      FailureMode = "timeout"
 	FailureTLSError     FailureMode = "tls_error"
 	FailureUnknown      FailureMode = "unknown"
@@ -1122,6 +1124,12 @@ func analyzeFailure(result CheckResult) FailureMode {
 	err := strings.ToLower(result.Error)
 
 	if strings.Contains(err, "reset") || strings.Contains(err, "rst") {
+		if injected, ok := nfq.RSTVerdict(result.Domain, result.Timestamp); ok {
+			if injected {
+				return FailureRSTInjected
+			}
+			return FailureRSTServer
+		}
 		if result.Duration < 100*time.Millisecond {
 			return FailureRSTImmediate
 		}
@@ -1137,8 +1145,11 @@ func analyzeFailure(result CheckResult) FailureMode {
 
 func suggestFamiliesForFailure(mode FailureMode) []StrategyFamily {
 	switch mode {
-	case FailureRSTImmediate:
+	case FailureRSTImmediate, FailureRSTInjected:
 		return []StrategyFamily{FamilyDesync, FamilyFakeSNI, FamilySynFake}
+	case FailureRSTServer:
+		// the server rejected what reached it, prefer strategies without decoys
+		return []StrategyFamily{FamilyTCPFrag, FamilyTLSRec, FamilyOOB}
 	case FailureTimeout:
 		return []StrategyFamily{FamilyTCPFrag, FamilyTLSRec, FamilyOOB}
 	default:
@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// responses kept at most, expired ones are dropped first when full
+const maxCacheEntries = 4096
+
+type cacheEntry struct {
+	resp    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// cache keeps upstream responses for as long as their TTLs allow.
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[string]cacheEntry)}
+}
+
+// get returns the cached answer to query, aged and with the query's ID.
+func (c *cache) get(key string, query []byte) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return age(e.resp, time.Since(e.stored), binary.BigEndian.Uint16(query[:2]))
+}
+
+func (c *cache) put(key string, resp []byte) {
+	ttl := cacheTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = cacheEntry{resp: append([]byte(nil), resp...), stored: now, expires: now.Add(ttl)}
+}
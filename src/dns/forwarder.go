@@ -0,0 +1,395 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	dotPort     = "853"
+
+	// idle DoT connections kept per upstream
+	maxIdleConns = 4
+)
+
+// Upstream is the encrypted resolver the queries of a set are sent to.
+type Upstream struct {
+	URL       string   // https://host/path for DoH, tls://host[:port] for DoT
+	Bootstrap []string // addresses of the upstream host, resolved by the system when empty
+	Plain     string   // host:port asked over UDP when the upstream fails, empty for none
+	Mark      uint     // firewall mark of the upstream connections
+}
+
+// ParseUpstream checks an upstream URL and returns its scheme, host and
+// port.
+func ParseUpstream(raw string) (scheme, host, port string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "tls":
+		port = dotPort
+	default:
+		return "", "", "", fmt.Errorf("unsupported scheme %q, use https:// or tls://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", "", "", errors.New("missing host")
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return u.Scheme, u.Hostname(), port, nil
+}
+
+// exchanger sends a query to one upstream.
+type exchanger interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// Forwarder resolves queries through DoH and DoT upstreams. Answers are
+// cached per upstream for as long as their TTLs allow, connections to an
+// upstream are reused.
+type Forwarder struct {
+	cache *cache
+	roots *x509.CertPool // upstream certificate roots, the system's when nil
+
+	mu      sync.Mutex
+	clients map[string]exchanger
+}
+
+func NewForwarder() *Forwarder {
+	return &Forwarder{cache: newCache(), clients: make(map[string]exchanger)}
+}
+
+// Exchange answers query through up. When the upstream fails and up has a
+// plain fallback, the answer comes from there and is not cached.
+func (f *Forwarder) Exchange(ctx context.Context, up Upstream, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query too short")
+	}
+	key, cacheable := questionKey(query)
+	key = up.URL + "|" + key
+	if cacheable {
+		if resp := f.cache.get(key, query); resp != nil {
+			return resp, nil
+		}
+	}
+
+	resp, err := f.exchange(ctx, up, query)
+	if err != nil {
+		if up.Plain == "" {
+			return nil, err
+		}
+		log.Tracef("DNS: %s failed, asking %s: %v", up.URL, up.Plain, err)
+		return exchangeUDP(ctx, up.Plain, up.Mark, query)
+	}
+	if cacheable {
+		f.cache.put(key, resp)
+	}
+	return resp, nil
+}
+
+func (f *Forwarder) exchange(ctx context.Context, up Upstream, query []byte) ([]byte, error) {
+	c, err := f.client(up)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, errors.New("response too short")
+	}
+	// DoH servers may answer a query with ID 0
+	copy(resp[:2], query[:2])
+	return resp, nil
+}
+
+func (f *Forwarder) client(up Upstream) (exchanger, error) {
+	key := fmt.Sprintf("%s|%s|%d", up.URL, strings.Join(up.Bootstrap, ","), up.Mark)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.clients[key]; ok {
+		return c, nil
+	}
+
+	scheme, host, port, err := ParseUpstream(up.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", up.URL, err)
+	}
+	d := dialer{bootstrap: up.Bootstrap, mark: up.Mark}
+	var c exchanger
+	if scheme == "https" {
+		c = &dohClient{url: up.URL, http: &http.Client{Transport: &http.Transport{
+			DialContext:         d.dial,
+			TLSClientConfig:     &tls.Config{RootCAs: f.roots, MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: dialTimeout,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: maxIdleConns,
+		}}}
+	} else {
+		c = &dotClient{address: net.JoinHostPort(host, port), serverName: host, roots: f.roots, dialer: d}
+	}
+	f.clients[key] = c
+	return c, nil
+}
+
+// dialer connects to an upstream through its bootstrap addresses, with the
+// mark that keeps the connection out of the queue.
+type dialer struct {
+	bootstrap []string
+	mark      uint
+}
+
+func (d dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{address}
+	if len(d.bootstrap) > 0 && net.ParseIP(host) == nil {
+		addrs = addrs[:0]
+		for _, ip := range d.bootstrap {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	nd := net.Dialer{Timeout: dialTimeout, Control: markControl(d.mark)}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = nd.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func markControl(mark uint) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// dohClient speaks DNS over HTTPS, RFC 8484.
+type dohClient struct {
+	url  string
+	http *http.Client
+}
+
+func (c *dohClient) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dotClient speaks DNS over TLS, RFC 7858, one query at a time per
+// connection.
+type dotClient struct {
+	address    string
+	serverName string
+	roots      *x509.CertPool
+	dialer     dialer
+
+	mu   sync.Mutex
+	idle []*tls.Conn
+}
+
+func (c *dotClient) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// an idle connection may have been closed by the server, retry on a
+	// new one
+	if conn := c.get(); conn != nil {
+		if resp, err := c.roundTrip(ctx, conn, query); err == nil {
+			return resp, nil
+		}
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.roundTrip(ctx, conn, query)
+}
+
+func (c *dotClient) dial(ctx context.Context) (*tls.Conn, error) {
+	raw, err := c.dialer.dial(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: c.serverName, RootCAs: c.roots, MinVersion: tls.VersionTLS12})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *dotClient) roundTrip(ctx context.Context, conn *tls.Conn, query []byte) ([]byte, error) {
+	resp, err := exchangeStream(ctx, conn, query)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return resp, nil
+}
+
+func (c *dotClient) get() *tls.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) == 0 {
+		return nil
+	}
+	conn := c.idle[len(c.idle)-1]
+	c.idle = c.idle[:len(c.idle)-1]
+	return conn
+}
+
+func (c *dotClient) put(conn *tls.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// exchangeStream sends a query with the two byte length prefix of DNS over
+// TCP and reads the answer.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(frame(query)); err != nil {
+		return nil, err
+	}
+	return readStream(conn)
+}
+
+// frame prefixes a message with its length, as sent over a stream.
+func frame(query []byte) []byte {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	return msg
+}
+
+func readStream(conn net.Conn) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeUDP asks a plain resolver.
+func exchangeUDP(ctx context.Context, address string, mark uint, query []byte) ([]byte, error) {
+	nd := net.Dialer{Timeout: dialTimeout, Control: markControl(mark)}
+	conn, err := nd.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// skip answers to other queries
+		if n >= 12 && bytes.Equal(buf[:2], query[:2]) {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// ExchangeTCP asks a plain resolver over TCP. If split falls inside the
+// framed query, it is written in two segments cut there, delay apart.
+func ExchangeTCP(ctx context.Context, address string, mark uint, query []byte, split int, delay time.Duration) ([]byte, error) {
+	nd := net.Dialer{Timeout: dialTimeout, Control: markControl(mark)}
+	conn, err := nd.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	msg := frame(query)
+	if split > 0 && split < len(msg) {
+		if _, err := conn.Write(msg[:split]); err != nil {
+			return nil, err
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		msg = msg[split:]
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	return readStream(conn)
+}
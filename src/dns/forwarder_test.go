@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExchangeTCP_SplitsQuery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	query := buildQuery(t, 42, "example.com.", 0)
+	answer := buildAnswer(t, 42, "example.com.", 300)
+	first := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 512)
+		n, _ := conn.Read(buf)
+		first <- append([]byte(nil), buf[:n]...)
+		if _, err := io.ReadFull(conn, make([]byte, 2+len(query)-n)); err != nil {
+			return
+		}
+		_, _ = conn.Write(frame(answer))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := ExchangeTCP(ctx, ln.Addr().String(), 0, query, 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, answer) {
+		t.Errorf("got answer %x, want %x", resp, answer)
+	}
+	if got := <-first; len(got) != 10 {
+		t.Errorf("first segment carried %d bytes, want 10", len(got))
+	}
+}
+
+// testCertificate returns a self-signed certificate for example.com and the
+// loopback addresses, and a pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// testForwarder returns a forwarder trusting roots.
+func testForwarder(roots *x509.CertPool) *Forwarder {
+	f := NewForwarder()
+	f.roots = roots
+	return f
+}
+
+func exchangeTimeout(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestForwarder_DoH(t *testing.T) {
+	cert, roots := testCertificate(t)
+	// servers may answer with ID 0
+	answer := buildAnswer(t, 0, "example.com.", 300)
+
+	var requests atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answer)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// example.com only reaches the test server through the bootstrap address
+	up := Upstream{URL: "https://example.com:" + port + "/dns-query", Bootstrap: []string{"127.0.0.1"}}
+	f := testForwarder(roots)
+	query := buildQuery(t, 42, "example.com.", 0)
+
+	resp, err := f.Exchange(exchangeTimeout(t), up, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 42 {
+		t.Errorf("answer ID %d, want the query's 42", id)
+	}
+	if !bytes.Equal(resp[2:], answer[2:]) {
+		t.Errorf("got answer %x, want %x", resp, answer)
+	}
+
+	// the second query is answered from the cache
+	if _, err := f.Exchange(exchangeTimeout(t), up, buildQuery(t, 43, "example.com.", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("server asked %d times, want once", n)
+	}
+}
+
+func TestForwarder_DoHError(t *testing.T) {
+	cert, roots := testCertificate(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	up := Upstream{URL: srv.URL + "/dns-query"}
+	if _, err := testForwarder(roots).Exchange(exchangeTimeout(t), up, buildQuery(t, 42, "example.com.", 0)); err == nil {
+		t.Error("failing DoH server gave an answer")
+	}
+}
+
+// serveDoT answers the queries of each connection with the query flagged as
+// a response, closing a connection after perConn answers.
+func serveDoT(ln net.Listener, perConn int, conns *atomic.Int32) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer conn.Close()
+			for range perConn {
+				query, err := readStream(conn)
+				if err != nil {
+					return
+				}
+				query[2] |= 0x80
+				if _, err := conn.Write(frame(query)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestForwarder_DoTRetriesClosedConnection(t *testing.T) {
+	cert, roots := testCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns atomic.Int32
+	go serveDoT(ln, 1, &conns)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	up := Upstream{URL: "tls://example.com:" + port, Bootstrap: []string{"127.0.0.1"}}
+	f := testForwarder(roots)
+
+	for i, name := range []string{"one.example.com.", "two.example.com."} {
+		query := buildQuery(t, uint16(100+i), name, 0)
+		resp, err := f.Exchange(exchangeTimeout(t), up, query)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if !bytes.Equal(resp[:2], query[:2]) || resp[2]&0x80 == 0 || !bytes.Equal(resp[12:], query[12:]) {
+			t.Errorf("query %d got answer %x", i, resp)
+		}
+		// let the server close the connection now idle
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("%d connections, want a new one after the server closed the first", n)
+	}
+}
+
+func TestForwarder_DoTReusesConnection(t *testing.T) {
+	cert, roots := testCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns atomic.Int32
+	go serveDoT(ln, 10, &conns)
+
+	up := Upstream{URL: "tls://" + ln.Addr().String()}
+	f := testForwarder(roots)
+	for i, name := range []string{"one.example.com.", "two.example.com.", "three.example.com."} {
+		if _, err := f.Exchange(exchangeTimeout(t), up, buildQuery(t, uint16(100+i), name, 0)); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections, want one reused", n)
+	}
+}
+
+func TestForwarder_PlainFallback(t *testing.T) {
+	// nothing listens on the upstream port any more
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := ln.Addr().String()
+	ln.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	answer := buildAnswer(t, 42, "example.com.", 300)
+	var asked atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			asked.Add(1)
+			if n >= 2 {
+				_, _ = pc.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	up := Upstream{URL: "tls://" + upstream, Plain: pc.LocalAddr().String()}
+	f := NewForwarder()
+	query := buildQuery(t, 42, "example.com.", 0)
+	for range 2 {
+		resp, err := f.Exchange(exchangeTimeout(t), up, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp, answer) {
+			t.Errorf("got answer %x, want %x", resp, answer)
+		}
+	}
+	// fallback answers are not cached
+	if n := asked.Load(); n != 2 {
+		t.Errorf("plain resolver asked %d times, want 2", n)
+	}
+
+	up.Plain = ""
+	if _, err := f.Exchange(exchangeTimeout(t), up, query); err == nil {
+		t.Error("failing upstream without a fallback gave an answer")
+	}
+}
@@ -0,0 +1,246 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// plain DNS over UDP without EDNS is limited to 512 bytes
+	minUDPSize = 512
+	// larger EDNS sizes are not honoured, a raw socket cannot send what
+	// needs fragmenting
+	maxUDPSize = 1232
+)
+
+// questionKey identifies what a query asks, regardless of its ID.
+func questionKey(query []byte) (string, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return "", false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return "", false
+	}
+	q := qs[0]
+	return strings.ToLower(q.Name.String()) + "|" + q.Type.String() + "|" + q.Class.String(), true
+}
+
+// UDPSize returns the reply size the client of query accepts over UDP, at
+// most maxUDPSize.
+func UDPSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minUDPSize
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return minUDPSize
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return minUDPSize
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return minUDPSize
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			return min(max(int(rh.Class), minUDPSize), maxUDPSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return minUDPSize
+		}
+	}
+}
+
+// Truncate cuts a response that does not fit limit down to its question
+// with the TC bit set, the client retries over TCP.
+func Truncate(resp []byte, limit int) []byte {
+	if len(resp) <= limit {
+		return resp
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return resp[:limit]
+	}
+	m.Header.Truncated = true
+	m.Answers, m.Authorities = nil, nil
+	var opt []dnsmessage.Resource
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, r)
+		}
+	}
+	m.Additionals = opt
+	out, err := m.Pack()
+	if err != nil {
+		return resp[:limit]
+	}
+	return out
+}
+
+// cacheTTL is how long a response may be cached: the lowest TTL of its
+// records, or the negative caching TTL of RFC 2308 for empty answers.
+func cacheTTL(resp []byte) time.Duration {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || m.Header.Truncated {
+		return 0
+	}
+	if m.Header.RCode != dnsmessage.RCodeSuccess && m.Header.RCode != dnsmessage.RCodeNameError {
+		return 0
+	}
+
+	if len(m.Answers) == 0 || m.Header.RCode == dnsmessage.RCodeNameError {
+		for _, r := range m.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				return time.Duration(min(r.Header.TTL, soa.MinTTL)) * time.Second
+			}
+		}
+		return 0
+	}
+
+	ttl := ^uint32(0)
+	for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range rs {
+			if r.Header.Type != dnsmessage.TypeOPT {
+				ttl = min(ttl, r.Header.TTL)
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// age lowers the TTLs of a cached response by the time it spent in the
+// cache and gives it the ID of the query it answers.
+func age(resp []byte, elapsed time.Duration, id uint16) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil
+	}
+	m.Header.ID = id
+	secs := uint32(elapsed / time.Second)
+	for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rs {
+			if rs[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if rs[i].Header.TTL > secs {
+				rs[i].Header.TTL -= secs
+			} else {
+				rs[i].Header.TTL = 0
+			}
+		}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// Answer is an address a response resolves its question to.
+type Answer struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// ParseResponse returns the names a response goes through, its question
+// first and then the targets of its CNAME chain, and the addresses the chain
+// ends at. Error responses only name their question and have no addresses,
+// whatever records they carry.
+func ParseResponse(resp []byte) (names []string, addrs []Answer, ok bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || !m.Header.Response || len(m.Questions) != 1 {
+		return nil, nil, false
+	}
+	chain := map[string]bool{normalizeName(m.Questions[0].Name): true}
+	names = []string{normalizeName(m.Questions[0].Name)}
+	if m.Header.RCode != dnsmessage.RCodeSuccess {
+		return names, nil, true
+	}
+
+	// CNAMEs come before the records they point to, but do not rely on it
+	for grew := true; grew; {
+		grew = false
+		for _, r := range m.Answers {
+			c, isCNAME := r.Body.(*dnsmessage.CNAMEResource)
+			if !isCNAME || !chain[normalizeName(r.Header.Name)] {
+				continue
+			}
+			if target := normalizeName(c.CNAME); !chain[target] {
+				chain[target] = true
+				names = append(names, target)
+				grew = true
+			}
+		}
+	}
+
+	for _, r := range m.Answers {
+		if !chain[normalizeName(r.Header.Name)] {
+			continue
+		}
+		ttl := time.Duration(r.Header.TTL) * time.Second
+		switch b := r.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, Answer{IP: net.IP(b.A[:]).To16(), TTL: ttl})
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, Answer{IP: net.IP(b.AAAA[:]), TTL: ttl})
+		}
+	}
+	return names, addrs, true
+}
+
+func normalizeName(n dnsmessage.Name) string {
+	return strings.ToLower(strings.TrimSuffix(n.String(), "."))
+}
+
+// Synthesize answers a query with addrs itself. Only the addresses of the
+// family asked for are included, questions for other types get an empty
+// answer. The result is false if query is not a single question.
+func Synthesize(query []byte, addrs []net.IP, ttl time.Duration) ([]byte, bool) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil || q.Header.Response || len(q.Questions) != 1 {
+		return nil, false
+	}
+	question := q.Questions[0]
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 q.Header.ID,
+			Response:           true,
+			OpCode:             q.Header.OpCode,
+			RecursionDesired:   q.Header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: q.Questions,
+	}
+	rh := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: question.Class,
+		TTL:   uint32(ttl / time.Second),
+	}
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: r})
+		} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: r})
+		}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,187 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildQuery(t *testing.T, id uint16, name string, ednsSize uint16) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	if ednsSize > 0 {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(int(ednsSize), dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		m.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func buildAnswer(t *testing.T, id uint16, name string, ttls ...uint32) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for i, ttl := range ttls {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}},
+		})
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCacheTTL(t *testing.T) {
+	if got := cacheTTL(buildAnswer(t, 1, "example.com.", 300, 60)); got != time.Minute {
+		t.Errorf("cacheTTL = %v, want the lowest record TTL", got)
+	}
+	if got := cacheTTL(buildAnswer(t, 1, "example.com.")); got != 0 {
+		t.Errorf("cacheTTL of an answer without records or SOA = %v, want 0", got)
+	}
+}
+
+func TestCache_AgesAndRewritesID(t *testing.T) {
+	c := newCache()
+	query := buildQuery(t, 0x1234, "example.com.", 0)
+	key, ok := questionKey(query)
+	if !ok {
+		t.Fatal("query has no question key")
+	}
+	c.put(key, buildAnswer(t, 0x1234, "example.com.", 120))
+
+	// the same question under another ID hits the entry
+	e := c.entries[key]
+	e.stored = e.stored.Add(-30 * time.Second)
+	c.entries[key] = e
+
+	resp := c.get(key, buildQuery(t, 0xabcd, "EXAMPLE.com.", 0))
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatalf("cached response does not unpack: %v", err)
+	}
+	if m.Header.ID != 0xabcd {
+		t.Errorf("ID = %#x, want the query's", m.Header.ID)
+	}
+	if ttl := m.Answers[0].Header.TTL; ttl != 90 {
+		t.Errorf("TTL = %d, want 90 after 30s in the cache", ttl)
+	}
+
+	e = c.entries[key]
+	e.expires = time.Now().Add(-time.Second)
+	c.entries[key] = e
+	if c.get(key, query) != nil {
+		t.Error("expired entry was served")
+	}
+}
+
+func TestUDPSizeAndTruncate(t *testing.T) {
+	if got := UDPSize(buildQuery(t, 1, "example.com.", 0)); got != 512 {
+		t.Errorf("UDPSize without EDNS = %d, want 512", got)
+	}
+	if got := UDPSize(buildQuery(t, 1, "example.com.", 4096)); got != maxUDPSize {
+		t.Errorf("UDPSize with EDNS 4096 = %d, want %d", got, maxUDPSize)
+	}
+
+	ttls := make([]uint32, 40)
+	for i := range ttls {
+		ttls[i] = 60
+	}
+	resp := buildAnswer(t, 7, "example.com.", ttls...)
+	if got := Truncate(resp, len(resp)); len(got) != len(resp) {
+		t.Error("a response that fits was changed")
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(Truncate(resp, 512)); err != nil {
+		t.Fatalf("truncated response does not unpack: %v", err)
+	}
+	if !m.Header.Truncated || len(m.Answers) != 0 || len(m.Questions) != 1 || m.Header.ID != 7 {
+		t.Errorf("truncated response: %+v", m)
+	}
+}
+
+func TestParseResponse_FollowsCNAMEChain(t *testing.T) {
+	name := func(s string) dnsmessage.Name { return dnsmessage.MustNewName(s) }
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true},
+		Questions: []dnsmessage.Question{{Name: name("WWW.Example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name("cdn.example.net."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name("www.example.com."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.CNAMEResource{CNAME: name("cdn.example.net.")},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name("other.example.org."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+				Body:   &dnsmessage.AResource{A: [4]byte{198, 51, 100, 1}},
+			},
+		},
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, addrs, ok := ParseResponse(resp)
+	if !ok {
+		t.Fatal("response not parsed")
+	}
+	if len(names) != 2 || names[0] != "www.example.com" || names[1] != "cdn.example.net" {
+		t.Errorf("names = %v", names)
+	}
+	if len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.1" || addrs[0].TTL != 30*time.Second {
+		t.Errorf("addrs = %v", addrs)
+	}
+
+	if _, _, ok := ParseResponse(buildQuery(t, 1, "example.com.", 0)); ok {
+		t.Error("a query was parsed as a response")
+	}
+
+	m.Header.RCode = dnsmessage.RCodeNameError
+	if resp, err = m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	names, addrs, ok = ParseResponse(resp)
+	if !ok || len(names) != 1 || len(addrs) != 0 {
+		t.Errorf("NXDOMAIN gave names %v and addresses %v", names, addrs)
+	}
+}
+
+func TestSynthesize_AnswersAskedFamily(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")}
+	resp, ok := Synthesize(buildQuery(t, 77, "example.com.", 0), addrs, 5*time.Minute)
+	if !ok {
+		t.Fatal("query was not answered")
+	}
+	names, got, ok := ParseResponse(resp)
+	if !ok || names[0] != "example.com" || len(got) != 1 || !got[0].IP.Equal(addrs[0]) || got[0].TTL != 5*time.Minute {
+		t.Errorf("unexpected answer %v %v", names, got)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 77 {
+		t.Errorf("answer has ID %d, want 77", id)
+	}
+
+	if _, ok := Synthesize(resp, addrs, time.Minute); ok {
+		t.Error("a response was answered")
+	}
+}
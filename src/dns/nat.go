@@ -1,47 +1,119 @@
 package dns
 
 import (
-	"fmt"
 	"net"
 	"sync"
 	"time"
 )
 
+const (
+	// redirected queries not answered by then are forgotten
+	natTimeout = 10 * time.Second
+	// queries in flight at most, the oldest are dropped beyond
+	maxNATEntries = 8192
+)
+
+// natKey is a query in flight: the client's address and port and the DNS
+// transaction ID, so queries a client sends from one port do not mix.
+type natKey struct {
+	client [16]byte
+	port   uint16
+	id     uint16
+}
+
 type dnsNATEntry struct {
 	originalDst net.IP
 	timestamp   time.Time
+	seq         uint64 // insertion number, the slot of the entry in natOrder
+}
+
+// natSlot is a key in insertion order. It is stale once the key was
+// deleted or set again, the entry then carries another seq.
+type natSlot struct {
+	key natKey
+	seq uint64
 }
 
 var (
-	dnsNATTable = make(map[string]dnsNATEntry)
-	dnsNATMu    sync.RWMutex
+	dnsNATTable = make(map[natKey]dnsNATEntry)
+	dnsNATMu    sync.Mutex
+
+	// natOrder is a ring of the keys as they were set, oldest at natHead,
+	// so the oldest query is dropped without scanning the table
+	natOrder [maxNATEntries]natSlot
+	natHead  int
+	natLen   int
+	natSeq   uint64
 )
 
-func dnsNATKey(ip net.IP, port uint16) string {
-	return fmt.Sprintf("%s:%d", ip.String(), port)
+func newNATKey(ip net.IP, port, id uint16) natKey {
+	k := natKey{port: port, id: id}
+	copy(k.client[:], ip.To16())
+	return k
 }
 
-func DnsNATSet(clientIP net.IP, clientPort uint16, originalDst net.IP) {
+// DnsNATSet remembers the server a redirected query was sent to.
+func DnsNATSet(clientIP net.IP, clientPort, id uint16, originalDst net.IP) {
+	now := time.Now()
 	dnsNATMu.Lock()
-	dnsNATTable[dnsNATKey(clientIP, clientPort)] = dnsNATEntry{
+	defer dnsNATMu.Unlock()
+
+	if natLen == maxNATEntries {
+		dropOldestNATLocked()
+	}
+	natSeq++
+	k := newNATKey(clientIP, clientPort, id)
+	natOrder[(natHead+natLen)%maxNATEntries] = natSlot{key: k, seq: natSeq}
+	natLen++
+	dnsNATTable[k] = dnsNATEntry{
 		originalDst: originalDst,
-		timestamp:   time.Now(),
+		timestamp:   now,
+		seq:         natSeq,
 	}
-	dnsNATMu.Unlock()
 }
 
-func DnsNATGet(clientIP net.IP, clientPort uint16) (net.IP, bool) {
-	dnsNATMu.RLock()
-	entry, ok := dnsNATTable[dnsNATKey(clientIP, clientPort)]
-	dnsNATMu.RUnlock()
-	if !ok || time.Since(entry.timestamp) > 10*time.Second {
+// dropOldestNATLocked removes the oldest slot and its entry unless the slot
+// is stale.
+func dropOldestNATLocked() {
+	s := natOrder[natHead]
+	if e, ok := dnsNATTable[s.key]; ok && e.seq == s.seq {
+		delete(dnsNATTable, s.key)
+	}
+	natHead = (natHead + 1) % maxNATEntries
+	natLen--
+}
+
+// DnsNATGet returns the server the client sent query id to.
+func DnsNATGet(clientIP net.IP, clientPort, id uint16) (net.IP, bool) {
+	dnsNATMu.Lock()
+	entry, ok := dnsNATTable[newNATKey(clientIP, clientPort, id)]
+	dnsNATMu.Unlock()
+	if !ok || time.Since(entry.timestamp) > natTimeout {
 		return nil, false
 	}
 	return entry.originalDst, true
 }
 
-func DnsNATDelete(clientIP net.IP, clientPort uint16) {
+func DnsNATDelete(clientIP net.IP, clientPort, id uint16) {
 	dnsNATMu.Lock()
-	delete(dnsNATTable, dnsNATKey(clientIP, clientPort))
+	delete(dnsNATTable, newNATKey(clientIP, clientPort, id))
 	dnsNATMu.Unlock()
 }
+
+// DnsNATCleanup drops queries that were never answered.
+func DnsNATCleanup() {
+	dnsNATMu.Lock()
+	cleanupNATLocked(time.Now())
+	dnsNATMu.Unlock()
+}
+
+// cleanupNATLocked drops expired queries, they are the oldest ones.
+func cleanupNATLocked(now time.Time) {
+	for natLen > 0 {
+		s := natOrder[natHead]
+		if e, ok := dnsNATTable[s.key]; ok && e.seq == s.seq && now.Sub(e.timestamp) <= natTimeout {
+			return
+		}
+		dropOldestNATLocked()
+	}
+}
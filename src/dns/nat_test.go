@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDnsNAT_KeyedByTransactionID(t *testing.T) {
+	client := net.ParseIP("192.168.1.10")
+	DnsNATSet(client, 5353, 1, net.ParseIP("8.8.8.8"))
+	DnsNATSet(client, 5353, 2, net.ParseIP("1.1.1.1"))
+	defer DnsNATDelete(client, 5353, 1)
+	defer DnsNATDelete(client, 5353, 2)
+
+	if dst, ok := DnsNATGet(client, 5353, 1); !ok || !dst.Equal(net.ParseIP("8.8.8.8")) {
+		t.Errorf("query 1 resolves to %v, %v", dst, ok)
+	}
+	if dst, ok := DnsNATGet(client, 5353, 2); !ok || !dst.Equal(net.ParseIP("1.1.1.1")) {
+		t.Errorf("query 2 resolves to %v, %v", dst, ok)
+	}
+	if _, ok := DnsNATGet(client, 5353, 3); ok {
+		t.Error("unknown transaction ID was found")
+	}
+}
+
+func TestDnsNAT_ExpiresAndStaysBounded(t *testing.T) {
+	client := net.ParseIP("192.168.1.10")
+	DnsNATSet(client, 5353, 9, net.ParseIP("8.8.8.8"))
+
+	dnsNATMu.Lock()
+	k := newNATKey(client, 5353, 9)
+	e := dnsNATTable[k]
+	e.timestamp = time.Now().Add(-natTimeout - time.Second)
+	dnsNATTable[k] = e
+	dnsNATMu.Unlock()
+
+	if _, ok := DnsNATGet(client, 5353, 9); ok {
+		t.Error("expired query was found")
+	}
+	DnsNATCleanup()
+	dnsNATMu.Lock()
+	_, kept := dnsNATTable[k]
+	dnsNATMu.Unlock()
+	if kept {
+		t.Error("cleanup kept an expired query")
+	}
+
+	for i := 0; i < maxNATEntries+100; i++ {
+		DnsNATSet(client, uint16(i>>16), uint16(i), net.ParseIP("8.8.8.8"))
+	}
+	dnsNATMu.Lock()
+	n := len(dnsNATTable)
+	dnsNATMu.Unlock()
+	resetNAT()
+	if n > maxNATEntries {
+		t.Errorf("table grew to %d entries", n)
+	}
+}
+
+func resetNAT() {
+	dnsNATMu.Lock()
+	defer dnsNATMu.Unlock()
+	dnsNATTable = make(map[natKey]dnsNATEntry)
+	natHead, natLen = 0, 0
+}
+
+func TestDnsNAT_DropsOldest(t *testing.T) {
+	resetNAT()
+	defer resetNAT()
+	client := net.ParseIP("192.168.1.10")
+	dst := net.ParseIP("8.8.8.8")
+
+	for i := 0; i < maxNATEntries; i++ {
+		DnsNATSet(client, uint16(i>>16), uint16(i), dst)
+	}
+	// query 1 is sent again, its first slot goes stale
+	DnsNATSet(client, 0, 1, dst)
+	DnsNATSet(client, 0, 0xffff, dst)
+
+	if _, ok := DnsNATGet(client, 0, 0); ok {
+		t.Error("oldest query was kept")
+	}
+	for _, id := range []uint16{1, 2, 0xffff} {
+		if _, ok := DnsNATGet(client, 0, id); !ok {
+			t.Errorf("query %d was dropped", id)
+		}
+	}
+	dnsNATMu.Lock()
+	n := len(dnsNATTable)
+	dnsNATMu.Unlock()
+	if n != maxNATEntries {
+		t.Errorf("%d queries kept, want %d", n, maxNATEntries)
+	}
+}
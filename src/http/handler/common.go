@@ -8,6 +8,7 @@ import (
 	"github.com/daniellavrushin/b4/geodat"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/nfq"
+	"github.com/daniellavrushin/b4/proxy"
 	"github.com/daniellavrushin/b4/utils"
 )
 
@@ -20,7 +21,11 @@ var (
 
 var (
 	globalPool        *nfq.Pool
+	globalProxy       *proxy.Server
+	globalLocalProxy  *proxy.LocalServer
 	tablesRefreshFunc func() error
+	targetsSyncFunc   func() error
+	tablesPreviewFunc func(cfg *config.Config, backend string, diff bool) (interface{}, error)
 )
 
 func setJsonHeader(w http.ResponseWriter) {
@@ -31,6 +36,14 @@ func SetNFQPool(pool *nfq.Pool) {
 	globalPool = pool
 }
 
+func SetTransparentProxy(p *proxy.Server) {
+	globalProxy = p
+}
+
+func SetLocalProxy(p *proxy.LocalServer) {
+	globalLocalProxy = p
+}
+
 func NewAPIHandler(cfg *config.Config) *API {
 	// Initialize geodata manager
 	geodataManager := geodat.NewGeodataManager(cfg.System.Geo.GeoSitePath, cfg.System.Geo.GeoIpPath)
@@ -95,6 +108,7 @@ func (api *API) RegisterEndpoints(mux *http.ServeMux, cfg *config.Config) {
 	api.RegisterSetsApi()
 	api.RegisterDnsApi()
 	api.RegisterDevicesApi()
+	api.RegisterTablesApi()
 }
 
 func sendResponse(w http.ResponseWriter, response interface{}) {
@@ -108,3 +122,11 @@ func sendResponse(w http.ResponseWriter, response interface{}) {
 func SetTablesRefreshFunc(fn func() error) {
 	tablesRefreshFunc = fn
 }
+
+func SetTargetsSyncFunc(fn func() error) {
+	targetsSyncFunc = fn
+}
+
+func SetTablesPreviewFunc(fn func(cfg *config.Config, backend string, diff bool) (interface{}, error)) {
+	tablesPreviewFunc = fn
+}
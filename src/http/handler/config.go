@@ -318,6 +318,12 @@ func (a *API) saveAndPushConfig(newCfg *config.Config) error {
 			return fmt.Errorf("failed to update global pool config: %v", err)
 		}
 	}
+	if globalProxy != nil {
+		globalProxy.UpdateConfig(newCfg)
+	}
+	if globalLocalProxy != nil {
+		globalLocalProxy.UpdateConfig(newCfg)
+	}
 
 	err := newCfg.SaveToFile(newCfg.ConfigPath)
 	if err != nil {
@@ -333,13 +339,15 @@ func (a *API) PerformSoftRestart(newCfg *config.Config, oldCfg *config.Config) b
 
 	oldPorts := strings.Join(oldCfg.CollectUDPPorts(), ",")
 	newPorts := strings.Join(newCfg.CollectUDPPorts(), ",")
+	oldTCPPorts := strings.Join(oldCfg.CollectTCPPorts(), ",")
+	newTCPPorts := strings.Join(newCfg.CollectTCPPorts(), ",")
 	shouldUpdate := false
 	if oldCfg.System.Tables.SkipSetup != newCfg.System.Tables.SkipSetup {
 
 		shouldUpdate = true
 	}
 
-	if !newCfg.System.Tables.SkipSetup && oldPorts != newPorts {
+	if !newCfg.System.Tables.SkipSetup && (oldPorts != newPorts || oldTCPPorts != newTCPPorts) {
 		shouldUpdate = true
 	}
 
@@ -362,14 +370,36 @@ func (a *API) PerformSoftRestart(newCfg *config.Config, oldCfg *config.Config) b
 		shouldUpdate = true
 	}
 
+	if oldCfg.System.Tables.KernelSets != newCfg.System.Tables.KernelSets {
+		shouldUpdate = true
+	}
+
+	if oldCfg.System.Tables.Integration != newCfg.System.Tables.Integration {
+		shouldUpdate = true
+	}
+
+	if oldCfg.System.Transparent != newCfg.System.Transparent {
+		log.Warnf("Transparent proxy settings changed, restart b4 to apply them")
+	}
+	if oldCfg.System.Proxy.Enabled != newCfg.System.Proxy.Enabled || oldCfg.System.Proxy.Address != newCfg.System.Proxy.Address {
+		log.Warnf("SOCKS5/HTTP proxy listener changed, restart b4 to apply it")
+	}
+
 	if shouldUpdate {
 		log.Infof("Core settings changed, performing soft system restart")
 		if oldPorts != newPorts {
 			log.Infof("UDP ports changed (%s -> %s), refreshing firewall rules", oldPorts, newPorts)
 		}
+		if oldTCPPorts != newTCPPorts {
+			log.Infof("TCP ports changed (%s -> %s), refreshing firewall rules", oldTCPPorts, newTCPPorts)
+		}
 		if err := tablesRefreshFunc(); err != nil {
 			log.Errorf("Failed to refresh tables: %v", err)
 		}
+	} else if !newCfg.System.Tables.SkipSetup && targetsSyncFunc != nil {
+		if err := targetsSyncFunc(); err != nil {
+			log.Errorf("Failed to sync kernel target sets: %v", err)
+		}
 	}
 
 	return shouldUpdate
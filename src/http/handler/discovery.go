@@ -87,6 +87,11 @@ func (api *API) handleStartDiscovery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if globalPool == nil {
+		http.Error(w, "Discovery needs the netfilter queue, it is not available with the transparent proxy", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Use ValidationTries from request, or default to 1 if not provided
 	validationTries := req.ValidationTries
 	if validationTries < 1 {
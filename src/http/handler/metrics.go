@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/nfq"
 )
 
 // Re-export for backward compatibility
@@ -20,6 +21,7 @@ func GetMetricsCollector() *metrics.MetricsCollector {
 func (api *API) RegisterMetricsApi() {
 	api.mux.HandleFunc("/api/metrics", api.getMetrics)
 	api.mux.HandleFunc("/api/metrics/summary", api.getMetricsSummary)
+	api.mux.HandleFunc("/api/metrics/hops", api.getObservedHops)
 }
 
 func (a *API) getMetrics(w http.ResponseWriter, r *http.Request) {
@@ -56,3 +58,15 @@ func (a *API) getMetricsSummary(w http.ResponseWriter, r *http.Request) {
 	enc := json.NewEncoder(w)
 	_ = enc.Encode(summary)
 }
+
+// getObservedHops lists the per-destination hop counts used by auto TTL.
+func (a *API) getObservedHops(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	setJsonHeader(w)
+	enc := json.NewEncoder(w)
+	_ = enc.Encode(nfq.ObservedHops())
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nfq"
 	"github.com/google/uuid"
 )
 
@@ -13,6 +14,7 @@ func (api *API) RegisterSetsApi() {
 	api.mux.HandleFunc("/api/sets", api.handleSets)
 	api.mux.HandleFunc("/api/sets/{id}", api.handleSetById)
 	api.mux.HandleFunc("/api/sets/reorder", api.handleReorderSets)
+	api.mux.HandleFunc("/api/sets/fallback", api.handleSetsFallback)
 	api.mux.HandleFunc("/api/sets/{id}/add-domain", api.handleSetDomains)
 }
 
@@ -291,6 +293,25 @@ func (api *API) initializeSetDefaults(set *config.SetConfig) {
 	if set.Faking.SNIMutation.FakeSNIs == nil {
 		set.Faking.SNIMutation.FakeSNIs = []string{}
 	}
+	if set.Fallback.Strategies == nil {
+		set.Fallback.Strategies = []string{}
+	}
+}
+
+// GET/DELETE /api/sets/fallback - per-domain strategy chosen by the adaptive fallback
+func (api *API) handleSetsFallback(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		setJsonHeader(w)
+		json.NewEncoder(w).Encode(nfq.DomainStrategies())
+	case http.MethodDelete:
+		nfq.ResetDomainStrategies()
+		log.Infof("Reset adaptive strategy fallback state")
+		setJsonHeader(w)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
 
 func (api *API) loadTargetsForSetCached(set *config.SetConfig) {
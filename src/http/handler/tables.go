@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+func (api *API) RegisterTablesApi() {
+	api.mux.HandleFunc("/api/tables/preview", api.handleTablesPreview)
+}
+
+// handleTablesPreview renders the firewall rules of the running config on
+// GET, or of the config in the body on POST, without applying them.
+// ?backend= picks nftables or iptables and ?diff=true compares the rules
+// with the installed ones.
+func (api *API) handleTablesPreview(w http.ResponseWriter, r *http.Request) {
+	if tablesPreviewFunc == nil {
+		http.Error(w, "Tables preview not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	cfg := api.cfg
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var proposed config.Config
+		if err := json.NewDecoder(r.Body).Decode(&proposed); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := proposed.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, set := range proposed.Sets {
+			api.loadTargetsForSetCached(set)
+		}
+		cfg = &proposed
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	preview, err := tablesPreviewFunc(cfg, query.Get("backend"), query.Get("diff") == "true")
+	if err != nil {
+		log.Errorf("Failed to render tables preview: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, preview)
+}
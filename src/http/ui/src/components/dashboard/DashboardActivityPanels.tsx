@@ -9,9 +9,10 @@ import {
   Chip,
   Divider,
 } from "@mui/material";
-import { formatNumber } from "@utils";
+import { formatBytes, formatNumber } from "@utils";
 import { colors } from "@design";
 import { ProtocolChip } from "@common/ProtocolChip";
+import { ProxyClient } from "./Page";
 
 interface Connection {
   timestamp: string;
@@ -25,15 +26,20 @@ interface Connection {
 interface DashboardActivityPanelsProps {
   topDomains: Record<string, number>;
   recentConnections: Connection[];
+  proxyClients: Record<string, ProxyClient>;
 }
 
 export const DashboardActivityPanels = ({
   topDomains,
   recentConnections,
+  proxyClients,
 }: DashboardActivityPanelsProps) => {
   const topDomainsData = Object.entries(topDomains)
     .sort((a, b) => b[1] - a[1])
     .slice(0, 10);
+  const proxyClientsData = Object.entries(proxyClients).sort(
+    (a, b) => b[1].connections - a[1].connections
+  );
 
   return (
     <Grid container spacing={3}>
@@ -156,6 +162,61 @@ export const DashboardActivityPanels = ({
           </List>
         </Paper>
       </Grid>
+
+      {proxyClientsData.length > 0 && (
+        <Grid size={{ xs: 12 }}>
+          <Paper
+            sx={{
+              p: 2,
+              bgcolor: colors.background.paper,
+              borderColor: colors.border.default,
+            }}
+            variant="outlined"
+          >
+            <Typography variant="h6" sx={{ mb: 2, color: colors.text.primary }}>
+              SOCKS5 / HTTP Proxy Clients
+            </Typography>
+            <List dense>
+              {proxyClientsData.map(([client, stats]) => (
+                <ListItem key={client}>
+                  <ListItemText
+                    primary={
+                      <Stack direction="row" spacing={1} alignItems="center">
+                        <Typography
+                          variant="body2"
+                          sx={{ color: colors.text.primary }}
+                        >
+                          {client}
+                          {stats.user && ` (${stats.user})`}
+                        </Typography>
+                        <Chip
+                          label={`${formatNumber(stats.active)} active`}
+                          size="small"
+                          sx={{
+                            bgcolor: colors.accent.primary,
+                            color: colors.primary,
+                          }}
+                        />
+                      </Stack>
+                    }
+                    secondary={
+                      <Typography
+                        variant="caption"
+                        sx={{ color: colors.text.secondary }}
+                      >
+                        {formatNumber(stats.connections)} connections •{" "}
+                        {formatNumber(stats.targeted)} targeted • ↑{" "}
+                        {formatBytes(stats.bytes_sent)} ↓{" "}
+                        {formatBytes(stats.bytes_recv)}
+                      </Typography>
+                    }
+                  />
+                </ListItem>
+              ))}
+            </List>
+          </Paper>
+        </Grid>
+      )}
     </Grid>
   );
 };
@@ -7,13 +7,27 @@ interface DashboardStatusBarProps {
   metrics: {
     nfqueue_status: string;
     tables_status: string;
-    worker_status: Array<unknown>;
+    worker_status: Array<{
+      queue_depth: number;
+      queue_capacity: number;
+      fallbacks: number;
+    }>;
     tcp_connections: number;
     udp_connections: number;
   };
 }
 
 export const DashboardStatusBar = ({ metrics }: DashboardStatusBarProps) => {
+  const queued = metrics.worker_status.reduce((n, w) => n + w.queue_depth, 0);
+  const capacity = metrics.worker_status.reduce(
+    (n, w) => n + w.queue_capacity,
+    0
+  );
+  const fallbacks = metrics.worker_status.reduce(
+    (n, w) => n + w.fallbacks,
+    0
+  );
+
   return (
     <Paper
       sx={{
@@ -40,6 +54,16 @@ export const DashboardStatusBar = ({ metrics }: DashboardStatusBarProps) => {
           label={`${metrics.worker_status.length} threads`}
           status={metrics.worker_status.length > 0 ? "active" : "error"}
         />
+        <StatusBadge
+          label={`Injection queue: ${queued}/${capacity}`}
+          status={capacity > 0 && queued >= capacity ? "warning" : "active"}
+        />
+        {fallbacks > 0 && (
+          <StatusBadge
+            label={`Passed unmodified: ${formatNumber(fallbacks)}`}
+            status="warning"
+          />
+        )}
         <StatusBadge
           label={`TCP: ${formatNumber(metrics.tcp_connections)}`}
           status="active"
@@ -46,6 +46,9 @@ export interface Metrics {
     id: number;
     status: string;
     processed: number;
+    queue_depth: number;
+    queue_capacity: number;
+    fallbacks: number;
   }>;
   nfqueue_status: string;
   tables_status: string;
@@ -64,6 +67,17 @@ export interface Metrics {
   }>;
   current_cps: number;
   current_pps: number;
+  proxy_clients: Record<string, ProxyClient>;
+}
+
+export interface ProxyClient {
+  user?: string;
+  connections: number;
+  active: number;
+  targeted: number;
+  bytes_sent: number;
+  bytes_recv: number;
+  last_seen: string;
 }
 
 const safeNumber = (val: number, defaultValue: number = 0): number => {
@@ -109,6 +123,7 @@ const normalizeMetrics = (data: null | Metrics): Metrics => {
       recent_events: [],
       current_cps: 0,
       current_pps: 0,
+      proxy_clients: {},
     };
   }
 
@@ -175,10 +190,20 @@ const normalizeMetrics = (data: null | Metrics): Metrics => {
     },
     worker_status: Array.isArray(data.worker_status)
       ? data.worker_status.map(
-          (w: { id: number; status: string; processed: number }) => ({
+          (w: {
+            id: number;
+            status: string;
+            processed: number;
+            queue_depth: number;
+            queue_capacity: number;
+            fallbacks: number;
+          }) => ({
             id: safeNumber(w?.id),
             status: String(w?.status || "unknown"),
             processed: safeNumber(w?.processed),
+            queue_depth: safeNumber(w?.queue_depth),
+            queue_capacity: safeNumber(w?.queue_capacity),
+            fallbacks: safeNumber(w?.fallbacks),
           })
         )
       : [],
@@ -217,6 +242,23 @@ const normalizeMetrics = (data: null | Metrics): Metrics => {
       : [],
     current_cps: safeNumber(data.current_cps),
     current_pps: safeNumber(data.current_pps),
+    proxy_clients:
+      data.proxy_clients && typeof data.proxy_clients === "object"
+        ? Object.fromEntries(
+            Object.entries(data.proxy_clients).map(([k, c]) => [
+              String(k),
+              {
+                user: c?.user ? String(c.user) : undefined,
+                connections: safeNumber(c?.connections),
+                active: safeNumber(c?.active),
+                targeted: safeNumber(c?.targeted),
+                bytes_sent: safeNumber(c?.bytes_sent),
+                bytes_recv: safeNumber(c?.bytes_recv),
+                last_seen: String(c?.last_seen || ""),
+              },
+            ])
+          )
+        : {},
   };
 };
 
@@ -332,6 +374,7 @@ export function DashboardPage() {
       <DashboardActivityPanels
         topDomains={metrics.top_domains}
         recentConnections={metrics.recent_connections}
+        proxyClients={metrics.proxy_clients}
       />
     </Container>
   );
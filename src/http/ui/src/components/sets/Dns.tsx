@@ -15,9 +15,12 @@ import {
   BlockIcon,
   SpeedIcon,
 } from "@b4.icons";
+import { useState } from "react";
 import {
   B4Alert,
   B4Badge,
+  B4ChipList,
+  B4PlusButton,
   B4Section,
   B4Switch,
   B4TextField,
@@ -39,13 +42,147 @@ interface DnsEntry {
 interface DnsSettingsProps {
   config: B4SetConfig;
   ipv6: boolean;
-  onChange: (field: string, value: string | boolean) => void;
+  onChange: (
+    field: string,
+    value: string | boolean | number | string[] | Record<string, string[]>
+  ) => void;
 }
 
 const POPULAR_DNS = (dns as DnsEntry[]).sort((a, b) =>
   a.name.localeCompare(b.name)
 );
 
+interface AddressListProps {
+  label: string;
+  title: string;
+  placeholder: string;
+  helperText: string;
+  items: string[];
+  onChange: (items: string[]) => void;
+}
+
+function AddressList({
+  label,
+  title,
+  placeholder,
+  helperText,
+  items,
+  onChange,
+}: AddressListProps) {
+  const [value, setValue] = useState("");
+
+  const handleAdd = () => {
+    const v = value.trim();
+    if (v && !items.includes(v)) {
+      onChange([...items, v]);
+    }
+    setValue("");
+  };
+
+  return (
+    <>
+      <Grid size={{ xs: 12, md: 6 }}>
+        <Box sx={{ display: "flex", gap: 1, alignItems: "flex-start" }}>
+          <B4TextField
+            label={label}
+            value={value}
+            onChange={(e) => setValue(e.target.value)}
+            onKeyDown={(e) => {
+              if (e.key === "Enter") {
+                e.preventDefault();
+                handleAdd();
+              }
+            }}
+            placeholder={placeholder}
+            helperText={helperText}
+          />
+          <B4PlusButton onClick={handleAdd} disabled={!value.trim()} />
+        </Box>
+      </Grid>
+      <B4ChipList
+        items={items}
+        getKey={(s) => s}
+        getLabel={(s) => s}
+        onDelete={(item) => onChange(items.filter((s) => s !== item))}
+        title={title}
+        gridSize={{ xs: 12, md: 6 }}
+      />
+    </>
+  );
+}
+
+interface HostsListProps {
+  hosts: Record<string, string[]>;
+  onChange: (hosts: Record<string, string[]>) => void;
+}
+
+function HostsList({ hosts, onChange }: HostsListProps) {
+  const [domain, setDomain] = useState("");
+  const [addresses, setAddresses] = useState("");
+
+  const handleAdd = () => {
+    const d = domain.trim().toLowerCase();
+    const ips = addresses
+      .split(/[\s,]+/)
+      .map((s) => s.trim())
+      .filter(Boolean);
+    if (d && ips.length > 0) {
+      onChange({ ...hosts, [d]: ips });
+    }
+    setDomain("");
+    setAddresses("");
+  };
+
+  const handleDelete = (d: string) => {
+    const next = { ...hosts };
+    delete next[d];
+    onChange(next);
+  };
+
+  return (
+    <>
+      <Grid size={{ xs: 12, md: 6 }}>
+        <Stack spacing={1}>
+          <B4TextField
+            label="Host"
+            value={domain}
+            onChange={(e) => setDomain(e.target.value)}
+            placeholder="e.g., example.com or *.example.com"
+            helperText="Domain or wildcard answered directly, without asking any resolver"
+          />
+          <Box sx={{ display: "flex", gap: 1, alignItems: "flex-start" }}>
+            <B4TextField
+              label="Addresses"
+              value={addresses}
+              onChange={(e) => setAddresses(e.target.value)}
+              onKeyDown={(e) => {
+                if (e.key === "Enter") {
+                  e.preventDefault();
+                  handleAdd();
+                }
+              }}
+              placeholder="e.g., 203.0.113.5, 2001:db8::5"
+              helperText="IPv4 and IPv6 addresses returned for it"
+            />
+            <B4PlusButton
+              onClick={handleAdd}
+              disabled={!domain.trim() || !addresses.trim()}
+            />
+          </Box>
+        </Stack>
+      </Grid>
+      <B4ChipList
+        items={Object.keys(hosts)}
+        getKey={(d) => d}
+        getLabel={(d) => `${d} → ${hosts[d].join(", ")}`}
+        onDelete={handleDelete}
+        title="Static Answers"
+        gridSize={{ xs: 12, md: 6 }}
+      />
+    </>
+  );
+}
+
 export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
   const dns = config.dns || { enabled: false, target_dns: "" };
   const selectedServer = POPULAR_DNS.find((d) => d.ip === dns.target_dns);
@@ -76,6 +213,50 @@ export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
           />
         </Grid>
 
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Learn IPs from DNS Answers"
+            checked={dns.learn_ips || false}
+            onChange={(checked: boolean) => onChange("dns.learn_ips", checked)}
+            description="Match the addresses DNS answers give for this set's domains, so QUIC and TLS without SNI to them are handled from the first packet"
+          />
+        </Grid>
+
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Filter Forged Answers"
+            checked={dns.filter_forged || false}
+            onChange={(checked: boolean) =>
+              onChange("dns.filter_forged", checked)
+            }
+            description="Drop injected answers for this set's domains: bogus addresses, zero TTL, or IP headers unlike the resolver's"
+          />
+        </Grid>
+
+        {dns.filter_forged && (
+          <>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4TextField
+                label="Hold Time"
+                type="number"
+                value={dns.hold_ms ?? 200}
+                onChange={(e) =>
+                  onChange("dns.hold_ms", Number(e.target.value))
+                }
+                helperText="Milliseconds an answer waits for a later, genuine one (0-2000)"
+              />
+            </Grid>
+            <AddressList
+              label="Add Bogus Address"
+              title="Bogus Addresses"
+              items={dns.bogus_ips || []}
+              onChange={(items) => onChange("dns.bogus_ips", items)}
+              placeholder="e.g., 10.0.0.0/8 or 195.208.4.1"
+              helperText="Addresses and CIDRs only forged answers or block pages point to"
+            />
+          </>
+        )}
+
         {dns.enabled && (
           <>
             {/* Custom IP input */}
@@ -89,6 +270,41 @@ export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
                 description="Split DNS packets using IP fragmentation to bypass DPI that pattern-matches domain names in queries"
               />
             </Grid>
+            <HostsList
+              hosts={dns.hosts || {}}
+              onChange={(hosts) => onChange("dns.hosts", hosts)}
+            />
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4TextField
+                label="Encrypted Upstream"
+                value={dns.upstream || ""}
+                onChange={(e) => onChange("dns.upstream", e.target.value)}
+                placeholder="e.g., https://dns.quad9.net/dns-query or tls://1.1.1.1"
+                helperText="Answer queries through DNS-over-HTTPS or DNS-over-TLS instead of the server below"
+              />
+            </Grid>
+            {dns.upstream && (
+              <>
+                <AddressList
+                  label="Add Bootstrap IP"
+                  title="Bootstrap IPs"
+                  items={dns.bootstrap || []}
+                  onChange={(items) => onChange("dns.bootstrap", items)}
+                  placeholder="e.g., 9.9.9.9"
+                  helperText="Addresses of the upstream host, so it is not looked up through the poisoned resolver"
+                />
+                <Grid size={{ xs: 12, md: 6 }}>
+                  <B4Switch
+                    label="Plain Fallback"
+                    checked={dns.plain_fallback || false}
+                    onChange={(checked: boolean) =>
+                      onChange("dns.plain_fallback", checked)
+                    }
+                    description="Ask the DNS server below, or the one the client asked, over plain UDP when the upstream fails"
+                  />
+                </Grid>
+              </>
+            )}
             <Grid size={{ xs: 12, md: 6 }}>
               <B4TextField
                 label="DNS Server IP"
@@ -289,11 +505,14 @@ export function DnsSettings({ config, onChange, ipv6 }: DnsSettingsProps) {
             </Grid>
 
             {/* Warnings */}
-            {!dns.target_dns && (
-              <B4Alert severity="warning" sx={{ m: 0 }}>
-                Select or enter a DNS server IP to enable redirect.
-              </B4Alert>
-            )}
+            {!dns.target_dns &&
+              !dns.upstream &&
+              Object.keys(dns.hosts || {}).length === 0 && (
+                <B4Alert severity="warning" sx={{ m: 0 }}>
+                  Select or enter a DNS server IP, or add static answers, to
+                  enable redirect.
+                </B4Alert>
+              )}
 
             {dns.target_dns === "8.8.8.8" && (
               <B4Alert severity="warning" sx={{ m: 0 }}>
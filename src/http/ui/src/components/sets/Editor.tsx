@@ -75,7 +75,15 @@ export const SetEditor = ({
 
   const handleChange = (
     field: string,
-    value: string | number | boolean | string[] | number[] | null | undefined
+    value:
+      | string
+      | number
+      | boolean
+      | string[]
+      | number[]
+      | Record<string, string[]>
+      | null
+      | undefined
   ) => {
     if (!editedSet) return;
 
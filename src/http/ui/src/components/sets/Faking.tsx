@@ -214,6 +214,57 @@ export const FakingSettings = ({ config, onChange }: FakingSettingsProps) => {
               disabled={!config.faking.sni}
             />
           </Grid>
+          <Grid size={{ xs: 12, md: 4 }}>
+            <B4Switch
+              label="Auto TTL"
+              checked={config.faking.auto_ttl?.enabled || false}
+              onChange={(checked: boolean) =>
+                onChange("faking.auto_ttl.enabled", checked)
+              }
+              description="Derive fake TTL from the hop count seen in the server's SYN-ACK; the fixed TTL applies until it is known"
+            />
+          </Grid>
+          {config.faking.auto_ttl?.enabled && (
+            <>
+              <Grid size={{ xs: 12, md: 4 }}>
+                <B4Slider
+                  label="Hops Minus"
+                  value={config.faking.auto_ttl.delta}
+                  onChange={(value: number) =>
+                    onChange("faking.auto_ttl.delta", value)
+                  }
+                  min={0}
+                  max={10}
+                  step={1}
+                  helperText="Subtracted from the observed hop count"
+                />
+              </Grid>
+              <Grid size={{ xs: 12, md: 2 }}>
+                <B4Slider
+                  label="Min TTL"
+                  value={config.faking.auto_ttl.min}
+                  onChange={(value: number) =>
+                    onChange("faking.auto_ttl.min", value)
+                  }
+                  min={1}
+                  max={64}
+                  step={1}
+                />
+              </Grid>
+              <Grid size={{ xs: 12, md: 2 }}>
+                <B4Slider
+                  label="Max TTL"
+                  value={config.faking.auto_ttl.max}
+                  onChange={(value: number) =>
+                    onChange("faking.auto_ttl.max", value)
+                  }
+                  min={1}
+                  max={64}
+                  step={1}
+                />
+              </Grid>
+            </>
+          )}
           <Grid size={{ xs: 12, md: 4 }}>
             <B4TextField
               label="Sequence Offset"
@@ -7,12 +7,14 @@ import {
   B4Slider,
   B4Alert,
   B4FormHeader,
+  B4TextField,
 } from "@b4.elements";
 import { B4SetConfig, FragmentationStrategy } from "@models/config";
 import { ComboSettings } from "./frags/Combo";
 import { DisorderSettings } from "./frags/Disorder";
 import { ExtSplitSettings } from "./frags/ExtSplit";
 import { FirstByteSettings } from "./frags/FirstByte";
+import { FallbackSettings } from "./frags/Fallback";
 import { TcpIpSettings } from "./frags/TcpIp";
 
 interface FragmentationSettingsProps {
@@ -77,6 +79,31 @@ export const FragmentationSettings = ({
           />
         </Grid>
 
+        <Grid size={{ xs: 12 }}>
+          <B4TextField
+            label="Strategy Pipeline"
+            value={config.pipeline || ""}
+            onChange={(e) => onChange("pipeline", e.target.value)}
+            placeholder="e.g., fake(ttl=5,payload=generated); split(at=sni+1); delay(20ms); disorder"
+            helperText="Ordered actions (fake, split, oob, disorder, delay, desync) that replace the method above - leave empty to use it"
+          />
+        </Grid>
+
+        <Grid size={{ xs: 12 }}>
+          <B4TextField
+            label="Split Positions"
+            value={(config.fragmentation.split_positions || []).join(", ")}
+            onChange={(e) =>
+              onChange(
+                "fragmentation.split_positions",
+                e.target.value.split(",").map((s) => s.trim())
+              )
+            }
+            placeholder="e.g., sni+1, midsld, endsni, -10"
+            helperText="Comma-separated split points for tcp, tls, disorder and oob: sni, midsni, endsni, sld, midsld, endsld, host, extensions, +/-N offsets, negative numbers count from the end"
+          />
+        </Grid>
+
         {isTcpOrIp && <TcpIpSettings config={config} onChange={onChange} />}
 
         {strategy === "combo" && (
@@ -163,6 +190,8 @@ export const FragmentationSettings = ({
             for bypass.
           </B4Alert>
         )}
+
+        <FallbackSettings config={config} onChange={onChange} />
       </Grid>
     </B4Section>
   );
@@ -80,6 +80,9 @@ export const ImportExportSettings = ({
       if (!frag.seq_overlap_pattern) {
         frag.seq_overlap_pattern = [];
       }
+      if (!frag.split_positions) {
+        frag.split_positions = [];
+      }
       // Remove deprecated overlap field
       delete frag.overlap;
     }
@@ -229,6 +229,7 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
         syn_fake_len: 0,
         syn_ttl: 3,
         drop_sack: false,
+        dport_filter: "",
         win: { mode: "off", values: [0, 1460, 8192, 65535] },
         desync: { mode: "off", ttl: 3, count: 3, post_desync: false },
         incoming: {
@@ -239,6 +240,8 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
           fake_count: 3,
           strategy: "badsum",
         },
+        forged: { enabled: false, ttl_tolerance: 2, window: true },
+        synack: { enabled: false, window: 1, wscale: -1, mss: 0, packets: 1 },
       } as B4SetConfig["tcp"],
       udp: {
         mode: "fake",
@@ -251,11 +254,46 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
         conn_bytes_limit: 8,
         seg2delay: 0,
       } as B4SetConfig["udp"],
+      http: {
+        enabled: false,
+        host_split: true,
+        host_case: false,
+        domain_case: false,
+        host_nospace: false,
+        fake_request: false,
+        fake_host: "www.google.com",
+      } as B4SetConfig["http"],
       dns: {
         enabled: false,
         target_dns: "",
         fragment_query: false,
+        upstream: "",
+        bootstrap: [],
+        plain_fallback: false,
+        learn_ips: false,
+        filter_forged: false,
+        hold_ms: 200,
+        bogus_ips: [
+          "0.0.0.0/8",
+          "10.0.0.0/8",
+          "127.0.0.0/8",
+          "172.16.0.0/12",
+          "192.168.0.0/16",
+          "::/128",
+          "::1/128",
+          "fc00::/7",
+        ],
+        hosts: {},
       } as B4SetConfig["dns"],
+      pipeline: "",
+      fallback: {
+        enabled: false,
+        strategies: [],
+        failures: 2,
+        timeout: 3000,
+        decay: 3600,
+        expire: 604800,
+      },
       fragmentation: {
         strategy: "tcp",
         reverse_order: true,
@@ -266,6 +304,7 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
         tlsrec_pos: 0,
         seq_overlap: 0,
         seq_overlap_pattern: [],
+        split_positions: [],
         combo: {
           extension_split: true,
           first_byte_split: true,
@@ -298,6 +337,12 @@ export const SetsManager = ({ config, onRefresh }: SetsManagerProps) => {
           fake_ext_count: 5,
           fake_snis: ["ya.ru", "vk.com", "max.ru"],
         },
+        auto_ttl: {
+          enabled: false,
+          delta: 1,
+          min: 3,
+          max: 20,
+        },
       } as B4SetConfig["faking"],
       targets: {
         sni_domains: [],
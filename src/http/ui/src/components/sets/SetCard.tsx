@@ -464,7 +464,9 @@ export const SetCard = ({
               icon={<DnsIcon />}
               enabled={set.dns?.enabled}
               tooltip={
-                set.dns?.enabled ? `DNS → ${set.dns.target_dns}` : "DNS OFF"
+                set.dns?.enabled
+                  ? `DNS → ${set.dns.upstream || set.dns.target_dns || "hosts"}`
+                  : "DNS OFF"
               }
             />
           </Box>
@@ -15,6 +15,7 @@ import {
   B4FormHeader,
   B4PlusButton,
   B4ChipList,
+  B4Switch,
 } from "@b4.elements";
 import { useState } from "react";
 
@@ -134,12 +135,14 @@ export const TcpSettings = ({ config, main, onChange }: TcpSettingsProps) => {
               onChange("tcp.conn_bytes_limit", value)
             }
             min={1}
-            max={main.id === config.id ? 100 : main.tcp.conn_bytes_limit}
+            max={100}
             step={1}
             helperText={
               main.id === config.id
                 ? "Main set limit (changing requires service restart to take effect)"
-                : `Max: ${main.tcp.conn_bytes_limit} (limited by main set)`
+                : config.tcp.conn_bytes_limit > main.tcp.conn_bytes_limit
+                  ? "Above the main set, only this set's targets get the extra packets"
+                  : "Packets per connection handled by this set"
             }
           />
         </Grid>
@@ -156,6 +159,16 @@ export const TcpSettings = ({ config, main, onChange }: TcpSettingsProps) => {
           />
         </Grid>
 
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4TextField
+            label="Port Filter"
+            value={config.tcp.dport_filter || ""}
+            onChange={(e) => onChange("tcp.dport_filter", e.target.value)}
+            placeholder="e.g., 8443,2053,6000-6100"
+            helperText="Extra TLS ports besides 443 - leave empty for 443 only"
+          />
+        </Grid>
+
         {/* SACK and SYN Fake */}
         <Grid size={{ xs: 12, md: 6 }}>
           <FormControlLabel
@@ -525,6 +538,177 @@ export const TcpSettings = ({ config, main, onChange }: TcpSettingsProps) => {
           />
         </Grid>
       </Grid>
+
+      {/* Forged Packet Filter */}
+      <B4FormHeader label="Forged Packet Filter" />
+      <Grid container spacing={3}>
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Drop Injected RST / Block Pages"
+            checked={config.tcp.forged?.enabled || false}
+            onChange={(checked: boolean) =>
+              onChange("tcp.forged.enabled", checked)
+            }
+            description="Drop incoming RST, FIN and HTTP responses whose TTL or window does not match the server's SYN-ACK"
+          />
+        </Grid>
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Slider
+            label="TTL Tolerance"
+            value={config.tcp.forged?.ttl_tolerance ?? 2}
+            onChange={(value: number) =>
+              onChange("tcp.forged.ttl_tolerance", value)
+            }
+            min={0}
+            max={10}
+            step={1}
+            disabled={!config.tcp.forged?.enabled}
+            helperText="Allowed TTL difference from the SYN-ACK"
+          />
+        </Grid>
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Compare TCP Window"
+            checked={config.tcp.forged?.window ?? true}
+            onChange={(checked: boolean) =>
+              onChange("tcp.forged.window", checked)
+            }
+            disabled={!config.tcp.forged?.enabled}
+            description="Also drop packets whose window cannot come from the server, scaled as its SYN-ACK announced"
+          />
+        </Grid>
+      </Grid>
+
+      {/* SYN-ACK Window Rewrite */}
+      <B4FormHeader label="SYN-ACK Window Rewrite" />
+      <Grid container spacing={3}>
+        <Grid size={{ xs: 12 }}>
+          <B4Switch
+            label="Shrink Server Window"
+            checked={config.tcp.synack?.enabled || false}
+            onChange={(checked: boolean) =>
+              onChange("tcp.synack.enabled", checked)
+            }
+            description="Advertise a tiny window in SYN-ACKs of IP-matched servers so the client sends its ClientHello in small segments itself"
+          />
+        </Grid>
+        {config.tcp.synack?.enabled && (
+          <>
+            <Grid size={{ xs: 12, md: 3 }}>
+              <B4TextField
+                label="Window"
+                type="number"
+                value={config.tcp.synack.window}
+                onChange={(e) =>
+                  onChange("tcp.synack.window", Number(e.target.value))
+                }
+                helperText="Window advertised to the client"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 3 }}>
+              <B4TextField
+                label="Client Packets"
+                type="number"
+                value={config.tcp.synack.packets}
+                onChange={(e) =>
+                  onChange("tcp.synack.packets", Number(e.target.value))
+                }
+                helperText="Client data packets before normal windows return"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 3 }}>
+              <B4TextField
+                label="Window Scale"
+                type="number"
+                value={config.tcp.synack.wscale}
+                onChange={(e) =>
+                  onChange("tcp.synack.wscale", Number(e.target.value))
+                }
+                helperText="-1 keeps the server's; affects the whole connection"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 3 }}>
+              <B4TextField
+                label="MSS"
+                type="number"
+                value={config.tcp.synack.mss}
+                onChange={(e) =>
+                  onChange("tcp.synack.mss", Number(e.target.value))
+                }
+                helperText="0 keeps the server's; affects the whole connection"
+              />
+            </Grid>
+          </>
+        )}
+      </Grid>
+
+      {/* Plain HTTP */}
+      <B4FormHeader label="Plain HTTP (port 80)" />
+      <Grid container spacing={3}>
+        <Grid size={{ xs: 12, md: 6 }}>
+          <B4Switch
+            label="Inspect HTTP Requests"
+            checked={config.http?.enabled || false}
+            onChange={(checked) => onChange("http.enabled", checked)}
+            description="Match sets by the Host header of unencrypted HTTP requests"
+          />
+        </Grid>
+
+        {config.http?.enabled && (
+          <>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Switch
+                label="Split Inside Host"
+                checked={config.http.host_split}
+                onChange={(checked) => onChange("http.host_split", checked)}
+                description="Send the request as two segments split in the middle of the Host value"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Switch
+                label="Mangle Header Case"
+                checked={config.http.host_case}
+                onChange={(checked) => onChange("http.host_case", checked)}
+                description='Rewrite "Host:" as "hOsT:"'
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Switch
+                label="Mangle Domain Case"
+                checked={config.http.domain_case}
+                onChange={(checked) => onChange("http.domain_case", checked)}
+                description="Mix upper and lower case in the Host value"
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Switch
+                label="Drop Space After Host"
+                checked={config.http.host_nospace}
+                onChange={(checked) => onChange("http.host_nospace", checked)}
+                description='Send "Host:example.com" (space moved behind the value)'
+              />
+            </Grid>
+            <Grid size={{ xs: 12, md: 6 }}>
+              <B4Switch
+                label="Fake Requests"
+                checked={config.http.fake_request}
+                onChange={(checked) => onChange("http.fake_request", checked)}
+                description="Send fake GET requests with a decoy Host using the set's faking strategy"
+              />
+            </Grid>
+            {config.http.fake_request && (
+              <Grid size={{ xs: 12, md: 6 }}>
+                <B4TextField
+                  label="Decoy Host"
+                  value={config.http.fake_host}
+                  onChange={(e) => onChange("http.fake_host", e.target.value)}
+                  placeholder="www.google.com"
+                />
+              </Grid>
+            )}
+          </>
+        )}
+      </Grid>
     </B4Section>
   );
 };
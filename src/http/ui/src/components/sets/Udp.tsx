@@ -165,12 +165,14 @@ export const UdpSettings = ({ config, main, onChange }: UdpSettingsProps) => {
                 value={config.udp.conn_bytes_limit}
                 onChange={(value) => onChange("udp.conn_bytes_limit", value)}
                 min={1}
-                max={main.id === config.id ? 30 : main.udp.conn_bytes_limit}
+                max={30}
                 step={1}
                 helperText={
                   main.id === config.id
                     ? "Main set limit (changing requires service restart to take effect)"
-                    : `Max: ${main.udp.conn_bytes_limit} (limited by main set)`
+                    : config.udp.conn_bytes_limit > main.udp.conn_bytes_limit
+                  ? "Above the main set, only this set's targets get the extra packets"
+                  : "Packets per connection handled by this set"
                 }
               />
             </Grid>
@@ -0,0 +1,141 @@
+import { useState } from "react";
+import { Grid, Box } from "@mui/material";
+import {
+  B4Alert,
+  B4ChipList,
+  B4FormHeader,
+  B4PlusButton,
+  B4Slider,
+  B4Switch,
+  B4TextField,
+} from "@b4.elements";
+import { B4SetConfig } from "@models/config";
+
+interface FallbackSettingsProps {
+  config: B4SetConfig;
+  onChange: (
+    field: string,
+    value: string | boolean | number | string[]
+  ) => void;
+}
+
+export const FallbackSettings = ({ config, onChange }: FallbackSettingsProps) => {
+  const [newStrategy, setNewStrategy] = useState("");
+  const fallback = config.fallback;
+  const strategies = fallback?.strategies || [];
+
+  const handleAdd = () => {
+    const value = newStrategy.trim();
+    if (value && !strategies.includes(value)) {
+      onChange("fallback.strategies", [...strategies, value]);
+    }
+    setNewStrategy("");
+  };
+
+  const handleRemove = (strategy: string) => {
+    onChange(
+      "fallback.strategies",
+      strategies.filter((s) => s !== strategy)
+    );
+  };
+
+  return (
+    <>
+      <B4FormHeader label="Adaptive Fallback" />
+
+      <Grid size={{ xs: 12 }}>
+        <B4Switch
+          label="Enable Adaptive Fallback"
+          checked={fallback?.enabled || false}
+          onChange={(checked: boolean) => onChange("fallback.enabled", checked)}
+          description="Watch each flow for a ServerHello and move a domain to the next strategy when this one keeps failing (RST, TLS alert, timeout or retransmitted ClientHello)"
+        />
+      </Grid>
+
+      {fallback?.enabled && (
+        <>
+          <Grid size={{ xs: 12, md: 6 }}>
+            <Box sx={{ display: "flex", gap: 1, alignItems: "flex-start" }}>
+              <B4TextField
+                label="Add Fallback Strategy"
+                value={newStrategy}
+                onChange={(e) => setNewStrategy(e.target.value)}
+                onKeyDown={(e) => {
+                  if (e.key === "Enter") {
+                    e.preventDefault();
+                    handleAdd();
+                  }
+                }}
+                placeholder="e.g., tls, disorder, fake(ttl=4); split(at=midsld)"
+                helperText="Strategy name or pipeline expression, tried in order"
+              />
+              <B4PlusButton onClick={handleAdd} disabled={!newStrategy.trim()} />
+            </Box>
+          </Grid>
+          <B4ChipList
+            items={strategies}
+            getKey={(s) => s}
+            getLabel={(s) => s}
+            onDelete={handleRemove}
+            title="Fallback Order"
+            gridSize={{ xs: 12, md: 6 }}
+          />
+
+          <Grid size={{ xs: 12, md: 4 }}>
+            <B4Slider
+              label="Failures Before Fallback"
+              value={fallback.failures}
+              onChange={(value: number) => onChange("fallback.failures", value)}
+              min={1}
+              max={10}
+              step={1}
+              helperText="Consecutive failed flows that trigger the next strategy"
+            />
+          </Grid>
+          <Grid size={{ xs: 12, md: 4 }}>
+            <B4Slider
+              label="ServerHello Timeout"
+              value={fallback.timeout}
+              onChange={(value: number) => onChange("fallback.timeout", value)}
+              min={500}
+              max={10000}
+              step={500}
+              valueSuffix=" ms"
+              helperText="A flow without an answer by then counts as failed"
+            />
+          </Grid>
+          <Grid size={{ xs: 12, md: 4 }}>
+            <B4Slider
+              label="Retry Preferred After"
+              value={fallback.decay}
+              onChange={(value: number) => onChange("fallback.decay", value)}
+              min={0}
+              max={86400}
+              step={300}
+              valueSuffix=" s"
+              helperText="Time before a domain goes back to the set's own strategy (0 = never)"
+            />
+          </Grid>
+          <Grid size={{ xs: 12, md: 4 }}>
+            <B4Slider
+              label="Forget Unused Domains After"
+              value={fallback.expire}
+              onChange={(value: number) => onChange("fallback.expire", value)}
+              min={0}
+              max={2592000}
+              step={86400}
+              valueSuffix=" s"
+              helperText="Time without connections before a domain's fallback state is dropped (0 = never)"
+            />
+          </Grid>
+
+          {strategies.length === 0 && (
+            <B4Alert severity="warning">
+              Add at least one fallback strategy.
+            </B4Alert>
+          )}
+        </>
+      )}
+    </>
+  );
+};
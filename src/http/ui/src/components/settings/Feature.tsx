@@ -7,9 +7,17 @@ import {
   B4Switch,
   B4Alert,
   B4Badge,
+  B4Select,
 } from "@b4.elements";
 import { Box, Typography } from "@mui/material";
 
+const INTEGRATIONS: Array<{ value: string; label: string }> = [
+  { value: "none", label: "None (B4 manages its rules)" },
+  { value: "auto", label: "Auto (fw4 or firewalld when present)" },
+  { value: "fw4", label: "OpenWrt fw4 include" },
+  { value: "firewalld", label: "firewalld direct rules" },
+] as const;
+
 interface FeatureSettingsProps {
   config: B4Config;
   onChange: (
@@ -56,6 +64,23 @@ export const FeatureSettings = ({ config, onChange }: FeatureSettingsProps) => {
           }
           description="Skip automatic IPTables/NFTables rules configuration"
         />
+        <B4Switch
+          label="Queue Only Target Addresses"
+          checked={config.system.tables.kernel_sets}
+          onChange={(checked: boolean) =>
+            onChange("system.tables.kernel_sets", checked)
+          }
+          description="Keep target IPs in nftables sets / ipsets so only their traffic (and SNI-matched flows) is queued"
+        />
+        <B4Select
+          label="System Firewall Integration"
+          value={config.system.tables.integration}
+          options={INTEGRATIONS}
+          onChange={(e) =>
+            onChange("system.tables.integration", String(e.target.value))
+          }
+          helperText="Install the rules through fw4 or firewalld so firewall reloads keep them"
+        />
         <B4Slider
           label="Firewall Monitor Interval in seconds (default 10s)"
           value={config.system.tables.monitor_interval}
@@ -65,7 +90,7 @@ export const FeatureSettings = ({ config, onChange }: FeatureSettingsProps) => {
           min={0}
           max={120}
           step={5}
-          helperText="Interval for monitoring B4 iptables/nftables rules"
+          helperText="Fallback polling of B4 iptables/nftables rules, nftables changes are detected immediately"
           alert={
             config.system.tables.monitor_interval <= 0 && (
               <B4Alert severity="warning">
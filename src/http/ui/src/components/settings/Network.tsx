@@ -1,5 +1,12 @@
 import { NetworkIcon } from "@b4.icons";
-import { B4FormGroup, B4Section, B4TextField, B4Slider } from "@b4.elements";
+import {
+  B4FormGroup,
+  B4Section,
+  B4Select,
+  B4TextField,
+  B4Slider,
+  B4Switch,
+} from "@b4.elements";
 import { B4Config } from "@models/config";
 
 interface NetworkSettingsProps {
@@ -10,6 +17,16 @@ interface NetworkSettingsProps {
   ) => void;
 }
 
+const VERDICT_MODES = [
+  { value: "reinject", label: "Reinject (raw socket)" },
+  { value: "modify", label: "Modified verdict" },
+];
+
+const TRANSPARENT_MODES = [
+  { value: "redirect", label: "REDIRECT (NAT)" },
+  { value: "tproxy", label: "TPROXY" },
+];
+
 export const NetworkSettings = ({ config, onChange }: NetworkSettingsProps) => (
   <B4Section
     title="Network Configuration"
@@ -40,6 +57,41 @@ export const NetworkSettings = ({ config, onChange }: NetworkSettingsProps) => (
         step={1}
         helperText="Number of worker threads for processing packets simultaneously (default 4)"
       />
+      <B4Slider
+        label="ClientHello Reassembly Timeout"
+        value={config.queue.reassembly_timeout}
+        onChange={(value) => onChange("queue.reassembly_timeout", value)}
+        min={0}
+        max={1000}
+        step={50}
+        valueSuffix=" ms"
+        helperText="How long to hold a ClientHello split across several packets (0 = disabled, default 200)"
+      />
+      <B4Slider
+        label="Injection Workers"
+        value={config.queue.inject_workers}
+        onChange={(value) => onChange("queue.inject_workers", value)}
+        min={1}
+        max={32}
+        step={1}
+        helperText="Goroutines per queue running strategies on matched packets (default 4)"
+      />
+      <B4Slider
+        label="Injection Queue Size"
+        value={config.queue.inject_queue_size}
+        onChange={(value) => onChange("queue.inject_queue_size", value)}
+        min={16}
+        max={4096}
+        step={16}
+        helperText="Matched packets waiting per queue; when full, new ones pass unmodified (default 256)"
+      />
+      <B4Select
+        label="Verdict Mode"
+        value={config.queue.verdict_mode}
+        options={VERDICT_MODES}
+        onChange={(e) => onChange("queue.verdict_mode", String(e.target.value))}
+        helperText="Modified verdict returns the first segment to the kernel and only sends fakes and extra segments through the raw socket"
+      />
     </B4FormGroup>
     <B4FormGroup label="Web Server" columns={2}>
       <B4TextField
@@ -61,5 +113,62 @@ export const NetworkSettings = ({ config, onChange }: NetworkSettingsProps) => (
         helperText="Web UI port (default: 7000)"
       />
     </B4FormGroup>
+    <B4FormGroup label="Transparent Proxy" columns={2}>
+      <B4Switch
+        label="Use Transparent Proxy"
+        checked={config.system.transparent.enabled}
+        onChange={(checked: boolean) =>
+          onChange("system.transparent.enabled", checked)
+        }
+        description="Redirect connections to a local proxy instead of NFQUEUE, for kernels without nfnetlink_queue (restart required)"
+      />
+      <B4Select
+        label="Redirect Mode"
+        value={config.system.transparent.mode}
+        options={TRANSPARENT_MODES}
+        onChange={(e) =>
+          onChange("system.transparent.mode", String(e.target.value))
+        }
+        helperText="TPROXY also needs the xt_TPROXY / nft_tproxy module"
+      />
+      <B4TextField
+        label="Proxy Port"
+        type="number"
+        value={config.system.transparent.port}
+        onChange={(e) =>
+          onChange("system.transparent.port", Number(e.target.value))
+        }
+        helperText="Local port the firewall redirects to (default: 10443)"
+      />
+    </B4FormGroup>
+    <B4FormGroup label="SOCKS5 / HTTP Proxy" columns={2}>
+      <B4Switch
+        label="Enable SOCKS5 / HTTP CONNECT Proxy"
+        checked={config.system.proxy.enabled}
+        onChange={(checked: boolean) =>
+          onChange("system.proxy.enabled", checked)
+        }
+        description="Applications using the proxy get the set strategies without firewall rules (restart required)"
+      />
+      <B4TextField
+        label="Listen Address"
+        value={config.system.proxy.address}
+        onChange={(e) => onChange("system.proxy.address", e.target.value)}
+        placeholder="127.0.0.1:1080"
+        helperText="host:port shared by SOCKS5 and HTTP CONNECT"
+      />
+      <B4TextField
+        label="Username"
+        value={config.system.proxy.username}
+        onChange={(e) => onChange("system.proxy.username", e.target.value)}
+        helperText="Leave empty to allow clients without auth"
+      />
+      <B4TextField
+        label="Password"
+        type="password"
+        value={config.system.proxy.password}
+        onChange={(e) => onChange("system.proxy.password", e.target.value)}
+      />
+    </B4FormGroup>
   </B4Section>
 );
@@ -41,6 +41,14 @@ export interface FakingConfig {
   payload_file: string;
   tls_mod: string[];
   tcp_md5: boolean;
+  auto_ttl: AutoTTLConfig;
+}
+
+export interface AutoTTLConfig {
+  enabled: boolean;
+  delta: number;
+  min: number;
+  max: number;
 }
 export type FragmentationStrategy =
   | "tcp"
@@ -65,6 +73,8 @@ export interface FragmentationConfig {
 
   seq_overlap_pattern: string[];
 
+  split_positions: string[];
+
   combo: ComboFragConfig;
   disorder: DisorderFragConfig;
 }
@@ -109,6 +119,16 @@ export type UdpMode = "drop" | "fake";
 export type UdpFilterQuicMode = "disabled" | "all" | "parse";
 export type UdpFakingStrategy = "none" | "ttl" | "checksum";
 
+export interface HttpConfig {
+  enabled: boolean;
+  host_split: boolean;
+  host_case: boolean;
+  domain_case: boolean;
+  host_nospace: boolean;
+  fake_request: boolean;
+  fake_host: string;
+}
+
 export interface UdpConfig {
   mode: UdpMode;
   fake_seq_length: number;
@@ -128,6 +148,10 @@ export interface QueueConfig {
   ipv6: boolean;
   interfaces: string[];
   devices: DevicesConfig;
+  reassembly_timeout: number;
+  verdict_mode: "reinject" | "modify";
+  inject_workers: number;
+  inject_queue_size: number;
 }
 
 export interface DevicesConfig {
@@ -156,10 +180,27 @@ export interface TcpConfig {
   syn_fake_len: number;
   syn_ttl: number;
   drop_sack: boolean;
+  dport_filter: string;
 
   desync: DesyncConfig;
   win: WinConfig;
   incoming: IncomingConfig;
+  forged: ForgedConfig;
+  synack: SynAckConfig;
+}
+
+export interface SynAckConfig {
+  enabled: boolean;
+  window: number;
+  wscale: number;
+  mss: number;
+  packets: number;
+}
+
+export interface ForgedConfig {
+  enabled: boolean;
+  ttl_tolerance: number;
+  window: boolean;
 }
 
 export interface IncomingConfig {
@@ -190,6 +231,21 @@ export interface WebServerConfig {
 export interface TableConfig {
   monitor_interval: number;
   skip_setup: false;
+  kernel_sets: boolean;
+  integration: "none" | "auto" | "fw4" | "firewalld";
+}
+
+export interface TransparentConfig {
+  enabled: boolean;
+  port: number;
+  mode: "redirect" | "tproxy";
+}
+
+export interface ProxyConfig {
+  enabled: boolean;
+  address: string;
+  username: string;
+  password: string;
 }
 
 export interface GeoConfig {
@@ -207,6 +263,8 @@ export interface SystemConfig {
   logging: LoggingConfig;
   web_server: WebServerConfig;
   tables: TableConfig;
+  transparent: TransparentConfig;
+  proxy: ProxyConfig;
   checker: DiscoveryConfig;
   geo: GeoConfig;
   api: ApiConfig;
@@ -226,10 +284,22 @@ export interface B4SetConfig {
 
   tcp: TcpConfig;
   udp: UdpConfig;
+  http: HttpConfig;
   fragmentation: FragmentationConfig;
   faking: FakingConfig;
   targets: TargetsConfig;
   dns: DNSConfig;
+  pipeline: string;
+  fallback: FallbackConfig;
+}
+
+export interface FallbackConfig {
+  enabled: boolean;
+  strategies: string[];
+  failures: number;
+  timeout: number;
+  decay: number;
+  expire: number;
 }
 
 export type ComboShuffleMode = "middle" | "full" | "reverse";
@@ -254,6 +324,14 @@ export interface DNSConfig {
   enabled: boolean;
   target_dns: string;
   fragment_query: boolean;
+  upstream: string;
+  bootstrap: string[];
+  plain_fallback: boolean;
+  learn_ips: boolean;
+  filter_forged: boolean;
+  hold_ms: number;
+  bogus_ips: string[];
+  hosts: Record<string, string[]>;
 }
 
 export const MAIN_SET_ID = "11111111-1111-1111-1111-111111111111";
@@ -18,6 +18,7 @@ import (
 	"github.com/daniellavrushin/b4/http/handler"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/nfq"
+	"github.com/daniellavrushin/b4/proxy"
 	"github.com/daniellavrushin/b4/quic"
 	"github.com/daniellavrushin/b4/tables"
 	"github.com/spf13/cobra"
@@ -131,17 +132,46 @@ func runB4(cmd *cobra.Command, args []string) error {
 		metrics.TablesStatus = "skipped"
 	}
 
-	// Start netfilter queue pool
-	log.Infof("Starting netfilter queue pool (queue: %d, threads: %d)", cfg.Queue.StartNum, cfg.Queue.Threads)
-	pool := nfq.NewPool(&cfg)
-	if err := pool.Start(); err != nil {
-		metrics.RecordEvent("error", fmt.Sprintf("NFQueue start failed: %v", err))
-		metrics.NFQueueStatus = "error"
-		return fmt.Errorf("netfilter queue start failed: %w", err)
+	var pool *nfq.Pool
+	var tproxy *proxy.Server
+	if cfg.System.Transparent.Enabled {
+		// Start the transparent proxy instead of the queue
+		log.Infof("Starting transparent proxy (port: %d, mode: %s)", cfg.System.Transparent.Port, cfg.System.Transparent.Mode)
+		tproxy = proxy.NewServer(&cfg)
+		if err := tproxy.Start(); err != nil {
+			metrics.RecordEvent("error", fmt.Sprintf("Transparent proxy start failed: %v", err))
+			metrics.NFQueueStatus = "error"
+			return fmt.Errorf("transparent proxy start failed: %w", err)
+		}
+		handler.SetTransparentProxy(tproxy)
+
+		metrics.RecordEvent("info", fmt.Sprintf("Transparent proxy started on port %d", cfg.System.Transparent.Port))
+		metrics.NFQueueStatus = "transparent proxy"
+	} else {
+		// Start netfilter queue pool
+		log.Infof("Starting netfilter queue pool (queue: %d, threads: %d)", cfg.Queue.StartNum, cfg.Queue.Threads)
+		pool = nfq.NewPool(&cfg)
+		if err := pool.Start(); err != nil {
+			metrics.RecordEvent("error", fmt.Sprintf("NFQueue start failed: %v", err))
+			metrics.NFQueueStatus = "error"
+			return fmt.Errorf("netfilter queue start failed: %w", err)
+		}
+
+		metrics.RecordEvent("info", fmt.Sprintf("NFQueue started with %d threads", cfg.Queue.Threads))
+		metrics.NFQueueStatus = "active"
 	}
 
-	metrics.RecordEvent("info", fmt.Sprintf("NFQueue started with %d threads", cfg.Queue.Threads))
-	metrics.NFQueueStatus = "active"
+	var localProxy *proxy.LocalServer
+	if cfg.System.Proxy.Enabled {
+		log.Infof("Starting SOCKS5/HTTP proxy (address: %s)", cfg.System.Proxy.Address)
+		localProxy = proxy.NewLocalServer(&cfg)
+		if err := localProxy.Start(); err != nil {
+			metrics.RecordEvent("error", fmt.Sprintf("SOCKS5/HTTP proxy start failed: %v", err))
+			return fmt.Errorf("SOCKS5/HTTP proxy start failed: %w", err)
+		}
+		handler.SetLocalProxy(localProxy)
+		metrics.RecordEvent("info", fmt.Sprintf("SOCKS5/HTTP proxy started on %s", cfg.System.Proxy.Address))
+	}
 
 	// Start tables monitor to handle rule restoration if system wipes them
 	var tablesMonitor *tables.Monitor
@@ -169,10 +199,10 @@ func runB4(cmd *cobra.Command, args []string) error {
 	metrics.RecordEvent("info", fmt.Sprintf("Shutdown initiated by signal: %v", sig))
 
 	// Perform graceful shutdown with timeout
-	return gracefulShutdown(&cfg, pool, httpServer, metrics)
+	return gracefulShutdown(&cfg, pool, tproxy, localProxy, httpServer, metrics)
 }
 
-func gracefulShutdown(cfg *config.Config, pool *nfq.Pool, httpServer *http.Server, metrics *handler.MetricsCollector) error {
+func gracefulShutdown(cfg *config.Config, pool *nfq.Pool, tproxy *proxy.Server, localProxy *proxy.LocalServer, httpServer *http.Server, metrics *handler.MetricsCollector) error {
 	// Create shutdown context with timeout
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -201,29 +231,50 @@ func gracefulShutdown(cfg *config.Config, pool *nfq.Pool, httpServer *http.Serve
 	b4http.Shutdown()
 
 	// Stop NFQueue pool
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Infof("Stopping netfilter queue pool...")
-		metrics.NFQueueStatus = "stopping"
-
-		// Use a goroutine with timeout for pool.Stop()
-		stopDone := make(chan struct{})
+	if pool != nil {
+		wg.Add(1)
 		go func() {
-			pool.Stop()
-			close(stopDone)
+			defer wg.Done()
+			log.Infof("Stopping netfilter queue pool...")
+			metrics.NFQueueStatus = "stopping"
+
+			// Use a goroutine with timeout for pool.Stop()
+			stopDone := make(chan struct{})
+			go func() {
+				pool.Stop()
+				close(stopDone)
+			}()
+
+			select {
+			case <-stopDone:
+				log.Infof("Netfilter queue pool stopped")
+			case <-shutdownCtx.Done():
+				log.Errorf("Netfilter queue pool stop timed out")
+				shutdownErrors <- fmt.Errorf("NFQueue stop timeout")
+			}
+
+			quic.Shutdown()
 		}()
+	}
 
-		select {
-		case <-stopDone:
-			log.Infof("Netfilter queue pool stopped")
-		case <-shutdownCtx.Done():
-			log.Errorf("Netfilter queue pool stop timed out")
-			shutdownErrors <- fmt.Errorf("NFQueue stop timeout")
-		}
+	// Stop transparent proxy
+	if tproxy != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metrics.NFQueueStatus = "stopping"
+			tproxy.Stop()
+		}()
+	}
 
-		quic.Shutdown()
-	}()
+	// Stop SOCKS5/HTTP proxy
+	if localProxy != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			localProxy.Stop()
+		}()
+	}
 
 	// Clean up iptables/nftables rules
 	if !cfg.System.Tables.SkipSetup {
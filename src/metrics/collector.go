@@ -22,16 +22,18 @@ type MetricsCollector struct {
 	CurrentPPS          float64           `json:"current_pps"`
 	CPUUsage            float64           `json:"cpu_usage"`
 
-	ConnectionRate    []TimeSeriesPoint `json:"connection_rate"`
-	PacketRate        []TimeSeriesPoint `json:"packet_rate"`
-	StartTime         time.Time         `json:"start_time"`
-	Uptime            string            `json:"uptime"`
-	MemoryUsage       MemoryStats       `json:"memory_usage"`
-	WorkerStatus      []WorkerHealth    `json:"worker_status"`
-	NFQueueStatus     string            `json:"nfqueue_status"`
-	TablesStatus      string            `json:"tables_status"`
-	RecentConnections []ConnectionLog   `json:"recent_connections"`
-	RecentEvents      []SystemEvent     `json:"recent_events"`
+	ConnectionRate    []TimeSeriesPoint         `json:"connection_rate"`
+	PacketRate        []TimeSeriesPoint         `json:"packet_rate"`
+	StartTime         time.Time                 `json:"start_time"`
+	Uptime            string                    `json:"uptime"`
+	MemoryUsage       MemoryStats               `json:"memory_usage"`
+	WorkerStatus      []WorkerHealth            `json:"worker_status"`
+	NFQueueStatus     string                    `json:"nfqueue_status"`
+	TablesStatus      string                    `json:"tables_status"`
+	RecentConnections []ConnectionLog           `json:"recent_connections"`
+	RecentEvents      []SystemEvent             `json:"recent_events"`
+	ForgedDropped     map[string]ForgedCounters `json:"forged_dropped"` // per set name
+	ProxyClients      map[string]ProxyClient    `json:"proxy_clients"`  // per SOCKS5 / HTTP CONNECT client address
 
 	lastUpdate      time.Time    `json:"-"`
 	mu              sync.RWMutex `json:"-"`
@@ -55,9 +57,12 @@ type MemoryStats struct {
 }
 
 type WorkerHealth struct {
-	Processed uint64 `json:"processed"`
-	ID        int    `json:"id"`
-	Status    string `json:"status"`
+	Processed     uint64 `json:"processed"`
+	ID            int    `json:"id"`
+	Status        string `json:"status"`
+	QueueDepth    int    `json:"queue_depth"`    // matched packets waiting for injection
+	QueueCapacity int    `json:"queue_capacity"` // injection queue size
+	Fallbacks     uint64 `json:"fallbacks"`      // packets passed unmodified while the queue was full
 }
 
 type ConnectionLog struct {
@@ -69,6 +74,25 @@ type ConnectionLog struct {
 	IsTarget    bool      `json:"is_target"`
 }
 
+// ForgedCounters counts incoming packets dropped as injected by the DPI.
+type ForgedCounters struct {
+	RST  uint64 `json:"rst"`
+	FIN  uint64 `json:"fin"`
+	HTTP uint64 `json:"http"`
+	DNS  uint64 `json:"dns"`
+}
+
+// ProxyClient counts the connections of a SOCKS5 or HTTP CONNECT client.
+type ProxyClient struct {
+	User        string    `json:"user,omitempty"`
+	Connections uint64    `json:"connections"`
+	Active      uint64    `json:"active"`
+	Targeted    uint64    `json:"targeted"` // connections a set applied to
+	BytesSent   uint64    `json:"bytes_sent"`
+	BytesRecv   uint64    `json:"bytes_recv"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
 type SystemEvent struct {
 	Timestamp time.Time `json:"timestamp"`
 	Level     string    `json:"level"`
@@ -87,6 +111,8 @@ func GetMetricsCollector() *MetricsCollector {
 			TopDomains:        make(map[string]uint64),
 			ProtocolDist:      make(map[string]uint64),
 			GeoDist:           make(map[string]uint64),
+			ForgedDropped:     make(map[string]ForgedCounters),
+			ProxyClients:      make(map[string]ProxyClient),
 			ConnectionRate:    make([]TimeSeriesPoint, 0, 60),
 			PacketRate:        make([]TimeSeriesPoint, 0, 60),
 			RecentConnections: make([]ConnectionLog, 0, 10),
@@ -223,6 +249,61 @@ func (m *MetricsCollector) RecordPacket(bytes uint64) {
 	m.BytesProcessed += bytes
 }
 
+// RecordForgedPacket counts a forged packet of kind "rst", "fin", "http" or
+// "dns" dropped for a set.
+func (m *MetricsCollector) RecordForgedPacket(set, kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.ForgedDropped[set]
+	switch kind {
+	case "rst":
+		c.RST++
+	case "fin":
+		c.FIN++
+	case "http":
+		c.HTTP++
+	case "dns":
+		c.DNS++
+	}
+	m.ForgedDropped[set] = c
+}
+
+// RecordProxyConnection counts a new connection of a proxy client.
+func (m *MetricsCollector) RecordProxyConnection(client, user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.ProxyClients[client]
+	c.User = user
+	c.Connections++
+	c.Active++
+	c.LastSeen = time.Now()
+	m.ProxyClients[client] = c
+}
+
+// CloseProxyConnection records how a finished proxy connection went, whether
+// a set applied to it and the bytes it moved.
+func (m *MetricsCollector) CloseProxyConnection(client string, isTarget bool, sent, recv uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.ProxyClients[client]
+	if !ok {
+		return
+	}
+	if c.Active > 0 {
+		c.Active--
+	}
+	if isTarget {
+		c.Targeted++
+	}
+	c.BytesSent += sent
+	c.BytesRecv += recv
+	c.LastSeen = time.Now()
+	m.ProxyClients[client] = c
+}
+
 func (m *MetricsCollector) RecordEvent(level, message string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -255,11 +336,26 @@ func (m *MetricsCollector) UpdateSingleWorker(workerID int, status string, proce
 		m.WorkerStatus = append(m.WorkerStatus, WorkerHealth{})
 	}
 
-	m.WorkerStatus[workerID] = WorkerHealth{
-		ID:        workerID,
-		Status:    status,
-		Processed: processed,
+	w := &m.WorkerStatus[workerID]
+	w.ID = workerID
+	w.Status = status
+	w.Processed = processed
+}
+
+// UpdateWorkerQueue records the injection queue state of a worker.
+func (m *MetricsCollector) UpdateWorkerQueue(workerID int, depth, capacity int, fallbacks uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.WorkerStatus) <= workerID {
+		m.WorkerStatus = append(m.WorkerStatus, WorkerHealth{})
 	}
+
+	w := &m.WorkerStatus[workerID]
+	w.ID = workerID
+	w.QueueDepth = depth
+	w.QueueCapacity = capacity
+	w.Fallbacks = fallbacks
 }
 
 func (m *MetricsCollector) CloseConnection() {
@@ -321,6 +417,16 @@ func (m *MetricsCollector) GetSnapshot() *MetricsCollector {
 		snapshot.GeoDist[k] = v
 	}
 
+	snapshot.ForgedDropped = make(map[string]ForgedCounters, len(m.ForgedDropped))
+	for k, v := range m.ForgedDropped {
+		snapshot.ForgedDropped[k] = v
+	}
+
+	snapshot.ProxyClients = make(map[string]ProxyClient, len(m.ProxyClients))
+	for k, v := range m.ProxyClients {
+		snapshot.ProxyClients[k] = v
+	}
+
 	if len(m.WorkerStatus) > 0 {
 		snapshot.WorkerStatus = make([]WorkerHealth, len(m.WorkerStatus))
 		copy(snapshot.WorkerStatus, m.WorkerStatus)
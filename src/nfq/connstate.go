@@ -1,7 +1,6 @@
 package nfq
 
 import (
-	"fmt"
 	"math/rand"
 	"sync"
 	"time"
@@ -18,14 +17,14 @@ type connInfo struct {
 
 type connStateTracker struct {
 	mu    sync.RWMutex
-	conns map[string]*connInfo
+	conns map[flowKey]*connInfo
 }
 
 var connState = &connStateTracker{
-	conns: make(map[string]*connInfo),
+	conns: make(map[flowKey]*connInfo),
 }
 
-func (t *connStateTracker) RegisterOutgoing(connKey string, set *config.SetConfig) {
+func (t *connStateTracker) RegisterOutgoing(connKey flowKey, set *config.SetConfig) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.conns[connKey] = &connInfo{
@@ -34,9 +33,7 @@ func (t *connStateTracker) RegisterOutgoing(connKey string, set *config.SetConfi
 	}
 }
 
-func (t *connStateTracker) GetSetForIncoming(clientIP string, clientPort uint16, serverIP string, serverPort uint16) *config.SetConfig {
-	outKey := fmt.Sprintf("%s:%d->%s:%d", clientIP, clientPort, serverIP, serverPort)
-
+func (t *connStateTracker) GetSetForIncoming(outKey flowKey) *config.SetConfig {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -49,9 +46,7 @@ func (t *connStateTracker) GetSetForIncoming(clientIP string, clientPort uint16,
 	return info.set
 }
 
-func (t *connStateTracker) TrackIncomingBytes(clientIP string, clientPort uint16, serverIP string, serverPort uint16, bytes uint64, inc *config.IncomingConfig) bool {
-	outKey := fmt.Sprintf("%s:%d->%s:%d", clientIP, clientPort, serverIP, serverPort)
-
+func (t *connStateTracker) TrackIncomingBytes(outKey flowKey, bytes uint64, inc *config.IncomingConfig) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -9,5 +9,8 @@ const (
 	UDPHeaderLen     = 8
 	TLSHandshakeType = 0x16
 	TLSClientHello   = 0x01
+	TLSServerHello   = 0x02
+	TLSAlertType     = 0x15
 	HTTPSPort        = 443
+	HTTPPort         = 80
 )
@@ -17,7 +17,10 @@ func (w *Worker) sendDisorderFragments(cfg *config.SetConfig, packet []byte, dst
 		return
 	}
 
-	splits := GetSNISplitPoints(pi.Payload, pi.PayloadLen, cfg.Fragmentation.MiddleSNI, 0)
+	splits := w.resolveSplitPositions(pi.Payload, cfg.Fragmentation.SplitPoints)
+	if len(splits) == 0 {
+		splits = GetSNISplitPoints(pi.Payload, pi.PayloadLen, cfg.Fragmentation.MiddleSNI, 0)
+	}
 	if len(splits) == 0 {
 		splits = []int{1, pi.PayloadLen / 2, pi.PayloadLen * 3 / 4}
 	}
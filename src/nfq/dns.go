@@ -3,6 +3,7 @@ package nfq
 import (
 	"encoding/binary"
 	"net"
+	"time"
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/dns"
@@ -16,8 +17,17 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 	if dport == 53 {
 		domain, ok := dns.ParseQueryDomain(payload)
 		if ok {
+			dnsID := binary.BigEndian.Uint16(payload[:2])
 			matcher := w.getMatcher()
-			if matchedSet, set := matcher.MatchSNI(domain); matchedSet && set.DNS.Enabled && set.DNS.TargetDNS != "" {
+			matchedSet, set := matcher.MatchSNI(domain)
+			if matchedSet && set.DNS.Enabled {
+				if resp, ok := w.hostsAnswer(set, domain, payload); ok {
+					return w.answerDnsQuery(set, domain, ipVersion, sport, raw, ihl, resp, id)
+				}
+			}
+			if matchedSet && set.DNS.Enabled && set.DNS.Upstream != "" {
+				return w.forwardDnsQuery(set, domain, ipVersion, sport, raw, ihl, id)
+			} else if matchedSet && set.DNS.Enabled && set.DNS.TargetDNS != "" {
 
 				targetIP := net.ParseIP(set.DNS.TargetDNS)
 				if targetIP == nil {
@@ -40,7 +50,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					originalDst := make(net.IP, 4)
 					copy(originalDst, raw[16:20])
 
-					dns.DnsNATSet(net.IP(raw[12:16]), sport, originalDst)
+					dns.DnsNATSet(net.IP(raw[12:16]), sport, dnsID, originalDst)
 
 					copy(raw[16:20], targetDNS)
 					sock.FixIPv4Checksum(raw[:ihl])
@@ -77,7 +87,7 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 					originalDst := make(net.IP, 16)
 					copy(originalDst, raw[24:40])
 
-					dns.DnsNATSet(net.IP(raw[8:24]), sport, originalDst)
+					dns.DnsNATSet(net.IP(raw[8:24]), sport, dnsID, originalDst)
 
 					copy(raw[24:40], targetDNS)
 					sock.FixUDPChecksumV6(raw)
@@ -97,32 +107,16 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 	}
 
 	if sport == 53 {
-		if ipVersion == IPv4 {
-			if originalDst, ok := dns.DnsNATGet(net.IP(raw[16:20]), dport); ok {
-				copy(raw[12:16], originalDst.To4())
-				sock.FixIPv4Checksum(raw[:ihl])
-				sock.FixUDPChecksum(raw, ihl)
-				dns.DnsNATDelete(net.IP(raw[16:20]), dport)
-				_ = w.sock.SendIPv4(raw, net.IP(raw[16:20]))
-				if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-					log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-				}
-				return 0
-			}
-		} else { // IPv6
-			cfg := w.getConfig()
-			if cfg.Queue.IPv6Enabled {
-				if originalDst, ok := dns.DnsNATGet(net.IP(raw[24:40]), dport); ok {
-					copy(raw[8:24], originalDst.To16())
-					sock.FixUDPChecksumV6(raw)
-					dns.DnsNATDelete(net.IP(raw[24:40]), dport)
-					_ = w.sock.SendIPv6(raw, net.IP(raw[24:40]))
-					if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if w.filterDnsResponse(ipVersion, dport, payload, raw, ihl, id) {
+			return 0
+		}
+		w.learnFromDnsResponse(payload)
+
+		if w.restoreDnsNAT(ipVersion, dport, raw, ihl) {
+			if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
 			}
+			return 0
 		}
 	}
 
@@ -132,6 +126,42 @@ func (w *Worker) processDnsPacket(ipVersion byte, sport uint16, dport uint16, pa
 	return 0
 }
 
+// restoreDnsNAT sends a response to a redirected query back to the client
+// as if the server it asked had answered. It reports whether raw was one.
+func (w *Worker) restoreDnsNAT(ipVersion byte, dport uint16, raw []byte, ihl int) bool {
+	if len(raw) < ihl+8+2 {
+		return false
+	}
+	dnsID := binary.BigEndian.Uint16(raw[ihl+8 : ihl+10])
+
+	if ipVersion == IPv4 {
+		originalDst, ok := dns.DnsNATGet(net.IP(raw[16:20]), dport, dnsID)
+		if !ok {
+			return false
+		}
+		copy(raw[12:16], originalDst.To4())
+		sock.FixIPv4Checksum(raw[:ihl])
+		sock.FixUDPChecksum(raw, ihl)
+		dns.DnsNATDelete(net.IP(raw[16:20]), dport, dnsID)
+		_ = w.sock.SendIPv4(raw, net.IP(raw[16:20]))
+		return true
+	}
+
+	cfg := w.getConfig()
+	if !cfg.Queue.IPv6Enabled {
+		return false
+	}
+	originalDst, ok := dns.DnsNATGet(net.IP(raw[24:40]), dport, dnsID)
+	if !ok {
+		return false
+	}
+	copy(raw[8:24], originalDst.To16())
+	sock.FixUDPChecksumV6(raw)
+	dns.DnsNATDelete(net.IP(raw[24:40]), dport, dnsID)
+	_ = w.sock.SendIPv6(raw, net.IP(raw[24:40]))
+	return true
+}
+
 // sendFragmentedDNSQuery fragments a DNS query to evade DPI
 func (w *Worker) sendFragmentedDNSQueryV4(cfg *config.SetConfig, raw []byte, ihl int, dst net.IP) {
 	udpOffset := ihl
@@ -244,3 +274,37 @@ func findDNSSplitPoint(dnsPayload []byte) int {
 
 	return len(dnsPayload) / 2
 }
+
+// Addresses learned from DNS answers live at least this long, the client
+// connects right after the answer even when its TTL is 0, and at most a day.
+const (
+	minDnsLearnTTL = time.Minute
+	maxDnsLearnTTL = 24 * time.Hour
+)
+
+// learnFromDnsResponse matches the addresses of an answer for a set's
+// domain with that set, so flows to them are matched from their first
+// packet without an SNI. The kernel target sets get them as well when
+// enabled.
+func (w *Worker) learnFromDnsResponse(payload []byte) {
+	names, addrs, ok := dns.ParseResponse(payload)
+	if !ok || len(addrs) == 0 {
+		return
+	}
+	matcher := w.getMatcher()
+	for _, name := range names {
+		matched, set := matcher.MatchSNI(name)
+		if !matched {
+			continue
+		}
+		if !set.DNS.LearnIPs {
+			return
+		}
+		for _, a := range addrs {
+			ttl := min(max(a.TTL, minDnsLearnTTL), maxDnsLearnTTL)
+			matcher.LearnIPToDomainTTL(a.IP, name, set, ttl)
+		}
+		log.Tracef("DNS: learned %d addresses of %s (set: %s)", len(addrs), name, set.Name)
+		return
+	}
+}
@@ -0,0 +1,269 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/florianl/go-nfqueue"
+)
+
+const (
+	// the IP TTL of a genuine answer stays this close to the resolver's usual
+	dnsTTLTolerance = 2
+	// answers to names no set filters kept per resolver, and how many of
+	// them are needed before the resolver's usual header is trusted
+	dnsBaselineSamples    = 8
+	dnsBaselineMinSamples = 3
+)
+
+// headerSample is the IP header of one answer.
+type headerSample struct {
+	ttl    uint8
+	df     bool
+	zeroID bool
+}
+
+// resolverBaseline keeps the IP headers of a resolver's recent answers to
+// names no set filters. Its usual header is what most of them agree on, so
+// a single injected answer cannot change it.
+type resolverBaseline struct {
+	samples  []headerSample
+	next     int
+	lastSeen time.Time
+}
+
+func (b *resolverBaseline) add(s headerSample) {
+	if len(b.samples) < dnsBaselineSamples {
+		b.samples = append(b.samples, s)
+	} else {
+		b.samples[b.next] = s
+	}
+	b.next = (b.next + 1) % dnsBaselineSamples
+	b.lastSeen = time.Now()
+}
+
+// usual returns the header most samples share, false while there are too
+// few of them to tell.
+func (b *resolverBaseline) usual() (headerSample, bool) {
+	if len(b.samples) < dnsBaselineMinSamples {
+		return headerSample{}, false
+	}
+	ttls := make(map[uint8]int)
+	var u headerSample
+	df, zeroID := 0, 0
+	for _, s := range b.samples {
+		ttls[s.ttl]++
+		if n := ttls[s.ttl]; n > ttls[u.ttl] || (n == ttls[u.ttl] && s.ttl < u.ttl) {
+			u.ttl = s.ttl
+		}
+		if s.df {
+			df++
+		}
+		if s.zeroID {
+			zeroID++
+		}
+	}
+	u.df = df*2 > len(b.samples)
+	u.zeroID = zeroID*2 > len(b.samples)
+	return u, true
+}
+
+// heldAnswer is an answer waiting for its hold window to pass.
+type heldAnswer struct {
+	raw     []byte
+	ihl     int
+	version byte
+	dport   uint16
+	name    string
+	set     *config.SetConfig
+	timer   *time.Timer
+}
+
+// dnsForgeryFilter drops answers injected on-path for the names of a set.
+// Injectors win the race against the resolver, so clean looking answers are
+// held for a moment: the last one to arrive before the window ends is
+// delivered and the earlier ones are dropped.
+type dnsForgeryFilter struct {
+	mu        sync.Mutex
+	held      map[string]*heldAnswer // client, port, resolver and DNS ID
+	baselines map[string]*resolverBaseline
+}
+
+var dnsForgeries = &dnsForgeryFilter{
+	held:      make(map[string]*heldAnswer),
+	baselines: make(map[string]*resolverBaseline),
+}
+
+// filterDnsResponse drops or holds an answer for a name of a set that
+// filters forged answers. It reports whether it took the packet.
+func (w *Worker) filterDnsResponse(ipVersion byte, dport uint16, payload []byte, raw []byte, ihl int, id uint32) bool {
+	if ipVersion == IPv6 && !w.getConfig().Queue.IPv6Enabled {
+		return false
+	}
+	resolver, client := packetAddrs(ipVersion, raw)
+
+	names, addrs, ok := dns.ParseResponse(payload)
+	if !ok {
+		return false
+	}
+	matcher := w.getMatcher()
+	var set *config.SetConfig
+	var name string
+	for _, n := range names {
+		if matched, st := matcher.MatchSNI(n); matched {
+			set, name = st, n
+			break
+		}
+	}
+	if set == nil || !set.DNS.FilterForged {
+		dnsForgeries.observe(resolver, raw)
+		return false
+	}
+
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+
+	if reason := dnsForgeries.check(resolver, raw, addrs, set.DNS.BogusNets); reason != "" {
+		metrics.GetMetricsCollector().RecordForgedPacket(set.Name, "dns")
+		log.Infof("DNS: dropped forged answer for %s from %s: %s (set: %s)", name, resolver, reason, set.Name)
+		return true
+	}
+
+	key := fmt.Sprintf("%s:%d %s %d", client, dport, resolver, binary.BigEndian.Uint16(payload[:2]))
+	a := &heldAnswer{
+		raw:     append([]byte(nil), raw...),
+		ihl:     ihl,
+		version: ipVersion,
+		dport:   dport,
+		name:    name,
+		set:     set,
+	}
+	if earlier := dnsForgeries.hold(key, a, time.Duration(set.DNS.HoldMs)*time.Millisecond, w.releaseDnsAnswer); earlier != nil {
+		metrics.GetMetricsCollector().RecordForgedPacket(set.Name, "dns")
+		log.Infof("DNS: dropped answer for %s from %s, a later one arrived (set: %s)", name, resolver, set.Name)
+	}
+	return true
+}
+
+// releaseDnsAnswer delivers a held answer the way an unfiltered one is.
+func (w *Worker) releaseDnsAnswer(a *heldAnswer) {
+	w.learnFromDnsResponse(a.raw[a.ihl+8:])
+	if w.restoreDnsNAT(a.version, a.dport, a.raw, a.ihl) {
+		return
+	}
+	_, client := packetAddrs(a.version, a.raw)
+	if a.version == IPv4 {
+		_ = w.sock.SendIPv4(a.raw, client)
+	} else {
+		_ = w.sock.SendIPv6(a.raw, client)
+	}
+}
+
+// hold keeps a until the window of its query passes and hands the answer
+// held then to release. The window opens with the first answer to the query
+// and a later one replaces the answer held, without extending it. hold
+// returns the replaced answer.
+func (f *dnsForgeryFilter) hold(key string, a *heldAnswer, window time.Duration, release func(*heldAnswer)) *heldAnswer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if earlier := f.held[key]; earlier != nil {
+		a.timer = earlier.timer
+		f.held[key] = a
+		return earlier
+	}
+
+	f.held[key] = a
+	var timer *time.Timer
+	timer = time.AfterFunc(window, func() {
+		f.mu.Lock()
+		current := f.held[key]
+		if current != nil && current.timer == timer {
+			delete(f.held, key)
+		} else {
+			current = nil
+		}
+		f.mu.Unlock()
+		if current != nil {
+			release(current)
+		}
+	})
+	a.timer = timer
+	return nil
+}
+
+// observe adds the header of an unfiltered answer to the resolver's samples.
+func (f *dnsForgeryFilter) observe(resolver net.IP, raw []byte) {
+	ttl, df, zeroID := dnsHeaderTraits(raw)
+	f.mu.Lock()
+	b := f.baselines[resolver.String()]
+	if b == nil {
+		b = &resolverBaseline{}
+		f.baselines[resolver.String()] = b
+	}
+	b.add(headerSample{ttl: ttl, df: df, zeroID: zeroID})
+	f.mu.Unlock()
+}
+
+// check returns why an answer is forged, empty when it looks genuine.
+func (f *dnsForgeryFilter) check(resolver net.IP, raw []byte, addrs []dns.Answer, bogus []*net.IPNet) string {
+	for _, a := range addrs {
+		for _, n := range bogus {
+			if n.Contains(a.IP) {
+				return "bogus address " + a.IP.String()
+			}
+		}
+		if a.TTL == 0 {
+			return "zero TTL"
+		}
+	}
+
+	f.mu.Lock()
+	var b headerSample
+	ok := false
+	if rb := f.baselines[resolver.String()]; rb != nil {
+		b, ok = rb.usual()
+	}
+	f.mu.Unlock()
+	if !ok {
+		return ""
+	}
+	ttl, df, zeroID := dnsHeaderTraits(raw)
+	switch {
+	case ttl > b.ttl+dnsTTLTolerance || ttl+dnsTTLTolerance < b.ttl:
+		return fmt.Sprintf("IP TTL %d, the resolver's answers have %d", ttl, b.ttl)
+	case raw[0]>>4 == IPv4 && df != b.df:
+		return "DF flag differs from the resolver's answers"
+	case raw[0]>>4 == IPv4 && zeroID && !b.zeroID:
+		return "IP ID 0"
+	}
+	return ""
+}
+
+// dnsHeaderTraits returns the IP TTL, the DF flag and whether the IP ID is
+// zero. IPv6 has neither flag nor ID.
+func dnsHeaderTraits(raw []byte) (ttl uint8, df, zeroID bool) {
+	ttl = packetTTL(raw)
+	if raw[0]>>4 == IPv4 {
+		df = raw[6]&0x40 != 0
+		zeroID = binary.BigEndian.Uint16(raw[4:6]) == 0
+	}
+	return ttl, df, zeroID
+}
+
+func (f *dnsForgeryFilter) Cleanup() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for resolver, b := range f.baselines {
+		if time.Since(b.lastSeen) > 10*time.Minute {
+			delete(f.baselines, resolver)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package nfq
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsHeader is the IPv4 header of an answer with the given TTL and DF flag.
+func dnsHeader(ttl uint8, df bool) []byte {
+	raw := make([]byte, 28)
+	raw[0] = 0x45
+	raw[5] = 1
+	if df {
+		raw[6] = 0x40
+	}
+	raw[8] = ttl
+	raw[9] = 17
+	return raw
+}
+
+func TestDnsForgeryFilter_BaselineNeedsMajority(t *testing.T) {
+	f := &dnsForgeryFilter{held: make(map[string]*heldAnswer), baselines: make(map[string]*resolverBaseline)}
+	resolver := net.ParseIP("8.8.8.8")
+
+	f.observe(resolver, dnsHeader(50, false))
+	if reason := f.check(resolver, dnsHeader(120, true), nil, nil); reason != "" {
+		t.Errorf("a single sample was trusted: %s", reason)
+	}
+
+	for range 4 {
+		f.observe(resolver, dnsHeader(120, true))
+	}
+	// an injected answer to an unfiltered name does not move the baseline
+	f.observe(resolver, dnsHeader(50, false))
+
+	if reason := f.check(resolver, dnsHeader(119, true), nil, nil); reason != "" {
+		t.Errorf("genuine answer was flagged: %s", reason)
+	}
+	if reason := f.check(resolver, dnsHeader(50, true), nil, nil); reason == "" {
+		t.Error("answer with the injector's TTL passed")
+	}
+	if reason := f.check(resolver, dnsHeader(120, false), nil, nil); reason == "" {
+		t.Error("answer without DF passed")
+	}
+}
+
+func TestDnsForgeryFilter_HoldReleasesLastAnswer(t *testing.T) {
+	f := &dnsForgeryFilter{held: make(map[string]*heldAnswer), baselines: make(map[string]*resolverBaseline)}
+
+	var mu sync.Mutex
+	var released []*heldAnswer
+	done := make(chan struct{})
+	release := func(a *heldAnswer) {
+		mu.Lock()
+		released = append(released, a)
+		mu.Unlock()
+		close(done)
+	}
+
+	first, second, third := &heldAnswer{name: "1"}, &heldAnswer{name: "2"}, &heldAnswer{name: "3"}
+	if earlier := f.hold("q", first, 50*time.Millisecond, release); earlier != nil {
+		t.Fatal("first answer replaced another")
+	}
+	if earlier := f.hold("q", second, 50*time.Millisecond, release); earlier != first {
+		t.Error("second answer did not replace the first")
+	}
+	if earlier := f.hold("q", third, 50*time.Millisecond, release); earlier != second {
+		t.Error("third answer did not replace the second")
+	}
+
+	mu.Lock()
+	if len(released) != 0 {
+		t.Error("an answer was released before the window ended")
+	}
+	mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("no answer was released")
+	}
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(released) != 1 || released[0] != third {
+		t.Errorf("released %v, want only the last answer", released)
+	}
+}
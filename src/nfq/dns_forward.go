@@ -0,0 +1,174 @@
+package nfq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+const (
+	// queries the upstream has not answered by then are given up, the
+	// client retries on its own
+	dnsForwardTimeout = 5 * time.Second
+	// queries resolved at once at most, further ones are dropped
+	maxDnsForwards = 256
+)
+
+var (
+	dnsForwarder = dns.NewForwarder()
+	dnsForwards  = make(chan struct{}, maxDnsForwards)
+)
+
+// startDnsForward runs resolve unless maxDnsForwards queries are already
+// being resolved, and reports whether it did.
+func startDnsForward(resolve func()) bool {
+	select {
+	case dnsForwards <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-dnsForwards }()
+		resolve()
+	}()
+	return true
+}
+
+// forwardDnsQuery answers a query through the set's encrypted upstream
+// instead of letting it reach the resolver the client asked. The query is
+// dropped and the answer is sent back as if that resolver had replied, its
+// address is kept in the DNS NAT table meanwhile.
+func (w *Worker) forwardDnsQuery(set *config.SetConfig, domain string, ipVersion byte, sport uint16, raw []byte, ihl int, id uint32) int {
+	cfg := w.getConfig()
+	if ipVersion == IPv6 && !cfg.Queue.IPv6Enabled {
+		if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+
+	query := append([]byte(nil), raw...)
+	client, server := packetAddrs(ipVersion, query)
+	dnsID := binary.BigEndian.Uint16(query[ihl+8 : ihl+10])
+	up := dnsUpstream(set, cfg.Queue.Mark, server)
+	dns.DnsNATSet(client, sport, dnsID, server)
+
+	started := startDnsForward(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+		defer cancel()
+
+		payload := query[ihl+8:]
+		resp, err := dnsForwarder.Exchange(ctx, up, payload)
+		if err != nil {
+			log.Tracef("DNS forward: %s via %s failed: %v", domain, up.URL, err)
+			return
+		}
+
+		w.learnFromDnsResponse(resp)
+
+		from, ok := dns.DnsNATGet(client, sport, dnsID)
+		if !ok {
+			log.Tracef("DNS forward: answer for %s came too late", domain)
+			return
+		}
+		dns.DnsNATDelete(client, sport, dnsID)
+
+		reply := buildDnsReply(ipVersion, from, client, sport, dns.Truncate(resp, dns.UDPSize(payload)))
+		if ipVersion == IPv4 {
+			_ = w.sock.SendIPv4(reply, client)
+		} else {
+			_ = w.sock.SendIPv6(reply, client)
+		}
+		log.Infof("DNS forward: %s -> %s (set: %s)", domain, up.URL, set.Name)
+	})
+	if !started {
+		dns.DnsNATDelete(client, sport, dnsID)
+		log.Tracef("DNS forward: too many queries in flight, dropped query for %s", domain)
+	}
+	return 0
+}
+
+// dnsUpstream is the set's encrypted upstream, falling back to its target
+// resolver or else to server, the one the client asked, when allowed.
+func dnsUpstream(set *config.SetConfig, mark uint, server net.IP) dns.Upstream {
+	up := dns.Upstream{
+		URL:       set.DNS.Upstream,
+		Bootstrap: set.DNS.Bootstrap,
+		Mark:      mark,
+	}
+	if set.DNS.PlainFallback {
+		plain := server.String()
+		if set.DNS.TargetDNS != "" {
+			plain = set.DNS.TargetDNS
+		}
+		up.Plain = net.JoinHostPort(plain, "53")
+	}
+	return up
+}
+
+// packetAddrs copies the source and destination addresses of a packet.
+func packetAddrs(ipVersion byte, raw []byte) (src, dst net.IP) {
+	if ipVersion == IPv4 {
+		return append(net.IP(nil), raw[12:16]...), append(net.IP(nil), raw[16:20]...)
+	}
+	return append(net.IP(nil), raw[8:24]...), append(net.IP(nil), raw[24:40]...)
+}
+
+// buildDnsReply builds the UDP packet carrying a DNS answer from the
+// resolver at from to port dport of client.
+func buildDnsReply(ipVersion byte, from, client net.IP, dport uint16, payload []byte) []byte {
+	pkt, ipLen := newDnsPacket(ipVersion, from, client, 17, 8+len(payload))
+
+	udp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(udp[0:2], 53)
+	binary.BigEndian.PutUint16(udp[2:4], dport)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	copy(udp[8:], payload)
+
+	if ipVersion == IPv4 {
+		sock.FixIPv4Checksum(pkt[:ipLen])
+		sock.FixUDPChecksum(pkt, ipLen)
+	} else {
+		sock.FixUDPChecksumV6(pkt)
+	}
+	return pkt
+}
+
+// newDnsPacket allocates a packet from src to dst with its IP header
+// filled in and room for l4Len bytes of proto after it.
+func newDnsPacket(ipVersion byte, src, dst net.IP, proto byte, l4Len int) ([]byte, int) {
+	ipLen := 20
+	if ipVersion == IPv6 {
+		ipLen = 40
+	}
+	pkt := make([]byte, ipLen+l4Len)
+
+	if ipVersion == IPv4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		pkt[6] = 0x40 // DF
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src.To4())
+		copy(pkt[16:20], dst.To4())
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(l4Len))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+	}
+	return pkt, ipLen
+}
@@ -0,0 +1,56 @@
+package nfq
+
+import (
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/florianl/go-nfqueue"
+)
+
+// static answers carry this TTL, their addresses stay matched as long
+const dnsHostsTTL = 5 * time.Minute
+
+// hostsAnswer answers query from the set's static hosts. The addresses are
+// matched to the set, so the connection the client opens to them is too.
+func (w *Worker) hostsAnswer(set *config.SetConfig, domain string, query []byte) ([]byte, bool) {
+	ips := set.DNS.LookupHost(domain)
+	if len(ips) == 0 {
+		return nil, false
+	}
+	resp, ok := dns.Synthesize(query, ips, dnsHostsTTL)
+	if !ok {
+		return nil, false
+	}
+	matcher := w.getMatcher()
+	for _, ip := range ips {
+		matcher.LearnIPToDomainTTL(ip, domain, set, dnsHostsTTL)
+	}
+	return resp, true
+}
+
+// answerDnsQuery replies to a UDP query with resp as if the server it was
+// sent to had answered, the query itself is dropped.
+func (w *Worker) answerDnsQuery(set *config.SetConfig, domain string, ipVersion byte, sport uint16, raw []byte, ihl int, resp []byte, id uint32) int {
+	cfg := w.getConfig()
+	if ipVersion == IPv6 && !cfg.Queue.IPv6Enabled {
+		if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+
+	client, server := packetAddrs(ipVersion, raw)
+	reply := buildDnsReply(ipVersion, server, client, sport, dns.Truncate(resp, dns.UDPSize(raw[ihl+8:])))
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+	if ipVersion == IPv4 {
+		_ = w.sock.SendIPv4(reply, client)
+	} else {
+		_ = w.sock.SendIPv6(reply, client)
+	}
+	log.Infof("DNS hosts: answered %s (set: %s)", domain, set.Name)
+	return 0
+}
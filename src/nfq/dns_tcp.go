@@ -0,0 +1,163 @@
+package nfq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+// answers are written to the client in segments of at most this size
+const dnsTCPSegment = 1200
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// processDnsTCP redirects a query sent over TCP. The connection is set up
+// before the query names the domain, so it cannot be moved to another
+// resolver packet by packet as UDP queries are. A matched query is dropped
+// and resolved by b4 itself instead, the answer is written into the
+// client's connection as if the server it asked had sent it and that
+// connection is closed on both ends. Only the first packets of a connection
+// are queued, queries past them reach the server the client asked.
+func (w *Worker) processDnsTCP(ipVersion byte, sport uint16, payload, raw []byte, ihl int, id uint32) int {
+	// only a query in a single segment on its own can be taken over
+	if len(payload) < 2+12 || int(binary.BigEndian.Uint16(payload[:2])) != len(payload)-2 {
+		return w.acceptDnsTCP(id)
+	}
+	query := append([]byte(nil), payload[2:]...)
+	domain, ok := dns.ParseQueryDomain(query)
+	if !ok {
+		return w.acceptDnsTCP(id)
+	}
+	matchedSet, set := w.getMatcher().MatchSNI(domain)
+	if !matchedSet || !set.DNS.Enabled ||
+		(set.DNS.Upstream == "" && set.DNS.TargetDNS == "" && set.DNS.LookupHost(domain) == nil) {
+		return w.acceptDnsTCP(id)
+	}
+	cfg := w.getConfig()
+	if ipVersion == IPv6 && !cfg.Queue.IPv6Enabled {
+		return w.acceptDnsTCP(id)
+	}
+
+	tcp := raw[ihl:]
+	seq := binary.BigEndian.Uint32(tcp[4:8])
+	ack := binary.BigEndian.Uint32(tcp[8:12])
+	client, server := packetAddrs(ipVersion, raw)
+	dnsID := binary.BigEndian.Uint16(query[:2])
+	dns.DnsNATSet(client, sport, dnsID, server)
+
+	if err := w.q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+
+	started := startDnsForward(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+		defer cancel()
+
+		resp, via, err := w.exchangeDnsTCP(ctx, set, domain, cfg.Queue.Mark, server, query)
+		if err != nil {
+			log.Tracef("DNS redirect (TCP): %s via %s failed: %v", domain, via, err)
+			return
+		}
+
+		w.learnFromDnsResponse(resp)
+
+		from, ok := dns.DnsNATGet(client, sport, dnsID)
+		if !ok {
+			log.Tracef("DNS redirect (TCP): answer for %s came too late", domain)
+			return
+		}
+		dns.DnsNATDelete(client, sport, dnsID)
+
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+
+		// the server never saw the query, so the client's sequence number
+		// is the one it expects
+		clientSeq := seq + uint32(len(payload))
+		for len(msg) > 0 {
+			n := min(len(msg), dnsTCPSegment)
+			w.sendDnsSegment(ipVersion, from, client, 53, sport, ack, clientSeq, tcpFlagPSH|tcpFlagACK, msg[:n])
+			ack += uint32(n)
+			msg = msg[n:]
+		}
+		w.sendDnsSegment(ipVersion, from, client, 53, sport, ack, clientSeq, tcpFlagFIN|tcpFlagACK, nil)
+		w.sendDnsSegment(ipVersion, client, server, sport, 53, seq, 0, tcpFlagRST, nil)
+
+		log.Infof("DNS redirect (TCP): %s -> %s (set: %s)", domain, via, set.Name)
+	})
+	if !started {
+		dns.DnsNATDelete(client, sport, dnsID)
+		log.Tracef("DNS redirect (TCP): too many queries in flight, dropped query for %s", domain)
+	}
+	return 0
+}
+
+func (w *Worker) acceptDnsTCP(id uint32) int {
+	if err := w.q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+		log.Tracef("failed to set verdict on packet %d: %v", id, err)
+	}
+	return 0
+}
+
+// exchangeDnsTCP resolves query the way the set answers UDP queries: from
+// its static hosts, through its upstream if it has one, or over TCP to its
+// target resolver, with the query cut in the middle of the name when
+// fragmentation is on.
+func (w *Worker) exchangeDnsTCP(ctx context.Context, set *config.SetConfig, domain string, mark uint, server net.IP, query []byte) ([]byte, string, error) {
+	if resp, ok := w.hostsAnswer(set, domain, query); ok {
+		return resp, "hosts", nil
+	}
+	if set.DNS.Upstream != "" {
+		up := dnsUpstream(set, mark, server)
+		resp, err := dnsForwarder.Exchange(ctx, up, query)
+		return resp, up.URL, err
+	}
+
+	split := 0
+	if set.DNS.FragmentQuery {
+		if split = findDNSSplitPoint(query); split <= 0 {
+			split = len(query) / 2
+		}
+		split += 2 // length prefix
+	}
+	delay := time.Duration(set.UDP.Seg2Delay) * time.Millisecond
+	resp, err := dns.ExchangeTCP(ctx, net.JoinHostPort(set.DNS.TargetDNS, "53"), mark, query, split, delay)
+	return resp, set.DNS.TargetDNS, err
+}
+
+// sendDnsSegment sends a TCP segment of a DNS connection from src to dst.
+func (w *Worker) sendDnsSegment(ipVersion byte, src, dst net.IP, sport, dport uint16, seq, ack uint32, flags byte, payload []byte) {
+	pkt, ipLen := newDnsPacket(ipVersion, src, dst, 6, 20+len(payload))
+
+	tcp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:2], sport)
+	binary.BigEndian.PutUint16(tcp[2:4], dport)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 0x50
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[20:], payload)
+
+	if ipVersion == IPv4 {
+		sock.FixIPv4Checksum(pkt[:ipLen])
+		sock.FixTCPChecksum(pkt)
+		_ = w.sock.SendIPv4(pkt, dst)
+	} else {
+		sock.FixTCPChecksumV6(pkt)
+		_ = w.sock.SendIPv6(pkt, dst)
+	}
+}
@@ -0,0 +1,298 @@
+package nfq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// DomainStrategy is the fallback state of a domain: which strategy of its
+// set is in use and how the flows using it went.
+type DomainStrategy struct {
+	SetID               string    `json:"set_id"`
+	Level               int       `json:"level"`    // 0 is the set's own strategy, N the Nth fallback
+	Strategy            string    `json:"strategy"` // empty for the set's own strategy
+	Successes           uint64    `json:"successes"`
+	Failures            uint64    `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Changed             time.Time `json:"changed"`
+	Used                time.Time `json:"used"` // last flow outcome
+}
+
+// maxFallbackDomains bounds the domains with a fallback state, the least
+// recently used ones are forgotten first.
+const maxFallbackDomains = 4096
+
+// pendingFlow is a matched flow whose ClientHello has been sent and that is
+// waiting for the server's answer. timer fails it when no answer came.
+type pendingFlow struct {
+	domain string
+	set    *config.SetConfig
+	level  int
+	timer  *time.Timer
+}
+
+type strategyTracker struct {
+	mu      sync.Mutex
+	path    string
+	dirty   bool
+	domains map[string]*DomainStrategy
+	flows   map[flowKey]*pendingFlow
+}
+
+var strategies = &strategyTracker{
+	domains: make(map[string]*DomainStrategy),
+	flows:   make(map[flowKey]*pendingFlow),
+}
+
+// apply returns the set to use for a flow to domain, a copy switched to the
+// fallback strategy the domain is currently on, and that fallback level.
+func (t *strategyTracker) apply(set *config.SetConfig, domain string) (*config.SetConfig, int) {
+	if !set.Fallback.Enabled || len(set.Fallback.Levels) == 0 {
+		return set, 0
+	}
+
+	t.mu.Lock()
+	ds, ok := t.domains[domain]
+	if !ok || ds.SetID != set.Id || ds.Level > len(set.Fallback.Levels) {
+		t.mu.Unlock()
+		return set, 0
+	}
+	if ds.Level > 0 && set.Fallback.Decay > 0 && time.Since(ds.Changed) > time.Duration(set.Fallback.Decay)*time.Second {
+		log.Infof("Fallback: retrying the preferred strategy for %s (set: %s)", domain, set.Name)
+		ds.Level = 0
+		ds.Strategy = ""
+		ds.ConsecutiveFailures = 0
+		ds.Changed = time.Now()
+		t.dirty = true
+	}
+	level := ds.Level
+	t.mu.Unlock()
+
+	if level == 0 {
+		return set, 0
+	}
+
+	fb := set.Fallback.Levels[level-1]
+	cfg := *set
+	cfg.PipelineSteps = fb.Pipeline
+	if fb.Pipeline == nil {
+		cfg.Fragmentation.Strategy = fb.Strategy
+	}
+	log.Tracef("Fallback: %s uses strategy %q (level %d)", domain, fb.Strategy, level)
+	return &cfg, level
+}
+
+// track starts watching a flow whose ClientHello was just sent. A flow that
+// is already pending sent its ClientHello again, which counts as a failure.
+func (t *strategyTracker) track(connKey flowKey, domain string, set *config.SetConfig, level int) {
+	if !set.Fallback.Enabled || len(set.Fallback.Levels) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.flows[connKey]; ok {
+		prev.timer.Stop()
+		t.record(prev, false, "retransmitted ClientHello")
+	}
+
+	timeout := time.Duration(set.Fallback.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	flow := &pendingFlow{domain: domain, set: set, level: level}
+	flow.timer = time.AfterFunc(timeout, func() { t.expire(connKey, flow) })
+	t.flows[connKey] = flow
+}
+
+// expire fails a flow that got no answer before its timeout.
+func (t *strategyTracker) expire(connKey flowKey, flow *pendingFlow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.flows[connKey] != flow {
+		return
+	}
+	delete(t.flows, connKey)
+	t.record(flow, false, "timeout")
+}
+
+// resolve settles a pending flow once the server answered it.
+func (t *strategyTracker) resolve(connKey flowKey, success bool, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flow, ok := t.flows[connKey]
+	if !ok {
+		return
+	}
+	delete(t.flows, connKey)
+	flow.timer.Stop()
+	t.record(flow, success, reason)
+}
+
+// record must be called with t.mu held.
+func (t *strategyTracker) record(flow *pendingFlow, success bool, reason string) {
+	set := flow.set
+	ds, ok := t.domains[flow.domain]
+	if !ok || ds.SetID != set.Id {
+		ds = &DomainStrategy{SetID: set.Id, Changed: time.Now()}
+		t.domains[flow.domain] = ds
+		t.trim(maxFallbackDomains)
+	}
+	ds.Used = time.Now()
+	t.dirty = true
+
+	if success {
+		ds.Successes++
+		ds.ConsecutiveFailures = 0
+		return
+	}
+
+	ds.Failures++
+	if flow.level != ds.Level {
+		// outcome of a flow started before the last switch
+		return
+	}
+	ds.ConsecutiveFailures++
+	log.Tracef("Fallback: %s failed with level %d: %s", flow.domain, ds.Level, reason)
+
+	threshold := set.Fallback.Failures
+	if threshold < 1 {
+		threshold = 1
+	}
+	if ds.ConsecutiveFailures < threshold {
+		return
+	}
+
+	ds.Level = (ds.Level + 1) % (len(set.Fallback.Levels) + 1)
+	ds.Strategy = ""
+	if ds.Level > 0 {
+		ds.Strategy = set.Fallback.Levels[ds.Level-1].Strategy
+	}
+	ds.ConsecutiveFailures = 0
+	ds.Changed = time.Now()
+	log.Infof("Fallback: %s switched to level %d %q after %d failures (set: %s)", flow.domain, ds.Level, ds.Strategy, threshold, set.Name)
+}
+
+// Cleanup forgets domains that are back on their set's own strategy, went
+// unused for the set's Expire time or whose set no longer falls back, and
+// persists changes. Pending flows time out on their own timers.
+func (t *strategyTracker) Cleanup(cfg *config.Config) {
+	expire := make(map[string]time.Duration, len(cfg.Sets))
+	for _, set := range cfg.Sets {
+		if set.Enabled && set.Fallback.Enabled {
+			expire[set.Id] = time.Duration(set.Fallback.Expire) * time.Second
+		}
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	for domain, ds := range t.domains {
+		ttl, ok := expire[ds.SetID]
+		if !ok || (ds.Level == 0 && ds.ConsecutiveFailures == 0) || (ttl > 0 && now.Sub(ds.Used) > ttl) {
+			delete(t.domains, domain)
+			t.dirty = true
+		}
+	}
+	t.trim(maxFallbackDomains)
+	t.mu.Unlock()
+
+	t.save()
+}
+
+// trim forgets the least recently used domains beyond max, t.mu must be held.
+func (t *strategyTracker) trim(max int) {
+	if len(t.domains) <= max {
+		return
+	}
+	domains := make([]string, 0, len(t.domains))
+	for domain := range t.domains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return t.domains[domains[i]].Used.Before(t.domains[domains[j]].Used)
+	})
+	for _, domain := range domains[:len(domains)-max] {
+		delete(t.domains, domain)
+	}
+	t.dirty = true
+}
+
+func (t *strategyTracker) load(configPath string) {
+	if configPath == "" {
+		return
+	}
+	path := filepath.Join(filepath.Dir(configPath), "strategy_fallback.json")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &t.domains); err != nil {
+		log.Errorf("Failed to parse strategy_fallback.json: %v", err)
+		t.domains = make(map[string]*DomainStrategy)
+	}
+	for _, ds := range t.domains {
+		if ds.Used.IsZero() {
+			ds.Used = ds.Changed
+		}
+	}
+}
+
+func (t *strategyTracker) save() {
+	t.mu.Lock()
+	if !t.dirty || t.path == "" {
+		t.mu.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(t.domains, "", "  ")
+	path := t.path
+	t.dirty = false
+	t.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Failed to encode strategy fallback state: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Errorf("Failed to save strategy fallback state: %v", err)
+	}
+}
+
+// DomainStrategies returns the fallback state of every domain seen so far.
+func DomainStrategies() map[string]DomainStrategy {
+	strategies.mu.Lock()
+	defer strategies.mu.Unlock()
+	result := make(map[string]DomainStrategy, len(strategies.domains))
+	for domain, ds := range strategies.domains {
+		result[domain] = *ds
+	}
+	return result
+}
+
+// ResetDomainStrategies puts every domain back on its set's own strategy.
+func ResetDomainStrategies() {
+	strategies.mu.Lock()
+	strategies.domains = make(map[string]*DomainStrategy)
+	strategies.dirty = true
+	strategies.mu.Unlock()
+	strategies.save()
+}
+
+// isServerHello reports whether a TCP payload starts with a TLS ServerHello.
+func isServerHello(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == TLSHandshakeType && payload[1] == 0x03 && payload[5] == TLSServerHello
+}
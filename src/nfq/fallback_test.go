@@ -0,0 +1,114 @@
+package nfq
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func newTestTracker() *strategyTracker {
+	return &strategyTracker{
+		domains: make(map[string]*DomainStrategy),
+		flows:   make(map[flowKey]*pendingFlow),
+	}
+}
+
+func fallbackConfig() *config.Config {
+	set := config.NewSetConfig()
+	set.Id = "fb"
+	set.Fallback.Enabled = true
+	set.Fallback.Strategies = []string{"disorder"}
+	set.Fallback.Levels = []config.FallbackLevel{{Strategy: "disorder"}}
+	set.Fallback.Failures = 1
+	set.Fallback.Timeout = 20
+	return &config.Config{Sets: []*config.SetConfig{&set}}
+}
+
+func TestStrategyTracker_TimeoutFailsWithoutCleanup(t *testing.T) {
+	tr := newTestTracker()
+	set := fallbackConfig().Sets[0]
+	key := newFlowKey(net.ParseIP("192.168.1.10"), 40000, net.ParseIP("93.184.216.34"), 443)
+
+	tr.track(key, "example.com", set, 0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		tr.mu.Lock()
+		ds := tr.domains["example.com"]
+		level, pending := 0, len(tr.flows)
+		if ds != nil {
+			level = ds.Level
+		}
+		tr.mu.Unlock()
+		if level == 1 && pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flow not failed after its timeout: level %d, %d pending", level, pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStrategyTracker_ResolveStopsTimer(t *testing.T) {
+	tr := newTestTracker()
+	set := fallbackConfig().Sets[0]
+	key := newFlowKey(net.ParseIP("192.168.1.10"), 40000, net.ParseIP("93.184.216.34"), 443)
+
+	tr.track(key, "example.com", set, 0)
+	tr.resolve(key, true, "")
+	time.Sleep(50 * time.Millisecond)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if ds := tr.domains["example.com"]; ds.Failures != 0 || ds.Successes != 1 {
+		t.Errorf("successes = %d, failures = %d", ds.Successes, ds.Failures)
+	}
+}
+
+func TestStrategyTracker_CleanupExpires(t *testing.T) {
+	cfg := fallbackConfig()
+	cfg.Sets[0].Fallback.Expire = 60
+	now := time.Now()
+
+	tr := newTestTracker()
+	tr.domains["fallen.com"] = &DomainStrategy{SetID: "fb", Level: 1, Used: now}
+	tr.domains["failing.com"] = &DomainStrategy{SetID: "fb", ConsecutiveFailures: 1, Used: now}
+	tr.domains["recovered.com"] = &DomainStrategy{SetID: "fb", Used: now}
+	tr.domains["idle.com"] = &DomainStrategy{SetID: "fb", Level: 1, Used: now.Add(-2 * time.Minute)}
+	tr.domains["removed.com"] = &DomainStrategy{SetID: "gone", Level: 1, Used: now}
+
+	tr.Cleanup(cfg)
+
+	for _, domain := range []string{"fallen.com", "failing.com"} {
+		if _, ok := tr.domains[domain]; !ok {
+			t.Errorf("%s was forgotten", domain)
+		}
+	}
+	for _, domain := range []string{"recovered.com", "idle.com", "removed.com"} {
+		if _, ok := tr.domains[domain]; ok {
+			t.Errorf("%s was kept", domain)
+		}
+	}
+}
+
+func TestStrategyTracker_TrimDropsLeastRecentlyUsed(t *testing.T) {
+	tr := newTestTracker()
+	now := time.Now()
+	for i := range 10 {
+		tr.domains[fmt.Sprintf("d%d.com", i)] = &DomainStrategy{SetID: "fb", Level: 1, Used: now.Add(time.Duration(i) * time.Second)}
+	}
+
+	tr.trim(4)
+
+	if len(tr.domains) != 4 {
+		t.Fatalf("%d domains left, want 4", len(tr.domains))
+	}
+	for i := 6; i < 10; i++ {
+		if _, ok := tr.domains[fmt.Sprintf("d%d.com", i)]; !ok {
+			t.Errorf("recently used d%d.com was dropped", i)
+		}
+	}
+}
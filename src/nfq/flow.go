@@ -0,0 +1,35 @@
+package nfq
+
+import (
+	"fmt"
+	"net"
+)
+
+// flowKey identifies a flow in the client->server direction. Being a
+// comparable struct it keys the trackers without formatting a string for
+// every packet.
+type flowKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+}
+
+func newFlowKey(src net.IP, sport uint16, dst net.IP, dport uint16) flowKey {
+	k := flowKey{sport: sport, dport: dport}
+	putFlowIP(&k.src, src)
+	putFlowIP(&k.dst, dst)
+	return k
+}
+
+// putFlowIP stores ip in its 16 byte form, IPv4 addresses as v4-mapped.
+func putFlowIP(b *[16]byte, ip net.IP) {
+	if len(ip) == net.IPv4len {
+		b[10], b[11] = 0xff, 0xff
+		copy(b[12:], ip)
+		return
+	}
+	copy(b[:], ip)
+}
+
+func (k flowKey) String() string {
+	return fmt.Sprintf("%s:%d->%s:%d", net.IP(k.src[:]), k.sport, net.IP(k.dst[:]), k.dport)
+}
@@ -0,0 +1,196 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// forgedWindowRatio bounds how far the window of a genuine server packet
+// strays from its SYN-ACK window. Receive buffers grow and shrink, but not by
+// orders of magnitude while a block page could still arrive.
+const forgedWindowRatio = 64
+
+// flowBaseline is what the genuine server looked like in the SYN-ACK of a flow.
+type flowBaseline struct {
+	ttl      uint8
+	window   uint16 // unscaled, as in every SYN-ACK
+	scale    uint8  // shift of the server's later windows
+	host     string
+	lastSeen time.Time
+}
+
+type rstVerdict struct {
+	injected bool
+	at       time.Time
+}
+
+// forgedFilter tells packets injected by a middlebox from genuine server
+// packets by comparing them to the SYN-ACK of their flow.
+type forgedFilter struct {
+	mu    sync.Mutex
+	flows map[flowKey]*flowBaseline
+	rsts  map[string]rstVerdict // last RST classification per domain
+}
+
+var forged = &forgedFilter{
+	flows: make(map[flowKey]*flowBaseline),
+	rsts:  make(map[string]rstVerdict),
+}
+
+var httpResponsePrefix = []byte("HTTP/1.")
+
+// learnForged reports whether the SYN-ACK of a server is worth a baseline: its
+// set filters forged packets, or discovery classifies the RSTs it runs into.
+// The set of a server matched by SNI alone is not known yet, its baseline
+// lasts until the first request settles it.
+func learnForged(cfg *config.Config, matcher *sni.SuffixSet, src net.IP) bool {
+	if log.IsDiscoveryActive() {
+		return true
+	}
+	if set := synAckSet(matcher, src); set != nil {
+		return set.TCP.Forged.Enabled
+	}
+	for _, set := range cfg.Sets {
+		if set.Enabled && set.TCP.Forged.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// learn records the SYN-ACK of a flow keyed client->server.
+func (f *forgedFilter) learn(connKey flowKey, raw []byte, ihl int) {
+	b := &flowBaseline{
+		ttl:      packetTTL(raw),
+		window:   binary.BigEndian.Uint16(raw[ihl+14 : ihl+16]),
+		scale:    synAckScale(raw, ihl),
+		lastSeen: time.Now(),
+	}
+
+	f.mu.Lock()
+	f.flows[connKey] = b
+	f.mu.Unlock()
+}
+
+// settle keeps the baseline of a flow whose request matched a set that needs
+// it, tied to the domain of its ClientHello or Host header, and forgets it
+// otherwise.
+func (f *forgedFilter) settle(connKey flowKey, host string, keep bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.flows[connKey]
+	if !ok {
+		return
+	}
+	if !keep {
+		delete(f.flows, connKey)
+		return
+	}
+	if host != "" {
+		b.host = host
+	}
+	b.lastSeen = time.Now()
+}
+
+// check classifies an incoming RST, FIN or HTTP response. kind is empty for
+// other packets or flows without a SYN-ACK baseline. The TTL must stay within
+// tolerance of the SYN-ACK and, if fc asks for it, the window must be one the
+// server could advertise. IPv4 IDs are not compared, many servers and load
+// balancers pick them at random.
+func (f *forgedFilter) check(connKey flowKey, raw []byte, ihl int, payload []byte, fc *config.ForgedConfig) (kind, reason string) {
+	flags := raw[ihl+13]
+	switch {
+	case flags&0x04 != 0:
+		kind = "rst"
+	case bytes.HasPrefix(payload, httpResponsePrefix):
+		kind = "http"
+	case flags&0x01 != 0:
+		kind = "fin"
+	default:
+		return "", ""
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.flows[connKey]
+	if !ok {
+		return "", ""
+	}
+	b.lastSeen = time.Now()
+
+	var reasons []string
+	ttl := packetTTL(raw)
+	diff := int(ttl) - int(b.ttl)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > int(fc.TTLTolerance) {
+		reasons = append(reasons, fmt.Sprintf("ttl %d, SYN-ACK had %d", ttl, b.ttl))
+	}
+	if window := binary.BigEndian.Uint16(raw[ihl+14 : ihl+16]); fc.Window && b.windowMismatch(kind, window) {
+		reasons = append(reasons, fmt.Sprintf("window %d<<%d, SYN-ACK had %d", window, b.scale, b.window))
+	}
+	reason = strings.Join(reasons, ", ")
+
+	if kind == "rst" && b.host != "" {
+		f.rsts[b.host] = rstVerdict{injected: reason != "", at: time.Now()}
+	}
+	return kind, reason
+}
+
+// windowMismatch reports a window the server of the flow would not send.
+// Unlike the SYN-ACK's, later windows are shifted by the scale the SYN-ACK
+// announced, which an injector does not know. Stacks send their RSTs with a
+// zero window, so only RSTs may carry one.
+func (b *flowBaseline) windowMismatch(kind string, window uint16) bool {
+	if window == 0 {
+		return kind != "rst"
+	}
+	got := uint64(window) << b.scale
+	base := uint64(max(b.window, 1))
+	return got > base*forgedWindowRatio || got*forgedWindowRatio < base
+}
+
+// synAckScale returns the window scale a SYN-ACK announces, 0 without the
+// option. A config rewriting nothing leaves the packet as it is.
+func synAckScale(raw []byte, ihl int) uint8 {
+	return rewriteSynAckOptions(raw, ihl, &config.SynAckConfig{WScale: -1})
+}
+
+func (f *forgedFilter) Cleanup() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for k, v := range f.flows {
+		if now.Sub(v.lastSeen) > 120*time.Second {
+			delete(f.flows, k)
+		}
+	}
+	for k, v := range f.rsts {
+		if now.Sub(v.at) > 10*time.Minute {
+			delete(f.rsts, k)
+		}
+	}
+}
+
+// RSTVerdict reports whether the last RST seen for domain since the given
+// time was injected by a middlebox rather than sent by the server.
+func RSTVerdict(domain string, since time.Time) (injected bool, ok bool) {
+	forged.mu.Lock()
+	defer forged.mu.Unlock()
+	v, ok := forged.rsts[domain]
+	if !ok || v.at.Before(since) {
+		return false, false
+	}
+	return v.injected, true
+}
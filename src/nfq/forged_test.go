@@ -0,0 +1,150 @@
+package nfq
+
+import (
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// useForgedFilter gives the test a fresh forged filter.
+func useForgedFilter(t *testing.T) {
+	t.Helper()
+	saved := forged
+	forged = &forgedFilter{
+		flows: make(map[flowKey]*flowBaseline),
+		rsts:  make(map[string]rstVerdict),
+	}
+	t.Cleanup(func() { forged = saved })
+}
+
+func TestForgedFilter_Check(t *testing.T) {
+	// MSS 1460, NOP, window scale 7
+	scaled := []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 7}
+	response := []byte("HTTP/1.1 302 Found\r\nLocation: http://blocked.example/\r\n\r\n")
+
+	tests := []struct {
+		name     string
+		options  []byte // of the SYN-ACK
+		noWindow bool   // window check off
+		ttl      uint8
+		flags    byte
+		window   uint16
+		payload  []byte
+		kind     string
+		forged   bool
+	}{
+		{"genuine rst", scaled, false, 50, 0x14, 0, nil, "rst", false},
+		{"rst ttl", scaled, false, 60, 0x14, 0, nil, "rst", true},
+		{"rst with an unscaled window", scaled, false, 50, 0x14, 64240, nil, "rst", true},
+		{"rst with a scaled window", scaled, false, 50, 0x14, 502, nil, "rst", false},
+		{"genuine response", scaled, false, 50, 0x18, 502, response, "http", false},
+		{"ttl within tolerance", scaled, false, 52, 0x18, 502, response, "http", false},
+		{"response ttl", scaled, false, 53, 0x18, 502, response, "http", true},
+		{"response with a zero window", scaled, false, 50, 0x18, 0, response, "http", true},
+		{"response with an unscaled window", scaled, false, 50, 0x18, 65535, response, "http", true},
+		{"window check off", scaled, true, 50, 0x18, 65535, response, "http", false},
+		{"genuine fin", scaled, false, 50, 0x11, 502, nil, "fin", false},
+		{"unscaled flow", nil, false, 50, 0x18, 65535, response, "http", false},
+		{"unscaled flow with a tiny window", nil, false, 50, 0x18, 10, response, "http", true},
+		{"ack", scaled, false, 60, 0x10, 0, nil, "", false},
+		{"data", scaled, false, 60, 0x18, 0, []byte("data"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useForgedFilter(t)
+			key := newFlowKey(testClient, 40000, testServer, 80)
+			synAck := tcpPacket{src: testServer, dst: testClient, sport: 80, dport: 40000, flags: 0x12, window: 64240, ttl: 50, options: tt.options}.build()
+			forged.learn(key, synAck, 20)
+
+			fc := &config.ForgedConfig{Enabled: true, TTLTolerance: 2, Window: !tt.noWindow}
+			pkt := tcpPacket{src: testServer, dst: testClient, sport: 80, dport: 40000, flags: tt.flags, window: tt.window, ttl: tt.ttl, payload: tt.payload}.build()
+			kind, reason := forged.check(key, pkt, 20, tt.payload, fc)
+			if kind != tt.kind {
+				t.Errorf("kind = %q, want %q", kind, tt.kind)
+			}
+			if (reason != "") != tt.forged {
+				t.Errorf("reason = %q, want forged %v", reason, tt.forged)
+			}
+		})
+	}
+}
+
+func TestForgedFilter_NoBaseline(t *testing.T) {
+	useForgedFilter(t)
+	key := newFlowKey(testClient, 40000, testServer, 443)
+	rst := tcpPacket{src: testServer, dst: testClient, sport: 443, dport: 40000, flags: 0x14, ttl: 200}.build()
+
+	if kind, reason := forged.check(key, rst, 20, nil, &config.DefaultSetConfig.TCP.Forged); kind != "" || reason != "" {
+		t.Errorf("flow without a SYN-ACK classified as %q (%s)", kind, reason)
+	}
+}
+
+// Only flows of sets filtering forged packets keep a SYN-ACK baseline.
+func TestForgedFilter_LearnsForEnabledSets(t *testing.T) {
+	tests := []struct {
+		name    string
+		byIP    bool   // set matches the server address, by SNI otherwise
+		enabled bool   // set filters forged packets
+		request string // domain of the ClientHello, none when empty
+		keep    bool
+	}{
+		{"ip set", true, true, "", true},
+		{"ip set without the filter", true, false, "", false},
+		{"sni set before the request", false, true, "", true},
+		{"sni set", false, true, "www.example.com", true},
+		{"sni set without the filter", false, false, "", false},
+		{"other domain", false, true, "www.example.org", false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useForgedFilter(t)
+			cfg, set := testConfig()
+			if tt.byIP {
+				set.Targets.IPs = []string{testServer.String()}
+			} else {
+				set.Targets.SNIDomains = []string{"example.com"}
+			}
+			set.TCP.Forged.Enabled = tt.enabled
+			w, _, _ := newTestWorker(t, cfg)
+
+			cport := uint16(42000 + i)
+			w.Handle(1, tcpPacket{src: testServer, dst: testClient, sport: 443, dport: cport, flags: 0x12, window: 64240}.build())
+			if tt.request != "" {
+				w.Handle(2, tcpPacket{src: testClient, dst: testServer, sport: cport, dport: 443, seq: 1, ack: 1, window: 502, payload: clientHello(t, tt.request)}.build())
+			}
+
+			forged.mu.Lock()
+			b, ok := forged.flows[newFlowKey(testClient, cport, testServer, 443)]
+			forged.mu.Unlock()
+			if ok != tt.keep {
+				t.Fatalf("baseline kept = %v, want %v", ok, tt.keep)
+			}
+			if ok && b.host != tt.request {
+				t.Errorf("baseline host = %q, want %q", b.host, tt.request)
+			}
+		})
+	}
+}
+
+func TestSynAckScale(t *testing.T) {
+	for _, tt := range []struct {
+		options []byte
+		want    uint8
+	}{
+		{nil, 0},
+		{[]byte{2, 4, 0x05, 0xb4}, 0},
+		{[]byte{2, 4, 0x05, 0xb4, 1, 3, 3, 7}, 7},
+		{[]byte{1, 3, 3, 20}, 14},
+	} {
+		pkt := tcpPacket{src: testServer, dst: testClient, sport: 443, dport: 40000, flags: 0x12, options: tt.options}.build()
+		before := string(pkt)
+		if got := synAckScale(pkt, 20); got != tt.want {
+			t.Errorf("scale of %x = %d, want %d", tt.options, got, tt.want)
+		}
+		if string(pkt) != before {
+			t.Errorf("reading the scale of %x changed the packet", tt.options)
+		}
+	}
+}
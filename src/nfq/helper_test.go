@@ -0,0 +1,191 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+var (
+	testClient  = net.ParseIP("192.168.1.10").To4()
+	testServer  = net.ParseIP("93.184.216.34").To4()
+	testClient6 = net.ParseIP("fd00::10")
+	testServer6 = net.ParseIP("2001:db8::34")
+)
+
+// testVerdicts records the verdicts a test worker set.
+type testVerdicts struct {
+	mu       sync.Mutex
+	verdicts map[uint32]int
+	modified map[uint32][]byte
+}
+
+func newTestVerdicts() *testVerdicts {
+	return &testVerdicts{verdicts: make(map[uint32]int), modified: make(map[uint32][]byte)}
+}
+
+func (v *testVerdicts) SetVerdict(id uint32, verdict int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.verdicts[id] = verdict
+	return nil
+}
+
+func (v *testVerdicts) SetVerdictModPacket(id uint32, verdict int, packet []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.verdicts[id] = verdict
+	v.modified[id] = append([]byte(nil), packet...)
+	return nil
+}
+
+// get returns the verdict of id and the packet it carried, nil when the
+// packet was not modified.
+func (v *testVerdicts) get(id uint32) (int, []byte, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verdict, ok := v.verdicts[id]
+	return verdict, v.modified[id], ok
+}
+
+// sentPackets records what a test worker put on the wire.
+type sentPackets struct {
+	mu   sync.Mutex
+	pkts [][]byte
+}
+
+func (s *sentPackets) all() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.pkts...)
+}
+
+// newTestWorker prepares cfg the way b4 does on start and returns an offline
+// worker for it with its verdicts and sent packets recorded.
+func newTestWorker(t *testing.T, cfg *config.Config) (*Worker, *testVerdicts, *sentPackets) {
+	t.Helper()
+	cfg.ConfigPath = filepath.Join(t.TempDir(), "b4.json")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	if _, _, _, err := cfg.LoadTargets(); err != nil {
+		t.Fatalf("failed to load targets: %v", err)
+	}
+
+	verdicts := newTestVerdicts()
+	sent := &sentPackets{}
+	sender := sock.NewSenderFunc(func(packet []byte, _ net.IP) error {
+		sent.mu.Lock()
+		sent.pkts = append(sent.pkts, append([]byte(nil), packet...))
+		sent.mu.Unlock()
+		return nil
+	})
+	return NewOfflineWorker(cfg, verdicts, sender, nil), verdicts, sent
+}
+
+// testConfig returns a config with a single set targeting domains.
+func testConfig(domains ...string) (*config.Config, *config.SetConfig) {
+	cfg := config.NewConfig()
+	set := config.NewSetConfig()
+	set.Targets.SNIDomains = domains
+	cfg.Sets = []*config.SetConfig{&set}
+	return &cfg, &set
+}
+
+func clientHello(t *testing.T, domain string) []byte {
+	t.Helper()
+	hello, err := capture.GenerateTLSClientHello(domain)
+	if err != nil {
+		t.Fatalf("failed to generate ClientHello: %v", err)
+	}
+	return hello
+}
+
+// tcpPacket describes a test TCP segment, IPv4 or IPv6 after src.
+type tcpPacket struct {
+	src, dst     net.IP
+	sport, dport uint16
+	seq, ack     uint32
+	flags        byte // ACK|PSH when 0
+	window       uint16
+	ttl          uint8  // 64 when 0
+	options      []byte // padded to 4 bytes
+	payload      []byte
+}
+
+func (p tcpPacket) build() []byte {
+	opts := append([]byte(nil), p.options...)
+	for len(opts)%4 != 0 {
+		opts = append(opts, 0)
+	}
+	tcpLen := TCPHeaderMinLen + len(opts)
+	ttl := p.ttl
+	if ttl == 0 {
+		ttl = 64
+	}
+	flags := p.flags
+	if flags == 0 {
+		flags = 0x18
+	}
+
+	v4 := p.src.To4() != nil
+	ihl := IPv6HeaderLen
+	if v4 {
+		ihl = 20
+	}
+	pkt := make([]byte, ihl+tcpLen+len(p.payload))
+	if v4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:6], 1)
+		pkt[8] = ttl
+		pkt[9] = 6
+		copy(pkt[12:16], p.src.To4())
+		copy(pkt[16:20], p.dst.To4())
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(tcpLen+len(p.payload)))
+		pkt[6] = 6
+		pkt[7] = ttl
+		copy(pkt[8:24], p.src.To16())
+		copy(pkt[24:40], p.dst.To16())
+	}
+
+	tcp := pkt[ihl:]
+	binary.BigEndian.PutUint16(tcp[0:2], p.sport)
+	binary.BigEndian.PutUint16(tcp[2:4], p.dport)
+	binary.BigEndian.PutUint32(tcp[4:8], p.seq)
+	binary.BigEndian.PutUint32(tcp[8:12], p.ack)
+	tcp[12] = byte(tcpLen/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], p.window)
+	copy(tcp[TCPHeaderMinLen:], opts)
+	copy(tcp[tcpLen:], p.payload)
+
+	fixChecksums(pkt)
+	return pkt
+}
+
+// fixChecksums recomputes the IP and TCP checksums of pkt in place.
+func fixChecksums(pkt []byte) {
+	if pkt[0]>>4 == IPv4 {
+		sock.FixIPv4Checksum(pkt[:int(pkt[0]&0x0f)*4])
+		sock.FixTCPChecksum(pkt)
+	} else {
+		sock.FixTCPChecksumV6(pkt)
+	}
+}
+
+// checksumsValid reports whether the checksums of pkt are the ones
+// fixChecksums would write.
+func checksumsValid(pkt []byte) bool {
+	fixed := append([]byte(nil), pkt...)
+	fixChecksums(fixed)
+	return string(fixed) == string(pkt)
+}
@@ -0,0 +1,177 @@
+package nfq
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+const (
+	// hopObservationTTL is how long an observed hop count is trusted.
+	hopObservationTTL = 10 * time.Minute
+	// servers whose hop count is kept at most, the least recently seen
+	// are dropped beyond
+	maxHopObservations = 4096
+)
+
+// HopObservation is the route length to a server estimated from the TTL (or
+// hop limit) of its SYN-ACK.
+type HopObservation struct {
+	IP       string    `json:"ip"`
+	TTL      uint8     `json:"ttl"`
+	Hops     uint8     `json:"hops"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type hopTracker struct {
+	mu    sync.RWMutex
+	hosts map[string]*HopObservation
+}
+
+var hops = &hopTracker{
+	hosts: make(map[string]*HopObservation),
+}
+
+// estimateHops guesses the initial TTL of the sender as the nearest common
+// default (64, 128 or 255) at or above the observed value.
+func estimateHops(ttl uint8) uint8 {
+	switch {
+	case ttl <= 64:
+		return 64 - ttl
+	case ttl <= 128:
+		return 128 - ttl
+	default:
+		return 255 - ttl
+	}
+}
+
+func (t *hopTracker) observe(ip net.IP, ttl uint8) {
+	if ttl == 0 {
+		return
+	}
+	key := ip.String()
+	obs := &HopObservation{
+		IP:       key,
+		TTL:      ttl,
+		Hops:     estimateHops(ttl),
+		LastSeen: time.Now(),
+	}
+
+	t.mu.Lock()
+	if _, ok := t.hosts[key]; !ok && len(t.hosts) >= maxHopObservations {
+		// make room for a batch so the sort is not paid on every SYN-ACK
+		t.trim(maxHopObservations - maxHopObservations/8)
+	}
+	t.hosts[key] = obs
+	t.mu.Unlock()
+}
+
+// trim drops the least recently seen observations beyond max.
+func (t *hopTracker) trim(max int) {
+	if len(t.hosts) <= max {
+		return
+	}
+	keys := make([]string, 0, len(t.hosts))
+	for key := range t.hosts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return t.hosts[keys[i]].LastSeen.Before(t.hosts[keys[j]].LastSeen)
+	})
+	for _, key := range keys[:len(keys)-max] {
+		delete(t.hosts, key)
+	}
+}
+
+func (t *hopTracker) get(ip net.IP) (HopObservation, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	obs, ok := t.hosts[ip.String()]
+	if !ok || time.Since(obs.LastSeen) > hopObservationTTL {
+		return HopObservation{}, false
+	}
+	return *obs, true
+}
+
+func (t *hopTracker) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, v := range t.hosts {
+		if now.Sub(v.LastSeen) > hopObservationTTL {
+			delete(t.hosts, k)
+		}
+	}
+}
+
+// ObservedHops returns the current hop estimates, most recent first.
+func ObservedHops() []HopObservation {
+	hops.mu.RLock()
+	result := make([]HopObservation, 0, len(hops.hosts))
+	for _, obs := range hops.hosts {
+		result = append(result, *obs)
+	}
+	hops.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result
+}
+
+// autoTTL derives the fake packet TTL for dst from its observed hop count:
+// hops minus Delta, clamped to [Min, Max].
+func autoTTL(at *config.AutoTTLConfig, dst net.IP) (uint8, HopObservation, bool) {
+	obs, ok := hops.get(dst)
+	if !ok {
+		return 0, obs, false
+	}
+
+	ttl := int(obs.Hops) - int(at.Delta)
+	if ttl < int(at.Min) {
+		ttl = int(at.Min)
+	}
+	if at.Max > 0 && ttl > int(at.Max) {
+		ttl = int(at.Max)
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+	return uint8(ttl), obs, true
+}
+
+// withAutoTTL returns a copy of the set whose fake, desync and SYN TTLs are
+// derived from the hop count to dst, or the set itself when auto TTL is off
+// or the destination has not been observed yet.
+func withAutoTTL(set *config.SetConfig, dst net.IP) *config.SetConfig {
+	if !set.Faking.AutoTTL.Enabled {
+		return set
+	}
+
+	ttl, obs, ok := autoTTL(&set.Faking.AutoTTL, dst)
+	if !ok {
+		log.Tracef("Auto TTL: no hop count for %s yet, using ttl=%d", dst, set.Faking.TTL)
+		return set
+	}
+	log.Tracef("Auto TTL: %s observed ttl=%d hops=%d -> fake ttl=%d", dst, obs.TTL, obs.Hops, ttl)
+
+	cfg := *set
+	cfg.Faking.TTL = ttl
+	cfg.TCP.Desync.TTL = ttl
+	if cfg.TCP.SynTTL != 0 {
+		cfg.TCP.SynTTL = ttl
+	}
+	return &cfg
+}
+
+// packetTTL returns the IPv4 TTL or IPv6 hop limit of a packet.
+func packetTTL(raw []byte) uint8 {
+	if raw[0]>>4 == IPv4 {
+		return raw[8]
+	}
+	return raw[7]
+}
@@ -0,0 +1,122 @@
+package nfq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestEstimateHops(t *testing.T) {
+	tests := []struct {
+		ttl  uint8
+		want uint8
+	}{
+		{1, 63},
+		{50, 14},
+		{63, 1},
+		{64, 0},
+		{65, 63},
+		{116, 12},
+		{128, 0},
+		{129, 126},
+		{240, 15},
+		{254, 1},
+		{255, 0},
+	}
+	for _, tt := range tests {
+		if got := estimateHops(tt.ttl); got != tt.want {
+			t.Errorf("estimateHops(%d) = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestWithAutoTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		observed uint8 // SYN-ACK TTL, 0 for an unobserved server
+		at       config.AutoTTLConfig
+		want     uint8
+	}{
+		{"hops minus delta", "198.51.100.1", 50, config.AutoTTLConfig{Delta: 2, Min: 1, Max: 20}, 12},
+		{"clamped to max", "198.51.100.2", 100, config.AutoTTLConfig{Delta: 1, Min: 1, Max: 10}, 10},
+		{"no max", "198.51.100.3", 100, config.AutoTTLConfig{Delta: 1, Min: 1}, 27},
+		{"clamped to min", "198.51.100.4", 62, config.AutoTTLConfig{Delta: 1, Min: 3, Max: 20}, 3},
+		{"delta past the hops", "198.51.100.5", 63, config.AutoTTLConfig{Delta: 5}, 1},
+		{"sender at the initial ttl", "198.51.100.6", 255, config.AutoTTLConfig{Delta: 1}, 1},
+		{"unobserved", "198.51.100.7", 0, config.AutoTTLConfig{Delta: 1, Min: 1, Max: 20}, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			hops.observe(ip, tt.observed)
+
+			set := config.NewSetConfig()
+			set.Faking.TTL = 8
+			set.TCP.SynTTL = 0
+			set.Faking.AutoTTL = tt.at
+			set.Faking.AutoTTL.Enabled = true
+
+			got := withAutoTTL(&set, ip)
+			if got.Faking.TTL != tt.want {
+				t.Errorf("fake ttl = %d, want %d", got.Faking.TTL, tt.want)
+			}
+			if tt.observed == 0 {
+				if got != &set {
+					t.Error("unobserved destination got a copy of the set")
+				}
+				return
+			}
+			if got.TCP.Desync.TTL != tt.want {
+				t.Errorf("desync ttl = %d, want %d", got.TCP.Desync.TTL, tt.want)
+			}
+			if got.TCP.SynTTL != 0 {
+				t.Errorf("syn ttl = %d, want it left off", got.TCP.SynTTL)
+			}
+			if set.Faking.TTL != 8 {
+				t.Error("the set itself was changed")
+			}
+		})
+	}
+}
+
+func TestWithAutoTTL_Disabled(t *testing.T) {
+	ip := net.ParseIP("198.51.100.8")
+	hops.observe(ip, 50)
+
+	set := config.NewSetConfig()
+	set.Faking.AutoTTL.Enabled = false
+	if got := withAutoTTL(&set, ip); got != &set {
+		t.Error("auto TTL applied while disabled")
+	}
+}
+
+func TestHopTracker_Capped(t *testing.T) {
+	tr := &hopTracker{hosts: make(map[string]*HopObservation)}
+	for i := range maxHopObservations + 10 {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		tr.observe(ip, 50)
+		tr.hosts[ip.String()].LastSeen = time.Now().Add(time.Duration(i) * time.Millisecond)
+	}
+
+	if len(tr.hosts) > maxHopObservations {
+		t.Fatalf("%d observations kept, want at most %d", len(tr.hosts), maxHopObservations)
+	}
+	if _, ok := tr.hosts["10.0.0.0"]; ok {
+		t.Error("least recently seen server was kept")
+	}
+	last := maxHopObservations + 9
+	if _, ok := tr.get(net.IPv4(10, byte(last>>16), byte(last>>8), byte(last))); !ok {
+		t.Error("most recently seen server was dropped")
+	}
+
+	// refreshing a known server makes no room
+	n := len(tr.hosts)
+	tr.observe(net.IPv4(10, byte(last>>16), byte(last>>8), byte(last)), 51)
+	if len(tr.hosts) != n {
+		t.Errorf("%d observations after refreshing one, want %d", len(tr.hosts), n)
+	}
+}
@@ -0,0 +1,122 @@
+package nfq
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+const defaultFakeHTTPHost = "www.google.com"
+
+// dropAndInjectHTTP handles plain HTTP requests: Host header mangling, decoy
+// requests and a split inside the Host value.
+func (w *Worker) dropAndInjectHTTP(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	pi, ok := ExtractPacketInfoV4(raw)
+	if !ok || pi.PayloadLen == 0 || !sni.IsHTTPRequest(pi.Payload) {
+		_ = w.sock.SendIPv4(raw, dst)
+		return
+	}
+
+	if mangleHTTPHost(pi.Payload, &cfg.HTTP) {
+		sock.FixTCPChecksum(raw)
+	}
+
+	if cfg.HTTP.FakeRequest {
+		w.sendFakeHTTPRequests(cfg, raw, dst)
+	}
+
+	split := httpHostSplitPoint(pi.Payload, &cfg.HTTP)
+	if split <= 0 {
+		_ = w.sock.SendIPv4(raw, dst)
+		return
+	}
+
+	seg1 := BuildSegmentV4(raw, pi, pi.Payload[:split], 0, 0)
+	seg2 := BuildSegmentV4(raw, pi, pi.Payload[split:], uint32(split), 1)
+	w.SendTwoSegmentsV4(seg1, seg2, dst, cfg.TCP.Seg2Delay, cfg.Fragmentation.ReverseOrder)
+}
+
+func (w *Worker) sendFakeHTTPRequests(cfg *config.SetConfig, original []byte, dst net.IP) {
+	fakeCfg := fakeHTTPConfig(cfg)
+	fake := sock.BuildFakeSNIPacketV4(original, fakeCfg)
+	if fake == nil {
+		return
+	}
+	for i := 0; i < fakeCount(cfg); i++ {
+		_ = w.sock.SendIPv4(fake, dst)
+	}
+}
+
+// mangleHTTPHost rewrites the Host header in place without changing the
+// payload length, so the sequence space stays in sync with the kernel.
+func mangleHTTPHost(payload []byte, hc *config.HTTPConfig) bool {
+	hdr, start, end, ok := sni.LocateHTTPHost(payload)
+	if !ok {
+		return false
+	}
+
+	changed := false
+
+	if hc.DomainCase {
+		for i := start + 1; i < end; i += 2 {
+			if c := payload[i]; c >= 'a' && c <= 'z' {
+				payload[i] = c - 'a' + 'A'
+				changed = true
+			}
+		}
+	}
+
+	if hc.HostCase {
+		copy(payload[hdr:hdr+4], "hOsT")
+		changed = true
+	}
+
+	// "Host: example.com\r\n" -> "Host:example.com \r\n"
+	colon := hdr + 4
+	if hc.HostNoSpace && start > colon+1 && payload[colon+1] == ' ' {
+		copy(payload[colon+1:end-1], payload[colon+2:end])
+		payload[end-1] = ' '
+		changed = true
+	}
+
+	return changed
+}
+
+// httpHostSplitPoint returns the payload offset in the middle of the Host
+// value, or 0 when the request should be sent unsplit.
+func httpHostSplitPoint(payload []byte, hc *config.HTTPConfig) int {
+	if !hc.HostSplit {
+		return 0
+	}
+	_, start, end, ok := sni.LocateHTTPHost(payload)
+	if !ok || end-start < 2 {
+		return 0
+	}
+	return start + (end-start)/2
+}
+
+// fakeHTTPConfig derives a faking config whose payload is a GET request for
+// the decoy host, so the regular fake packet builders can be reused.
+func fakeHTTPConfig(cfg *config.SetConfig) *config.SetConfig {
+	host := cfg.HTTP.FakeHost
+	if host == "" {
+		host = defaultFakeHTTPHost
+	}
+
+	fakeCfg := *cfg
+	fakeCfg.Faking.SNIType = config.FakePayloadCustom
+	fakeCfg.Faking.CustomPayload = fmt.Sprintf(
+		"GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\n\r\n", host)
+	fakeCfg.Faking.TLSMod = nil
+	return &fakeCfg
+}
+
+func fakeCount(cfg *config.SetConfig) int {
+	if cfg.Faking.SNISeqLength > 0 {
+		return cfg.Faking.SNISeqLength
+	}
+	return 1
+}
@@ -0,0 +1,47 @@
+package nfq
+
+import (
+	"net"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// dropAndInjectHTTPv6 handles plain HTTP requests for IPv6
+func (w *Worker) dropAndInjectHTTPv6(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	pi, ok := ExtractPacketInfoV6(raw)
+	if !ok || pi.PayloadLen == 0 || !sni.IsHTTPRequest(pi.Payload) {
+		_ = w.sock.SendIPv6(raw, dst)
+		return
+	}
+
+	if mangleHTTPHost(pi.Payload, &cfg.HTTP) {
+		sock.FixTCPChecksumV6(raw)
+	}
+
+	if cfg.HTTP.FakeRequest {
+		w.sendFakeHTTPRequestsV6(cfg, raw, dst)
+	}
+
+	split := httpHostSplitPoint(pi.Payload, &cfg.HTTP)
+	if split <= 0 {
+		_ = w.sock.SendIPv6(raw, dst)
+		return
+	}
+
+	seg1 := BuildSegmentV6(raw, pi, pi.Payload[:split], 0)
+	seg2 := BuildSegmentV6(raw, pi, pi.Payload[split:], uint32(split))
+	w.SendTwoSegmentsV6(seg1, seg2, dst, cfg.TCP.Seg2Delay, cfg.Fragmentation.ReverseOrder)
+}
+
+func (w *Worker) sendFakeHTTPRequestsV6(cfg *config.SetConfig, original []byte, dst net.IP) {
+	fakeCfg := fakeHTTPConfig(cfg)
+	fake := sock.BuildFakeSNIPacketV6(original, fakeCfg)
+	if fake == nil {
+		return
+	}
+	for i := 0; i < fakeCount(cfg); i++ {
+		_ = w.sock.SendIPv6(fake, dst)
+	}
+}
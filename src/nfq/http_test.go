@@ -0,0 +1,128 @@
+package nfq
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+const testHTTPRequest = "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n"
+
+func TestMangleHTTPHost(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		hc   config.HTTPConfig
+		want string // request after mangling, req when unchanged
+	}{
+		{"off", testHTTPRequest, config.HTTPConfig{}, testHTTPRequest},
+		{"domain case", testHTTPRequest, config.HTTPConfig{DomainCase: true},
+			"GET / HTTP/1.1\r\nHost: eXaMpLe.cOm\r\nAccept: */*\r\n\r\n"},
+		{"host case", testHTTPRequest, config.HTTPConfig{HostCase: true},
+			"GET / HTTP/1.1\r\nhOsT: example.com\r\nAccept: */*\r\n\r\n"},
+		{"host no space", testHTTPRequest, config.HTTPConfig{HostNoSpace: true},
+			"GET / HTTP/1.1\r\nHost:example.com \r\nAccept: */*\r\n\r\n"},
+		{"all", testHTTPRequest, config.HTTPConfig{DomainCase: true, HostCase: true, HostNoSpace: true},
+			"GET / HTTP/1.1\r\nhOsT:eXaMpLe.cOm \r\nAccept: */*\r\n\r\n"},
+		{"already without space", "GET / HTTP/1.1\r\nHost:example.com\r\n\r\n", config.HTTPConfig{HostNoSpace: true},
+			"GET / HTTP/1.1\r\nHost:example.com\r\n\r\n"},
+		{"domain already upper case", "GET / HTTP/1.1\r\nHost: EXAMPLE.COM\r\n\r\n", config.HTTPConfig{DomainCase: true},
+			"GET / HTTP/1.1\r\nHost: EXAMPLE.COM\r\n\r\n"},
+		{"no host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", config.HTTPConfig{DomainCase: true, HostCase: true, HostNoSpace: true},
+			"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte(tt.req)
+			changed := mangleHTTPHost(payload, &tt.hc)
+			if got := string(payload); got != tt.want {
+				t.Errorf("mangled to %q, want %q", got, tt.want)
+			}
+			if changed != (tt.want != tt.req) {
+				t.Errorf("reported changed = %v", changed)
+			}
+		})
+	}
+}
+
+func TestHTTPHostSplitPoint(t *testing.T) {
+	start := strings.Index(testHTTPRequest, "example.com")
+
+	tests := []struct {
+		name string
+		req  string
+		hc   config.HTTPConfig
+		want int
+	}{
+		{"middle of the host", testHTTPRequest, config.HTTPConfig{HostSplit: true}, start + len("example.com")/2},
+		{"disabled", testHTTPRequest, config.HTTPConfig{}, 0},
+		{"one letter host", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", config.HTTPConfig{HostSplit: true}, 0},
+		{"no host", "GET / HTTP/1.1\r\n\r\n", config.HTTPConfig{HostSplit: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpHostSplitPoint([]byte(tt.req), &tt.hc); got != tt.want {
+				t.Errorf("split at %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropAndInjectHTTP(t *testing.T) {
+	mangled := "GET / HTTP/1.1\r\nhOsT: example.com\r\nAccept: */*\r\n\r\n"
+	split := strings.Index(mangled, "example.com") + len("example.com")/2
+
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		inject   func(w *Worker, cfg *config.SetConfig, pkt []byte, dst net.IP)
+	}{
+		{"ipv4", testClient, testServer, (*Worker).dropAndInjectHTTP},
+		{"ipv6", testClient6, testServer6, (*Worker).dropAndInjectHTTPv6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, set := testConfig("example.com")
+			set.HTTP = config.HTTPConfig{Enabled: true, HostSplit: true, HostCase: true, FakeRequest: true, FakeHost: "decoy.example"}
+			set.Faking.SNISeqLength = 1
+			set.TCP.Seg2Delay = 0
+			set.Fragmentation.ReverseOrder = false
+			w, _, sent := newTestWorker(t, cfg)
+
+			pkt := tcpPacket{src: tt.src, dst: tt.dst, sport: 40000, dport: 80, seq: 1000, ack: 5000, window: 502, payload: []byte(testHTTPRequest)}.build()
+			tt.inject(w, cfg.Sets[0], pkt, tt.dst)
+
+			got := sent.all()
+			if len(got) != 3 {
+				t.Fatalf("sent %d packets, want a fake and 2 segments", len(got))
+			}
+			fake, _ := pipelinePacketInfo(got[0])
+			if !bytes.Contains(fake.Payload, []byte("Host: decoy.example\r\n")) {
+				t.Errorf("fake request carries %q", fake.Payload)
+			}
+
+			var payload []byte
+			for i, pkt := range got[1:] {
+				pi, ok := pipelinePacketInfo(pkt)
+				if !ok {
+					t.Fatalf("segment %d is not a TCP packet", i)
+				}
+				if !checksumsValid(pkt) {
+					t.Errorf("segment %d has broken checksums", i)
+				}
+				payload = append(payload, pi.Payload...)
+				if i == 0 && len(pi.Payload) != split {
+					t.Errorf("first segment ends at %d, want %d", len(pi.Payload), split)
+				}
+			}
+			if string(payload) != mangled {
+				t.Errorf("segments carry %q, want %q", payload, mangled)
+			}
+		})
+	}
+}
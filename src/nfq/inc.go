@@ -8,14 +8,42 @@ import (
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
 	"github.com/daniellavrushin/b4/sock"
 	"github.com/florianl/go-nfqueue"
 )
 
 var corruptionStrategies = []string{"badsum", "badseq", "badack", "all"}
 
-func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byte, ihl int, src net.IP, dstStr string, dport uint16, srcStr string, sport uint16, payload []byte) int {
-	incomingSet := connState.GetSetForIncoming(dstStr, dport, srcStr, sport)
+func (w *Worker) HandleIncoming(q Verdicts, id uint32, v byte, raw []byte, ihl int, src net.IP, outKey flowKey, srcStr string, sport uint16, payload []byte) int {
+	incomingSet := connState.GetSetForIncoming(outKey)
+
+	// Drop RSTs, FINs and HTTP block pages injected on the way
+	fc := &config.DefaultSetConfig.TCP.Forged
+	if incomingSet != nil {
+		fc = &incomingSet.TCP.Forged
+	}
+	if kind, reason := forged.check(outKey, raw, ihl, payload, fc); reason != "" {
+		if incomingSet != nil && incomingSet.TCP.Forged.Enabled {
+			log.Tracef("Dropped forged %s from %s:%d (%s, set: %s)", kind, srcStr, sport, reason, incomingSet.Name)
+			metrics.GetMetricsCollector().RecordForgedPacket(incomingSet.Name, kind)
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to drop forged packet %d: %v", id, err)
+			}
+			return 0
+		}
+		log.Tracef("Forged %s from %s:%d passed through (%s)", kind, srcStr, sport, reason)
+	}
+
+	// Settle the strategy fallback outcome of the flow
+	switch {
+	case raw[ihl+13]&0x04 != 0:
+		strategies.resolve(outKey, false, "RST")
+	case isServerHello(payload):
+		strategies.resolve(outKey, true, "")
+	case len(payload) > 0 && payload[0] == TLSAlertType:
+		strategies.resolve(outKey, false, "TLS alert")
+	}
 
 	if incomingSet != nil && incomingSet.TCP.Incoming.Mode != config.ConfigOff {
 		payloadLen := len(payload)
@@ -32,7 +60,7 @@ func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byt
 				}
 
 			case "reset":
-				if connState.TrackIncomingBytes(dstStr, dport, srcStr, sport, uint64(payloadLen), inc) {
+				if connState.TrackIncomingBytes(outKey, uint64(payloadLen), inc) {
 					if v == IPv4 {
 						w.InjectResetIncoming(incomingSet, raw, ihl, src)
 					} else {
@@ -41,7 +69,7 @@ func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byt
 				}
 
 			case "fin":
-				if connState.TrackIncomingBytes(dstStr, dport, srcStr, sport, uint64(payloadLen), inc) {
+				if connState.TrackIncomingBytes(outKey, uint64(payloadLen), inc) {
 					if v == IPv4 {
 						w.InjectFinIncoming(incomingSet, raw, ihl, src)
 					} else {
@@ -50,7 +78,7 @@ func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byt
 				}
 
 			case "desync":
-				if connState.TrackIncomingBytes(dstStr, dport, srcStr, sport, uint64(payloadLen), inc) {
+				if connState.TrackIncomingBytes(outKey, uint64(payloadLen), inc) {
 					if v == IPv4 {
 						w.InjectDesyncIncoming(incomingSet, raw, ihl, src)
 					} else {
@@ -61,6 +89,17 @@ func (w *Worker) HandleIncoming(q *nfqueue.Nfqueue, id uint32, v byte, raw []byt
 		}
 	}
 
+	// Keep advertising the small window of a clamped SYN-ACK
+	if window, ok := clamped.serverWindow(outKey); ok && (v == IPv4 || ihl == IPv6HeaderLen) {
+		pkt := make([]byte, len(raw))
+		copy(pkt, raw)
+		setTCPWindow(pkt, ihl, window)
+		if err := q.SetVerdictModPacket(id, nfqueue.NfAccept, pkt); err != nil {
+			log.Tracef("failed to set modified verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+
 	if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 		log.Tracef("failed to accept incoming packet %d: %v", id, err)
 	}
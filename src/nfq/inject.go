@@ -0,0 +1,234 @@
+package nfq
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+type injectKind uint8
+
+const (
+	injectTCP injectKind = iota
+	injectHTTP
+	injectQUIC
+)
+
+func (k injectKind) String() string {
+	switch k {
+	case injectHTTP:
+		return "http"
+	case injectQUIC:
+		return "quic"
+	}
+	return "tcp"
+}
+
+// injectJob is a matched packet waiting for an injection worker. The packet
+// lives in a pooled buffer that goes back to the pool once the job ran.
+type injectJob struct {
+	kind    injectKind
+	set     *config.SetConfig
+	buf     *[]byte
+	level   int    // fallback level applied to set, reported by offline workers
+	id      uint32 // queued packet, for jobs setting its verdict
+	verdict bool   // the packet is still queued and the job sets its verdict
+}
+
+var packetBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+// copyPacket copies raw into a pooled buffer, release it with putPacket.
+func copyPacket(raw []byte) *[]byte {
+	buf := packetBufs.Get().(*[]byte)
+	*buf = append((*buf)[:0], raw...)
+	return buf
+}
+
+func putPacket(buf *[]byte) {
+	packetBufs.Put(buf)
+}
+
+// startInjectors starts the fixed set of goroutines running strategies for
+// the packets matched on this queue.
+func (w *Worker) startInjectors(cfg *config.Config) {
+	workers := cfg.Queue.InjectWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	size := cfg.Queue.InjectQueueSize
+	if size < 1 {
+		size = 1
+	}
+	w.jobs = make(chan injectJob, size)
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for {
+				select {
+				case <-w.ctx.Done():
+					w.drainJobs()
+					return
+				case job := <-w.jobs:
+					w.runJob(job)
+				}
+			}
+		}()
+	}
+}
+
+// drainJobs lets the packets still waiting for an injection worker through
+// unmodified when the worker stops: queued packets get an accept verdict and
+// dropped ones are sent as they were.
+func (w *Worker) drainJobs() {
+	for {
+		select {
+		case job := <-w.jobs:
+			if job.verdict {
+				if err := w.q.SetVerdict(job.id, nfqueue.NfAccept); err != nil {
+					log.Tracef("failed to set verdict on packet %d: %v", job.id, err)
+				}
+			} else {
+				w.sendRaw(*job.buf, packetDst(*job.buf))
+			}
+			putPacket(job.buf)
+		default:
+			return
+		}
+	}
+}
+
+// injectReady reports whether a matched packet can be queued. The queue
+// callback is the only producer, so a free slot stays free until inject.
+func (w *Worker) injectReady() bool {
+	if w.inline || len(w.jobs) < cap(w.jobs) {
+		return true
+	}
+	atomic.AddUint64(&w.injectFallbacks, 1)
+	return false
+}
+
+// inject queues a matched packet that was already dropped, injectReady must
+// have returned true. level is the fallback level set was built from.
+func (w *Worker) inject(kind injectKind, set *config.SetConfig, level int, raw []byte) {
+	w.enqueue(injectJob{kind: kind, set: set, level: level, buf: copyPacket(raw)})
+}
+
+// injectVerdict queues a matched packet still waiting for its verdict, the
+// worker running it sets the verdict. injectReady must have returned true.
+func (w *Worker) injectVerdict(kind injectKind, set *config.SetConfig, level int, raw []byte, id uint32) {
+	w.enqueue(injectJob{kind: kind, set: set, level: level, buf: copyPacket(raw), id: id, verdict: true})
+}
+
+func (w *Worker) enqueue(job injectJob) {
+	if w.inline {
+		w.runJob(job)
+		return
+	}
+	w.jobs <- job
+}
+
+// after runs fn once d has passed without holding up the caller, unless the
+// worker has stopped by then. Offline workers run fn right away so a packet
+// has caused everything it will when Handle returns.
+func (w *Worker) after(d time.Duration, fn func()) {
+	if w.inline {
+		fn()
+		return
+	}
+	time.AfterFunc(d, func() {
+		if w.ctx.Err() == nil {
+			fn()
+		}
+	})
+}
+
+func (w *Worker) runJob(job injectJob) {
+	if job.verdict {
+		w.injectWithVerdict(w.q, job.id, *job.buf, func() { w.runInject(job.kind, job.set, job.level, *job.buf) })
+	} else {
+		w.runInject(job.kind, job.set, job.level, *job.buf)
+	}
+	putPacket(job.buf)
+}
+
+// passUnmodified lets a matched packet through as is when the injection
+// workers are saturated. Segments held for reassembly were already dropped
+// and are replayed instead.
+func (w *Worker) passUnmodified(q Verdicts, id uint32, held [][]byte, dst net.IP) {
+	log.Tracef("Injection queue %d full, passing packet %d unmodified", w.qnum, id)
+	if held == nil {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return
+	}
+	if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+	for _, seg := range held {
+		w.sendRaw(seg, dst)
+	}
+}
+
+// packetDst returns the destination address of an IPv4 or IPv6 packet.
+func packetDst(pkt []byte) net.IP {
+	if pkt[0]>>4 == IPv4 {
+		return net.IP(pkt[16:20])
+	}
+	return net.IP(pkt[24:40])
+}
+
+// runInject runs the strategy of set on a copy of a matched packet.
+func (w *Worker) runInject(kind injectKind, set *config.SetConfig, level int, pkt []byte) {
+	w.report(kind.String(), set, level, pkt)
+	v4 := pkt[0]>>4 == IPv4
+	dst := packetDst(pkt)
+
+	if kind == injectQUIC {
+		if v4 {
+			w.dropAndInjectQUIC(set, pkt, dst)
+		} else {
+			w.dropAndInjectQUICV6(set, pkt, dst)
+		}
+		return
+	}
+
+	if set.TCP.DropSACK {
+		if v4 {
+			pkt = sock.StripSACKFromTCP(pkt)
+		} else {
+			pkt = sock.StripSACKFromTCPv6(pkt)
+		}
+	}
+
+	switch {
+	case kind == injectHTTP && v4:
+		w.dropAndInjectHTTP(set, pkt, dst)
+	case kind == injectHTTP:
+		w.dropAndInjectHTTPv6(set, pkt, dst)
+	case v4:
+		w.dropAndInjectTCP(set, pkt, dst)
+	default:
+		w.dropAndInjectTCPv6(set, pkt, dst)
+	}
+}
+
+// InjectQueue returns the number of matched packets waiting for injection,
+// the queue capacity and how many packets passed unmodified because it was
+// full.
+func (w *Worker) InjectQueue() (depth, capacity int, fallbacks uint64) {
+	return len(w.jobs), cap(w.jobs), atomic.LoadUint64(&w.injectFallbacks)
+}
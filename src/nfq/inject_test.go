@@ -0,0 +1,48 @@
+package nfq
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+func TestDrainJobs_PassesQueuedPackets(t *testing.T) {
+	cfg := config.NewConfig()
+	w := NewWorkerWithQueue(&cfg, 0)
+	verdicts := newTestVerdicts()
+	var sent [][]byte
+	var sentTo []net.IP
+	w.q = verdicts
+	w.sock = sock.NewSenderFunc(func(packet []byte, dst net.IP) error {
+		sent = append(sent, append([]byte(nil), packet...))
+		sentTo = append(sentTo, append(net.IP(nil), dst...))
+		return nil
+	})
+	w.jobs = make(chan injectJob, 4)
+
+	pkt := make([]byte, 40)
+	pkt[0] = 0x45
+	copy(pkt[16:20], net.ParseIP("93.184.216.34").To4())
+	set := config.NewSetConfig()
+	w.jobs <- injectJob{kind: injectTCP, set: &set, buf: copyPacket(pkt), id: 7, verdict: true}
+	w.jobs <- injectJob{kind: injectTCP, set: &set, buf: copyPacket(pkt)}
+
+	w.drainJobs()
+
+	if len(w.jobs) != 0 {
+		t.Errorf("%d jobs left queued", len(w.jobs))
+	}
+	if v, _, ok := verdicts.get(7); !ok || v != nfqueue.NfAccept {
+		t.Errorf("queued packet got verdict %d (set: %v), want accept", v, ok)
+	}
+	if len(sent) != 1 || !bytes.Equal(sent[0], pkt) {
+		t.Fatalf("dropped packet was not sent unmodified: %x", sent)
+	}
+	if !sentTo[0].Equal(net.ParseIP("93.184.216.34")) {
+		t.Errorf("sent to %s", sentTo[0])
+	}
+}
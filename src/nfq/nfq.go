@@ -3,7 +3,6 @@ package nfq
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
 	"os"
 	"strings"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/daniellavrushin/b4/capture"
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/dns"
 	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/metrics"
 	"github.com/daniellavrushin/b4/quic"
@@ -31,6 +31,8 @@ func (w *Worker) Start() error {
 		return err
 	}
 	w.sock = s
+	w.mark = uint32(mark)
+	w.hellos = newHelloReassembler(w.sendRaw)
 
 	c := nfqueue.Config{
 		NfQueue:      w.qnum,
@@ -44,6 +46,8 @@ func (w *Worker) Start() error {
 	}
 	w.q = q
 
+	w.startInjectors(cfg)
+
 	w.wg.Add(1)
 	go w.gc(cfg)
 
@@ -53,477 +57,555 @@ func (w *Worker) Start() error {
 		pid := os.Getpid()
 		log.Tracef("NFQ bound pid=%d queue=%d", pid, w.qnum)
 		defer w.wg.Done()
-		_ = q.RegisterWithErrorFunc(w.ctx, func(a nfqueue.Attribute) int {
-			cfg := w.getConfig()
-			set := cfg.MainSet
-
-			matcher := w.getMatcher()
-			id := *a.PacketID
+		_ = q.RegisterWithErrorFunc(w.ctx, w.handle, func(e error) int {
+			if w.ctx.Err() != nil {
 
-			if a.Mark != nil && *a.Mark == uint32(mark) {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
+				if errors.Is(e, syscall.ENOBUFS) {
+					now := time.Now().Unix()
+					last := atomic.LoadInt64(&w.lastOverflowLog)
+					if now-last >= 5 {
+						if atomic.CompareAndSwapInt64(&w.lastOverflowLog, last, now) {
+							log.Warnf("nfq queue %d overflow - packets dropped", w.qnum)
+						}
+					}
+					return 0
 				}
-				return 0
-			}
 
-			// Interface filtering
-			if !w.matchesInterface(a) {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
-				}
 				return 0
 			}
-
-			select {
-			case <-w.ctx.Done():
+			if errors.Is(e, os.ErrClosed) || errors.Is(e, net.ErrClosed) || errors.Is(e, syscall.EBADF) {
 				return 0
-			default:
 			}
-
-			atomic.AddUint64(&w.packetsProcessed, 1)
-
-			if a.PacketID == nil || a.Payload == nil || len(*a.Payload) == 0 {
-				if a.PacketID != nil && q != nil {
-					if err := q.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on invalid packet %d: %v", *a.PacketID, err)
-					}
-				}
+			if ne, ok := e.(net.Error); ok && ne.Timeout() {
 				return 0
 			}
-			raw := *a.Payload
-
-			v := raw[0] >> 4
-			if v != IPv4 && v != IPv6 {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
-				}
+			msg := e.Error()
+			if strings.Contains(msg, "use of closed file") || strings.Contains(msg, "file descriptor") {
 				return 0
 			}
-			var proto uint8
-			var src, dst net.IP
-			var ihl int
-			if v == IPv4 {
-				if len(raw) < 20 {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				ihl = int(raw[0]&0x0f) * 4
-				if len(raw) < ihl {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+			log.Errorf("nfq: %v", e)
+			return 0
+		})
+	}()
 
-				// Check for IP fragmentation
-				fragOffset := binary.BigEndian.Uint16(raw[6:8]) & 0x1FFF
-				moreFragments := (binary.BigEndian.Uint16(raw[6:8]) & 0x2000) != 0
+	return nil
+}
 
-				if fragOffset != 0 || moreFragments {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to accept fragmented IPv4 packet %d: %v", id, err)
-					}
-					return 0
-				}
+// handle is the queue callback. It decides the verdict of one packet and
+// runs the strategy of the set it matches.
+func (w *Worker) handle(a nfqueue.Attribute) int {
+	cfg := w.getConfig()
+	set := cfg.MainSet
+	q := w.q
 
-				proto = raw[9]
-				src = net.IP(raw[12:16])
-				dst = net.IP(raw[16:20])
+	matcher := w.getMatcher()
+	id := *a.PacketID
 
-			} else {
-				if len(raw) < IPv6HeaderLen {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				ihl = IPv6HeaderLen
-				nextHeader := raw[6]
-				offset := 40
-
-				for {
-					switch nextHeader {
-					case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options
-						if len(raw) < offset+2 {
-							if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-								log.Tracef("failed to set verdict on packet %d: %v", id, err)
-							}
-							return 0
-						}
-						nextHeader = raw[offset]
-						hdrLen := int(raw[offset+1])*8 + 8
-						offset += hdrLen
-					case 44:
-						if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-							log.Tracef("failed to accept fragmented IPv6 packet %d: %v", id, err)
-						}
-						return 0
-					default:
-						goto done
-					}
-				}
-			done:
-				proto = nextHeader
-				ihl = offset
-				src = net.IP(raw[8:24])
-				dst = net.IP(raw[24:40])
+	if a.Mark != nil && *a.Mark == w.mark {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+
+	// Interface filtering
+	if !w.matchesInterface(a) {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+
+	select {
+	case <-w.ctx.Done():
+		return 0
+	default:
+	}
+
+	atomic.AddUint64(&w.packetsProcessed, 1)
+
+	if a.PacketID == nil || a.Payload == nil || len(*a.Payload) == 0 {
+		if a.PacketID != nil && q != nil {
+			if err := q.SetVerdict(*a.PacketID, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on invalid packet %d: %v", *a.PacketID, err)
 			}
+		}
+		return 0
+	}
+	raw := *a.Payload
 
-			if src.IsLoopback() || dst.IsLoopback() {
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
-				}
-				return 0
+	v := raw[0] >> 4
+	if v != IPv4 && v != IPv6 {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+	var proto uint8
+	var src, dst net.IP
+	var ihl int
+	if v == IPv4 {
+		if len(raw) < 20 {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
+		ihl = int(raw[0]&0x0f) * 4
+		if len(raw) < ihl {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
 			}
-			srcStr := src.String()
-			dstStr := dst.String()
+			return 0
+		}
 
-			srcMac := w.getMacByIp(srcStr)
+		// Check for IP fragmentation
+		fragOffset := binary.BigEndian.Uint16(raw[6:8]) & 0x1FFF
+		moreFragments := (binary.BigEndian.Uint16(raw[6:8]) & 0x2000) != 0
 
-			matched, st := matcher.MatchIP(dst)
-			if matched {
-				set = st
+		if fragOffset != 0 || moreFragments {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to accept fragmented IPv4 packet %d: %v", id, err)
 			}
+			return 0
+		}
 
-			// TCP processing
-			if proto == 6 && len(raw) >= ihl+TCPHeaderMinLen {
-				tcp := raw[ihl:]
-				if len(tcp) < TCPHeaderMinLen {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
-				datOff := int((tcp[12]>>4)&0x0f) * 4
-				if len(tcp) < datOff {
+		proto = raw[9]
+		src = net.IP(raw[12:16])
+		dst = net.IP(raw[16:20])
+
+	} else {
+		if len(raw) < IPv6HeaderLen {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
+		ihl = IPv6HeaderLen
+		nextHeader := raw[6]
+		offset := 40
+
+		for {
+			switch nextHeader {
+			case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options
+				if len(raw) < offset+2 {
 					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 						log.Tracef("failed to set verdict on packet %d: %v", id, err)
 					}
 					return 0
 				}
-				payload := tcp[datOff:]
-				sport := binary.BigEndian.Uint16(tcp[0:2])
-				dport := binary.BigEndian.Uint16(tcp[2:4])
-
-				if sport == HTTPSPort {
-					return w.HandleIncoming(q, id, v, raw, ihl, src, dstStr, dport, srcStr, sport, payload)
+				nextHeader = raw[offset]
+				hdrLen := int(raw[offset+1])*8 + 8
+				offset += hdrLen
+			case 44:
+				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+					log.Tracef("failed to accept fragmented IPv6 packet %d: %v", id, err)
 				}
+				return 0
+			default:
+				goto done
+			}
+		}
+	done:
+		proto = nextHeader
+		ihl = offset
+		src = net.IP(raw[8:24])
+		dst = net.IP(raw[24:40])
+	}
 
-				tcpFlags := tcp[13]
-				isSyn := (tcpFlags & 0x02) != 0 // SYN flag
-				isAck := (tcpFlags & 0x10) != 0 // ACK flag
-				isRst := (tcpFlags & 0x04) != 0
-				if isRst && dport == HTTPSPort {
-					log.Tracef("RST received from %s:%d", dstStr, dport)
-				}
+	if src.IsLoopback() || dst.IsLoopback() {
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
+	srcStr := src.String()
+	dstStr := dst.String()
 
-				if isSyn && !isAck && dport == HTTPSPort && matched {
-					log.Tracef("TCP SYN to %s:%d (set: %s)", dstStr, dport, set.Name)
+	srcMac := w.getMacByIp(srcStr)
 
-					metrics := metrics.GetMetricsCollector()
-					metrics.RecordConnection("TCP-SYN", "", srcStr, dstStr, true)
+	matched, st := matcher.MatchIP(dst)
+	if matched {
+		set = st
+	}
 
-					if v == IPv4 {
-						// Syndata - modify SYN packet to include payload
-						modsyn := raw
+	// TCP processing
+	if proto == 6 && len(raw) >= ihl+TCPHeaderMinLen {
+		tcp := raw[ihl:]
+		if len(tcp) < TCPHeaderMinLen {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
+		datOff := int((tcp[12]>>4)&0x0f) * 4
+		if len(tcp) < datOff {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
+		payload := tcp[datOff:]
+		sport := binary.BigEndian.Uint16(tcp[0:2])
+		dport := binary.BigEndian.Uint16(tcp[2:4])
 
-						// SynFake - independent
-						if set.TCP.SynFake {
-							w.sendFakeSyn(set, raw, ihl, datOff)
-						}
+		if dport == 53 && len(payload) > 0 {
+			return w.processDnsTCP(v, sport, payload, raw, ihl, id)
+		}
 
-						if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
-							w.sendFakeSynWithMD5(set, raw, ihl, dst)
-						}
+		// SYN-ACKs reveal the hop count to the server for auto TTL and
+		// are the baseline to spot forged packets of the flow
+		if tcp[13]&0x12 == 0x12 {
+			connKey := newFlowKey(dst, dport, src, sport)
+			hops.observe(src, packetTTL(raw))
+			if learnForged(cfg, matcher, src) {
+				forged.learn(connKey, raw, ihl)
+			}
+			if w.clampSynAck(q, id, matcher, raw, ihl, src, sport, connKey) {
+				return 0
+			}
+		}
 
-						_ = w.sock.SendIPv4(modsyn, dst)
-					} else {
-						if set.TCP.SynFake {
-							w.sendFakeSynV6(set, raw, ihl, datOff)
-						}
+		isServerPort := isTLSPort(matcher, sport) || sport == HTTPPort
+		if isServerPort && !isTLSPort(matcher, dport) && dport != HTTPPort {
+			return w.HandleIncoming(q, id, v, raw, ihl, src, newFlowKey(dst, dport, src, sport), srcStr, sport, payload)
+		}
 
-						if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
-							w.sendFakeSynWithMD5V6(set, raw, dst)
-						}
+		connKey := newFlowKey(src, sport, dst, dport)
+		if len(payload) > 0 {
+			clamped.clientData(connKey)
+		}
 
-						_ = w.sock.SendIPv6(raw, dst)
-					}
+		tcpFlags := tcp[13]
+		isSyn := (tcpFlags & 0x02) != 0 // SYN flag
+		isAck := (tcpFlags & 0x10) != 0 // ACK flag
+		isRst := (tcpFlags & 0x04) != 0
+		if isRst && isTLSPort(matcher, dport) {
+			log.Tracef("RST received from %s:%d", dstStr, dport)
+		}
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		// IP-matched sets only apply to 443 and the ports they list
+		if matched && !tcpPortAllowed(matcher, dport, set) {
+			matched = false
+			set = cfg.MainSet
+		}
 
-				host := ""
-				matchedIP := matched
-				matchedSNI := false
-				ipTarget := ""
-				sniTarget := ""
-
-				if dport == HTTPSPort && len(payload) > 0 {
-					log.Tracef("TCP payload to %s: len=%d, first5=%x", dstStr, len(payload), payload[:min(5, len(payload))])
-					if len(payload) >= 5 && payload[0] == 0x16 {
-						log.Tracef("TLS record: type=%x ver=%x%x len=%d", payload[0], payload[1], payload[2],
-							int(payload[3])<<8|int(payload[4]))
-					}
-					connKey := fmt.Sprintf("%s:%d->%s:%d", srcStr, sport, dstStr, dport)
+		if isSyn && !isAck && isTLSPort(matcher, dport) && matched {
+			log.Tracef("TCP SYN to %s:%d (set: %s)", dstStr, dport, set.Name)
+			set = withAutoTTL(set, dst)
+			w.report("syn", set, 0, raw)
 
-					host, _ = sni.ParseTLSClientHelloSNI(payload)
+			metrics := metrics.GetMetricsCollector()
+			metrics.RecordConnection("TCP-SYN", "", srcStr, dstStr, true)
 
-					if captureManager := capture.GetManager(cfg); captureManager != nil {
-						captureManager.CapturePayload(connKey, host, "tls", payload)
-					}
+			if v == IPv4 {
+				// Syndata - modify SYN packet to include payload
+				modsyn := raw
 
-					if host != "" {
-						if mSNI, stSNI := matcher.MatchSNI(host); mSNI {
-							matchedSNI = true
-							matched = true
-							set = stSNI
-							// Learn IP-to-domain association for future UDP packets
-							matcher.LearnIPToDomain(dst, host, stSNI)
-						}
-					}
+				// SynFake - independent
+				if set.TCP.SynFake {
+					w.sendFakeSyn(set, raw, ihl, datOff)
 				}
 
-				if matchedIP {
-					ipTarget = st.Name
-				}
-				if matchedSNI {
-					sniTarget = set.Name
+				if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
+					w.sendFakeSynWithMD5(set, raw, ihl, dst)
 				}
 
-				if !log.IsDiscoveryActive() {
-					log.Infof(",TCP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+				_ = w.sock.SendIPv4(modsyn, dst)
+			} else {
+				if set.TCP.SynFake {
+					w.sendFakeSynV6(set, raw, ihl, datOff)
 				}
 
-				if matched {
-					metrics := metrics.GetMetricsCollector()
-					metrics.RecordConnection("TCP", host, srcStr, dstStr, true)
-					metrics.RecordPacket(uint64(len(raw)))
+				if set.Fragmentation.Strategy != config.ConfigNone && set.Faking.TCPMD5 {
+					w.sendFakeSynWithMD5V6(set, raw, dst)
+				}
 
-					if matched && set.TCP.Incoming.Mode != config.ConfigOff {
-						connKey := fmt.Sprintf("%s:%d->%s:%d", srcStr, sport, dstStr, dport)
-						connState.RegisterOutgoing(connKey, set)
-					}
+				_ = w.sock.SendIPv6(raw, dst)
+			}
 
-					packetCopy := make([]byte, len(raw))
-					copy(packetCopy, raw)
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
 
-					if set.TCP.DropSACK {
-						if v == 4 {
-							packetCopy = sock.StripSACKFromTCP(packetCopy)
-						} else {
-							packetCopy = sock.StripSACKFromTCPv6(packetCopy)
-						}
-					}
+		// Hold segments of a ClientHello spread across several packets
+		var heldSegments [][]byte
+		if isTLSPort(matcher, dport) && len(payload) > 0 {
+			timeout := time.Duration(cfg.Queue.ReassemblyTimeout) * time.Millisecond
+			state, full, segments := w.hellos.add(connKey, raw, ihl, ihl+datOff, dst, timeout)
+			switch state {
+			case helloHeld:
+				if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+					log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				}
+				return 0
+			case helloComplete:
+				raw = full
+				payload = raw[ihl+datOff:]
+				heldSegments = segments
+			}
+		}
 
-					dstCopy := make(net.IP, len(dst))
-					copy(dstCopy, dst)
-					setCopy := set
+		host := ""
+		matchedIP := matched
+		matchedSNI := false
+		ipTarget := ""
+		sniTarget := ""
+
+		if isTLSPort(matcher, dport) && len(payload) > 0 {
+			log.Tracef("TCP payload to %s: len=%d, first5=%x", dstStr, len(payload), payload[:min(5, len(payload))])
+			if len(payload) >= 5 && payload[0] == 0x16 {
+				log.Tracef("TLS record: type=%x ver=%x%x len=%d", payload[0], payload[1], payload[2],
+					int(payload[3])<<8|int(payload[4]))
+			}
+			host, _ = sni.ParseTLSClientHelloSNI(payload)
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-						return 0
-					}
+			if captureManager := capture.GetManager(cfg); captureManager != nil {
+				captureManager.CapturePayload(connKey.String(), host, "tls", payload)
+			}
 
-					w.wg.Add(1)
-					go func(s *config.SetConfig, pkt []byte, d net.IP) {
-						defer w.wg.Done()
-						if v == 4 {
-							w.dropAndInjectTCP(s, pkt, d)
-						} else {
-							w.dropAndInjectTCPv6(s, pkt, d)
-						}
-					}(setCopy, packetCopy, dstCopy)
-					return 0
+			if host != "" {
+				if mSNI, stSNI := matcher.MatchSNI(host); mSNI && tcpPortAllowed(matcher, dport, stSNI) {
+					matchedSNI = true
+					matched = true
+					set = stSNI
+					// Learn IP-to-domain association for future UDP packets
+					matcher.LearnIPToDomain(dst, host, stSNI)
 				}
+			}
+		}
 
-				if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-					log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		if host == "" && dport == HTTPPort && len(payload) > 0 {
+			host, _ = sni.ParseHTTPHost(payload)
+			if host != "" {
+				if mSNI, stSNI := matcher.MatchSNI(host); mSNI && tcpPortAllowed(matcher, dport, stSNI) {
+					matchedSNI = true
+					matched = true
+					set = stSNI
+					matcher.LearnIPToDomain(dst, host, stSNI)
 				}
-				return 0
 			}
+		}
 
-			// UDP processing
-			if proto == 17 && len(raw) >= ihl+8 {
-				udp := raw[ihl:]
-				if len(udp) < 8 {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		// a ClientHello without an SNI to an address a DNS answer or an
+		// earlier flow resolved for a set
+		if !matched && host == "" && isTLSPort(matcher, dport) && len(payload) >= 6 && payload[0] == 0x16 && payload[5] == 0x01 {
+			if mLearned, learnedSet, learnedDomain := matcher.MatchLearnedIP(dst); mLearned && tcpPortAllowed(matcher, dport, learnedSet) {
+				matchedSNI = true
+				matched = true
+				set = learnedSet
+				host = learnedDomain
+			}
+		}
 
-				payload := udp[8:]
-				sport := binary.BigEndian.Uint16(udp[0:2])
-				dport := binary.BigEndian.Uint16(udp[2:4])
-				connKey := fmt.Sprintf("%s:%d->%s:%d", srcStr, sport, dstStr, dport)
+		if matchedIP {
+			ipTarget = st.Name
+		}
+		if matchedSNI {
+			sniTarget = set.Name
+		}
 
-				// Handle DNS packets
-				if sport == 53 || dport == 53 {
-					return w.processDnsPacket(v, sport, dport, payload, raw, ihl, id)
-				}
+		if !log.IsDiscoveryActive() {
+			log.Infof(",TCP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+		}
 
-				if utils.IsPrivateIP(dst) {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if host != "" || matched {
+			forged.settle(connKey, host, matched && (set.TCP.Forged.Enabled || log.IsDiscoveryActive()))
+		}
 
-				matchedIP := matched
-				matchedQUIC := false
-				isSTUN := false
-				host := ""
-				ipTarget := ""
-				sniTarget := ""
+		if matched {
+			metrics := metrics.GetMetricsCollector()
+			metrics.RecordConnection("TCP", host, srcStr, dstStr, true)
+			metrics.RecordPacket(uint64(len(raw)))
 
-				if matchedIP {
-					ipTarget = st.Name
-				}
+			if set.TCP.Incoming.Mode != config.ConfigOff || set.TCP.Forged.Enabled {
+				connState.RegisterOutgoing(connKey, set)
+			}
 
-				if !matchedIP {
-					if mLearned, learnedSet, learnedDomain := matcher.MatchLearnedIP(dst); mLearned {
-						matchedIP = true
-						matched = true
-						set = learnedSet
-						host = learnedDomain
-						sniTarget = learnedSet.Name
-						ipTarget = learnedSet.Name
-					}
-				}
+			setCopy := withAutoTTL(set, dst)
+			kind := injectTCP
+			if dport == HTTPPort && set.HTTP.Enabled && !isTLSPort(matcher, dport) {
+				kind = injectHTTP
+			}
 
-				isSTUN = stun.IsSTUNMessage(payload)
+			level := 0
+			if kind == injectTCP && host != "" && set.Fallback.Enabled {
+				setCopy, level = strategies.apply(setCopy, host)
+				strategies.track(connKey, host, set, level)
+			}
 
-				if host == "" {
-					if h, ok := sni.ParseQUICClientHelloSNI(payload); ok {
-						host = h
-					}
-				}
+			if !w.injectReady() {
+				w.passUnmodified(q, id, heldSegments, dst)
+				return 0
+			}
 
-				if host != "" {
-					if mSNI, sniSet := matcher.MatchSNI(host); mSNI {
-						matchedQUIC = true
-						set = sniSet
-						sniTarget = sniSet.Name
-						matcher.LearnIPToDomain(dst, host, sniSet)
-					}
-				}
+			if cfg.Queue.VerdictMode == config.VerdictModify {
+				// the verdict is set by the injection worker
+				w.injectVerdict(kind, setCopy, level, raw, id)
+				return 0
+			}
 
-				if !matchedQUIC && matchedIP && set.UDP.FilterQUIC == "all" {
-					if quic.IsInitial(payload) {
-						matchedQUIC = true
-					}
-				}
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+				return 0
+			}
 
-				if captureManager := capture.GetManager(cfg); captureManager != nil {
-					captureManager.CapturePayload(connKey, host, "quic", payload)
-				}
+			w.inject(kind, setCopy, level, raw)
+			return 0
+		}
 
-				shouldHandle := (matchedIP || matchedQUIC) && !(isSTUN && set.UDP.FilterSTUN)
+		if heldSegments != nil {
+			// earlier segments were dropped while buffering, replay all of them
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+			}
+			for _, seg := range heldSegments {
+				w.sendRaw(seg, dst)
+			}
+			return 0
+		}
 
-				matched = shouldHandle
+		if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+			log.Tracef("failed to set verdict on packet %d: %v", id, err)
+		}
+		return 0
+	}
 
-				if !log.IsDiscoveryActive() {
-					log.Infof(",UDP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
-				}
+	// UDP processing
+	if proto == 17 && len(raw) >= ihl+8 {
+		udp := raw[ihl:]
+		if len(udp) < 8 {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
 
-				if isSTUN && set.UDP.FilterSTUN {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		payload := udp[8:]
+		sport := binary.BigEndian.Uint16(udp[0:2])
+		dport := binary.BigEndian.Uint16(udp[2:4])
+		// Handle DNS packets
+		if sport == 53 || dport == 53 {
+			return w.processDnsPacket(v, sport, dport, payload, raw, ihl, id)
+		}
 
-				if !shouldHandle {
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if utils.IsPrivateIP(dst) {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
 
-				metrics := metrics.GetMetricsCollector()
-				metrics.RecordConnection("UDP", host, srcStr, dstStr, matched)
-				metrics.RecordPacket(uint64(len(raw)))
+		matchedIP := matched
+		matchedQUIC := false
+		isSTUN := false
+		host := ""
+		ipTarget := ""
+		sniTarget := ""
 
-				switch set.UDP.Mode {
-				case "drop":
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
-					}
-					return 0
+		if matchedIP {
+			ipTarget = st.Name
+		}
 
-				case "fake":
-					packetCopy := make([]byte, len(raw))
-					copy(packetCopy, raw)
-					dstCopy := make(net.IP, len(dst))
-					copy(dstCopy, dst)
-					setCopy := set
+		if !matchedIP {
+			if mLearned, learnedSet, learnedDomain := matcher.MatchLearnedIP(dst); mLearned {
+				matchedIP = true
+				matched = true
+				set = learnedSet
+				host = learnedDomain
+				sniTarget = learnedSet.Name
+				ipTarget = learnedSet.Name
+			}
+		}
 
-					if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
-						log.Tracef("failed to set drop verdict on UDP packet %d: %v", id, err)
-						return 0
-					}
+		isSTUN = stun.IsSTUNMessage(payload)
 
-					w.wg.Add(1)
-					go func(s *config.SetConfig, pkt []byte, d net.IP) {
-						defer w.wg.Done()
-						if v == IPv4 {
-							w.dropAndInjectQUIC(s, pkt, d)
-						} else {
-							w.dropAndInjectQUICV6(s, pkt, d)
-						}
-					}(setCopy, packetCopy, dstCopy)
-					return 0
+		if host == "" {
+			if h, ok := sni.ParseQUICClientHelloSNI(payload); ok {
+				host = h
+			}
+		}
 
-				default:
-					if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
-						log.Tracef("failed to set verdict on packet %d: %v", id, err)
-					}
-					return 0
-				}
+		if host != "" {
+			if mSNI, sniSet := matcher.MatchSNI(host); mSNI {
+				matchedQUIC = true
+				set = sniSet
+				sniTarget = sniSet.Name
+				matcher.LearnIPToDomain(dst, host, sniSet)
 			}
+		}
 
+		if !matchedQUIC && matchedIP && set.UDP.FilterQUIC == "all" {
+			if quic.IsInitial(payload) {
+				matchedQUIC = true
+			}
+		}
+
+		if captureManager := capture.GetManager(cfg); captureManager != nil {
+			captureManager.CapturePayload(newFlowKey(src, sport, dst, dport).String(), host, "quic", payload)
+		}
+
+		shouldHandle := (matchedIP || matchedQUIC) && !(isSTUN && set.UDP.FilterSTUN)
+
+		matched = shouldHandle
+
+		if !log.IsDiscoveryActive() {
+			log.Infof(",UDP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, srcStr, sport, ipTarget, dstStr, dport, srcMac)
+		}
+
+		if isSTUN && set.UDP.FilterSTUN {
 			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
 				log.Tracef("failed to set verdict on packet %d: %v", id, err)
 			}
 			return 0
-		}, func(e error) int {
-			if w.ctx.Err() != nil {
+		}
 
-				if errors.Is(e, syscall.ENOBUFS) {
-					now := time.Now().Unix()
-					last := atomic.LoadInt64(&w.lastOverflowLog)
-					if now-last >= 5 {
-						if atomic.CompareAndSwapInt64(&w.lastOverflowLog, last, now) {
-							log.Warnf("nfq queue %d overflow - packets dropped", w.qnum)
-						}
-					}
-					return 0
-				}
+		if !shouldHandle {
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
+			}
+			return 0
+		}
 
-				return 0
+		metrics := metrics.GetMetricsCollector()
+		metrics.RecordConnection("UDP", host, srcStr, dstStr, matched)
+		metrics.RecordPacket(uint64(len(raw)))
+
+		switch set.UDP.Mode {
+		case "drop":
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
 			}
-			if errors.Is(e, os.ErrClosed) || errors.Is(e, net.ErrClosed) || errors.Is(e, syscall.EBADF) {
+			return 0
+
+		case "fake":
+			if !w.injectReady() {
+				w.passUnmodified(q, id, nil, dst)
 				return 0
 			}
-			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+
+			if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+				log.Tracef("failed to set drop verdict on UDP packet %d: %v", id, err)
 				return 0
 			}
-			msg := e.Error()
-			if strings.Contains(msg, "use of closed file") || strings.Contains(msg, "file descriptor") {
-				return 0
+
+			w.inject(injectQUIC, withAutoTTL(set, dst), 0, raw)
+			return 0
+
+		default:
+			if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+				log.Tracef("failed to set verdict on packet %d: %v", id, err)
 			}
-			log.Errorf("nfq: %v", e)
 			return 0
-		})
-	}()
+		}
+	}
 
-	return nil
+	if err := q.SetVerdict(id, nfqueue.NfAccept); err != nil {
+		log.Tracef("failed to set verdict on packet %d: %v", id, err)
+	}
+	return 0
 }
 
 func (w *Worker) dropAndInjectQUIC(cfg *config.SetConfig, raw []byte, dst net.IP) {
@@ -589,6 +671,11 @@ func (w *Worker) dropAndInjectTCP(cfg *config.SetConfig, raw []byte, dst net.IP)
 		return
 	}
 
+	if len(cfg.PipelineSteps) > 0 {
+		w.runPipeline(cfg, raw, dst)
+		return
+	}
+
 	if cfg.Faking.SNIMutation.Mode != config.ConfigOff {
 		raw = w.MutateClientHello(cfg, raw, dst)
 	}
@@ -638,6 +725,9 @@ func (w *Worker) dropAndInjectTCP(cfg *config.SetConfig, raw []byte, dst net.IP)
 }
 
 func (w *Worker) sendTCPFragments(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, false) {
+		return
+	}
 
 	seg2d := cfg.TCP.Seg2Delay
 	ipHdrLen := int((packet[0] & 0x0F) * 4)
@@ -876,6 +966,19 @@ func (w *Worker) sendFakeSNISequence(cfg *config.SetConfig, original []byte, dst
 	}
 }
 
+// isTLSPort reports whether TCP traffic on port is processed: 443 or any set's TCP port filter.
+func isTLSPort(matcher *sni.SuffixSet, port uint16) bool {
+	return port == HTTPSPort || matcher.MatchTCPPort(port)
+}
+
+// tcpPortAllowed reports whether set applies to TCP traffic on port.
+func tcpPortAllowed(matcher *sni.SuffixSet, port uint16, set *config.SetConfig) bool {
+	if port == HTTPPort && set.HTTP.Enabled {
+		return true
+	}
+	return port == HTTPSPort || matcher.TCPPortMatchesSet(port, set)
+}
+
 func (w *Worker) getMacByIp(ip string) string {
 
 	if ipToMac := w.ipToMac.Load(); ipToMac != nil {
@@ -888,8 +991,8 @@ func (w *Worker) Stop() {
 	if w.cancel != nil {
 		w.cancel()
 	}
-	if w.q != nil {
-		_ = w.q.Close()
+	if queue, ok := w.q.(*nfqueue.Nfqueue); ok {
+		_ = queue.Close()
 	}
 	done := make(chan struct{})
 	go func() { w.wg.Wait(); close(done) }()
@@ -902,23 +1005,42 @@ func (w *Worker) Stop() {
 	}
 }
 
+// cleanupTrackers expires the state shared by all workers, every tracker
+// keeping per-flow or per-server state belongs here.
+func cleanupTrackers(cfg *config.Config) {
+	connState.Cleanup()
+	hops.Cleanup()
+	strategies.Cleanup(cfg)
+	forged.Cleanup()
+	dnsForgeries.Cleanup()
+	clamped.Cleanup()
+	dns.DnsNATCleanup()
+}
+
 func (w *Worker) gc(cfg *config.Config) {
 	defer w.wg.Done()
 	t := time.NewTicker(30 * time.Second)
 	defer t.Stop()
+	stats := time.NewTicker(time.Second)
+	defer stats.Stop()
+	workerID := int(w.qnum - uint16(cfg.Queue.StartNum))
 	for {
 		select {
 		case <-w.ctx.Done():
 			return
 		case <-t.C:
-			connState.Cleanup()
+			cleanupTrackers(w.getConfig())
 
 			if cfg.System.WebServer.IsEnabled {
 				mtcs := metrics.GetMetricsCollector()
-				workerID := int(w.qnum - uint16(cfg.Queue.StartNum))
 				processed := atomic.LoadUint64(&w.packetsProcessed)
 				mtcs.UpdateSingleWorker(workerID, "active", processed)
 			}
+		case <-stats.C:
+			if cfg.System.WebServer.IsEnabled {
+				depth, capacity, fallbacks := w.InjectQueue()
+				metrics.GetMetricsCollector().UpdateWorkerQueue(workerID, depth, capacity, fallbacks)
+			}
 		}
 	}
 }
@@ -73,6 +73,11 @@ func (w *Worker) dropAndInjectTCPv6(cfg *config.SetConfig, raw []byte, dst net.I
 		return
 	}
 
+	if len(cfg.PipelineSteps) > 0 {
+		w.runPipeline(cfg, raw, dst)
+		return
+	}
+
 	if cfg.Faking.SNIMutation.Mode != config.ConfigOff {
 		raw = w.MutateClientHelloV6(cfg, raw, dst)
 	}
@@ -122,6 +127,10 @@ func (w *Worker) dropAndInjectTCPv6(cfg *config.SetConfig, raw []byte, dst net.I
 }
 
 func (w *Worker) sendTCPSegmentsv6(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, false) {
+		return
+	}
+
 	ipv6HdrLen := 40
 	tcpHdrLen := int((packet[ipv6HdrLen+12] >> 4) * 4)
 	seg2d := cfg.TCP.Seg2Delay
@@ -0,0 +1,45 @@
+package nfq
+
+import (
+	"github.com/daniellavrushin/b4/config"
+	"github.com/florianl/go-nfqueue"
+)
+
+// Applied is a strategy run on a matched packet, reported by offline
+// workers.
+type Applied struct {
+	Kind   string            // "syn", "tcp", "http" or "quic"
+	Set    *config.SetConfig // as run, after auto TTL and fallback levels
+	Level  int               // fallback level Set was built from, 0 for the set's own strategy
+	Packet []byte
+}
+
+// NewOfflineWorker returns a worker fed by Handle instead of a netfilter
+// queue, for replaying captured traffic. Verdicts go to q and crafted
+// packets to sender. Strategies run inside Handle, so all a packet caused
+// has been recorded when it returns; applied, if set, is told about each
+// strategy run.
+func NewOfflineWorker(cfg *config.Config, q Verdicts, sender PacketSender, applied func(Applied)) *Worker {
+	w := NewWorkerWithQueue(cfg, uint16(cfg.Queue.StartNum))
+	w.matcher.Store(buildMatcher(cfg))
+	w.ipToMac.Store(make(map[string]string))
+	w.q = q
+	w.sock = sender
+	w.mark = uint32(cfg.Queue.Mark)
+	w.hellos = newHelloReassembler(w.sendRaw)
+	w.inline = true
+	w.applied = applied
+	return w
+}
+
+// Handle runs the queue callback on packet as if the queue delivered it
+// with id.
+func (w *Worker) Handle(id uint32, packet []byte) {
+	w.handle(nfqueue.Attribute{PacketID: &id, Payload: &packet})
+}
+
+func (w *Worker) report(kind string, set *config.SetConfig, level int, pkt []byte) {
+	if w.applied != nil {
+		w.applied(Applied{Kind: kind, Set: set, Level: level, Packet: pkt})
+	}
+}
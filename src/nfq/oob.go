@@ -11,6 +11,10 @@ import (
 )
 
 func (w *Worker) sendOOBFragments(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, true) {
+		return
+	}
+
 	ipHdrLen := int((packet[0] & 0x0F) * 4)
 	if len(packet) < ipHdrLen+20 {
 		_ = w.sock.SendIPv4(packet, dst)
@@ -97,14 +101,7 @@ func (w *Worker) sendOOBFragments(cfg *config.SetConfig, packet []byte, dst net.
 	sock.FixTCPChecksum(fake)
 
 	// Optionally corrupt checksum based on faking strategy
-	switch cfg.Faking.Strategy {
-	case "tcp_check":
-		fake[ipHdrLen+16] ^= 0xFF
-		fake[ipHdrLen+17] ^= 0xFF
-	case "md5sum":
-		fake[ipHdrLen+16] ^= 0xFF
-		fake[10] ^= 0xFF
-	}
+	corruptOOBDecoy(cfg.Faking.Strategy, fake, ipHdrLen)
 
 	// ===== Segment 2: payload[oobPos:] - CLEAN =====
 	seg2DataLen := payloadLen - oobPos
@@ -155,6 +152,10 @@ func (w *Worker) sendOOBFragments(cfg *config.SetConfig, packet []byte, dst net.
 
 // sendOOBFragmentsV6 is the IPv6 version of OOB injection
 func (w *Worker) sendOOBFragmentsV6(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, true) {
+		return
+	}
+
 	const ipv6HdrLen = 40
 
 	if len(packet) < ipv6HdrLen+20 {
@@ -229,11 +230,7 @@ func (w *Worker) sendOOBFragmentsV6(cfg *config.SetConfig, packet []byte, dst ne
 	binary.BigEndian.PutUint16(fake[4:6], uint16(fakeLen-ipv6HdrLen))
 	sock.FixTCPChecksumV6(fake)
 
-	switch cfg.Faking.Strategy {
-	case "tcp_check", "md5sum":
-		fake[ipv6HdrLen+16] ^= 0xFF
-		fake[ipv6HdrLen+17] ^= 0xFF
-	}
+	corruptOOBDecoy(cfg.Faking.Strategy, fake, ipv6HdrLen)
 
 	// ===== Segment 2: payload[oobPos:] - CLEAN =====
 	seg2DataLen := payloadLen - oobPos
@@ -274,3 +271,21 @@ func (w *Worker) sendOOBFragmentsV6(cfg *config.SetConfig, packet []byte, dst ne
 
 	log.Tracef("OOB v6: Sent seg1=%d, fake=%d (hop=%d), seg2=%d bytes", seg1Len, fakeLen, fake[7], seg2Len)
 }
+
+// corruptOOBDecoy breaks the checksums of a decoy carrying the OOB byte as
+// the faking strategy asks. tcp is the TCP header offset, md5sum breaks the
+// IPv4 header checksum too.
+func corruptOOBDecoy(strategy string, decoy []byte, tcp int) {
+	switch strategy {
+	case "tcp_check":
+		decoy[tcp+16] ^= 0xFF
+		decoy[tcp+17] ^= 0xFF
+	case "md5sum":
+		decoy[tcp+16] ^= 0xFF
+		if decoy[0]>>4 == IPv4 {
+			decoy[10] ^= 0xFF
+		} else {
+			decoy[tcp+17] ^= 0xFF
+		}
+	}
+}
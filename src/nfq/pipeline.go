@@ -0,0 +1,241 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// generatedHellos caches ClientHellos built for fake(payload=generated), keyed by SNI.
+var generatedHellos sync.Map
+
+// pipelinePlan collects what the segmenting actions of a pipeline decided;
+// the real payload is emitted once all actions have run.
+type pipelinePlan struct {
+	splits   []int
+	oob      map[int]byte
+	disorder bool
+	gap      time.Duration
+}
+
+// runPipeline executes the set's strategy pipeline on a TCP packet. IPv4 and
+// IPv6 share the engine, only packet building and sending differ.
+func (w *Worker) runPipeline(cfg *config.SetConfig, raw []byte, dst net.IP) {
+	pi, ok := pipelinePacketInfo(raw)
+	if !ok || pi.PayloadLen == 0 {
+		w.sendRaw(raw, dst)
+		return
+	}
+
+	w.runPipelineSteps(cfg, cfg.PipelineSteps, raw, pi, &pipelinePlan{oob: make(map[int]byte)}, dst)
+}
+
+func pipelinePacketInfo(raw []byte) (PacketInfo, bool) {
+	if raw[0]>>4 == IPv6 {
+		return ExtractPacketInfoV6(raw)
+	}
+	return ExtractPacketInfoV4(raw)
+}
+
+// runPipelineSteps runs steps and emits the payload as planned. A delay
+// before the payload is split schedules the remaining steps rather than
+// holding up the injection worker, on a copy of raw as the job's buffer is
+// reused once it returns.
+func (w *Worker) runPipelineSteps(cfg *config.SetConfig, steps []config.PipelineStep, raw []byte, pi PacketInfo, plan *pipelinePlan, dst net.IP) {
+	for i, step := range steps {
+		switch step.Action {
+		case config.ActionFake:
+			w.pipelineFake(cfg, &step, raw, dst, pi.IsIPv6)
+
+		case config.ActionDesync:
+			desyncCfg := *cfg
+			desyncCfg.TCP.Desync.Mode = step.Mode
+			if pi.IsIPv6 {
+				w.ExecuteDesyncIPv6(&desyncCfg, raw, dst)
+			} else {
+				w.ExecuteDesyncIPv4(&desyncCfg, raw, dst)
+			}
+
+		case config.ActionSplit:
+			for _, at := range step.At {
+				if pos, ok := w.resolveSplitPosition(pi.Payload, at); ok {
+					plan.splits = append(plan.splits, pos)
+				}
+			}
+
+		case config.ActionOOB:
+			for _, at := range step.At {
+				if pos, ok := w.resolveSplitPosition(pi.Payload, at); ok {
+					plan.splits = append(plan.splits, pos)
+					plan.oob[pos] = step.Char
+				}
+			}
+
+		case config.ActionDisorder:
+			plan.disorder = true
+
+		case config.ActionDelay:
+			if len(plan.splits) > 0 {
+				plan.gap = step.Delay
+				continue
+			}
+			pkt := append([]byte(nil), raw...)
+			rest := steps[i+1:]
+			w.after(step.Delay, func() {
+				pi, _ := pipelinePacketInfo(pkt)
+				w.runPipelineSteps(cfg, rest, pkt, pi, plan, dst)
+			})
+			return
+		}
+	}
+
+	w.emitPipelineSegments(cfg, raw, pi, plan, dst)
+}
+
+func (w *Worker) emitPipelineSegments(cfg *config.SetConfig, raw []byte, pi PacketInfo, plan *pipelinePlan, dst net.IP) {
+	splits := uniqueSorted(plan.splits, pi.PayloadLen)
+	bounds := append(append([]int{0}, splits...), pi.PayloadLen)
+
+	type pipeSegment struct {
+		decoy []byte // OOB decoy sent right before data
+		data  []byte
+	}
+	segments := make([]pipeSegment, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		var seg pipeSegment
+		if pi.IsIPv6 {
+			seg.data = BuildSegmentV6(raw, pi, pi.Payload[start:end], uint32(start))
+		} else {
+			seg.data = BuildSegmentV4(raw, pi, pi.Payload[start:end], uint32(start), uint16(i))
+		}
+		if char, ok := plan.oob[start]; ok {
+			seg.decoy = buildOOBDecoy(cfg, raw, pi, start, char)
+		}
+		segments = append(segments, seg)
+	}
+
+	if plan.disorder {
+		for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+			segments[i], segments[j] = segments[j], segments[i]
+		}
+	}
+
+	// segments only hold their own buffers, so the ones after a gap are
+	// sent from a timer instead of the injection worker
+	var send func(i int)
+	send = func(i int) {
+		for ; i < len(segments); i++ {
+			if segments[i].decoy != nil {
+				w.sendRaw(segments[i].decoy, dst)
+			}
+			w.sendRaw(segments[i].data, dst)
+			if plan.gap > 0 && i+1 < len(segments) {
+				next := i + 1
+				w.after(plan.gap, func() { send(next) })
+				return
+			}
+		}
+	}
+	send(0)
+
+	log.Tracef("Pipeline: sent %d segments (splits=%v, disorder=%v)", len(segments), splits, plan.disorder)
+}
+
+// pipelineFake sends decoy packets built by the regular fake builders from a
+// copy of the set's faking config overridden by the step arguments.
+func (w *Worker) pipelineFake(cfg *config.SetConfig, step *config.PipelineStep, raw []byte, dst net.IP, isV6 bool) {
+	fakeCfg := *cfg
+	fk := &fakeCfg.Faking
+
+	if step.TTL > 0 {
+		fk.TTL = step.TTL
+		if step.Strategy == "" {
+			fk.Strategy = "ttl"
+		}
+	}
+	if step.Strategy != "" {
+		fk.Strategy = step.Strategy
+	}
+
+	switch step.Payload {
+	case "default1":
+		fk.SNIType = config.FakePayloadDefault1
+	case "default2":
+		fk.SNIType = config.FakePayloadDefault2
+	case "random":
+		fk.SNIType = config.FakePayloadRandom
+	case "generated":
+		hello, ok := generatedHello(step.SNI)
+		if !ok {
+			return
+		}
+		fk.SNIType = config.FakePayloadCustom
+		fk.CustomPayload = string(hello)
+	}
+
+	var fake []byte
+	if isV6 {
+		fake = sock.BuildFakeSNIPacketV6(raw, &fakeCfg)
+	} else {
+		fake = sock.BuildFakeSNIPacketV4(raw, &fakeCfg)
+	}
+	if fake == nil {
+		return
+	}
+
+	for i := 0; i < step.Count; i++ {
+		w.sendRaw(fake, dst)
+	}
+}
+
+func generatedHello(host string) ([]byte, bool) {
+	if host == "" {
+		host = defaultFakeHTTPHost
+	}
+	if cached, ok := generatedHellos.Load(host); ok {
+		return cached.([]byte), true
+	}
+	hello, err := capture.GenerateTLSClientHello(host)
+	if err != nil {
+		log.Tracef("Pipeline: failed to generate fake ClientHello for %s: %v", host, err)
+		return nil, false
+	}
+	generatedHellos.Store(host, hello)
+	return hello, true
+}
+
+// buildOOBDecoy builds a one-byte urgent segment at pos that expires before
+// reaching the server, its checksums broken as the faking strategy asks.
+func buildOOBDecoy(cfg *config.SetConfig, raw []byte, pi PacketInfo, pos int, char byte) []byte {
+	ttl := cfg.Faking.TTL
+	if ttl == 0 {
+		ttl = 3
+	}
+
+	tcp := pi.IPHdrLen
+	if pi.IsIPv6 {
+		decoy := BuildSegmentV6(raw, pi, []byte{char}, uint32(pos))
+		decoy[7] = ttl
+		decoy[tcp+13] |= 0x20
+		binary.BigEndian.PutUint16(decoy[tcp+18:tcp+20], 1)
+		sock.FixTCPChecksumV6(decoy)
+		corruptOOBDecoy(cfg.Faking.Strategy, decoy, tcp)
+		return decoy
+	}
+
+	decoy := BuildSegmentV4(raw, pi, []byte{char}, uint32(pos), 0)
+	decoy[8] = ttl
+	decoy[tcp+13] |= 0x20
+	binary.BigEndian.PutUint16(decoy[tcp+18:tcp+20], 1)
+	sock.FixIPv4Checksum(decoy[:tcp])
+	sock.FixTCPChecksum(decoy)
+	corruptOOBDecoy(cfg.Faking.Strategy, decoy, tcp)
+	return decoy
+}
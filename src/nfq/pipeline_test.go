@@ -0,0 +1,131 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeline_Segments(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	s := bytes.Index(hello, []byte("www.example.com"))
+
+	tests := []struct {
+		name     string
+		src, dst net.IP
+	}{
+		{"ipv4", testClient, testServer},
+		{"ipv6", testClient6, testServer6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, set := testConfig("example.com")
+			set.Pipeline = "fake; split(at=sni+1); disorder; oob(pos=2)"
+			set.Faking.Strategy = "ttl"
+			set.Faking.TTL = 5
+			w, _, sent := newTestWorker(t, cfg)
+
+			pkt := tcpPacket{src: tt.src, dst: tt.dst, sport: 40000, dport: 443, seq: 1000, ack: 5000, window: 502, payload: hello}.build()
+			w.runPipeline(cfg.Sets[0], pkt, tt.dst)
+
+			type segment struct {
+				offset int
+				ttl    uint8
+				urgent bool
+				data   []byte
+			}
+			want := []segment{
+				{offset: s + 1, ttl: 64, data: hello[s+1:]},
+				{offset: 2, ttl: 5, urgent: true, data: []byte("x")},
+				{offset: 2, ttl: 64, data: hello[2 : s+1]},
+				{offset: 0, ttl: 64, data: hello[:2]},
+			}
+
+			got := sent.all()
+			if len(got) != 1+len(want) {
+				t.Fatalf("sent %d packets, want a fake and %d segments", len(got), len(want))
+			}
+			if ttl := packetTTL(got[0]); ttl != 5 {
+				t.Errorf("fake ttl = %d, want 5", ttl)
+			}
+
+			for i, seg := range want {
+				pkt := got[i+1]
+				pi, ok := pipelinePacketInfo(pkt)
+				if !ok {
+					t.Fatalf("segment %d is not a TCP packet", i)
+				}
+				tcp := pkt[pi.IPHdrLen:]
+				if off := int(binary.BigEndian.Uint32(tcp[4:8]) - 1000); off != seg.offset {
+					t.Errorf("segment %d at offset %d, want %d", i, off, seg.offset)
+				}
+				if ttl := packetTTL(pkt); ttl != seg.ttl {
+					t.Errorf("segment %d ttl = %d, want %d", i, ttl, seg.ttl)
+				}
+				if urgent := tcp[13]&0x20 != 0; urgent != seg.urgent {
+					t.Errorf("segment %d urgent = %v, want %v", i, urgent, seg.urgent)
+				}
+				if !bytes.Equal(pi.Payload, seg.data) {
+					t.Errorf("segment %d carries %q, want %q", i, pi.Payload, seg.data)
+				}
+				if !checksumsValid(pkt) {
+					t.Errorf("segment %d has broken checksums", i)
+				}
+			}
+		})
+	}
+}
+
+// Delays run from timers on the live queue: the worker returns right away
+// and the packet buffer it was given may be reused.
+func TestPipeline_DelayDoesNotBlock(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+
+	tests := []struct {
+		name     string
+		pipeline string
+		now      int // packets sent before runPipeline returns
+		total    int
+	}{
+		{"before split", "fake; delay(100ms); split(at=2)", 1, 3},
+		{"between segments", "split(at=2,at=4); delay(50ms)", 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, set := testConfig("example.com")
+			set.Pipeline = tt.pipeline
+			w, _, sent := newTestWorker(t, cfg)
+			w.inline = false
+			defer w.cancel()
+
+			pkt := tcpPacket{src: testClient, dst: testServer, sport: 40000, dport: 443, seq: 1000, ack: 5000, window: 502, payload: hello}.build()
+			start := time.Now()
+			w.runPipeline(cfg.Sets[0], pkt, testServer)
+			if d := time.Since(start); d > 40*time.Millisecond {
+				t.Errorf("runPipeline blocked for %v", d)
+			}
+			if n := len(sent.all()); n != tt.now {
+				t.Errorf("%d packets sent before returning, want %d", n, tt.now)
+			}
+			clear(pkt)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for len(sent.all()) < tt.total && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			got := sent.all()
+			if len(got) != tt.total {
+				t.Fatalf("sent %d packets, want %d", len(got), tt.total)
+			}
+			last := got[len(got)-1]
+			pi, ok := pipelinePacketInfo(last)
+			if !ok || len(pi.Payload) == 0 || !bytes.HasSuffix(hello, pi.Payload) {
+				t.Error("delayed segment was built from the reused buffer")
+			}
+		})
+	}
+}
@@ -33,6 +33,7 @@ func NewPool(cfg *config.Config) *Pool {
 	}
 
 	matcher := buildMatcher(cfg)
+	strategies.load(cfg.ConfigPath)
 
 	dhcpMgr := dhcp.NewManager()
 
@@ -65,7 +66,7 @@ func NewPool(cfg *config.Config) *Pool {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 		for range ticker.C {
-			connState.Cleanup()
+			cleanupTrackers(ws[0].getConfig())
 		}
 	}()
 
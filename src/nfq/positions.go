@@ -0,0 +1,143 @@
+package nfq
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// resolveSplitPosition turns a position expression into a payload offset.
+func (w *Worker) resolveSplitPosition(payload []byte, at config.SplitPosition) (int, bool) {
+	pos := at.Offset
+	switch at.Marker {
+	case "":
+		if pos < 0 {
+			pos += len(payload)
+		}
+
+	case "extensions":
+		if clientHelloRecordLen(payload) == 0 {
+			return 0, false
+		}
+		ext := w.findExtensionsOffset(payload)
+		if ext < 0 {
+			return 0, false
+		}
+		pos += ext
+
+	default:
+		start, end, ok := locateHostname(payload)
+		if !ok {
+			return 0, false
+		}
+		switch at.Marker {
+		case "sld", "midsld", "endsld":
+			start, end = secondLevelLabel(payload, start, end)
+		}
+		switch at.Marker {
+		case "sni", "host", "sld":
+			pos += start
+		case "midsni", "midhost", "midsld":
+			pos += start + (end-start)/2
+		case "endsni", "endhost", "endsld":
+			pos += end
+		}
+	}
+
+	if pos <= 0 || pos >= len(payload) {
+		return 0, false
+	}
+	return pos, true
+}
+
+// resolveSplitPositions resolves every position that applies to the payload
+// and returns the distinct offsets in ascending order.
+func (w *Worker) resolveSplitPositions(payload []byte, positions []config.SplitPosition) []int {
+	splits := make([]int, 0, len(positions))
+	for _, at := range positions {
+		if pos, ok := w.resolveSplitPosition(payload, at); ok {
+			splits = append(splits, pos)
+		}
+	}
+	return uniqueSorted(splits, len(payload))
+}
+
+// ResolveSplitPositions is resolveSplitPositions for data planes without a
+// worker, the positions only depend on the payload.
+func ResolveSplitPositions(payload []byte, positions []config.SplitPosition) []int {
+	return (*Worker)(nil).resolveSplitPositions(payload, positions)
+}
+
+// locateHostname spans the SNI of a TLS ClientHello or the Host value of a
+// plain HTTP request.
+func locateHostname(payload []byte) (start, end int, ok bool) {
+	if start, end, ok = locateSNI(payload); ok {
+		return start, end, true
+	}
+	if _, start, end, ok = sni.LocateHTTPHost(payload); !ok {
+		return 0, 0, false
+	}
+	// drop the port of an HTTP Host
+	if i := bytes.LastIndexByte(payload[start:end], ':'); i > 0 && !bytes.Contains(payload[start:end], []byte("]")) {
+		end = start + i
+	}
+	return start, end, true
+}
+
+// secondLevelLabel narrows a hostname span to the label before the last dot,
+// "example" in "www.example.com". A single-label name is returned as is.
+func secondLevelLabel(payload []byte, start, end int) (int, int) {
+	name := bytes.TrimSuffix(payload[start:end], []byte("."))
+	last := bytes.LastIndexByte(name, '.')
+	if last < 0 {
+		return start, start + len(name)
+	}
+	first := bytes.LastIndexByte(name[:last], '.') + 1
+	return start + first, start + last
+}
+
+// sendAtSplitPositions splits the payload at the set's split positions,
+// honoring reverse order and the segment delay, with an OOB decoy before the
+// first split when oob is set. It returns false when no position applies to
+// the payload, leaving the strategy to use its own split points.
+func (w *Worker) sendAtSplitPositions(cfg *config.SetConfig, packet []byte, dst net.IP, oob bool) bool {
+	if len(cfg.Fragmentation.SplitPoints) == 0 {
+		return false
+	}
+
+	var pi PacketInfo
+	var ok bool
+	if packet[0]>>4 == IPv6 {
+		pi, ok = ExtractPacketInfoV6(packet)
+	} else {
+		pi, ok = ExtractPacketInfoV4(packet)
+	}
+	if !ok || pi.PayloadLen == 0 {
+		return false
+	}
+
+	splits := w.resolveSplitPositions(pi.Payload, cfg.Fragmentation.SplitPoints)
+	if len(splits) == 0 {
+		return false
+	}
+
+	plan := pipelinePlan{
+		splits:   splits,
+		oob:      make(map[int]byte),
+		disorder: cfg.Fragmentation.ReverseOrder,
+		gap:      time.Duration(cfg.TCP.Seg2Delay) * time.Millisecond,
+	}
+	if oob {
+		char := cfg.Fragmentation.OOBChar
+		if char == 0 {
+			char = 'x'
+		}
+		plan.oob[splits[0]] = char
+	}
+
+	w.emitPipelineSegments(cfg, packet, pi, &plan, dst)
+	return true
+}
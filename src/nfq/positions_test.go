@@ -0,0 +1,179 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// extensionsOffset walks a ClientHello to its extensions length field.
+func extensionsOffset(hello []byte) int {
+	pos := 43
+	pos += 1 + int(hello[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(hello[pos:]))
+	pos += 1 + int(hello[pos])
+	return pos
+}
+
+func parsePositions(t *testing.T, exprs ...string) []config.SplitPosition {
+	t.Helper()
+	positions, err := config.ParseSplitPositions(exprs)
+	if err != nil {
+		t.Fatalf("invalid positions %v: %v", exprs, err)
+	}
+	return positions
+}
+
+func TestResolveSplitPositions_ClientHello(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	s := bytes.Index(hello, []byte("www.example.com"))
+	if s < 0 {
+		t.Fatal("SNI not found in the ClientHello")
+	}
+	e := s + len("www.example.com")
+	sld := s + len("www.")
+	ext := extensionsOffset(hello)
+
+	tests := []struct {
+		expr string
+		want []int
+	}{
+		{"sni", []int{s}},
+		{"sni+2", []int{s + 2}},
+		{"sni-3", []int{s - 3}},
+		{"midsni", []int{s + 7}},
+		{"endsni", []int{e}},
+		{"endsni-1", []int{e - 1}},
+		{"sld", []int{sld}},
+		{"midsld", []int{sld + 3}},
+		{"endsld", []int{sld + len("example")}},
+		{"extensions", []int{ext}},
+		{"extensions+4", []int{ext + 4}},
+		{"host", []int{s}},
+		{"midhost", []int{s + 7}},
+		{"endhost", []int{e}},
+		{"1", []int{1}},
+		{"-10", []int{len(hello) - 10}},
+		{"100000", nil},
+		{"sni-100000", nil},
+		{"endsni+100000", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := ResolveSplitPositions(hello, parsePositions(t, tt.expr))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s resolved to %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSplitPositions_HTTP(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: www.example.com:8080\r\nUser-Agent: test\r\n\r\n")
+	s := bytes.Index(req, []byte("www.example.com"))
+	e := s + len("www.example.com")
+
+	tests := []struct {
+		expr string
+		want []int
+	}{
+		{"host", []int{s}},
+		{"host+1", []int{s + 1}},
+		{"midhost", []int{s + 7}},
+		{"endhost", []int{e}},
+		{"sni", []int{s}},
+		{"sld", []int{s + 4}},
+		{"endsld", []int{s + 11}},
+		{"-2", []int{len(req) - 2}},
+		{"extensions", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := ResolveSplitPositions(req, parsePositions(t, tt.expr))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s resolved to %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSplitPositions_UniqueSorted(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	s := bytes.Index(hello, []byte("www.example.com"))
+
+	got := ResolveSplitPositions(hello, parsePositions(t, "endsni", "sni", "host", "sni+0", "100000", "sni-100000", "1"))
+	want := []int{1, s, s + len("www.example.com")}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolved to %v, want %v", got, want)
+	}
+}
+
+func TestResolveSplitPositions_NotAHello(t *testing.T) {
+	if got := ResolveSplitPositions([]byte("garbage payload"), parsePositions(t, "sni", "midsld", "extensions")); len(got) != 0 {
+		t.Errorf("landmarks resolved on a payload without any: %v", got)
+	}
+}
+
+// dataOffsets returns the payload offsets of the real data segments among
+// sent, skipping fakes and OOB decoys, and the number of decoys.
+func dataOffsets(sent [][]byte, seq0 uint32) (offsets []int, decoys int) {
+	for _, pkt := range sent {
+		ihl := int(pkt[0]&0x0f) * 4
+		tcp := pkt[ihl:]
+		if tcp[13]&0x20 != 0 {
+			decoys++
+			continue
+		}
+		if pkt[8] != 64 || len(tcp) <= int(tcp[12]>>4)*4 {
+			continue
+		}
+		offsets = append(offsets, int(binary.BigEndian.Uint32(tcp[4:8])-seq0))
+	}
+	sort.Ints(offsets)
+	return offsets, decoys
+}
+
+func TestSplitPositions_Strategies(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	s := bytes.Index(hello, []byte("www.example.com"))
+	want := []int{0, s + 1, s + len("www.") + 3}
+
+	tests := []struct {
+		strategy string
+		send     func(w *Worker, cfg *config.SetConfig, pkt []byte)
+		decoys   int
+	}{
+		{"tcp", func(w *Worker, cfg *config.SetConfig, pkt []byte) { w.sendTCPFragments(cfg, pkt, testServer) }, 0},
+		{"tls", func(w *Worker, cfg *config.SetConfig, pkt []byte) { w.sendTLSFragments(cfg, pkt, testServer) }, 0},
+		{"oob", func(w *Worker, cfg *config.SetConfig, pkt []byte) { w.sendOOBFragments(cfg, pkt, testServer) }, 1},
+		{"disorder", func(w *Worker, cfg *config.SetConfig, pkt []byte) { w.sendDisorderFragments(cfg, pkt, testServer) }, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			cfg, set := testConfig("example.com")
+			set.Fragmentation.Strategy = tt.strategy
+			set.Fragmentation.SplitPositions = []string{"midsld", "sni+1", "sni+1"}
+			set.Faking.SNI = false
+			set.TCP.Seg2Delay = 0
+			w, _, sent := newTestWorker(t, cfg)
+
+			pkt := tcpPacket{src: testClient, dst: testServer, sport: 40000, dport: 443, seq: 1000, ack: 5000, window: 502, payload: hello}.build()
+			tt.send(w, cfg.Sets[0], pkt)
+
+			offsets, decoys := dataOffsets(sent.all(), 1000)
+			if !slices.Equal(offsets, want) {
+				t.Errorf("segments start at %v, want %v", offsets, want)
+			}
+			if decoys != tt.decoys {
+				t.Errorf("%d OOB decoys, want %d", decoys, tt.decoys)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+)
+
+// maxHelloSize caps how much of a ClientHello record is buffered (one full TLS record).
+const maxHelloSize = 5 + 16384
+
+type helloState int
+
+const (
+	helloPass     helloState = iota // not buffered, process the packet as is
+	helloHeld                       // packet is held, drop it
+	helloComplete                   // ClientHello is complete, process the reassembled packet
+)
+
+type helloBuffer struct {
+	header  []byte   // IP+TCP header of the first segment
+	tcpOff  int      // offset of the TCP header within header
+	payload []byte   // in-order payload collected so far
+	packets [][]byte // original segments, replayed on timeout or gap
+	need    int      // full TLS record length
+	nextSeq uint32
+	dst     net.IP
+	timer   *time.Timer
+}
+
+// helloReassembler holds the first segments of a flow until the whole
+// ClientHello record is available, so a hello larger than one MSS can still
+// be matched and split.
+type helloReassembler struct {
+	mu    sync.Mutex
+	flows map[flowKey]*helloBuffer
+	send  func(pkt []byte, dst net.IP)
+}
+
+func newHelloReassembler(send func(pkt []byte, dst net.IP)) *helloReassembler {
+	return &helloReassembler{
+		flows: make(map[flowKey]*helloBuffer),
+		send:  send,
+	}
+}
+
+// add feeds a TCP data segment of a flow. On helloComplete it returns the
+// reassembled packet together with the original segments it replaces.
+func (r *helloReassembler) add(key flowKey, raw []byte, ihl, payloadStart int, dst net.IP, timeout time.Duration) (helloState, []byte, [][]byte) {
+	payload := raw[payloadStart:]
+	seq := binary.BigEndian.Uint32(raw[ihl+4 : ihl+8])
+
+	r.mu.Lock()
+	buf, ok := r.flows[key]
+	if !ok {
+		defer r.mu.Unlock()
+		if timeout <= 0 {
+			return helloPass, nil, nil
+		}
+		need := clientHelloRecordLen(payload)
+		if need <= len(payload) || need > maxHelloSize {
+			return helloPass, nil, nil
+		}
+		if _, ok := sni.ParseTLSClientHelloSNI(payload); ok {
+			return helloPass, nil, nil
+		}
+
+		buf = &helloBuffer{
+			header:  append([]byte(nil), raw[:payloadStart]...),
+			tcpOff:  ihl,
+			payload: append(make([]byte, 0, need), payload...),
+			packets: [][]byte{append([]byte(nil), raw...)},
+			need:    need,
+			nextSeq: seq + uint32(len(payload)),
+			dst:     append(net.IP(nil), dst...),
+		}
+		buf.timer = time.AfterFunc(timeout, func() { r.expire(key, buf) })
+		r.flows[key] = buf
+		log.Tracef("ClientHello of %d bytes split across segments, buffering %s", need, key)
+		return helloHeld, nil, nil
+	}
+
+	switch {
+	case seq == buf.nextSeq:
+		buf.payload = append(buf.payload, payload...)
+		buf.packets = append(buf.packets, append([]byte(nil), raw...))
+		buf.nextSeq += uint32(len(payload))
+		if len(buf.payload) < buf.need {
+			r.mu.Unlock()
+			return helloHeld, nil, nil
+		}
+		r.remove(key, buf)
+		r.mu.Unlock()
+		log.Tracef("ClientHello reassembled from %d segments for %s", len(buf.packets), key)
+		return helloComplete, buf.build(raw[ihl+13]), buf.packets
+
+	case int32(seq-buf.nextSeq) < 0:
+		// retransmission of data already held
+		r.mu.Unlock()
+		return helloHeld, nil, nil
+
+	default:
+		// gap in the stream, give up and let the original segments through
+		r.remove(key, buf)
+		r.mu.Unlock()
+		log.Tracef("ClientHello reassembly gap for %s, passing %d segments through", key, len(buf.packets))
+		r.flush(buf)
+		return helloPass, nil, nil
+	}
+}
+
+func (r *helloReassembler) expire(key flowKey, buf *helloBuffer) {
+	r.mu.Lock()
+	if r.flows[key] != buf {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.flows, key)
+	r.mu.Unlock()
+
+	log.Tracef("ClientHello reassembly timed out for %s, passing %d segments through", key, len(buf.packets))
+	r.flush(buf)
+}
+
+// remove must be called with r.mu held.
+func (r *helloReassembler) remove(key flowKey, buf *helloBuffer) {
+	buf.timer.Stop()
+	delete(r.flows, key)
+}
+
+func (r *helloReassembler) flush(buf *helloBuffer) {
+	for _, pkt := range buf.packets {
+		r.send(pkt, buf.dst)
+	}
+}
+
+// build assembles one packet from the first segment's header and the full
+// payload, taking the TCP flags of the last segment.
+func (b *helloBuffer) build(lastFlags byte) []byte {
+	hdrLen := len(b.header)
+	pkt := make([]byte, hdrLen+len(b.payload))
+	copy(pkt, b.header)
+	copy(pkt[hdrLen:], b.payload)
+
+	pkt[b.tcpOff+13] = lastFlags
+
+	if pkt[0]>>4 == IPv4 {
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		sock.FixIPv4Checksum(pkt[:b.tcpOff])
+		sock.FixTCPChecksum(pkt)
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-IPv6HeaderLen))
+		sock.FixTCPChecksumV6(pkt)
+	}
+	return pkt
+}
+
+// clientHelloRecordLen returns the full length of the TLS handshake record
+// carrying a ClientHello at the start of payload, or 0 if there is none.
+func clientHelloRecordLen(payload []byte) int {
+	if len(payload) < 6 || payload[0] != TLSHandshakeType || payload[1] != 0x03 || payload[5] != TLSClientHello {
+		return 0
+	}
+	return 5 + int(binary.BigEndian.Uint16(payload[3:5]))
+}
+
+func (w *Worker) sendRaw(pkt []byte, dst net.IP) {
+	if pkt[0]>>4 == IPv4 {
+		_ = w.sock.SendIPv4(pkt, dst)
+	} else {
+		_ = w.sock.SendIPv6(pkt, dst)
+	}
+}
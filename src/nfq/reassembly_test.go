@@ -0,0 +1,152 @@
+package nfq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingReassembler returns a reassembler whose flushed segments are
+// collected.
+func recordingReassembler() (*helloReassembler, func() [][]byte) {
+	var mu sync.Mutex
+	var sent [][]byte
+	r := newHelloReassembler(func(pkt []byte, _ net.IP) {
+		mu.Lock()
+		sent = append(sent, pkt)
+		mu.Unlock()
+	})
+	return r, func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), sent...)
+	}
+}
+
+// helloSegment is the part [from, to) of payload sent by the client at seq
+// 1000+from.
+func helloSegment(client, server net.IP, payload []byte, from, to int, flags byte) []byte {
+	return tcpPacket{
+		src: client, dst: server, sport: 40000, dport: 443,
+		seq: 1000 + uint32(from), ack: 5000, flags: flags, window: 502,
+		payload: payload[from:to],
+	}.build()
+}
+
+func feed(r *helloReassembler, pkt []byte, timeout time.Duration) (helloState, []byte, [][]byte) {
+	ihl := IPv6HeaderLen
+	if pkt[0]>>4 == IPv4 {
+		ihl = int(pkt[0]&0x0f) * 4
+	}
+	src, dst := net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	if ihl == IPv6HeaderLen {
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	}
+	key := newFlowKey(src, binary.BigEndian.Uint16(pkt[ihl:]), dst, binary.BigEndian.Uint16(pkt[ihl+2:]))
+	return r.add(key, pkt, ihl, ihl+int(pkt[ihl+12]>>4)*4, dst, timeout)
+}
+
+func TestHelloReassembler(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	n := len(hello)
+
+	type step struct {
+		from, to int
+		want     helloState
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		flushed int // segments passed through on a gap
+		held    int // segments the reassembled packet replaces
+	}{
+		{"two segments", []step{{0, 50, helloHeld}, {50, n, helloComplete}}, 0, 2},
+		{"three segments", []step{{0, 20, helloHeld}, {20, 60, helloHeld}, {60, n, helloComplete}}, 0, 3},
+		{"retransmission", []step{{0, 50, helloHeld}, {0, 50, helloHeld}, {50, n, helloComplete}}, 0, 2},
+		{"gap", []step{{0, 50, helloHeld}, {60, n, helloPass}}, 1, 0},
+		{"whole hello", []step{{0, n, helloPass}}, 0, 0},
+		{"not tls", []step{{5, 60, helloPass}}, 0, 0},
+	}
+
+	for _, family := range []struct {
+		name           string
+		client, server net.IP
+	}{{"ipv4", testClient, testServer}, {"ipv6", testClient6, testServer6}} {
+		for _, tt := range tests {
+			t.Run(family.name+" "+tt.name, func(t *testing.T) {
+				r, sent := recordingReassembler()
+				var full []byte
+				var held [][]byte
+				for i, s := range tt.steps {
+					flags := byte(0x10)
+					if s.to == n {
+						flags = 0x18
+					}
+					state, pkt, segs := feed(r, helloSegment(family.client, family.server, hello, s.from, s.to, flags), time.Minute)
+					if state != s.want {
+						t.Fatalf("step %d: state %d, want %d", i, state, s.want)
+					}
+					if state == helloComplete {
+						full, held = pkt, segs
+					}
+				}
+
+				if got := len(sent()); got != tt.flushed {
+					t.Errorf("%d segments passed through, want %d", got, tt.flushed)
+				}
+				if len(r.flows) != 0 {
+					t.Errorf("%d flows left buffered", len(r.flows))
+				}
+				if tt.held == 0 {
+					return
+				}
+				if len(held) != tt.held {
+					t.Errorf("reassembled packet replaces %d segments, want %d", len(held), tt.held)
+				}
+
+				want := helloSegment(family.client, family.server, hello, 0, n, 0x18)
+				if !bytes.Equal(full, want) {
+					t.Errorf("reassembled packet differs from the whole hello sent at once")
+				}
+				if !checksumsValid(full) {
+					t.Error("reassembled packet checksums not fixed")
+				}
+			})
+		}
+	}
+}
+
+func TestHelloReassembler_NoTimeoutPasses(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	r, _ := recordingReassembler()
+	if state, _, _ := feed(r, helloSegment(testClient, testServer, hello, 0, 50, 0x10), 0); state != helloPass {
+		t.Errorf("state %d with reassembly off, want pass", state)
+	}
+}
+
+func TestHelloReassembler_ExpiryFlushes(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	r, sent := recordingReassembler()
+	first := helloSegment(testClient, testServer, hello, 0, 20, 0x10)
+	second := helloSegment(testClient, testServer, hello, 20, 60, 0x10)
+
+	feed(r, first, 20*time.Millisecond)
+	feed(r, second, 20*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for len(sent()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := sent()
+	if len(got) != 2 || !bytes.Equal(got[0], first) || !bytes.Equal(got[1], second) {
+		t.Fatalf("held segments not flushed in order on expiry: %d sent", len(got))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.flows) != 0 {
+		t.Errorf("%d flows left buffered", len(r.flows))
+	}
+}
@@ -0,0 +1,183 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+// clampedFlow is a flow whose SYN-ACK window was shrunk; server packets keep
+// advertising the small window until the client sent enough data packets.
+// Their window field is scaled by the client, unlike the SYN-ACK's.
+type clampedFlow struct {
+	window    uint16
+	scale     uint8 // window scale the SYN-ACK advertised to the client
+	remaining int
+	lastSeen  time.Time
+}
+
+type synAckClamper struct {
+	mu    sync.Mutex
+	flows map[flowKey]*clampedFlow
+}
+
+var clamped = &synAckClamper{
+	flows: make(map[flowKey]*clampedFlow),
+}
+
+// clampSynAck rewrites the SYN-ACK of a flow to an IP-matched set with
+// SYN-ACK window rewriting enabled. It returns false when the packet was
+// left for normal processing.
+func (w *Worker) clampSynAck(q Verdicts, id uint32, matcher *sni.SuffixSet, raw []byte, ihl int, src net.IP, sport uint16, connKey flowKey) bool {
+	set := synAckSet(matcher, src)
+	if set == nil || !set.TCP.SynAck.Enabled || !tcpPortAllowed(matcher, sport, set) {
+		return false
+	}
+	if raw[0]>>4 == IPv6 && ihl != IPv6HeaderLen {
+		return false
+	}
+
+	sa := &set.TCP.SynAck
+	pkt := make([]byte, len(raw))
+	copy(pkt, raw)
+	scale := rewriteSynAckOptions(pkt, ihl, sa)
+	setTCPWindow(pkt, ihl, sa.Window)
+
+	clamped.start(connKey, sa, scale)
+	log.Tracef("SYN-ACK window of %s clamped to %d (set: %s)", connKey, sa.Window, set.Name)
+
+	if err := q.SetVerdictModPacket(id, nfqueue.NfAccept, pkt); err != nil {
+		log.Tracef("failed to set modified verdict on packet %d: %v", id, err)
+	}
+	return true
+}
+
+// synAckSet finds the set of a server from its address alone, the SNI is not
+// known before the handshake completes.
+func synAckSet(matcher *sni.SuffixSet, src net.IP) *config.SetConfig {
+	if ok, set := matcher.MatchIP(src); ok {
+		return set
+	}
+	if ok, set, _ := matcher.MatchLearnedIP(src); ok {
+		return set
+	}
+	return nil
+}
+
+func (c *synAckClamper) start(connKey flowKey, sa *config.SynAckConfig, scale uint8) {
+	packets := sa.Packets
+	if packets < 1 {
+		packets = 1
+	}
+	c.mu.Lock()
+	c.flows[connKey] = &clampedFlow{window: sa.Window, scale: scale, remaining: packets, lastSeen: time.Now()}
+	c.mu.Unlock()
+}
+
+// serverWindow returns the window field to write into a server packet of a
+// clamped flow, the clamped window shifted by the advertised window scale so
+// the client ends up with the same number of bytes as after the SYN-ACK.
+func (c *synAckClamper) serverWindow(connKey flowKey) (uint16, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.flows[connKey]
+	if !ok {
+		return 0, false
+	}
+	f.lastSeen = time.Now()
+	window := f.window >> f.scale
+	if window == 0 {
+		window = 1
+	}
+	return window, true
+}
+
+// clientData counts a client data packet, the flow is released after the
+// configured number of packets.
+func (c *synAckClamper) clientData(connKey flowKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.flows) == 0 {
+		return
+	}
+	f, ok := c.flows[connKey]
+	if !ok {
+		return
+	}
+	f.remaining--
+	if f.remaining <= 0 {
+		delete(c.flows, connKey)
+		log.Tracef("SYN-ACK window clamp of %s released", connKey)
+	}
+}
+
+func (c *synAckClamper) Cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, v := range c.flows {
+		if now.Sub(v.lastSeen) > 120*time.Second {
+			delete(c.flows, k)
+		}
+	}
+}
+
+// rewriteSynAckOptions overrides the MSS and window scale options in place
+// and returns the window scale the client applies to later server windows,
+// 0 when the SYN-ACK carries no window scale option. A rewritten scale lasts
+// for the whole connection, not just the clamped packets.
+func rewriteSynAckOptions(pkt []byte, ihl int, sa *config.SynAckConfig) uint8 {
+	dataOff := int(pkt[ihl+12]>>4) * 4
+	end := ihl + dataOff
+	if end > len(pkt) {
+		return 0
+	}
+
+	var scale uint8
+	for i := ihl + TCPHeaderMinLen; i < end; {
+		kind := pkt[i]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			i++
+			continue
+		}
+		if i+1 >= end {
+			break
+		}
+		optLen := int(pkt[i+1])
+		if optLen < 2 || i+optLen > end {
+			break
+		}
+		switch {
+		case kind == 2 && optLen == 4 && sa.MSS > 0:
+			binary.BigEndian.PutUint16(pkt[i+2:i+4], sa.MSS)
+		case kind == 3 && optLen == 3:
+			if sa.WScale >= 0 {
+				pkt[i+2] = byte(sa.WScale)
+			}
+			// RFC 7323 caps the shift at 14
+			scale = min(pkt[i+2], 14)
+		}
+		i += optLen
+	}
+	return scale
+}
+
+// setTCPWindow sets the TCP window of a packet and fixes its checksum.
+func setTCPWindow(pkt []byte, ihl int, window uint16) {
+	binary.BigEndian.PutUint16(pkt[ihl+14:ihl+16], window)
+	if pkt[0]>>4 == IPv4 {
+		sock.FixTCPChecksum(pkt)
+	} else {
+		sock.FixTCPChecksumV6(pkt)
+	}
+}
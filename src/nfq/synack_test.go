@@ -0,0 +1,95 @@
+package nfq
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+func TestClampSynAck_ScalesServerWindows(t *testing.T) {
+	// MSS 1460, NOP, window scale 7
+	options := []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 7}
+
+	tests := []struct {
+		name      string
+		client    net.IP
+		server    net.IP
+		wscale    int
+		wantScale byte
+		wantLater uint16 // window field of the server segment after the SYN-ACK
+	}{
+		{"ipv4", testClient, testServer, -1, 7, 1024 >> 7},
+		{"ipv4 rewritten scale", testClient, testServer, 2, 2, 1024 >> 2},
+		{"ipv6", testClient6, testServer6, -1, 7, 1024 >> 7},
+		{"ipv6 rewritten scale", testClient6, testServer6, 2, 2, 1024 >> 2},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, set := testConfig()
+			set.Targets.IPs = []string{tt.server.String()}
+			set.TCP.SynAck.Enabled = true
+			set.TCP.SynAck.Window = 1024
+			set.TCP.SynAck.WScale = tt.wscale
+			set.TCP.SynAck.MSS = 536
+			set.TCP.SynAck.Packets = 2
+			w, verdicts, _ := newTestWorker(t, cfg)
+
+			cport := uint16(41000 + i)
+			w.Handle(1, tcpPacket{src: tt.server, dst: tt.client, sport: 443, dport: cport, flags: 0x12, window: 64240, options: options}.build())
+			w.Handle(2, tcpPacket{src: tt.server, dst: tt.client, sport: 443, dport: cport, flags: 0x10, window: 502}.build())
+
+			verdict, synAck, _ := verdicts.get(1)
+			if verdict != nfqueue.NfAccept || synAck == nil {
+				t.Fatalf("SYN-ACK not accepted modified: verdict %d", verdict)
+			}
+			tcp := synAck[len(synAck)-28:]
+			if got := binary.BigEndian.Uint16(tcp[14:16]); got != 1024 {
+				t.Errorf("SYN-ACK window %d, want the unscaled 1024", got)
+			}
+			if got := binary.BigEndian.Uint16(tcp[22:24]); got != 536 {
+				t.Errorf("SYN-ACK MSS %d, want 536", got)
+			}
+			if tcp[27] != tt.wantScale {
+				t.Errorf("SYN-ACK window scale %d, want %d", tcp[27], tt.wantScale)
+			}
+			if !checksumsValid(synAck) {
+				t.Error("SYN-ACK checksum not fixed")
+			}
+
+			_, later, _ := verdicts.get(2)
+			if later == nil {
+				t.Fatal("server segment passed unmodified")
+			}
+			tcp = later[len(later)-20:]
+			if got := binary.BigEndian.Uint16(tcp[14:16]); got != tt.wantLater {
+				t.Errorf("server segment window %d, want %d", got, tt.wantLater)
+			}
+			if !checksumsValid(later) {
+				t.Error("server segment checksum not fixed")
+			}
+		})
+	}
+}
+
+func TestClampedFlow_WindowAtLeastOne(t *testing.T) {
+	c := &synAckClamper{flows: make(map[flowKey]*clampedFlow)}
+	key := newFlowKey(testClient, 40000, testServer, 443)
+	c.flows[key] = &clampedFlow{window: 40, scale: 7, remaining: 1}
+
+	if window, ok := c.serverWindow(key); !ok || window != 1 {
+		t.Errorf("serverWindow = %d, %v, want 1", window, ok)
+	}
+}
+
+func TestRewriteSynAckOptions_NoWindowScale(t *testing.T) {
+	_, set := testConfig()
+	set.TCP.SynAck.WScale = 5
+	pkt := tcpPacket{src: testServer, dst: testClient, sport: 443, dport: 40000, flags: 0x12, options: []byte{2, 4, 0x05, 0xb4}}.build()
+
+	if scale := rewriteSynAckOptions(pkt, 20, &set.TCP.SynAck); scale != 0 {
+		t.Errorf("scale = %d without a window scale option", scale)
+	}
+}
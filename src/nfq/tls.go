@@ -9,6 +9,10 @@ import (
 )
 
 func (w *Worker) sendTLSFragments(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, false) {
+		return
+	}
+
 	ipHdrLen := int((packet[0] & 0x0F) * 4)
 	tcpHdrLen := int((packet[ipHdrLen+12] >> 4) * 4)
 	payloadStart := ipHdrLen + tcpHdrLen
@@ -61,6 +65,10 @@ func (w *Worker) sendTLSFragments(cfg *config.SetConfig, packet []byte, dst net.
 }
 
 func (w *Worker) sendTLSFragmentsV6(cfg *config.SetConfig, packet []byte, dst net.IP) {
+	if w.sendAtSplitPositions(cfg, packet, dst, false) {
+		return
+	}
+
 	ipv6HdrLen := 40
 	tcpHdrLen := int((packet[ipv6HdrLen+12] >> 4) * 4)
 	payloadStart := ipv6HdrLen + tcpHdrLen
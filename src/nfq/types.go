@@ -2,12 +2,12 @@ package nfq
 
 import (
 	"context"
+	"net"
 	"sync"
 	"sync/atomic"
 
 	"github.com/daniellavrushin/b4/dhcp"
 	"github.com/daniellavrushin/b4/sock"
-	"github.com/florianl/go-nfqueue"
 )
 
 type Segment struct {
@@ -32,17 +32,40 @@ type PacketInfo struct {
 	IsIPv6       bool
 }
 
+// Verdicts receives the decisions of the queue callback. It is the netfilter
+// queue itself, or a recorder when packets are replayed.
+type Verdicts interface {
+	SetVerdict(id uint32, verdict int) error
+	SetVerdictModPacket(id uint32, verdict int, packet []byte) error
+}
+
+// PacketSender puts the packets built by the strategies on the wire. It is
+// the raw socket sock.Sender, or a recorder when packets are replayed.
+type PacketSender interface {
+	SendIPv4(packet []byte, dst net.IP) error
+	SendIPv6(packet []byte, dst net.IP) error
+	Capture(orig []byte, verdict func(pkt []byte) error) *sock.Capture
+	Release(c *sock.Capture) bool
+	Close()
+}
+
 type Worker struct {
 	packetsProcessed uint64
+	injectFallbacks  uint64
 	lastOverflowLog  int64
 	cfg              atomic.Value
 	qnum             uint16
 	ctx              context.Context
 	cancel           context.CancelFunc
-	q                *nfqueue.Nfqueue
+	q                Verdicts
+	mark             uint32 // packets sent by b4 itself
 	wg               sync.WaitGroup
 	matcher          atomic.Value
-	sock             *sock.Sender
+	sock             PacketSender
 	ipToMac          atomic.Value
 	connState        sync.Map
+	hellos           *helloReassembler
+	jobs             chan injectJob
+	inline           bool          // run strategies in the callback, offline workers
+	applied          func(Applied) // told about every strategy run, offline workers
 }
@@ -0,0 +1,24 @@
+package nfq
+
+import (
+	"github.com/daniellavrushin/b4/log"
+	"github.com/florianl/go-nfqueue"
+)
+
+// injectWithVerdict runs a strategy on a packet still waiting for its verdict
+// and returns its first real segment to the kernel as an accept verdict with
+// modified contents, only fakes and further segments go out the raw socket.
+// The packet is dropped when the strategy sent no segment that could be
+// returned.
+func (w *Worker) injectWithVerdict(q Verdicts, id uint32, pkt []byte, inject func()) {
+	capture := w.sock.Capture(pkt, func(seg []byte) error {
+		return q.SetVerdictModPacket(id, nfqueue.NfAccept, seg)
+	})
+	inject()
+	if w.sock.Release(capture) {
+		return
+	}
+	if err := q.SetVerdict(id, nfqueue.NfDrop); err != nil {
+		log.Tracef("failed to set drop verdict on packet %d: %v", id, err)
+	}
+}
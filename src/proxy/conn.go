@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDst returns where the client connected to. TPROXY keeps it as the
+// local address, REDIRECT leaves it in conntrack.
+func (s *Server) originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if s.tproxy {
+		return local, nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			var mreq *unix.IPv6Mreq
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if serr == nil {
+				dst = originalDst4(mreq)
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if serr == nil {
+			dst = originalDst6(info)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, serr
+}
+
+// originalDst4 decodes the sockaddr_in that SO_ORIGINAL_DST returns in the
+// 20 bytes of an ipv6_mreq.
+func originalDst4(mreq *unix.IPv6Mreq) *net.TCPAddr {
+	a := mreq.Multiaddr
+	return &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(binary.BigEndian.Uint16(a[2:4]))}
+}
+
+// originalDst6 decodes the sockaddr_in6 that SO_ORIGINAL_DST returns at the
+// start of an ip6_mtuinfo. The port was read as a host order integer.
+func originalDst6(info *unix.IPv6MTUInfo) *net.TCPAddr {
+	port := make([]byte, 2)
+	binary.NativeEndian.PutUint16(port, info.Addr.Port)
+	return &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port))}
+}
+
+// readFirst reads what the client sends first, a whole TLS record or the
+// first read of anything else. Nothing read before the timeout is not an
+// error, the server may be the one to speak first.
+func readFirst(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 5+1<<14)
+	n := 0
+	for {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return buf[:n], nil
+			}
+			if n > 0 && errors.Is(err, io.EOF) {
+				return buf[:n], nil
+			}
+			return nil, err
+		}
+		if buf[0] != 0x16 {
+			return buf[:n], nil
+		}
+		if n < 5 {
+			// the record header itself was split
+			continue
+		}
+		if want := 5 + int(binary.BigEndian.Uint16(buf[3:5])); n >= want || want > len(buf) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// halfConn is a client connection that can pass on a half close.
+type halfConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// dialMarked connects to address with the queue mark set, so the firewall
+// lets the connection pass instead of redirecting it back to the proxy or
+// queueing it. Host names are resolved here.
+func dialMarked(address string, mark uint) (*net.TCPConn, error) {
+	if mark == 0 {
+		mark = 0x8000
+	}
+	d := net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// relay copies both directions until each side is done, passing on half
+// closes. It returns the bytes sent to upstream and received from it.
+func relay(client halfConn, upstream *net.TCPConn) (sent, recv int64) {
+	done := make(chan struct{}, 2)
+	go func() {
+		sent, _ = io.Copy(upstream, client)
+		_ = upstream.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		recv, _ = io.Copy(client, upstream)
+		_ = client.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return sent, recv
+}
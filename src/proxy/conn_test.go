@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOriginalDst4(t *testing.T) {
+	var mreq unix.IPv6Mreq
+	binary.NativeEndian.PutUint16(mreq.Multiaddr[0:2], unix.AF_INET)
+	binary.BigEndian.PutUint16(mreq.Multiaddr[2:4], 443)
+	copy(mreq.Multiaddr[4:8], []byte{93, 184, 216, 34})
+
+	got := originalDst4(&mreq)
+	if !got.IP.Equal(net.ParseIP("93.184.216.34")) || got.Port != 443 {
+		t.Errorf("originalDst4 = %s, want 93.184.216.34:443", got)
+	}
+}
+
+func TestOriginalDst6(t *testing.T) {
+	var info unix.IPv6MTUInfo
+	info.Addr.Family = unix.AF_INET6
+	// the kernel writes the port in network order, the struct reads it back
+	// in host order
+	info.Addr.Port = binary.NativeEndian.Uint16([]byte{0x1f, 0x90})
+	ip := net.ParseIP("2001:db8::1")
+	copy(info.Addr.Addr[:], ip)
+
+	got := originalDst6(&info)
+	if !got.IP.Equal(ip) || got.Port != 8080 {
+		t.Errorf("originalDst6 = %s, want [2001:db8::1]:8080", got)
+	}
+}
+
+func TestReadFirst(t *testing.T) {
+	record := []byte{0x16, 0x03, 0x01, 0x00, 0x06, 1, 2, 3, 4, 5, 6}
+
+	tests := []struct {
+		name    string
+		writes  [][]byte
+		close   bool
+		want    []byte
+		wantErr bool
+	}{
+		{"record in one write", [][]byte{record}, false, record, false},
+		{"record across writes", [][]byte{record[:3], record[3:7], record[7:]}, false, record, false},
+		{"record then more data", [][]byte{append(append([]byte{}, record...), 0x17, 0x03)}, false, append(append([]byte{}, record...), 0x17, 0x03), false},
+		{"not tls", [][]byte{[]byte("GET / HTTP/1.1\r\n")}, false, []byte("GET / HTTP/1.1\r\n"), false},
+		{"truncated record", [][]byte{record[:7]}, true, record[:7], false},
+		{"silent client", nil, false, []byte{}, false},
+		{"closed without data", nil, true, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				for _, w := range tt.writes {
+					if _, err := client.Write(w); err != nil {
+						return
+					}
+				}
+				if tt.close {
+					client.Close()
+				}
+			}()
+			defer client.Close()
+
+			got, err := readFirst(server, 50*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("readFirst = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
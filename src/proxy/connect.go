@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// connectHandshake reads an HTTP CONNECT request and checks its Basic proxy
+// auth. Other methods are refused, b4 only tunnels.
+func connectHandshake(conn *bufferedConn, cfg *config.ProxyConfig) (request, error) {
+	var req request
+	r, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return req, err
+	}
+	if r.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, "Allow: CONNECT")
+		return req, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	user, pass, _ := proxyBasicAuth(r)
+	if !authorized(cfg, user, pass) {
+		writeHTTPStatus(conn, http.StatusProxyAuthRequired, `Proxy-Authenticate: Basic realm="b4"`)
+		return req, errAuth
+	}
+	if cfg.Username != "" {
+		req.user = user
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, "")
+		return req, fmt.Errorf("bad CONNECT target %q: %w", r.Host, err)
+	}
+	if net.ParseIP(host) == nil {
+		req.host = host
+	}
+	req.addr = r.Host
+	return req, nil
+}
+
+// proxyBasicAuth returns the credentials of the Proxy-Authorization header.
+func proxyBasicAuth(r *http.Request) (string, string, bool) {
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(raw), ":")
+}
+
+// connectReply answers the CONNECT request with the outcome of the dial.
+func connectReply(conn io.Writer, dialErr error) error {
+	if dialErr != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway, "")
+		return dialErr
+	}
+	_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+func writeHTTPStatus(conn io.Writer, code int, header string) {
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if header != "" {
+		fmt.Fprintf(w, "%s\r\n", header)
+	}
+	w.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	_ = w.Flush()
+}
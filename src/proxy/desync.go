@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nfq"
+	"github.com/daniellavrushin/b4/sock"
+	"golang.org/x/sys/unix"
+)
+
+// A socket cannot forge packets, so the strategies are mapped onto what the
+// kernel sends for us:
+//
+//   - splits become separate writes, TCP_NODELAY sends each as a segment
+//   - tls rewrites the ClientHello into two TLS records
+//   - oob sends the OOB character as urgent data with MSG_OOB
+//   - disorder and reverse order send the first segment with a TTL of 1,
+//     it is lost on the way and retransmitted after the rest
+//   - fakes are written with the fake TTL and replaced by the real data
+//     before the kernel retransmits them
+//
+// Seg2Delay is waited between the segments.
+
+// segment is one write of the first data.
+type segment struct {
+	data []byte
+	oob  byte // sent as urgent data after the segment
+}
+
+// desync writes the first data of a matched connection to conn.
+func desync(conn *net.TCPConn, set *config.SetConfig, payload []byte) error {
+	if err := conn.SetNoDelay(true); err != nil {
+		return err
+	}
+	w := socketWriter{conn: conn, v6: conn.RemoteAddr().(*net.TCPAddr).IP.To4() == nil}
+
+	segs := segments(set, payload)
+	gap := time.Duration(set.TCP.Seg2Delay) * time.Millisecond
+	disorder := set.Fragmentation.Strategy == "disorder" || set.Fragmentation.ReverseOrder
+	log.Tracef("Transparent proxy: %d bytes in %d segments (set: %s)", len(payload), len(segs), set.Name)
+
+	for i, seg := range segs {
+		var err error
+		switch {
+		case i == 0 && set.Faking.SNI:
+			err = w.writeFaked(seg.data, fakeData(set, len(seg.data)), int(set.Faking.TTL))
+		case i == 0 && disorder && len(segs) > 1:
+			err = w.writeTTL(seg.data, 1)
+		default:
+			_, err = conn.Write(seg.data)
+		}
+		if err != nil {
+			return err
+		}
+		if seg.oob != 0 {
+			if err := w.writeOOB(seg.oob); err != nil {
+				return err
+			}
+		}
+		if gap > 0 && i < len(segs)-1 {
+			time.Sleep(gap)
+		}
+	}
+	return nil
+}
+
+// segments cuts the first data at the set's split points. Split positions
+// win over the strategy's own points like they do in the queue.
+func segments(set *config.SetConfig, payload []byte) []segment {
+	frag := &set.Fragmentation
+	if frag.Strategy == "tls" && len(frag.SplitPoints) == 0 {
+		if first, second, ok := splitTLSRecord(payload, frag.TLSRecordPosition); ok {
+			return []segment{{data: first}, {data: second}}
+		}
+	}
+
+	var splits []int
+	if len(frag.SplitPoints) > 0 {
+		splits = nfq.ResolveSplitPositions(payload, frag.SplitPoints)
+	}
+	if len(splits) == 0 {
+		switch frag.Strategy {
+		case "none":
+		case "firstbyte":
+			splits = []int{1}
+		case "combo":
+			splits = nfq.GetComboSplitPoints(payload, len(payload), &frag.Combo, frag.MiddleSNI)
+		case "oob":
+			splits = []int{oobPosition(frag, payload)}
+		default:
+			splits = nfq.GetSNISplitPoints(payload, len(payload), frag.MiddleSNI, frag.SNIPosition)
+			if len(splits) == 0 {
+				splits = []int{1}
+			}
+		}
+	}
+
+	var segs []segment
+	prev := 0
+	for _, at := range splits {
+		if at <= prev || at >= len(payload) {
+			continue
+		}
+		segs = append(segs, segment{data: payload[prev:at]})
+		prev = at
+	}
+	segs = append(segs, segment{data: payload[prev:]})
+
+	if frag.Strategy == "oob" && len(segs) > 1 {
+		segs[0].oob = frag.OOBChar
+		if segs[0].oob == 0 {
+			segs[0].oob = 'x'
+		}
+	}
+	return segs
+}
+
+// oobPosition is where the oob strategy puts the urgent byte, in the middle
+// of the SNI when asked to.
+func oobPosition(frag *config.FragmentationConfig, payload []byte) int {
+	pos := frag.OOBPosition
+	if frag.MiddleSNI {
+		if mid := nfq.ResolveSplitPositions(payload, []config.SplitPosition{{Marker: "midsni"}}); len(mid) > 0 {
+			pos = mid[0]
+		}
+	}
+	if pos >= len(payload) {
+		pos = len(payload) / 2
+	}
+	if pos <= 0 {
+		pos = 1
+	}
+	return pos
+}
+
+// splitTLSRecord rewrites a single TLS record into two records, the first
+// one carrying pos bytes of the handshake.
+func splitTLSRecord(payload []byte, pos int) ([]byte, []byte, bool) {
+	if len(payload) < 6 || payload[0] != 0x16 {
+		return nil, nil, false
+	}
+	body := payload[5:]
+	if int(binary.BigEndian.Uint16(payload[3:5])) != len(body) {
+		return nil, nil, false
+	}
+	if pos <= 0 {
+		pos = 1
+	}
+	if pos >= len(body) {
+		pos = len(body) / 2
+	}
+
+	first := make([]byte, 5+pos)
+	copy(first, payload[:5])
+	binary.BigEndian.PutUint16(first[3:5], uint16(pos))
+	copy(first[5:], body[:pos])
+
+	second := make([]byte, 5+len(body)-pos)
+	copy(second, payload[:5])
+	binary.BigEndian.PutUint16(second[3:5], uint16(len(body)-pos))
+	copy(second[5:], body[pos:])
+	return first, second, true
+}
+
+// fakeData is the set's fake payload cut or padded to n bytes, a fake takes
+// the sequence space of the segment it stands in for.
+func fakeData(set *config.SetConfig, n int) []byte {
+	fake := make([]byte, n)
+	copy(fake, sock.GetPayload(&set.Faking))
+	return fake
+}
+
+// socketWriter applies per-write socket options to an upstream connection.
+type socketWriter struct {
+	conn *net.TCPConn
+	v6   bool
+}
+
+func (w socketWriter) ttlOption() (int, int) {
+	if w.v6 {
+		return unix.SOL_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+	return unix.SOL_IP, unix.IP_TTL
+}
+
+// control runs fn on the socket descriptor.
+func (w socketWriter) control(fn func(fd int) error) error {
+	raw, err := w.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := raw.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// withTTL runs fn with the TTL of the socket lowered to ttl.
+func (w socketWriter) withTTL(ttl int, fn func() error) error {
+	level, opt := w.ttlOption()
+	var orig int
+	err := w.control(func(fd int) error {
+		var err error
+		if orig, err = unix.GetsockoptInt(fd, level, opt); err != nil {
+			return err
+		}
+		return unix.SetsockoptInt(fd, level, opt, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	ferr := fn()
+	if err := w.control(func(fd int) error { return unix.SetsockoptInt(fd, level, opt, orig) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// writeTTL sends data with a TTL too low to reach the server, the kernel
+// retransmits it with the normal TTL once it is not acknowledged.
+func (w socketWriter) writeTTL(data []byte, ttl int) error {
+	return w.withTTL(ttl, func() error {
+		if _, err := w.conn.Write(data); err != nil {
+			return err
+		}
+		w.waitSent()
+		return nil
+	})
+}
+
+// writeOOB sends b as TCP urgent data, receivers without SO_OOBINLINE take
+// it out of the stream.
+func (w socketWriter) writeOOB(b byte) error {
+	raw, err := w.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Write(func(fd uintptr) bool {
+		serr = unix.Sendto(int(fd), []byte{b}, unix.MSG_OOB, nil)
+		return serr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// writeFaked sends fake with a low TTL from pages the socket keeps a
+// reference to, then puts data in their place. The fake goes out once, the
+// retransmission carries the real data with the normal TTL.
+func (w socketWriter) writeFaked(data, fake []byte, ttl int) error {
+	if ttl <= 0 {
+		ttl = 8
+	}
+	size := (len(data) + unix.Getpagesize() - 1) &^ (unix.Getpagesize() - 1)
+	page, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(page)
+	copy(page, fake)
+
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		return err
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	return w.withTTL(ttl, func() error {
+		iov := unix.Iovec{Base: &page[0]}
+		iov.SetLen(len(data))
+		if _, err := unix.Vmsplice(p[1], []unix.Iovec{iov}, 0); err != nil {
+			return err
+		}
+		raw, err := w.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		sent := 0
+		var serr error
+		err = raw.Write(func(fd uintptr) bool {
+			for sent < len(data) {
+				n, err := unix.Splice(p[0], nil, int(fd), nil, len(data)-sent, 0)
+				if err == unix.EAGAIN {
+					return false
+				}
+				if err != nil {
+					serr = err
+					return true
+				}
+				sent += int(n)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return serr
+		}
+		w.waitSent()
+		copy(page, data)
+		return nil
+	})
+}
+
+// waitSent waits until the kernel has put everything written on the wire,
+// so a socket option change does not apply to it.
+func (w socketWriter) waitSent() {
+	for i := 0; i < 100; i++ {
+		var pending uint32
+		_ = w.control(func(fd int) error {
+			info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+			if err == nil {
+				pending = info.Notsent_bytes
+			}
+			return err
+		})
+		if pending == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/nfq"
+)
+
+func buildHello(t *testing.T) []byte {
+	t.Helper()
+	hello, err := capture.GenerateTLSClientHello("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func joinSegments(segs []segment) []byte {
+	var out []byte
+	for _, s := range segs {
+		out = append(out, s.data...)
+	}
+	return out
+}
+
+func TestSegments(t *testing.T) {
+	hello := buildHello(t)
+	sniSplit := nfq.ResolveSplitPositions(hello, []config.SplitPosition{{Marker: "sni", Offset: 1}})
+	if len(sniSplit) != 1 {
+		t.Fatalf("sni+1 resolved to %v", sniSplit)
+	}
+
+	tests := []struct {
+		name   string
+		frag   func(*config.FragmentationConfig)
+		splits []int // offsets the segments but the last end at
+		oob    byte
+	}{
+		{"none", func(f *config.FragmentationConfig) { f.Strategy = "none" }, nil, 0},
+		{"firstbyte", func(f *config.FragmentationConfig) { f.Strategy = "firstbyte" }, []int{1}, 0},
+		{"oob default char", func(f *config.FragmentationConfig) {
+			f.Strategy = "oob"
+			f.OOBPosition = 3
+			f.MiddleSNI = false
+			f.OOBChar = 0
+		}, []int{3}, 'x'},
+		{"oob char", func(f *config.FragmentationConfig) {
+			f.Strategy = "oob"
+			f.OOBPosition = 3
+			f.MiddleSNI = false
+			f.OOBChar = 'a'
+		}, []int{3}, 'a'},
+		{"split positions win over tls", func(f *config.FragmentationConfig) {
+			f.Strategy = "tls"
+			f.SplitPoints = []config.SplitPosition{{Marker: "sni", Offset: 1}}
+		}, sniSplit, 0},
+		{"unresolved positions fall back", func(f *config.FragmentationConfig) {
+			f.Strategy = "firstbyte"
+			f.SplitPoints = []config.SplitPosition{{Offset: 100000}}
+		}, []int{1}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := config.NewSetConfig()
+			tt.frag(&set.Fragmentation)
+			segs := segments(&set, hello)
+
+			if len(segs) != len(tt.splits)+1 {
+				t.Fatalf("got %d segments, want %d", len(segs), len(tt.splits)+1)
+			}
+			prev := 0
+			for i, at := range tt.splits {
+				if len(segs[i].data) != at-prev {
+					t.Errorf("segment %d has %d bytes, want %d", i, len(segs[i].data), at-prev)
+				}
+				prev = at
+			}
+			if !bytes.Equal(joinSegments(segs), hello) {
+				t.Error("segments do not carry the payload")
+			}
+			if segs[0].oob != tt.oob {
+				t.Errorf("oob = %q, want %q", segs[0].oob, tt.oob)
+			}
+		})
+	}
+}
+
+func TestSegments_TLSRecord(t *testing.T) {
+	hello := buildHello(t)
+	set := config.NewSetConfig()
+	set.Fragmentation.Strategy = "tls"
+	set.Fragmentation.TLSRecordPosition = 10
+
+	segs := segments(&set, hello)
+	if len(segs) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segs))
+	}
+	if got := binary.BigEndian.Uint16(segs[0].data[3:5]); got != 10 {
+		t.Errorf("first record length %d, want 10", got)
+	}
+}
+
+func TestSplitTLSRecord(t *testing.T) {
+	record := func(body int) []byte {
+		b := []byte{0x16, 0x03, 0x01, 0, 0}
+		binary.BigEndian.PutUint16(b[3:5], uint16(body))
+		for i := 0; i < body; i++ {
+			b = append(b, byte(i))
+		}
+		return b
+	}
+	badLength := record(20)
+	badLength[4] = 30
+	notHandshake := record(20)
+	notHandshake[0] = 0x17
+
+	tests := []struct {
+		name    string
+		payload []byte
+		pos     int
+		ok      bool
+		first   int // body bytes in the first record
+	}{
+		{"middle", record(20), 5, true, 5},
+		{"zero position", record(20), 0, true, 1},
+		{"negative position", record(20), -3, true, 1},
+		{"past the body", record(20), 20, true, 10},
+		{"not a handshake", notHandshake, 5, false, 0},
+		{"length mismatch", badLength, 5, false, 0},
+		{"header only", record(0), 5, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second, ok := splitTLSRecord(tt.payload, tt.pos)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			body := tt.payload[5:]
+			if got := int(binary.BigEndian.Uint16(first[3:5])); got != tt.first || len(first) != 5+tt.first {
+				t.Errorf("first record length %d (%d bytes), want %d", got, len(first), tt.first)
+			}
+			if got := int(binary.BigEndian.Uint16(second[3:5])); got != len(body)-tt.first || len(second) != 5+got {
+				t.Errorf("second record length %d (%d bytes), want %d", got, len(second), len(body)-tt.first)
+			}
+			if !bytes.Equal(first[:3], tt.payload[:3]) || !bytes.Equal(second[:3], tt.payload[:3]) {
+				t.Error("records lost the type or version")
+			}
+			if !bytes.Equal(append(first[5:], second[5:]...), body) {
+				t.Error("records do not carry the handshake")
+			}
+		})
+	}
+}
+
+func TestOOBPosition(t *testing.T) {
+	hello := buildHello(t)
+	mid := nfq.ResolveSplitPositions(hello, []config.SplitPosition{{Marker: "midsni"}})
+	if len(mid) != 1 {
+		t.Fatalf("midsni resolved to %v", mid)
+	}
+
+	tests := []struct {
+		name      string
+		pos       int
+		middleSNI bool
+		payload   []byte
+		want      int
+	}{
+		{"configured", 3, false, hello, 3},
+		{"zero", 0, false, hello, 1},
+		{"negative", -2, false, hello, 1},
+		{"past the payload", 100, false, make([]byte, 10), 5},
+		{"at the payload end", 10, false, make([]byte, 10), 5},
+		{"middle of the sni", 3, true, hello, mid[0]},
+		{"no sni keeps the position", 3, true, make([]byte, 10), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frag := config.FragmentationConfig{OOBPosition: tt.pos, MiddleSNI: tt.middleSNI}
+			if got := oobPosition(&frag, tt.payload); got != tt.want {
+				t.Errorf("oobPosition = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+)
+
+// clients get this long to finish the proxy handshake
+const handshakeTimeout = 10 * time.Second
+
+var errAuth = errors.New("authentication failed")
+
+// LocalServer is the SOCKS5 and HTTP CONNECT proxy. Applications opt in by
+// using it, their connections get the strategy of the matched set without
+// any firewall rules. Both protocols share one listener, a SOCKS5 client
+// starts with its version byte.
+type LocalServer struct {
+	core
+
+	address string
+}
+
+func NewLocalServer(cfg *config.Config) *LocalServer {
+	s := &LocalServer{
+		core:    core{conns: make(map[net.Conn]struct{})},
+		address: cfg.System.Proxy.Address,
+	}
+	s.UpdateConfig(cfg)
+	return s
+}
+
+func (s *LocalServer) Start() error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.address, err)
+	}
+	s.serve(ln, "SOCKS5/HTTP proxy", s.handle)
+	log.Infof("SOCKS5/HTTP proxy listening on %s", ln.Addr())
+	return nil
+}
+
+// Stop closes the listener and every proxied connection.
+func (s *LocalServer) Stop() {
+	s.shutdown()
+	log.Infof("SOCKS5/HTTP proxy stopped")
+}
+
+// request is what a client asked the proxy for.
+type request struct {
+	host string // name to resolve, empty for an address
+	addr string // host:port to dial
+	user string
+}
+
+func (s *LocalServer) handle(conn *net.TCPConn) {
+	cfg := s.getConfig()
+	client := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	src := conn.RemoteAddr().(*net.TCPAddr)
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	first, err := client.r.Peek(1)
+	if err != nil {
+		return
+	}
+	socks := first[0] == socksVersion
+
+	var req request
+	if socks {
+		req, err = socksHandshake(client, &cfg.System.Proxy)
+	} else {
+		req, err = connectHandshake(client, &cfg.System.Proxy)
+	}
+	if err != nil {
+		log.Tracef("Proxy: handshake with %s failed: %v", src, err)
+		return
+	}
+
+	upstream, err := dialMarked(req.addr, cfg.Queue.Mark)
+	if socks {
+		err = socksReply(client, upstream, err)
+	} else {
+		err = connectReply(client, err)
+	}
+	if err != nil {
+		log.Tracef("Proxy: %s to %s failed: %v", src, req.addr, err)
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+		return
+	}
+	defer upstream.Close()
+	_ = conn.SetDeadline(time.Time{})
+
+	addr := src.IP.String()
+	collector := metrics.GetMetricsCollector()
+	collector.RecordProxyConnection(addr, req.user)
+	targeted, sent, recv := s.forward(client, upstream, req.host)
+	collector.CloseProxyConnection(addr, targeted, uint64(sent), uint64(recv))
+}
+
+// authorized reports whether the credentials match the configured ones, any
+// credentials do when no username is configured.
+func authorized(cfg *config.ProxyConfig, user, pass string) bool {
+	if cfg.Username == "" {
+		return true
+	}
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.Username))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.Password))
+	return u&p == 1
+}
+
+// bufferedConn reads through the reader the handshake was parsed with, a
+// client may send its first data right behind the request. It embeds the
+// net.Conn interface rather than the *net.TCPConn so no WriteTo is promoted,
+// io.Copy would use it and skip what the reader buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
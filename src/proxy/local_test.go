@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// handshake runs serve on one end of a pipe while the other end sends
+// input, and returns what serve wrote back.
+func handshake(t *testing.T, input []byte, serve func(net.Conn) (request, error)) (request, []byte, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write(input)
+	}()
+	replies := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		replies <- b
+	}()
+
+	req, err := serve(server)
+	server.Close()
+	return req, <-replies, err
+}
+
+func socksRequest(atyp byte, addr []byte, port uint16) []byte {
+	b := []byte{socksVersion, socksConnect, 0x00, atyp}
+	if atyp == socksDomain {
+		b = append(b, byte(len(addr)))
+	}
+	b = append(b, addr...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func socksUserPassAuth(user, pass string) []byte {
+	b := append([]byte{socksAuthVer, byte(len(user))}, user...)
+	return append(append(b, byte(len(pass))), pass...)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	noAuth := []byte{socksVersion, 1, socksNoAuth}
+	userPass := []byte{socksVersion, 2, socksNoAuth, socksUserPass}
+	succeeded := []byte{socksVersion, socksNoAuth}
+	authOK := []byte{socksVersion, socksUserPass, socksAuthVer, 0x00}
+
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name     string
+		username string
+		input    []byte
+		want     request
+		reply    []byte // what the client reads, a prefix when the request failed
+		wantErr  error
+	}{
+		{
+			name:  "domain",
+			input: cat(noAuth, socksRequest(socksDomain, []byte("example.com"), 443)),
+			want:  request{host: "example.com", addr: "example.com:443"},
+			reply: succeeded,
+		},
+		{
+			name:  "domain holding an address",
+			input: cat(noAuth, socksRequest(socksDomain, []byte("93.184.216.34"), 443)),
+			want:  request{addr: "93.184.216.34:443"},
+			reply: succeeded,
+		},
+		{
+			name:  "ipv4",
+			input: cat(noAuth, socksRequest(socksIPv4, net.ParseIP("93.184.216.34").To4(), 80)),
+			want:  request{addr: "93.184.216.34:80"},
+			reply: succeeded,
+		},
+		{
+			name:  "ipv6",
+			input: cat(noAuth, socksRequest(socksIPv6, net.ParseIP("2001:db8::1"), 443)),
+			want:  request{addr: "[2001:db8::1]:443"},
+			reply: succeeded,
+		},
+		{
+			name:     "auth",
+			username: "user",
+			input:    cat(userPass, socksUserPassAuth("user", "secret"), socksRequest(socksDomain, []byte("example.com"), 443)),
+			want:     request{host: "example.com", addr: "example.com:443", user: "user"},
+			reply:    authOK,
+		},
+		{
+			name:     "wrong password",
+			username: "user",
+			input:    cat(userPass, socksUserPassAuth("user", "guess")),
+			reply:    []byte{socksVersion, socksUserPass, socksAuthVer, 0x01},
+			wantErr:  errAuth,
+		},
+		{
+			name:     "no auth offered",
+			username: "user",
+			input:    noAuth,
+			reply:    []byte{socksVersion, socksNoMethods},
+		},
+		{
+			name:  "bind",
+			input: cat(noAuth, []byte{socksVersion, 0x02, 0x00, socksIPv4, 127, 0, 0, 1, 0, 80}),
+			reply: cat(succeeded, []byte{socksVersion, socksCmdNotSupported}),
+		},
+		{
+			name:  "unknown address type",
+			input: cat(noAuth, []byte{socksVersion, socksConnect, 0x00, 0x05}),
+			reply: cat(succeeded, []byte{socksVersion, socksAddrNotSupported}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ProxyConfig{Username: tt.username, Password: "secret"}
+			req, reply, err := handshake(t, tt.input, func(c net.Conn) (request, error) {
+				return socksHandshake(c, cfg)
+			})
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.want.addr == "" && err == nil {
+				t.Fatalf("handshake succeeded with %+v", req)
+			}
+			if tt.want.addr != "" && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if req != tt.want {
+				t.Errorf("request = %+v, want %+v", req, tt.want)
+			}
+			if !bytes.HasPrefix(reply, tt.reply) {
+				t.Errorf("reply = %x, want %x", reply, tt.reply)
+			}
+		})
+	}
+}
+
+func TestConnectHandshake(t *testing.T) {
+	basic := func(user, pass string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		input    string
+		want     request
+		status   string // status line written on failure
+	}{
+		{
+			name:  "domain",
+			input: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			want:  request{host: "example.com", addr: "example.com:443"},
+		},
+		{
+			name:  "ipv6",
+			input: "CONNECT [2001:db8::1]:443 HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n",
+			want:  request{addr: "[2001:db8::1]:443"},
+		},
+		{
+			name:     "auth",
+			username: "user",
+			input:    "CONNECT example.com:443 HTTP/1.1\r\n" + basic("user", "secret") + "\r\n",
+			want:     request{host: "example.com", addr: "example.com:443", user: "user"},
+		},
+		{
+			name:     "wrong password",
+			username: "user",
+			input:    "CONNECT example.com:443 HTTP/1.1\r\n" + basic("user", "guess") + "\r\n",
+			status:   "HTTP/1.1 407 ",
+		},
+		{
+			name:     "no credentials",
+			username: "user",
+			input:    "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+			status:   "HTTP/1.1 407 ",
+		},
+		{
+			name:   "not connect",
+			input:  "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			status: "HTTP/1.1 405 ",
+		},
+		{
+			name:   "no port",
+			input:  "CONNECT example.com HTTP/1.1\r\n\r\n",
+			status: "HTTP/1.1 400 ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ProxyConfig{Username: tt.username, Password: "secret"}
+			req, reply, err := handshake(t, []byte(tt.input), func(c net.Conn) (request, error) {
+				return connectHandshake(&bufferedConn{Conn: c, r: bufio.NewReader(c)}, cfg)
+			})
+
+			if tt.status != "" {
+				if err == nil {
+					t.Fatalf("handshake succeeded with %+v", req)
+				}
+				if !strings.HasPrefix(string(reply), tt.status) {
+					t.Errorf("reply = %q, want %q", reply, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if req != tt.want {
+				t.Errorf("request = %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+// Data sent right behind the request sits in the handshake's reader and
+// must come first when the connection is copied.
+func TestBufferedConn_CopyKeepsBufferedData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\nhello"))
+		c.Close()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	if _, err := connectHandshake(client, &config.ProxyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, client); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "hello" {
+		t.Errorf("copied %q, want %q", got.String(), "hello")
+	}
+}
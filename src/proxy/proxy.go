@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/metrics"
+	"github.com/daniellavrushin/b4/sni"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	httpPort  = 80
+	httpsPort = 443
+
+	// clients of TLS and HTTP speak first, anything else gets forwarded
+	// untouched after this long
+	firstDataTimeout = 2 * time.Second
+	dialTimeout      = 10 * time.Second
+)
+
+// core is what the proxy listeners share: the sets new connections are
+// matched against and the connections to close on stop.
+type core struct {
+	cfg     atomic.Pointer[config.Config]
+	matcher atomic.Pointer[sni.SuffixSet]
+
+	listeners []net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// UpdateConfig switches the sets and strategies of new connections. The
+// listeners keep their address until restart.
+func (c *core) UpdateConfig(cfg *config.Config) {
+	c.cfg.Store(cfg)
+	c.matcher.Store(sni.NewSuffixSet(cfg.Sets))
+}
+
+func (c *core) getConfig() *config.Config {
+	return c.cfg.Load()
+}
+
+// serve accepts connections on ln until it is closed.
+func (c *core) serve(ln net.Listener, name string, handle func(*net.TCPConn)) {
+	c.listeners = append(c.listeners, ln)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Errorf("%s accept failed: %v", name, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			c.track(conn, true)
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				defer c.track(conn, false)
+				defer conn.Close()
+				handle(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+}
+
+// shutdown closes the listeners and every proxied connection.
+func (c *core) shutdown() {
+	for _, ln := range c.listeners {
+		_ = ln.Close()
+	}
+	c.mu.Lock()
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+func (c *core) track(conn net.Conn, add bool) {
+	c.mu.Lock()
+	if add {
+		c.conns[conn] = struct{}{}
+	} else {
+		delete(c.conns, conn)
+	}
+	c.mu.Unlock()
+}
+
+// forward reads what the client sends first, writes it to upstream with the
+// strategy of the set it matches and relays the rest. host is the name the
+// client asked the proxy for, empty when only the address is known. It
+// reports whether a set applied and the bytes relayed each way.
+func (c *core) forward(client halfConn, upstream *net.TCPConn, host string) (targeted bool, sent, recv int64) {
+	c.track(upstream, true)
+	defer c.track(upstream, false)
+	matcher := c.matcher.Load()
+
+	src := client.RemoteAddr().(*net.TCPAddr)
+	dst := upstream.RemoteAddr().(*net.TCPAddr)
+	payload, err := readFirst(client, firstDataTimeout)
+	if err != nil {
+		log.Tracef("Proxy: %s closed before sending: %v", src, err)
+		return false, 0, 0
+	}
+
+	dport := uint16(dst.Port)
+	if len(payload) > 0 {
+		if name, _ := sni.ParseTLSClientHelloSNI(payload); name != "" {
+			host = name
+		} else if dport == httpPort {
+			if name, _ := sni.ParseHTTPHost(payload); name != "" {
+				host = name
+			}
+		}
+	}
+	set, ipTarget, sniTarget := matchSet(matcher, host, dst.IP, dport)
+
+	if !log.IsDiscoveryActive() {
+		log.Infof(",TCP,%s,%s,%s:%d,%s,%s:%d,%s", sniTarget, host, src.IP, src.Port, ipTarget, dst.IP, dst.Port, "")
+	}
+	metrics.GetMetricsCollector().RecordConnection("TCP", host, src.IP.String(), dst.IP.String(), set != nil)
+
+	if set != nil && len(payload) > 0 {
+		if host != "" {
+			matcher.LearnIPToDomain(dst.IP, host, set)
+		}
+		err = desync(upstream, set, payload)
+	} else if len(payload) > 0 {
+		_, err = upstream.Write(payload)
+	}
+	if err != nil {
+		log.Tracef("Proxy: failed to send first data to %s: %v", dst, err)
+		return set != nil, 0, 0
+	}
+
+	sent, recv = relay(client, upstream)
+	return set != nil, sent + int64(len(payload)), recv
+}
+
+// Server is the transparent proxy data plane. The firewall redirects TCP
+// connections to it instead of queueing their packets, it reads what the
+// client sends first, matches the sets and writes it to the real
+// destination with the set's strategy applied at the socket level.
+type Server struct {
+	core
+
+	port   int
+	tproxy bool
+}
+
+func NewServer(cfg *config.Config) *Server {
+	s := &Server{
+		core:   core{conns: make(map[net.Conn]struct{})},
+		port:   cfg.System.Transparent.Port,
+		tproxy: cfg.System.Transparent.Mode == config.TransparentTProxy,
+	}
+	s.UpdateConfig(cfg)
+	return s
+}
+
+// Start listens on the proxy port for every enabled IP version.
+func (s *Server) Start() error {
+	cfg := s.getConfig()
+	lc := net.ListenConfig{Control: s.listenControl}
+
+	var networks []string
+	if cfg.Queue.IPv4Enabled {
+		networks = append(networks, "tcp4")
+	}
+	if cfg.Queue.IPv6Enabled {
+		networks = append(networks, "tcp6")
+	}
+	for _, network := range networks {
+		ln, err := lc.Listen(context.Background(), network, ":"+strconv.Itoa(s.port))
+		if err != nil {
+			s.shutdown()
+			return fmt.Errorf("failed to listen on %s port %d: %w", network, s.port, err)
+		}
+		s.serve(ln, "Transparent proxy", s.handle)
+		log.Infof("Transparent proxy listening on %s", ln.Addr())
+	}
+	if len(s.listeners) == 0 {
+		return errors.New("transparent proxy needs IPv4 or IPv6 enabled")
+	}
+	return nil
+}
+
+// listenControl lets a TPROXY listener accept connections to any address.
+func (s *Server) listenControl(network, address string, c syscall.RawConn) error {
+	if !s.tproxy {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("failed to set transparent socket option: %w", serr)
+	}
+	return nil
+}
+
+// Stop closes the listeners and every proxied connection.
+func (s *Server) Stop() {
+	s.shutdown()
+	log.Infof("Transparent proxy stopped")
+}
+
+func (s *Server) handle(client *net.TCPConn) {
+	cfg := s.getConfig()
+
+	src := client.RemoteAddr().(*net.TCPAddr)
+	dst, err := s.originalDst(client)
+	if err != nil {
+		log.Tracef("Transparent proxy: no original destination for %s: %v", src, err)
+		return
+	}
+	// a connection to the listener itself was not redirected
+	if dst.Port == s.port {
+		log.Tracef("Transparent proxy: dropping direct connection from %s", src)
+		return
+	}
+
+	upstream, err := dialMarked(dst.String(), cfg.Queue.Mark)
+	if err != nil {
+		log.Tracef("Transparent proxy: failed to connect to %s: %v", dst, err)
+		return
+	}
+	defer upstream.Close()
+
+	s.forward(client, upstream, "")
+}
+
+// matchSet picks the set of a connection the way the queue does: the SNI or
+// Host first, the destination address otherwise. IP-matched sets only apply
+// to 443 and the ports they list.
+func matchSet(matcher *sni.SuffixSet, host string, ip net.IP, dport uint16) (set *config.SetConfig, ipTarget, sniTarget string) {
+	if ok, st := matcher.MatchIP(ip); ok && tcpPortAllowed(matcher, dport, st) {
+		set, ipTarget = st, st.Name
+	}
+	if host != "" {
+		if ok, st := matcher.MatchSNI(host); ok && tcpPortAllowed(matcher, dport, st) {
+			set, sniTarget = st, st.Name
+		}
+	}
+	return set, ipTarget, sniTarget
+}
+
+// tcpPortAllowed reports whether set applies to TCP traffic on port.
+func tcpPortAllowed(matcher *sni.SuffixSet, port uint16, set *config.SetConfig) bool {
+	if port == httpPort && set.HTTP.Enabled {
+		return true
+	}
+	return port == httpsPort || matcher.TCPPortMatchesSet(port, set)
+}
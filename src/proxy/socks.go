@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// SOCKS5 as in RFC 1928, with the username/password auth of RFC 1929. Only
+// CONNECT is served, names are resolved by b4 so the client needs no DNS.
+const (
+	socksVersion   = 0x05
+	socksAuthVer   = 0x01
+	socksNoAuth    = 0x00
+	socksUserPass  = 0x02
+	socksNoMethods = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNetworkUnreachable = 0x03
+	socksHostUnreachable    = 0x04
+	socksConnRefused        = 0x05
+	socksCmdNotSupported    = 0x07
+	socksAddrNotSupported   = 0x08
+)
+
+// socksHandshake negotiates auth and reads the CONNECT request.
+func socksHandshake(conn io.ReadWriter, cfg *config.ProxyConfig) (request, error) {
+	var req request
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return req, err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return req, err
+	}
+
+	want := byte(socksNoAuth)
+	if cfg.Username != "" {
+		want = socksUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socksVersion, socksNoMethods})
+		return req, fmt.Errorf("no acceptable auth method offered: %v", methods)
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return req, err
+	}
+	if want == socksUserPass {
+		user, pass, err := readSocksAuth(conn)
+		if err != nil {
+			return req, err
+		}
+		if !authorized(cfg, user, pass) {
+			_, _ = conn.Write([]byte{socksAuthVer, 0x01})
+			return req, errAuth
+		}
+		if _, err := conn.Write([]byte{socksAuthVer, 0x00}); err != nil {
+			return req, err
+		}
+		req.user = user
+	}
+
+	// VER CMD RSV ATYP
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return req, err
+	}
+	if head[0] != socksVersion {
+		return req, fmt.Errorf("unexpected SOCKS version %d", head[0])
+	}
+	if head[1] != socksConnect {
+		_ = writeSocksReply(conn, socksCmdNotSupported, nil)
+		return req, fmt.Errorf("unsupported SOCKS command %d", head[1])
+	}
+
+	var host string
+	switch head[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return req, err
+		}
+		host = ip.String()
+	case socksDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return req, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return req, err
+		}
+		host = string(name)
+		if net.ParseIP(host) == nil {
+			req.host = host
+		}
+	default:
+		_ = writeSocksReply(conn, socksAddrNotSupported, nil)
+		return req, fmt.Errorf("unsupported SOCKS address type %d", head[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return req, err
+	}
+	req.addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return req, nil
+}
+
+// readSocksAuth reads a username/password subnegotiation.
+func readSocksAuth(conn io.Reader) (string, string, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", "", err
+	}
+	if b[0] != socksAuthVer {
+		return "", "", fmt.Errorf("unexpected auth version %d", b[0])
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return "", "", err
+	}
+	pass := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", "", err
+	}
+	return string(user), string(pass), nil
+}
+
+// socksReply answers the CONNECT request with the outcome of the dial.
+func socksReply(conn io.Writer, upstream *net.TCPConn, dialErr error) error {
+	if dialErr != nil {
+		_ = writeSocksReply(conn, socksReplyCode(dialErr), nil)
+		return dialErr
+	}
+	return writeSocksReply(conn, socksSucceeded, upstream.LocalAddr().(*net.TCPAddr))
+}
+
+func writeSocksReply(conn io.Writer, code byte, bound *net.TCPAddr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	if bound == nil {
+		bound = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := bound.IP.To4(); ip4 != nil {
+		reply = append(append(reply, socksIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socksIPv6), bound.IP.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(bound.Port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksReplyCode maps a dial error onto the SOCKS reply field.
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	case errors.As(err, &ne) && ne.Timeout():
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,53 @@
+package replay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// Replay is the test helper: it prepares cfg the way b4 does on start and
+// replays packets one millisecond apart. A config that does not validate
+// fails the test.
+func Replay(tb testing.TB, cfg *config.Config, packets ...[]byte) *Result {
+	tb.Helper()
+	start := time.Unix(0, 0)
+	ps := make([]Packet, len(packets))
+	for i, data := range packets {
+		ps[i] = Packet{Time: start.Add(time.Duration(i) * time.Millisecond), Data: data}
+	}
+	return run(tb, cfg, ps)
+}
+
+// ReplayFile replays a pcap or pcapng file like Replay.
+func ReplayFile(tb testing.TB, cfg *config.Config, path string) *Result {
+	tb.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatalf("replay: %v", err)
+	}
+	defer f.Close()
+	ps, err := ReadPcap(f)
+	if err != nil {
+		tb.Fatalf("replay: %v", err)
+	}
+	return run(tb, cfg, ps)
+}
+
+func run(tb testing.TB, cfg *config.Config, packets []Packet) *Result {
+	tb.Helper()
+	if cfg.ConfigPath == "" {
+		// payload captures are kept next to the config
+		cfg.ConfigPath = filepath.Join(tb.TempDir(), "b4.json")
+	}
+	if err := cfg.Validate(); err != nil {
+		tb.Fatalf("replay: invalid configuration: %v", err)
+	}
+	if _, _, _, err := cfg.LoadTargets(); err != nil {
+		tb.Fatalf("replay: failed to load targets: %v", err)
+	}
+	return Run(cfg, packets)
+}
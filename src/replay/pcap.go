@@ -0,0 +1,153 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng section header block type, pcap files start with their own magic
+var ngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// packetReader is what pcapgo's pcap and pcapng readers have in common.
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// ReadPcap reads the IP packets of a pcap or pcapng capture. Link layer
+// headers are stripped, packets that are not IPv4 or IPv6 are skipped.
+func ReadPcap(r io.Reader) ([]Packet, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+
+	var pr packetReader
+	var linkType func(gopacket.CaptureInfo) layers.LinkType
+	if bytes.Equal(magic, ngMagic) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pcapng: %w", err)
+		}
+		pr = ng
+		linkType = func(ci gopacket.CaptureInfo) layers.LinkType {
+			if intf, err := ng.Interface(ci.InterfaceIndex); err == nil {
+				return intf.LinkType
+			}
+			return ng.LinkType()
+		}
+	} else {
+		p, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pcap: %w", err)
+		}
+		pr = p
+		linkType = func(gopacket.CaptureInfo) layers.LinkType { return p.LinkType() }
+	}
+
+	var packets []Packet
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, fmt.Errorf("failed to read packet %d: %w", len(packets)+1, err)
+		}
+		ip, ok := stripLinkLayer(linkType(ci), data)
+		if !ok {
+			continue
+		}
+		packets = append(packets, Packet{Time: ci.Timestamp, Data: append([]byte(nil), ip...)})
+	}
+}
+
+// stripLinkLayer returns the IP packet of a frame.
+func stripLinkLayer(lt layers.LinkType, data []byte) ([]byte, bool) {
+	switch lt {
+	case layers.LinkTypeRaw, 12, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case layers.LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		data = data[16:]
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// 802.1Q and QinQ tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if len(data) == 0 || (data[0]>>4 != 4 && data[0]>>4 != 6) {
+		return nil, false
+	}
+	return data, true
+}
+
+// WritePcap writes the events as pcapng. Each event kind is an interface of
+// its own, named after it, so a capture viewer can filter verdicts with
+// frame.interface_name.
+func WritePcap(w io.Writer, events []Event) error {
+	kinds := []EventKind{EventAccept, EventModified, EventDrop, EventInject}
+	opts := pcapgo.NgWriterOptions{SectionInfo: pcapgo.NgSectionInfo{Application: "b4 replay"}}
+
+	var ng *pcapgo.NgWriter
+	index := make(map[EventKind]int, len(kinds))
+	for i, kind := range kinds {
+		intf := pcapgo.NgInterface{
+			Name:                string(kind),
+			Description:         kind.description(),
+			LinkType:            layers.LinkTypeRaw,
+			TimestampResolution: 9,
+		}
+		if i == 0 {
+			var err error
+			if ng, err = pcapgo.NewNgWriterInterface(w, intf, opts); err != nil {
+				return err
+			}
+			index[kind] = 0
+			continue
+		}
+		id, err := ng.AddInterface(intf)
+		if err != nil {
+			return err
+		}
+		index[kind] = id
+	}
+
+	for _, e := range events {
+		ci := gopacket.CaptureInfo{
+			Timestamp:      e.Time,
+			CaptureLength:  len(e.Packet),
+			Length:         len(e.Packet),
+			InterfaceIndex: index[e.Kind],
+		}
+		if err := ng.WritePacket(ci, e.Packet); err != nil {
+			return err
+		}
+	}
+	return ng.Flush()
+}
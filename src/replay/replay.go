@@ -0,0 +1,336 @@
+// Package replay feeds captured packets through the queue callback of b4
+// without a netfilter queue or raw sockets, and records the verdicts and the
+// packets b4 would have sent.
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/nfq"
+	"github.com/daniellavrushin/b4/sock"
+	"github.com/florianl/go-nfqueue"
+)
+
+// Packet is an IP packet as it reached the queue.
+type Packet struct {
+	Time time.Time
+	Data []byte
+}
+
+type EventKind string
+
+const (
+	EventAccept   EventKind = "accept"   // the packet passed unchanged
+	EventModified EventKind = "modified" // the packet passed with new contents
+	EventDrop     EventKind = "drop"     // the packet was dropped
+	EventInject   EventKind = "inject"   // b4 sent a packet of its own
+)
+
+func (k EventKind) description() string {
+	switch k {
+	case EventAccept:
+		return "packets accepted unchanged"
+	case EventModified:
+		return "packets accepted with modified contents"
+	case EventDrop:
+		return "packets dropped"
+	}
+	return "packets sent by b4"
+}
+
+// Event is a verdict or a sent packet. Its time is the capture time of the
+// packet that caused it plus the time b4 took to get there, so the delays of
+// a strategy show.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Kind   EventKind `json:"kind"`
+	Input  int       `json:"input"` // index of the replayed packet that caused it
+	Packet []byte    `json:"-"`
+}
+
+// Flow sums up what happened to the packets of one connection.
+type Flow struct {
+	Proto    string `json:"proto"`
+	Client   string `json:"client"` // source of the first packet seen
+	Server   string `json:"server"`
+	Set      string `json:"set,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	Packets  int    `json:"packets"`
+	Accepted int    `json:"accepted"`
+	Modified int    `json:"modified"`
+	Dropped  int    `json:"dropped"`
+	Injected int    `json:"injected"`
+}
+
+type Result struct {
+	Packets   int     `json:"packets"`
+	Events    []Event `json:"events"`
+	Flows     []*Flow `json:"flows"`
+	NoVerdict []int   `json:"no_verdict,omitempty"` // packets left without a verdict
+	flows     map[string]*Flow
+}
+
+// Run replays packets through a worker configured by cfg. Strategies run
+// synchronously, so the result covers everything the packets caused.
+func Run(cfg *config.Config, packets []Packet) *Result {
+	r := &recorder{
+		packets: packets,
+		res:     &Result{Packets: len(packets), flows: make(map[string]*Flow)},
+	}
+	w := nfq.NewOfflineWorker(cfg, r, sock.NewSenderFunc(r.send), r.applied)
+	for i, p := range packets {
+		r.begin(i, p)
+		w.Handle(uint32(i+1), p.Data)
+		r.end()
+	}
+	return r.res
+}
+
+// recorder takes the verdicts and sent packets of the worker.
+type recorder struct {
+	mu      sync.Mutex
+	packets []Packet
+	res     *Result
+
+	input     int
+	verdicted bool
+	base      time.Time // capture time of the current packet
+	started   time.Time // when processing it started
+	last      time.Time
+}
+
+func (r *recorder) begin(i int, p Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.input, r.verdicted = i, false
+	r.base, r.started = p.Time, time.Now()
+	if r.base.Before(r.last) {
+		r.base = r.last
+	}
+	r.flow(p.Data).Packets++
+}
+
+func (r *recorder) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.verdicted {
+		r.res.NoVerdict = append(r.res.NoVerdict, r.input)
+	}
+}
+
+// record adds an event, r.mu must be held.
+func (r *recorder) record(kind EventKind, pkt []byte) {
+	t := r.base.Add(time.Since(r.started))
+	if t.Before(r.last) {
+		t = r.last
+	}
+	r.last = t
+	r.res.Events = append(r.res.Events, Event{Time: t, Kind: kind, Input: r.input, Packet: append([]byte(nil), pkt...)})
+
+	f := r.flow(pkt)
+	switch kind {
+	case EventAccept:
+		f.Accepted++
+	case EventModified:
+		f.Modified++
+	case EventDrop:
+		f.Dropped++
+	case EventInject:
+		f.Injected++
+	}
+}
+
+func (r *recorder) SetVerdict(id uint32, verdict int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.verdicted = true
+	pkt := r.packets[id-1].Data
+	if verdict == nfqueue.NfDrop {
+		r.record(EventDrop, pkt)
+	} else {
+		r.record(EventAccept, pkt)
+	}
+	return nil
+}
+
+func (r *recorder) SetVerdictModPacket(id uint32, verdict int, packet []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.verdicted = true
+	if verdict == nfqueue.NfDrop {
+		r.record(EventDrop, r.packets[id-1].Data)
+	} else {
+		r.record(EventModified, packet)
+	}
+	return nil
+}
+
+func (r *recorder) send(packet []byte, _ net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(EventInject, packet)
+	return nil
+}
+
+func (r *recorder) applied(a nfq.Applied) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.flow(a.Packet)
+	f.Set = a.Set.Name
+	desc := describe(a)
+	if f.Strategy == "" {
+		f.Strategy = desc
+	} else if !strings.Contains(f.Strategy, desc) {
+		f.Strategy += "; " + desc
+	}
+}
+
+// flow returns the flow of pkt, created with the packet's source as the
+// client when it is new. r.mu must be held.
+func (r *recorder) flow(pkt []byte) *Flow {
+	proto, src, dst := endpoints(pkt)
+	key := proto + " " + src + " " + dst
+	if src > dst {
+		key = proto + " " + dst + " " + src
+	}
+	f, ok := r.res.flows[key]
+	if !ok {
+		f = &Flow{Proto: proto, Client: src, Server: dst}
+		r.res.flows[key] = f
+		r.res.Flows = append(r.res.Flows, f)
+	}
+	return f
+}
+
+// endpoints returns the protocol and the addresses of a packet, with ports
+// for TCP and UDP.
+func endpoints(pkt []byte) (proto, src, dst string) {
+	var next byte
+	var ihl int
+	var srcIP, dstIP net.IP
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl = int(pkt[0]&0x0f) * 4
+		next, srcIP, dstIP = pkt[9], net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		ihl = 40
+		next, srcIP, dstIP = pkt[6], net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	default:
+		return "?", "?", "?"
+	}
+
+	switch next {
+	case 6, 17:
+		proto = "tcp"
+		if next == 17 {
+			proto = "udp"
+		}
+		if len(pkt) >= ihl+4 {
+			sport := binary.BigEndian.Uint16(pkt[ihl : ihl+2])
+			dport := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
+			return proto, net.JoinHostPort(srcIP.String(), strconv.Itoa(int(sport))), net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dport)))
+		}
+	default:
+		proto = "ip/" + strconv.Itoa(int(next))
+	}
+	return proto, srcIP.String(), dstIP.String()
+}
+
+// describe names the strategy of an applied set the way the settings do,
+// listing only the steps that ran: a pipeline replaces the fragmentation,
+// fake and desync steps.
+func describe(a nfq.Applied) string {
+	set := a.Set
+	var parts []string
+	switch a.Kind {
+	case "quic":
+		parts = append(parts, "udp "+set.UDP.Mode)
+		if set.UDP.Mode == "fake" {
+			parts = append(parts, "fake "+set.UDP.FakingStrategy)
+		}
+	case "syn":
+		parts = append(parts, "syn")
+		if set.TCP.SynFake {
+			parts = append(parts, "fake syn")
+		}
+		if set.Faking.TCPMD5 && set.Fragmentation.Strategy != config.ConfigNone {
+			parts = append(parts, "md5")
+		}
+	default:
+		if a.Kind == "http" {
+			parts = append(parts, "http")
+		}
+		if len(set.PipelineSteps) > 0 {
+			expr := set.Pipeline
+			if a.Level > 0 && a.Level <= len(set.Fallback.Strategies) {
+				expr = set.Fallback.Strategies[a.Level-1]
+			}
+			parts = append(parts, "pipeline "+expr)
+			break
+		}
+		parts = append(parts, "frag "+set.Fragmentation.Strategy)
+		if len(set.Fragmentation.SplitPositions) > 0 {
+			parts = append(parts, "split "+strings.Join(set.Fragmentation.SplitPositions, ","))
+		}
+		if set.Fragmentation.ReverseOrder {
+			parts = append(parts, "reverse")
+		}
+		if set.Faking.SNI {
+			parts = append(parts, fmt.Sprintf("fake %s ttl %d", set.Faking.Strategy, set.Faking.TTL))
+		}
+		if set.TCP.Desync.Mode != "" && set.TCP.Desync.Mode != config.ConfigOff {
+			parts = append(parts, "desync "+set.TCP.Desync.Mode)
+		}
+	}
+	if a.Level > 0 {
+		parts = append(parts, fmt.Sprintf("fallback level %d", a.Level))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Count returns how many events of kind were recorded.
+func (res *Result) Count(kind EventKind) int {
+	n := 0
+	for _, e := range res.Events {
+		if e.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Report renders the per-flow summary.
+func (res *Result) Report() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d packets: %d accepted, %d modified, %d dropped, %d injected\n",
+		res.Packets, res.Count(EventAccept), res.Count(EventModified), res.Count(EventDrop), res.Count(EventInject))
+	if len(res.NoVerdict) > 0 {
+		fmt.Fprintf(&b, "%d packets without a verdict: %v\n", len(res.NoVerdict), res.NoVerdict)
+	}
+
+	flows := append([]*Flow(nil), res.Flows...)
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Set != "" && flows[j].Set == "" })
+
+	b.WriteString("\n")
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROTO\tCLIENT\tSERVER\tSET\tSTRATEGY\tPACKETS\tACCEPT\tMODIFY\tDROP\tINJECT")
+	for _, f := range flows {
+		set, strategy := f.Set, f.Strategy
+		if set == "" {
+			set, strategy = "-", "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n",
+			f.Proto, f.Client, f.Server, set, strategy, f.Packets, f.Accepted, f.Modified, f.Dropped, f.Injected)
+	}
+	_ = tw.Flush()
+	return b.String()
+}
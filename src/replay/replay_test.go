@@ -0,0 +1,380 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/capture"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sock"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildHelloPacket(t *testing.T, domain string) []byte {
+	t.Helper()
+	hello, err := capture.GenerateTLSClientHello(domain)
+	if err != nil {
+		t.Fatalf("failed to generate ClientHello: %v", err)
+	}
+	return buildTCPPacket(40000, hello)
+}
+
+func buildTCPPacket(sport uint16, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], []byte{192, 168, 1, 10})
+	copy(pkt[16:20], []byte{93, 184, 216, 34})
+
+	binary.BigEndian.PutUint16(pkt[20:], sport)
+	binary.BigEndian.PutUint16(pkt[22:], 443)
+	binary.BigEndian.PutUint32(pkt[24:], 1000)
+	binary.BigEndian.PutUint32(pkt[28:], 2000)
+	pkt[32] = 0x50
+	pkt[33] = 0x18
+	binary.BigEndian.PutUint16(pkt[34:], 64240)
+	copy(pkt[40:], payload)
+
+	sock.FixIPv4Checksum(pkt[:20])
+	sock.FixTCPChecksum(pkt)
+	return pkt
+}
+
+// buildServerPacket is a packet of 93.184.216.34:443 to the client port
+// 40000 with the given TTL, IPv4 ID and TCP flags.
+func buildServerPacket(ttl uint8, ipID uint16, flags byte, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:6], ipID)
+	pkt[8] = ttl
+	pkt[9] = 6
+	copy(pkt[12:16], []byte{93, 184, 216, 34})
+	copy(pkt[16:20], []byte{192, 168, 1, 10})
+
+	binary.BigEndian.PutUint16(pkt[20:], 443)
+	binary.BigEndian.PutUint16(pkt[22:], 40000)
+	binary.BigEndian.PutUint32(pkt[24:], 5000)
+	binary.BigEndian.PutUint32(pkt[28:], 1001)
+	pkt[32] = 0x50
+	pkt[33] = flags
+	binary.BigEndian.PutUint16(pkt[34:], 64240)
+	copy(pkt[40:], payload)
+
+	sock.FixIPv4Checksum(pkt[:20])
+	sock.FixTCPChecksum(pkt)
+	return pkt
+}
+
+// buildHelloWithoutSNI is a ClientHello with no extensions, like one
+// hiding its server name.
+func buildHelloWithoutSNI() []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0x00)                   // session ID
+	body = append(body, 0x00, 0x02, 0x13, 0x01) // cipher suites
+	body = append(body, 0x01, 0x00)             // compression
+	hs := append([]byte{0x01, 0x00, 0x00, byte(len(body))}, body...)
+	return append([]byte{0x16, 0x03, 0x01, 0x00, byte(len(hs))}, hs...)
+}
+
+// buildDNSAnswer is a response of 8.8.8.8 resolving name to 93.184.216.34.
+func buildDNSAnswer(t *testing.T, name string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 7, Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}},
+		}},
+	}
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], []byte{8, 8, 8, 8})
+	copy(pkt[16:20], []byte{192, 168, 1, 10})
+	binary.BigEndian.PutUint16(pkt[20:], 53)
+	binary.BigEndian.PutUint16(pkt[22:], 5353)
+	binary.BigEndian.PutUint16(pkt[24:], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+
+	sock.FixIPv4Checksum(pkt[:20])
+	sock.FixUDPChecksum(pkt, 20)
+	return pkt
+}
+
+func packDNSQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 9, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	query, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// buildDNSQuery is a query for name sent to 8.8.8.8 from port 5353.
+func buildDNSQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	query := packDNSQuery(t, name)
+	pkt := make([]byte, 28+len(query))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], []byte{192, 168, 1, 10})
+	copy(pkt[16:20], []byte{8, 8, 8, 8})
+	binary.BigEndian.PutUint16(pkt[20:], 5353)
+	binary.BigEndian.PutUint16(pkt[22:], 53)
+	binary.BigEndian.PutUint16(pkt[24:], uint16(8+len(query)))
+	copy(pkt[28:], query)
+
+	sock.FixIPv4Checksum(pkt[:20])
+	sock.FixUDPChecksum(pkt, 20)
+	return pkt
+}
+
+// buildDNSQueryTCP is a query for name sent over an established TCP
+// connection to 8.8.8.8.
+func buildDNSQueryTCP(t *testing.T, name string) []byte {
+	t.Helper()
+	query := packDNSQuery(t, name)
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	payload = append(payload, query...)
+
+	pkt := buildTCPPacket(40002, payload)
+	copy(pkt[16:20], []byte{8, 8, 8, 8})
+	binary.BigEndian.PutUint16(pkt[22:], 53)
+	sock.FixIPv4Checksum(pkt[:20])
+	sock.FixTCPChecksum(pkt)
+	return pkt
+}
+
+func testConfig(domains ...string) *config.Config {
+	cfg := config.NewConfig()
+	set := config.NewSetConfig()
+	set.Targets.SNIDomains = domains
+	cfg.Sets = []*config.SetConfig{&set}
+	return &cfg
+}
+
+func TestReplay_TargetedClientHello(t *testing.T) {
+	res := Replay(t, testConfig("example.com"), buildHelloPacket(t, "www.example.com"))
+
+	if len(res.NoVerdict) != 0 {
+		t.Fatalf("packets without a verdict: %v", res.NoVerdict)
+	}
+	if res.Count(EventAccept) != 0 {
+		t.Errorf("targeted ClientHello passed unchanged:\n%s", res.Report())
+	}
+	if res.Count(EventInject) == 0 {
+		t.Errorf("no packets sent for a targeted ClientHello:\n%s", res.Report())
+	}
+
+	if len(res.Flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(res.Flows))
+	}
+	f := res.Flows[0]
+	if f.Set != "default" || f.Strategy == "" {
+		t.Errorf("flow set = %q, strategy = %q", f.Set, f.Strategy)
+	}
+	if f.Client != "192.168.1.10:40000" || f.Server != "93.184.216.34:443" {
+		t.Errorf("flow endpoints = %s -> %s", f.Client, f.Server)
+	}
+	if !strings.Contains(res.Report(), "default") {
+		t.Errorf("report misses the set:\n%s", res.Report())
+	}
+}
+
+func TestReplay_DescribesPipeline(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].Pipeline = "split(at=sni+1); disorder"
+	cfg.Sets[0].Fragmentation.SplitPositions = []string{"midsld"}
+	res := Replay(t, cfg, buildHelloPacket(t, "www.example.com"))
+
+	if len(res.Flows) != 1 {
+		t.Fatalf("expected 1 flow, got %d", len(res.Flows))
+	}
+	if s := res.Flows[0].Strategy; s != "pipeline split(at=sni+1); disorder" {
+		t.Errorf("strategy = %q", s)
+	}
+}
+
+func TestReplay_UntargetedClientHello(t *testing.T) {
+	res := Replay(t, testConfig("example.com"), buildHelloPacket(t, "www.example.org"))
+
+	if res.Count(EventAccept) != 1 || len(res.Events) != 1 {
+		t.Errorf("expected a single accept, got:\n%s", res.Report())
+	}
+	if res.Flows[0].Set != "" {
+		t.Errorf("untargeted flow got set %q", res.Flows[0].Set)
+	}
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	res := Replay(t, testConfig("example.com"), buildHelloPacket(t, "www.example.com"))
+
+	var buf bytes.Buffer
+	if err := WritePcap(&buf, res.Events); err != nil {
+		t.Fatalf("WritePcap: %v", err)
+	}
+	packets, err := ReadPcap(&buf)
+	if err != nil {
+		t.Fatalf("ReadPcap: %v", err)
+	}
+	if len(packets) != len(res.Events) {
+		t.Fatalf("read %d packets, wrote %d", len(packets), len(res.Events))
+	}
+	for i, p := range packets {
+		if !bytes.Equal(p.Data, res.Events[i].Packet) {
+			t.Errorf("packet %d differs", i)
+		}
+		if !p.Time.Equal(res.Events[i].Time) {
+			t.Errorf("packet %d time = %v, want %v", i, p.Time, res.Events[i].Time)
+		}
+	}
+}
+
+func TestStripLinkLayer(t *testing.T) {
+	ip := []byte{0x45, 0, 0, 20}
+
+	eth := append(make([]byte, 12), 0x81, 0x00, 0, 1, 0x08, 0x00)
+	if got, ok := stripLinkLayer(1, append(eth, ip...)); !ok || !bytes.Equal(got, ip) {
+		t.Errorf("VLAN ethernet frame: got %x, %v", got, ok)
+	}
+
+	arp := append(make([]byte, 12), 0x08, 0x06)
+	if _, ok := stripLinkLayer(1, append(arp, ip...)); ok {
+		t.Error("ARP frame was not skipped")
+	}
+
+	if got, ok := stripLinkLayer(113, append(make([]byte, 16), ip...)); !ok || !bytes.Equal(got, ip) {
+		t.Errorf("Linux cooked frame: got %x, %v", got, ok)
+	}
+}
+
+func TestReplay_LearnsIPsFromDNS(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].DNS.LearnIPs = true
+	res := Replay(t, cfg, buildDNSAnswer(t, "www.example.com."), buildTCPPacket(40001, buildHelloWithoutSNI()))
+
+	if res.Count(EventAccept) != 1 {
+		t.Errorf("expected only the DNS answer to pass unchanged:\n%s", res.Report())
+	}
+	if f := res.Flows[1]; f.Set != "default" {
+		t.Errorf("ClientHello without SNI to a learned address got set %q:\n%s", f.Set, res.Report())
+	}
+
+	cfg = testConfig("example.com")
+	res = Replay(t, cfg, buildDNSAnswer(t, "www.example.com."), buildTCPPacket(40001, buildHelloWithoutSNI()))
+	if res.Count(EventAccept) != 2 {
+		t.Errorf("addresses were learned with learning disabled:\n%s", res.Report())
+	}
+}
+
+func TestReplay_DropsForgedDNSAnswer(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].DNS.FilterForged = true
+	cfg.Sets[0].DNS.BogusIPs = []string{"93.184.216.0/24"}
+	res := Replay(t, cfg, buildDNSAnswer(t, "www.example.com."))
+
+	if res.Count(EventDrop) != 1 || len(res.Events) != 1 {
+		t.Errorf("expected the answer with a bogus address to be dropped:\n%s", res.Report())
+	}
+
+	cfg = testConfig("example.com")
+	res = Replay(t, cfg, buildDNSAnswer(t, "www.example.com."))
+	if res.Count(EventAccept) != 1 {
+		t.Errorf("answer was filtered with the filter disabled:\n%s", res.Report())
+	}
+}
+
+func TestReplay_RedirectsDNSOverTCP(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].DNS.Enabled = true
+	cfg.Sets[0].DNS.TargetDNS = "127.0.0.1"
+	res := Replay(t, cfg, buildDNSQueryTCP(t, "www.example.com."), buildDNSQueryTCP(t, "other.org."))
+
+	if res.Count(EventDrop) != 1 || res.Count(EventAccept) != 1 {
+		t.Errorf("expected only the targeted query to be taken over:\n%s", res.Report())
+	}
+}
+
+func TestReplay_AnswersFromDNSHosts(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].DNS.Enabled = true
+	cfg.Sets[0].DNS.Hosts = map[string][]string{"*.example.com": {"203.0.113.5"}}
+
+	hello := buildTCPPacket(40001, buildHelloWithoutSNI())
+	copy(hello[16:20], []byte{203, 0, 113, 5})
+	sock.FixIPv4Checksum(hello[:20])
+	sock.FixTCPChecksum(hello)
+	res := Replay(t, cfg, buildDNSQuery(t, "www.example.com."), hello)
+
+	var reply []byte
+	for _, e := range res.Events {
+		if e.Kind == EventInject && e.Input == 0 {
+			reply = e.Packet
+		}
+	}
+	if reply == nil {
+		t.Fatalf("expected the query to be answered by b4:\n%s", res.Report())
+	}
+	if len(reply) < 28 || !bytes.Equal(reply[12:16], []byte{8, 8, 8, 8}) || binary.BigEndian.Uint16(reply[22:24]) != 5353 {
+		t.Fatalf("reply does not come from the resolver asked: %x", reply)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(reply[28:]); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 9 || len(m.Questions) != 1 || len(m.Answers) != 1 || m.Answers[0].Header.TTL == 0 {
+		t.Fatalf("unexpected answer %+v", m)
+	}
+	if a, ok := m.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{203, 0, 113, 5} {
+		t.Errorf("answer resolves to %v", m.Answers[0].Body)
+	}
+
+	for _, f := range res.Flows {
+		if f.Proto == "tcp" && f.Set != "default" {
+			t.Errorf("connection to the static address got set %q:\n%s", f.Set, res.Report())
+		}
+	}
+}
+
+func TestReplay_ForgedHTTPResponse(t *testing.T) {
+	cfg := testConfig("example.com")
+	cfg.Sets[0].TCP.Forged.Enabled = true
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+
+	// a server numbering its packets at random is still genuine
+	res := Replay(t, cfg,
+		buildServerPacket(52, 100, 0x12, nil),
+		buildHelloPacket(t, "www.example.com"),
+		buildServerPacket(52, 51234, 0x18, response))
+	if e := res.Events[len(res.Events)-1]; e.Input != 2 || e.Kind != EventAccept {
+		t.Errorf("genuine response with a random IP ID was not accepted:\n%s", res.Report())
+	}
+
+	res = Replay(t, cfg,
+		buildServerPacket(52, 100, 0x12, nil),
+		buildHelloPacket(t, "www.example.com"),
+		buildServerPacket(61, 101, 0x18, response))
+	if e := res.Events[len(res.Events)-1]; e.Input != 2 || e.Kind != EventDrop {
+		t.Errorf("response with a TTL unlike the SYN-ACK's was not dropped:\n%s", res.Report())
+	}
+}
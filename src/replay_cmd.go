@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/replay"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayConfigPath string
+	replayOutPath    string
+	replayJSON       bool
+	replayVerbose    bool
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <capture.pcap>",
+	Short: "Run a packet capture through the packet pipeline offline and record what b4 would do",
+	Long: `Feeds the IP packets of a pcap or pcapng capture through the same queue
+handling b4 runs on a live system, without a netfilter queue or raw sockets.
+The verdicts and the packets b4 would have sent are written to --out as
+pcapng, with an interface per verdict, and the set and strategy applied to
+each flow is printed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runReplay,
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayConfigPath, "config", "", "Path to the config file with the sets to replay against")
+	replayCmd.Flags().StringVar(&replayOutPath, "out", "", "Write the verdicts and sent packets to this pcapng file")
+	replayCmd.Flags().BoolVar(&replayJSON, "json", false, "Print the flows and events as JSON")
+	replayCmd.Flags().BoolVar(&replayVerbose, "verbose", false, "Print the packet log of b4 to stderr")
+	_ = replayCmd.MarkFlagRequired("config")
+
+	rootCmd.AddCommand(replayCmd)
+}
+
+func runReplay(cmd *cobra.Command, args []string) error {
+	c := config.NewConfig()
+	c.ConfigPath = replayConfigPath
+	if err := c.LoadWithMigration(replayConfigPath); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if _, _, _, err := c.LoadTargets(); err != nil {
+		return fmt.Errorf("failed to load targets: %w", err)
+	}
+
+	level := log.LevelError
+	if replayVerbose {
+		level = log.LevelTrace
+	}
+	log.Init(os.Stderr, level, true)
+
+	in, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	packets, err := replay.ReadPcap(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	res := replay.Run(&c, packets)
+
+	if replayOutPath != "" {
+		out, err := os.Create(replayOutPath)
+		if err != nil {
+			return err
+		}
+		if err := replay.WritePcap(out, res.Events); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to write %s: %w", replayOutPath, err)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	if replayJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	fmt.Print(res.Report())
+	return nil
+}
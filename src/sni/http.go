@@ -0,0 +1,103 @@
+package sni
+
+import (
+	"bytes"
+	"strings"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("POST "),
+	[]byte("HEAD "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+var httpHostHeader = []byte("host:")
+
+// IsHTTPRequest reports whether b starts with a known HTTP request method.
+func IsHTTPRequest(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocateHTTPHost finds the Host header of a plain HTTP request. hdr is the
+// offset of the header name, [start, end) spans the value without the
+// surrounding whitespace. A Host line cut off by the end of b may hold a
+// partial name and is not reported.
+func LocateHTTPHost(b []byte) (hdr, start, end int, ok bool) {
+	if !IsHTTPRequest(b) {
+		return 0, 0, 0, false
+	}
+
+	// skip the request line
+	i := bytes.IndexByte(b, '\n')
+	for i >= 0 && i+1 < len(b) {
+		line := i + 1
+		lineEnd := len(b)
+		if n := bytes.IndexByte(b[line:], '\n'); n >= 0 {
+			lineEnd = line + n
+		}
+
+		l := bytes.TrimRight(b[line:lineEnd], "\r")
+		if len(l) == 0 {
+			break // end of headers
+		}
+
+		if len(l) >= len(httpHostHeader) && bytes.EqualFold(l[:len(httpHostHeader)], httpHostHeader) {
+			if lineEnd == len(b) {
+				return 0, 0, 0, false
+			}
+			s := line + len(httpHostHeader)
+			e := line + len(l)
+			for s < e && (b[s] == ' ' || b[s] == '\t') {
+				s++
+			}
+			for e > s && (b[e-1] == ' ' || b[e-1] == '\t') {
+				e--
+			}
+			if e == s {
+				return 0, 0, 0, false
+			}
+			return line, s, e, true
+		}
+
+		if lineEnd == len(b) {
+			break
+		}
+		i = lineEnd
+	}
+
+	return 0, 0, 0, false
+}
+
+// ParseHTTPHost extracts the lowercased host name (without port) from the Host
+// header of a plain HTTP request.
+func ParseHTTPHost(b []byte) (string, bool) {
+	_, s, e, ok := LocateHTTPHost(b)
+	if !ok {
+		return "", false
+	}
+
+	host := string(b[s:e])
+	if strings.HasPrefix(host, "[") {
+		return "", false // IPv6 literal, nothing to match by name
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+
+	if !validateSNI(host) {
+		return "", false
+	}
+	return host, true
+}
@@ -0,0 +1,98 @@
+package sni
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsHTTPRequest(t *testing.T) {
+	tests := []struct {
+		req  string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"POST /form HTTP/1.1\r\n", true},
+		{"HEAD / HTTP/1.0\r\n", true},
+		{"OPTIONS * HTTP/1.1\r\n", true},
+		{"CONNECT example.com:443 HTTP/1.1\r\n", true},
+		{"get / HTTP/1.1\r\n", false},
+		{"BREW /pot HTCPCP/1.0\r\n", false},
+		{"GET", false},
+		{"\x16\x03\x01\x02\x00", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsHTTPRequest([]byte(tt.req)); got != tt.want {
+			t.Errorf("IsHTTPRequest(%q) = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestLocateHTTPHost(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		host string // value spanned by [start, end), empty when not found
+	}{
+		{"first line", "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n", "example.com"},
+		{"last line", "GET / HTTP/1.1\r\nAccept: */*\r\nUser-Agent: test\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"mixed case name", "GET / HTTP/1.1\r\nhOsT: example.com\r\n\r\n", "example.com"},
+		{"upper case name", "GET / HTTP/1.1\r\nHOST: example.com\r\n\r\n", "example.com"},
+		{"no space", "GET / HTTP/1.1\r\nHost:example.com\r\n\r\n", "example.com"},
+		{"surrounding whitespace", "GET / HTTP/1.1\r\nHost: \texample.com \t\r\n\r\n", "example.com"},
+		{"bare newlines", "GET / HTTP/1.1\nHost: example.com\n\n", "example.com"},
+		{"port", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080"},
+		{"header block not finished", "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */", "example.com"},
+		{"no host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", ""},
+		{"host in the body", "POST / HTTP/1.1\r\nContent-Length: 17\r\n\r\nHost: example.com\r\n", ""},
+		{"host value cut off", "GET / HTTP/1.1\r\nHost: exam", ""},
+		{"empty value", "GET / HTTP/1.1\r\nHost: \r\n\r\n", ""},
+		{"longer header name", "GET / HTTP/1.1\r\nHost-Override: example.com\r\n\r\n", ""},
+		{"request line only", "GET / HTTP/1.1", ""},
+		{"not http", "BREW / HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := []byte(tt.req)
+			hdr, start, end, ok := LocateHTTPHost(b)
+			if tt.host == "" {
+				if ok {
+					t.Fatalf("found host %q", b[start:end])
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("host not found")
+			}
+			if got := string(b[start:end]); got != tt.host {
+				t.Errorf("host = %q, want %q", got, tt.host)
+			}
+			if want := strings.Index(strings.ToLower(tt.req), "\nhost:") + 1; hdr != want {
+				t.Errorf("header at %d, want %d", hdr, want)
+			}
+		})
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.COM\r\n\r\n", "example.com"},
+		{"GET / HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n", "www.example.com"},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "localhost"},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: intranet\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: exa mple.com\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\n\r\n", ""},
+		{"SSH-2.0-OpenSSH_9.6\r\n", ""},
+	}
+	for _, tt := range tests {
+		got, ok := ParseHTTPHost([]byte(tt.req))
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("ParseHTTPHost(%q) = %q, %v, want %q", tt.req, got, ok, tt.want)
+		}
+	}
+}
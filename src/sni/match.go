@@ -32,6 +32,8 @@ type SuffixSet struct {
 	ipRanger   cidranger.Ranger
 	portRanges []portRange
 
+	tcpPortRanges []portRange
+
 	ipCache      map[string]*cacheEntry
 	ipCacheLRU   *list.List
 	ipCacheMu    sync.RWMutex
@@ -60,10 +62,29 @@ type cacheEntry struct {
 type learnedIPEntry struct {
 	domain    string
 	set       *config.SetConfig
+	ttl       time.Duration
 	learnedAt time.Time
+	notified  time.Time
 	element   *list.Element
 }
 
+// learnHook is told about learned addresses so they can be mirrored into the
+// kernel target sets.
+var learnHook atomic.Value
+
+// OnLearnIP registers fn to be called when an address is learned for a set,
+// and again once half of its lifetime passed while it is still in use. fn
+// must not block.
+func OnLearnIP(fn func(ip net.IP, set *config.SetConfig, ttl time.Duration)) {
+	learnHook.Store(fn)
+}
+
+func notifyLearned(ip net.IP, set *config.SetConfig, ttl time.Duration) {
+	if fn, ok := learnHook.Load().(func(net.IP, *config.SetConfig, time.Duration)); ok && fn != nil {
+		fn(ip, set, ttl)
+	}
+}
+
 type regexWithSet struct {
 	regex *regexp.Regexp
 	set   *config.SetConfig
@@ -155,36 +176,44 @@ func NewSuffixSet(sets []*config.SetConfig) *SuffixSet {
 			}
 		}
 
-		if set.UDP.DPortFilter != "" {
-			ports := strings.Split(set.UDP.DPortFilter, ",")
-			for _, part := range ports {
-				part = strings.TrimSpace(part)
-				if part == "" {
-					continue
-				}
+		s.portRanges = append(s.portRanges, parsePortRanges(set.UDP.DPortFilter, set)...)
+		s.tcpPortRanges = append(s.tcpPortRanges, parsePortRanges(set.TCP.DPortFilter, set)...)
+	}
 
-				if strings.Contains(part, "-") {
-					bounds := strings.SplitN(part, "-", 2)
-					if len(bounds) == 2 {
-						min, err1 := strconv.Atoi(bounds[0])
-						max, err2 := strconv.Atoi(bounds[1])
-						if err1 == nil && err2 == nil {
-							if min >= 0 && max >= 0 && min <= max {
-								s.portRanges = append(s.portRanges, portRange{min: min, max: max, set: set})
-							}
-						}
-					}
-				} else {
-					port, err := strconv.Atoi(part)
-					if err == nil && port >= 0 {
-						s.portRanges = append(s.portRanges, portRange{min: port, max: port, set: set})
+	return s
+}
+
+func parsePortRanges(filter string, set *config.SetConfig) []portRange {
+	if filter == "" {
+		return nil
+	}
+
+	var ranges []portRange
+	for _, part := range strings.Split(filter, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if strings.Contains(part, "-") {
+			bounds := strings.SplitN(part, "-", 2)
+			if len(bounds) == 2 {
+				min, err1 := strconv.Atoi(bounds[0])
+				max, err2 := strconv.Atoi(bounds[1])
+				if err1 == nil && err2 == nil {
+					if min >= 0 && max >= 0 && min <= max {
+						ranges = append(ranges, portRange{min: min, max: max, set: set})
 					}
 				}
 			}
+		} else {
+			port, err := strconv.Atoi(part)
+			if err == nil && port >= 0 {
+				ranges = append(ranges, portRange{min: port, max: port, set: set})
+			}
 		}
 	}
-
-	return s
+	return ranges
 }
 
 func (s *SuffixSet) MatchUDPPort(dport uint16) (bool, *config.SetConfig) {
@@ -364,20 +393,36 @@ func (s *SuffixSet) matchRegex(host string) (bool, *config.SetConfig) {
 }
 
 func (s *SuffixSet) LearnIPToDomain(ip net.IP, domain string, set *config.SetConfig) {
+	s.LearnIPToDomainTTL(ip, domain, set, 0)
+}
+
+// LearnIPToDomainTTL learns ip for ttl since it was last used, a DNS answer
+// is trusted for as long as its record says. 0 uses the default lifetime.
+func (s *SuffixSet) LearnIPToDomainTTL(ip net.IP, domain string, set *config.SetConfig, ttl time.Duration) {
 	if s == nil || ip == nil || domain == "" || set == nil {
 		return
 	}
+	if ttl <= 0 {
+		ttl = s.learnedIPTTL
+	}
 
 	ipStr := ip.String()
 
 	s.learnedIPCacheMu.Lock()
 	defer s.learnedIPCacheMu.Unlock()
 
+	now := time.Now()
 	if entry, exists := s.learnedIPCache[ipStr]; exists {
 		s.learnedIPCacheLRU.MoveToFront(entry.element)
+		moved := entry.set != set
 		entry.domain = domain
 		entry.set = set
-		entry.learnedAt = time.Now()
+		entry.ttl = ttl
+		entry.learnedAt = now
+		if moved || now.Sub(entry.notified) > ttl/2 {
+			entry.notified = now
+			notifyLearned(ip, set, ttl)
+		}
 		return
 	}
 
@@ -393,9 +438,12 @@ func (s *SuffixSet) LearnIPToDomain(ip net.IP, domain string, set *config.SetCon
 	s.learnedIPCache[ipStr] = &learnedIPEntry{
 		domain:    domain,
 		set:       set,
-		learnedAt: time.Now(),
+		ttl:       ttl,
+		learnedAt: now,
+		notified:  now,
 		element:   element,
 	}
+	notifyLearned(ip, set, ttl)
 }
 
 func (s *SuffixSet) MatchLearnedIP(ip net.IP) (bool, *config.SetConfig, string) {
@@ -421,7 +469,7 @@ func (s *SuffixSet) MatchLearnedIP(ip net.IP) (bool, *config.SetConfig, string)
 		return false, nil, ""
 	}
 
-	if time.Since(entry.learnedAt) > s.learnedIPTTL {
+	if time.Since(entry.learnedAt) > entry.ttl {
 		if currentEntry, stillExists := s.learnedIPCache[ipStr]; stillExists && currentEntry == entry {
 			delete(s.learnedIPCache, ipStr)
 			s.learnedIPCacheLRU.Remove(entry.element)
@@ -490,3 +538,31 @@ func (s *SuffixSet) MatchUDPPortOnly(dport uint16) (bool, *config.SetConfig) {
 	}
 	return false, nil
 }
+
+// MatchTCPPort reports whether any enabled set listed dport in its TCP port filter.
+func (s *SuffixSet) MatchTCPPort(dport uint16) bool {
+	if s == nil {
+		return false
+	}
+	port := int(dport)
+	for _, r := range s.tcpPortRanges {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// TCPPortMatchesSet reports whether targetSet listed dport in its TCP port filter.
+func (s *SuffixSet) TCPPortMatchesSet(dport uint16, targetSet *config.SetConfig) bool {
+	if s == nil || targetSet == nil {
+		return false
+	}
+	port := int(dport)
+	for _, r := range s.tcpPortRanges {
+		if r.set == targetSet && port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package sock
 
 import (
+	"net"
+	"sync"
 	"testing"
 
 	"github.com/daniellavrushin/b4/config"
@@ -44,3 +46,60 @@ func BenchmarkStripSACKFromTCP(b *testing.B) {
 		StripSACKFromTCP(pkt)
 	}
 }
+
+// benchSender stands in for the raw socket and the verdict: both copy the
+// packet once, as the kernel does.
+func benchSender() (*Sender, func([]byte) error) {
+	var sink []byte
+	send := func(p []byte, _ net.IP) error {
+		sink = append(sink[:0], p...)
+		return nil
+	}
+	verdict := func(p []byte) error {
+		sink = append(sink[:0], p...)
+		return nil
+	}
+	return NewSenderFunc(send), verdict
+}
+
+// BenchmarkSendReinject is the default path: the queued packet is dropped and
+// every segment is sent from a goroutine through the raw socket.
+func BenchmarkSendReinject(b *testing.B) {
+	s, _ := benchSender()
+	pkt := buildMinimalIPv4TCPPacket(517)
+	dst := net.IPv4(10, 0, 0, 1)
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cp := make([]byte, len(pkt))
+		copy(cp, pkt)
+		wg.Add(1)
+		go func(p []byte) {
+			defer wg.Done()
+			seg1, seg2, _ := SplitTCPSegmentV4(p)
+			_ = s.SendIPv4(seg2, dst)
+			_ = s.SendIPv4(seg1, dst)
+		}(cp)
+		wg.Wait()
+	}
+}
+
+// BenchmarkSendModifiedVerdict returns the first segment in the verdict and
+// only sends the rest through the raw socket.
+func BenchmarkSendModifiedVerdict(b *testing.B) {
+	s, verdict := benchSender()
+	pkt := buildMinimalIPv4TCPPacket(517)
+	dst := net.IPv4(10, 0, 0, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := s.Capture(pkt, verdict)
+		seg1, seg2, _ := SplitTCPSegmentV4(pkt)
+		_ = s.SendIPv4(seg2, dst)
+		_ = s.SendIPv4(seg1, dst)
+		if !s.Release(c) {
+			b.Fatal("expected a segment in the verdict")
+		}
+	}
+}
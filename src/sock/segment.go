@@ -0,0 +1,90 @@
+package sock
+
+import (
+	"encoding/binary"
+)
+
+// SplitTCPSegmentV4 splits the payload of an IPv4 TCP packet in two halves and
+// returns two correctly sequenced segments.
+func SplitTCPSegmentV4(packet []byte) ([]byte, []byte, bool) {
+	if len(packet) < 40 || packet[0]>>4 != 4 || packet[9] != 6 {
+		return nil, nil, false
+	}
+	if binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0 {
+		return nil, nil, false // already an IP fragment
+	}
+
+	ipHdrLen := int((packet[0] & 0x0F) * 4)
+	if len(packet) < ipHdrLen+20 {
+		return nil, nil, false
+	}
+	tcpHdrLen := int((packet[ipHdrLen+12] >> 4) * 4)
+	payloadStart := ipHdrLen + tcpHdrLen
+	payloadLen := len(packet) - payloadStart
+	if payloadLen < 2 {
+		return nil, nil, false
+	}
+
+	half := payloadLen / 2
+	seq := binary.BigEndian.Uint32(packet[ipHdrLen+4 : ipHdrLen+8])
+	id := binary.BigEndian.Uint16(packet[4:6])
+
+	seg1 := make([]byte, payloadStart+half)
+	copy(seg1, packet[:payloadStart+half])
+	ClearTCPFlags(seg1[ipHdrLen:], 0x08|0x01) // PSH, FIN stay on the last segment
+	binary.BigEndian.PutUint16(seg1[2:4], uint16(len(seg1)))
+	FixIPv4Checksum(seg1[:ipHdrLen])
+	FixTCPChecksum(seg1)
+
+	seg2 := make([]byte, payloadStart+payloadLen-half)
+	copy(seg2, packet[:payloadStart])
+	copy(seg2[payloadStart:], packet[payloadStart+half:])
+	binary.BigEndian.PutUint32(seg2[ipHdrLen+4:ipHdrLen+8], seq+uint32(half))
+	binary.BigEndian.PutUint16(seg2[4:6], id+1)
+	binary.BigEndian.PutUint16(seg2[2:4], uint16(len(seg2)))
+	FixIPv4Checksum(seg2[:ipHdrLen])
+	FixTCPChecksum(seg2)
+
+	return seg1, seg2, true
+}
+
+// SplitTCPSegmentV6 is the IPv6 counterpart of SplitTCPSegmentV4. Packets with
+// extension headers are not split.
+func SplitTCPSegmentV6(packet []byte) ([]byte, []byte, bool) {
+	if len(packet) < 60 || packet[0]>>4 != 6 || packet[6] != 6 {
+		return nil, nil, false
+	}
+
+	const ipHdrLen = 40
+	tcpHdrLen := int((packet[ipHdrLen+12] >> 4) * 4)
+	payloadStart := ipHdrLen + tcpHdrLen
+	payloadLen := len(packet) - payloadStart
+	if payloadLen < 2 {
+		return nil, nil, false
+	}
+
+	half := payloadLen / 2
+	seq := binary.BigEndian.Uint32(packet[ipHdrLen+4 : ipHdrLen+8])
+
+	seg1 := make([]byte, payloadStart+half)
+	copy(seg1, packet[:payloadStart+half])
+	ClearTCPFlags(seg1[ipHdrLen:], 0x08|0x01)
+	binary.BigEndian.PutUint16(seg1[4:6], uint16(len(seg1)-ipHdrLen))
+	FixTCPChecksumV6(seg1)
+
+	seg2 := make([]byte, payloadStart+payloadLen-half)
+	copy(seg2, packet[:payloadStart])
+	copy(seg2[payloadStart:], packet[payloadStart+half:])
+	binary.BigEndian.PutUint32(seg2[ipHdrLen+4:ipHdrLen+8], seq+uint32(half))
+	binary.BigEndian.PutUint16(seg2[4:6], uint16(len(seg2)-ipHdrLen))
+	FixTCPChecksumV6(seg2)
+
+	return seg1, seg2, true
+}
+
+// ClearTCPFlags clears the given flag bits in a TCP header.
+func ClearTCPFlags(tcp []byte, flags byte) {
+	if len(tcp) > 13 {
+		tcp[13] &^= flags
+	}
+}
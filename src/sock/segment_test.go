@@ -0,0 +1,58 @@
+package sock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSplitTCPSegmentV4(t *testing.T) {
+	pkt := buildMinimalIPv4TCPPacket(101)
+
+	seg1, seg2, ok := SplitTCPSegmentV4(pkt)
+	if !ok {
+		t.Fatal("expected packet to be split")
+	}
+
+	if got := binary.BigEndian.Uint16(seg1[2:4]); int(got) != len(seg1) {
+		t.Errorf("seg1 total length %d, want %d", got, len(seg1))
+	}
+	if got := binary.BigEndian.Uint16(seg2[2:4]); int(got) != len(seg2) {
+		t.Errorf("seg2 total length %d, want %d", got, len(seg2))
+	}
+	if got := binary.BigEndian.Uint32(seg2[24:28]); got != 1000+50 {
+		t.Errorf("seg2 seq %d, want %d", got, 1050)
+	}
+	if seg1[33]&0x08 != 0 {
+		t.Error("PSH should only be set on the last segment")
+	}
+
+	payload := append(append([]byte{}, seg1[40:]...), seg2[40:]...)
+	if !bytes.Equal(payload, pkt[40:]) {
+		t.Error("segments do not carry the original payload")
+	}
+}
+
+func TestSplitTCPSegmentV4_TooSmall(t *testing.T) {
+	if _, _, ok := SplitTCPSegmentV4(buildMinimalIPv4TCPPacket(1)); ok {
+		t.Error("single byte payload should not be split")
+	}
+}
+
+func TestSplitTCPSegmentV6(t *testing.T) {
+	pkt := buildMinimalIPv6TCPPacket(100)
+
+	seg1, seg2, ok := SplitTCPSegmentV6(pkt)
+	if !ok {
+		t.Fatal("expected packet to be split")
+	}
+
+	if got := binary.BigEndian.Uint16(seg1[4:6]); int(got) != len(seg1)-40 {
+		t.Errorf("seg1 payload length %d, want %d", got, len(seg1)-40)
+	}
+	seq1 := binary.BigEndian.Uint32(seg1[44:48])
+	seq2 := binary.BigEndian.Uint32(seg2[44:48])
+	if seq2-seq1 != 50 {
+		t.Errorf("seg2 seq offset %d, want 50", seq2-seq1)
+	}
+}
@@ -12,6 +12,9 @@ type Sender struct {
 	fd4  int
 	fd6  int
 	mark int
+	send func(packet []byte, dst net.IP) error // replaces the sockets when set
+
+	captures captureTable
 }
 
 func NewSenderWithMark(mark int) (*Sender, error) {
@@ -51,25 +54,66 @@ func NewSenderWithMark(mark int) (*Sender, error) {
 	return s, nil
 }
 
+// NewSenderFunc returns a Sender handing every packet to send instead of a
+// raw socket, for replays and tests.
+func NewSenderFunc(send func(packet []byte, dst net.IP) error) *Sender {
+	return &Sender{fd4: -1, fd6: -1, send: send}
+}
+
 func NewSender(mark int) (*Sender, error) {
 	return NewSenderWithMark(mark)
 }
 
 func (s *Sender) SendIPv4(packet []byte, destIP net.IP) error {
+	if s.intercept(packet) {
+		log.Tracef("Returning IPv4 packet to %s in verdict, len=%d", destIP.String(), len(packet))
+		return nil
+	}
+	if s.send != nil {
+		return s.send(packet, destIP)
+	}
 	log.Tracef("Sending IPv4 packet to %s, len=%d", destIP.String(), len(packet))
 	addr := syscall.SockaddrInet4{}
 	copy(addr.Addr[:], destIP.To4())
-	return syscall.Sendto(s.fd4, packet, 0, &addr)
+	err := syscall.Sendto(s.fd4, packet, 0, &addr)
+	if err == syscall.EMSGSIZE {
+		// Reassembled payloads can exceed the path MTU, resend as smaller segments
+		if seg1, seg2, ok := SplitTCPSegmentV4(packet); ok {
+			log.Tracef("IPv4 packet of %d bytes exceeds MTU, splitting", len(packet))
+			if err := s.SendIPv4(seg1, destIP); err != nil {
+				return err
+			}
+			return s.SendIPv4(seg2, destIP)
+		}
+	}
+	return err
 }
 
 func (s *Sender) SendIPv6(packet []byte, destIP net.IP) error {
+	if s.intercept(packet) {
+		log.Tracef("Returning IPv6 packet to %s in verdict, len=%d", destIP.String(), len(packet))
+		return nil
+	}
+	if s.send != nil {
+		return s.send(packet, destIP)
+	}
 	if s.fd6 < 0 {
 		return nil
 	}
 	log.Tracef("Sending IPv6 packet to %s, len=%d", destIP.String(), len(packet))
 	addr := syscall.SockaddrInet6{}
 	copy(addr.Addr[:], destIP.To16())
-	return syscall.Sendto(s.fd6, packet, 0, &addr)
+	err := syscall.Sendto(s.fd6, packet, 0, &addr)
+	if err == syscall.EMSGSIZE {
+		if seg1, seg2, ok := SplitTCPSegmentV6(packet); ok {
+			log.Tracef("IPv6 packet of %d bytes exceeds MTU, splitting", len(packet))
+			if err := s.SendIPv6(seg1, destIP); err != nil {
+				return err
+			}
+			return s.SendIPv6(seg2, destIP)
+		}
+	}
+	return err
 }
 
 func (s *Sender) Close() {
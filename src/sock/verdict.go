@@ -0,0 +1,162 @@
+package sock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// Capture hands the first real segment of a queued TCP packet back to the
+// caller instead of sending it through the raw socket, so the kernel can
+// forward it as the packet's accept verdict. Fakes and every later segment
+// still go out the raw socket.
+type Capture struct {
+	key     string
+	ttl     uint8
+	seq     uint32
+	payload []byte
+	verdict func(pkt []byte) error
+	issued  bool
+}
+
+type captureTable struct {
+	active int32
+	mu     sync.Mutex
+	flows  map[string]*Capture
+}
+
+// Capture registers the queued packet orig; the first packet of the same flow
+// sent afterwards that carries the original TTL and a slice of the original
+// payload at its sequence offset is passed to verdict instead of the socket.
+// Release must be called once the packet has been fully processed.
+func (s *Sender) Capture(orig []byte, verdict func(pkt []byte) error) *Capture {
+	key, ttl, seq, payload, ok := tcpSegmentInfo(orig)
+	if !ok {
+		return &Capture{}
+	}
+	c := &Capture{
+		key:     key,
+		ttl:     ttl,
+		seq:     seq,
+		payload: append([]byte(nil), payload...),
+		verdict: verdict,
+	}
+
+	s.captures.mu.Lock()
+	if s.captures.flows == nil {
+		s.captures.flows = make(map[string]*Capture)
+	}
+	if _, busy := s.captures.flows[key]; busy {
+		// a retransmission of the flow is still being processed
+		s.captures.mu.Unlock()
+		return &Capture{}
+	}
+	s.captures.flows[key] = c
+	atomic.AddInt32(&s.captures.active, 1)
+	s.captures.mu.Unlock()
+	return c
+}
+
+// Release unregisters the capture and reports whether a verdict was issued.
+func (s *Sender) Release(c *Capture) bool {
+	if c.key == "" {
+		return false
+	}
+	s.captures.mu.Lock()
+	if s.captures.flows[c.key] == c {
+		delete(s.captures.flows, c.key)
+		atomic.AddInt32(&s.captures.active, -1)
+	}
+	issued := c.issued
+	s.captures.mu.Unlock()
+	return issued
+}
+
+// intercept passes packet to the verdict of its flow's capture and reports
+// whether it was consumed.
+func (s *Sender) intercept(packet []byte) bool {
+	if atomic.LoadInt32(&s.captures.active) == 0 {
+		return false
+	}
+	key, ttl, seq, payload, ok := tcpSegmentInfo(packet)
+	if !ok {
+		return false
+	}
+
+	s.captures.mu.Lock()
+	c, ok := s.captures.flows[key]
+	if !ok || c.issued || !c.matches(packet, ttl, seq, payload) {
+		s.captures.mu.Unlock()
+		return false
+	}
+	c.issued = true
+	s.captures.mu.Unlock()
+
+	if err := c.verdict(packet); err != nil {
+		s.captures.mu.Lock()
+		c.issued = false
+		s.captures.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// matches reports whether a segment is part of the original data as the
+// server would see it, fakes differ in TTL, payload or carry urgent data.
+func (c *Capture) matches(packet []byte, ttl uint8, seq uint32, payload []byte) bool {
+	if ttl != c.ttl || len(payload) == 0 {
+		return false
+	}
+	ihl := 40
+	if packet[0]>>4 == 4 {
+		ihl = int(packet[0]&0x0f) * 4
+	}
+	if packet[ihl+13]&0x20 != 0 {
+		return false
+	}
+	off := int(seq - c.seq)
+	if off < 0 || off+len(payload) > len(c.payload) {
+		return false
+	}
+	return bytes.Equal(payload, c.payload[off:off+len(payload)])
+}
+
+// tcpSegmentInfo extracts the flow key, TTL, sequence number and payload of
+// an IPv4 or IPv6 TCP packet.
+func tcpSegmentInfo(packet []byte) (key string, ttl uint8, seq uint32, payload []byte, ok bool) {
+	if len(packet) < 20 {
+		return "", 0, 0, nil, false
+	}
+	var ihl int
+	var addrs []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl = int(packet[0]&0x0f) * 4
+		if packet[9] != 6 {
+			return "", 0, 0, nil, false
+		}
+		ttl = packet[8]
+		addrs = packet[12:20]
+	case 6:
+		ihl = 40
+		if len(packet) < ihl || packet[6] != 6 {
+			return "", 0, 0, nil, false
+		}
+		ttl = packet[7]
+		addrs = packet[8:40]
+	default:
+		return "", 0, 0, nil, false
+	}
+	if len(packet) < ihl+20 {
+		return "", 0, 0, nil, false
+	}
+	dataOff := int(packet[ihl+12]>>4) * 4
+	if dataOff < 20 || len(packet) < ihl+dataOff {
+		return "", 0, 0, nil, false
+	}
+
+	key = string(addrs) + string(packet[ihl:ihl+4])
+	seq = binary.BigEndian.Uint32(packet[ihl+4 : ihl+8])
+	return key, ttl, seq, packet[ihl+dataOff:], true
+}
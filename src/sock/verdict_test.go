@@ -0,0 +1,54 @@
+package sock
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCapture_FirstRealSegment(t *testing.T) {
+	s := &Sender{fd4: -1, fd6: -1}
+	pkt := buildMinimalIPv4TCPPacket(100)
+	dst := net.IPv4(10, 0, 0, 1)
+
+	var got [][]byte
+	c := s.Capture(pkt, func(seg []byte) error {
+		got = append(got, seg)
+		return nil
+	})
+
+	fake := buildMinimalIPv4TCPPacket(100)
+	fake[8] = 3
+	fake[40] ^= 0xff
+	_ = s.SendIPv4(fake, dst)
+
+	seg1, seg2, ok := SplitTCPSegmentV4(pkt)
+	if !ok {
+		t.Fatal("expected packet to be split")
+	}
+	_ = s.SendIPv4(seg2, dst)
+	_ = s.SendIPv4(seg1, dst)
+
+	if !s.Release(c) {
+		t.Fatal("expected a verdict to be issued")
+	}
+	if len(got) != 1 || &got[0][0] != &seg2[0] {
+		t.Errorf("expected only the first real segment in the verdict, got %d", len(got))
+	}
+	if s.intercept(seg1) {
+		t.Error("released capture should not intercept packets")
+	}
+}
+
+func TestCapture_NoRealSegment(t *testing.T) {
+	s := &Sender{fd4: -1, fd6: -1}
+	pkt := buildMinimalIPv4TCPPacket(100)
+
+	c := s.Capture(pkt, func([]byte) error { return nil })
+	fake := buildMinimalIPv4TCPPacket(100)
+	fake[8] = 3
+	_ = s.SendIPv4(fake, net.IPv4(10, 0, 0, 1))
+
+	if s.Release(c) {
+		t.Error("a packet with another TTL should not be returned in the verdict")
+	}
+}
@@ -13,6 +13,11 @@ import (
 
 var modulesLoaded sync.Once
 
+// packets of a DNS over TCP connection queued: the handshake, the query and
+// its retransmits while b4 resolves it. A query sent after that, on a
+// connection kept open or retransmitted yet again, goes to the server asked.
+const dnsTCPPackets = 8
+
 func AddRules(cfg *config.Config) error {
 	if cfg.System.Tables.SkipSetup {
 		return nil
@@ -22,12 +27,24 @@ func AddRules(cfg *config.Config) error {
 		ClearRules(cfg)
 		return AddRules(cfg)
 	})
+	handler.SetTargetsSyncFunc(func() error {
+		return SyncTargets(cfg)
+	})
 
 	backend := detectFirewallBackend()
 	log.Tracef("Detected firewall backend: %s", backend)
 	metrics := handler.GetMetricsCollector()
 	metrics.TablesStatus = backend
 
+	switch integrationMode(cfg) {
+	case config.IntegrationFW4:
+		metrics.TablesStatus = config.IntegrationFW4
+		return NewFW4Manager(cfg).Apply()
+	case config.IntegrationFirewalld:
+		metrics.TablesStatus = config.IntegrationFirewalld
+		return NewFirewalldManager(cfg).Apply()
+	}
+
 	if backend == "nftables" {
 		nft := NewNFTablesManager(cfg)
 		return nft.Apply()
@@ -39,6 +56,25 @@ func AddRules(cfg *config.Config) error {
 }
 
 func ClearRules(cfg *config.Config) error {
+	if cfg.System.Tables.SkipSetup {
+		return nil
+	}
+
+	// rules of an integration used before are removed as well
+	mode := integrationMode(cfg)
+	if mode != config.IntegrationFW4 {
+		removeFW4Include()
+	}
+	if mode != config.IntegrationFirewalld {
+		removeFirewalldRules()
+	}
+
+	switch mode {
+	case config.IntegrationFW4:
+		return NewFW4Manager(cfg).Clear()
+	case config.IntegrationFirewalld:
+		return NewFirewalldManager(cfg).Clear()
+	}
 
 	backend := detectFirewallBackend()
 
@@ -60,6 +96,16 @@ func run(args ...string) (string, error) {
 	return out.String(), err
 }
 
+func runInput(input string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
 func setSysctlOrProc(name, val string) {
 	_, _ = run("sh", "-c", "sysctl -w "+name+"="+val+" || echo "+val+" > /proc/sys/"+strings.ReplaceAll(name, ".", "/"))
 }
@@ -69,7 +115,15 @@ func getSysctlOrProc(name string) string {
 	return strings.TrimSpace(out)
 }
 
+// detectFirewallBackend prefers nftables when it is in use, programmed over
+// netlink when the kernel answers and through nft otherwise. iptables rules
+// are applied with iptables-restore where available.
 func detectFirewallBackend() string {
+	tables, nlErr := nlTableCount()
+	if nlErr == nil && tables > 0 {
+		return "nftables"
+	}
+
 	if hasBinary("nft") {
 		out, err := run("nft", "list", "tables")
 		if err == nil && out != "" {
@@ -85,6 +139,9 @@ func detectFirewallBackend() string {
 		return "iptables"
 	}
 
+	if nlErr == nil {
+		return "nftables"
+	}
 	return "iptables"
 }
 
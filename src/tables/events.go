@@ -0,0 +1,132 @@
+package tables
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// rulesetChange is a committed nftables transaction that removed something
+// from a table b4 keeps rules in. cause names the process behind it.
+type rulesetChange struct {
+	cause string
+}
+
+// watchedTables are the tables whose changes can remove b4 rules, our own
+// table and the tables iptables-nft keeps the iptables rules in.
+var watchedTables = map[string]bool{
+	nftTableName: true,
+	"mangle":     true,
+	"nat":        true,
+}
+
+// watchRuleset subscribes to nftables change notifications. A change is
+// sent once per transaction of another process that deleted a table, chain,
+// rule or set of a watched table. Legacy xtables does not notify, only
+// iptables-nft does. The watch ends when stop is closed.
+func watchRuleset(stop <-chan struct{}) (<-chan rulesetChange, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.JoinGroup(unix.NFNLGRP_NFTABLES); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to join nftables group: %w", err)
+	}
+
+	changes := make(chan rulesetChange, 1)
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	go func() {
+		defer close(changes)
+		pid := uint32(os.Getpid())
+		removed := false
+		for {
+			msgs, err := conn.Receive()
+			if err != nil {
+				if errors.Is(err, unix.ENOBUFS) {
+					// notifications were dropped, let the check decide
+					notifyChange(changes, "ruleset change (events lost)")
+					removed = false
+					continue
+				}
+				select {
+				case <-stop:
+				default:
+					notifyChange(changes, "ruleset watch failed: "+err.Error())
+				}
+				return
+			}
+			for _, msg := range msgs {
+				ev, ok := decodeRulesetEvent(msg)
+				if !ok {
+					continue
+				}
+				if ev.msgType != unix.NFT_MSG_NEWGEN {
+					removed = removed || (ev.deletes && watchedTables[ev.table])
+					continue
+				}
+				// the generation message closes every transaction
+				if removed && ev.pid != pid {
+					notifyChange(changes, fmt.Sprintf("ruleset change by %s (pid %d)", ev.proc, ev.pid))
+				}
+				removed = false
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// notifyChange never blocks, a pending change already triggers a check.
+func notifyChange(changes chan<- rulesetChange, cause string) {
+	select {
+	case changes <- rulesetChange{cause: cause}:
+	default:
+	}
+}
+
+type rulesetEvent struct {
+	msgType uint16
+	deletes bool
+	table   string
+	pid     uint32
+	proc    string
+}
+
+func decodeRulesetEvent(msg netlink.Message) (rulesetEvent, bool) {
+	t := uint16(msg.Header.Type)
+	if t>>8 != unix.NFNL_SUBSYS_NFTABLES || len(msg.Data) < 4 {
+		return rulesetEvent{}, false
+	}
+	ev := rulesetEvent{msgType: t & 0xff}
+	switch ev.msgType {
+	case unix.NFT_MSG_DELTABLE, unix.NFT_MSG_DELCHAIN, unix.NFT_MSG_DELRULE, unix.NFT_MSG_DELSET:
+		ev.deletes = true
+	case unix.NFT_MSG_NEWGEN:
+	default:
+		return ev, true
+	}
+
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return rulesetEvent{}, false
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch {
+		case ev.msgType == unix.NFT_MSG_NEWGEN && ad.Type() == unix.NFTA_GEN_PROC_PID:
+			ev.pid = ad.Uint32()
+		case ev.msgType == unix.NFT_MSG_NEWGEN && ad.Type() == unix.NFTA_GEN_PROC_NAME:
+			ev.proc = ad.String()
+		case ev.deletes && ad.Type() == 1: // NFTA_{TABLE_NAME,CHAIN_TABLE,RULE_TABLE,SET_TABLE}
+			ev.table = ad.String()
+		}
+	}
+	return ev, ad.Err() == nil
+}
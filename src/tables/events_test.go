@@ -0,0 +1,56 @@
+package tables
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func rulesetMessage(t *testing.T, msgType uint16, attrs func(ae *netlink.AttributeEncoder)) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	attrs(ae)
+	data, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | int(msgType))},
+		Data:   append([]byte{unix.NFPROTO_INET, unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+}
+
+func TestDecodeRulesetEvent(t *testing.T) {
+	del := rulesetMessage(t, unix.NFT_MSG_DELRULE, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, "mangle")
+		ae.String(unix.NFTA_RULE_CHAIN, "PREROUTING")
+	})
+	ev, ok := decodeRulesetEvent(del)
+	if !ok || !ev.deletes || ev.table != "mangle" {
+		t.Errorf("unexpected rule event: %+v", ev)
+	}
+
+	gen := rulesetMessage(t, unix.NFT_MSG_NEWGEN, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_GEN_ID, 7)
+		ae.Uint32(unix.NFTA_GEN_PROC_PID, 1234)
+		ae.String(unix.NFTA_GEN_PROC_NAME, "fw4")
+	})
+	ev, ok = decodeRulesetEvent(gen)
+	if !ok || ev.msgType != unix.NFT_MSG_NEWGEN || ev.pid != 1234 || ev.proc != "fw4" {
+		t.Errorf("unexpected generation event: %+v", ev)
+	}
+
+	add := rulesetMessage(t, unix.NFT_MSG_NEWRULE, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftTableName)
+	})
+	if ev, ok := decodeRulesetEvent(add); !ok || ev.deletes {
+		t.Errorf("unexpected add event: %+v", ev)
+	}
+
+	other := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE << 8)}, Data: make([]byte, 4)}
+	if _, ok := decodeRulesetEvent(other); ok {
+		t.Error("expected messages of other subsystems to be ignored")
+	}
+}
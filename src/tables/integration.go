@@ -0,0 +1,294 @@
+package tables
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// fw4IncludePath is loaded by OpenWrt fw4 after its own ruleset on every
+// start and reload.
+var fw4IncludePath = "/usr/share/nftables.d/ruleset-post/b4.nft"
+
+// firewalldComment tags the direct rules b4 adds to firewalld.
+const firewalldComment = "b4"
+
+// integrationMode resolves the configured firewall integration to none, fw4
+// or firewalld.
+func integrationMode(cfg *config.Config) string {
+	switch cfg.System.Tables.Integration {
+	case config.IntegrationFW4, config.IntegrationFirewalld:
+		return cfg.System.Tables.Integration
+	case config.IntegrationAuto:
+		if fw4Available() {
+			return config.IntegrationFW4
+		}
+		if firewalldRunning() {
+			return config.IntegrationFirewalld
+		}
+	}
+	return config.IntegrationNone
+}
+
+func fw4Available() bool {
+	if !hasBinary("fw4") {
+		return false
+	}
+	info, err := os.Stat(filepath.Dir(filepath.Dir(fw4IncludePath)))
+	return err == nil && info.IsDir()
+}
+
+func firewalldRunning() bool {
+	if !hasBinary("firewall-cmd") {
+		return false
+	}
+	out, err := run("firewall-cmd", "--state")
+	return err == nil && strings.TrimSpace(out) == "running"
+}
+
+// FW4Manager keeps the b4 table in an fw4 include file, so fw4 restores it
+// whenever it reloads the firewall. The table itself is installed the same
+// way as without fw4.
+type FW4Manager struct {
+	nft *NFTablesManager
+}
+
+func NewFW4Manager(cfg *config.Config) *FW4Manager {
+	return &FW4Manager{nft: NewNFTablesManager(cfg)}
+}
+
+// include renders the include file, the script replaces the table so it is
+// safe to load on top of a running ruleset.
+func (f *FW4Manager) include() string {
+	return "# Generated by b4, removed when b4 clears its rules\n" + f.nft.ruleset().script()
+}
+
+func (f *FW4Manager) writeInclude() error {
+	if err := os.MkdirAll(filepath.Dir(fw4IncludePath), 0755); err != nil {
+		return fmt.Errorf("failed to create fw4 include directory: %w", err)
+	}
+	if err := os.WriteFile(fw4IncludePath, []byte(f.include()), 0644); err != nil {
+		return fmt.Errorf("failed to write fw4 include: %w", err)
+	}
+	return nil
+}
+
+func (f *FW4Manager) Apply() error {
+	if err := f.writeInclude(); err != nil {
+		return err
+	}
+	log.Infof("FW4: rules installed as %s", fw4IncludePath)
+	return f.nft.Apply()
+}
+
+func (f *FW4Manager) Clear() error {
+	removeFW4Include()
+	return f.nft.Clear()
+}
+
+func removeFW4Include() {
+	if err := os.Remove(fw4IncludePath); err == nil {
+		log.Tracef("FW4: removed %s", fw4IncludePath)
+	}
+}
+
+// FirewalldManager installs the iptables rules as firewalld direct rules,
+// both at runtime and permanently, so a firewalld reload puts them back.
+type FirewalldManager struct {
+	ipt *IPTablesManager
+}
+
+func NewFirewalldManager(cfg *config.Config) *FirewalldManager {
+	return &FirewalldManager{ipt: NewIPTablesManager(cfg)}
+}
+
+// directRule is a firewalld direct rule. Rules of a chain are ordered by
+// priority, lower first.
+type directRule struct {
+	ipt      string
+	table    string
+	chain    string
+	priority int
+	args     []string
+}
+
+func (r directRule) family() string {
+	if r.ipt == "ip6tables" {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// command returns the firewall-cmd arguments adding or removing the rule.
+func (r directRule) command(op string) []string {
+	return append([]string{"--direct", op, r.family(), r.table, r.chain, strconv.Itoa(r.priority)}, r.args...)
+}
+
+// directRules converts the manifest. Inserted rules get negative priorities
+// in reverse so they end up in the order iptables -I would give them.
+func (f *FirewalldManager) directRules(m Manifest) []directRule {
+	var rules []directRule
+	seen := make(map[string]bool)
+	inserted, appended := 0, 0
+	for _, r := range m.Rules {
+		key := r.IPT + " " + r.Table + " " + r.Chain + " " + strings.Join(r.Spec, " ")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		priority := appended
+		if strings.ToUpper(r.Action) == "I" {
+			inserted++
+			priority = -inserted
+		} else {
+			appended++
+		}
+		table := r.Table
+		if table == "" {
+			table = "mangle"
+		}
+		rules = append(rules, directRule{ipt: r.IPT, table: table, chain: r.Chain, priority: priority, args: commentSpec(r.Spec)})
+	}
+	return rules
+}
+
+// commentSpec tags spec with the b4 comment ahead of its target.
+func commentSpec(spec []string) []string {
+	i := len(spec)
+	for j, s := range spec {
+		if s == "-j" {
+			i = j
+			break
+		}
+	}
+	out := append([]string{}, spec[:i]...)
+	out = append(out, "-m", "comment", "--comment", firewalldComment)
+	return append(out, spec[i:]...)
+}
+
+// firewallCmd runs a direct rule change at runtime and in the permanent
+// configuration.
+func firewallCmd(args ...string) error {
+	if out, err := run(append([]string{"firewall-cmd"}, args...)...); err != nil {
+		return fmt.Errorf("firewall-cmd %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(out))
+	}
+	if out, err := run(append([]string{"firewall-cmd", "--permanent"}, args...)...); err != nil {
+		return fmt.Errorf("firewall-cmd --permanent %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func (f *FirewalldManager) Apply() error {
+	ipt := f.ipt
+	log.Infof("FIREWALLD: adding direct rules")
+	loadKernelModules()
+
+	plan := ipt.targetPlan()
+	m, err := ipt.manifestFor(plan)
+	if err != nil {
+		return err
+	}
+	if plan.usesSets() {
+		sets := plan.kernelSets(ipt.cfg.Queue.IPv4Enabled, ipt.cfg.Queue.IPv6Enabled)
+		if err := ipsetCreate(sets); err != nil {
+			return err
+		}
+		if err := ipsetReplace(sets); err != nil {
+			return err
+		}
+	}
+
+	removeFirewalldRules()
+	for _, c := range m.Chains {
+		r := directRule{ipt: c.IPT}
+		if err := firewallCmd("--direct", "--add-chain", r.family(), c.Table, c.Name); err != nil {
+			return err
+		}
+	}
+	rules := f.directRules(m)
+	for _, r := range rules {
+		if err := firewallCmd(r.command("--add-rule")...); err != nil {
+			return err
+		}
+	}
+	for _, s := range m.Sysctls {
+		s.Apply()
+	}
+	if err := addTProxyRoutes(ipt.cfg); err != nil {
+		return err
+	}
+
+	if plan.usesSets() {
+		if err := targets.activate(ipt.cfg, "iptables", plan); err != nil {
+			return err
+		}
+	}
+	log.Infof("FIREWALLD: added %d direct rules", len(rules))
+	return nil
+}
+
+// Clear removes the direct rules, then whatever b4 inserted into iptables
+// itself before firewalld took over.
+func (f *FirewalldManager) Clear() error {
+	removeFirewalldRules()
+	return f.ipt.Clear()
+}
+
+// installedDirectRules lists the b4 direct rules of the permanent
+// configuration in firewall-cmd --get-all-rules form.
+func installedDirectRules() []string {
+	out, err := run("firewall-cmd", "--permanent", "--direct", "--get-all-rules")
+	if err != nil {
+		return nil
+	}
+	var rules []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && (fields[2] == "B4" || strings.Contains(line, "--comment "+firewalldComment+" ")) {
+			rules = append(rules, strings.TrimSpace(line))
+		}
+	}
+	return rules
+}
+
+// removeFirewalldRules removes the b4 direct rules and chains, whether they
+// were added at runtime or permanently.
+func removeFirewalldRules() {
+	if !firewalldRunning() {
+		return
+	}
+	for _, line := range installedDirectRules() {
+		args := append([]string{"--direct", "--remove-rule"}, strings.Fields(line)...)
+		_, _ = run(append([]string{"firewall-cmd"}, args...)...)
+		_, _ = run(append([]string{"firewall-cmd", "--permanent"}, args...)...)
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		for _, table := range restoreTables {
+			args := []string{"--direct", "--remove-chain", family, table, "B4"}
+			_, _ = run(append([]string{"firewall-cmd"}, args...)...)
+			_, _ = run(append([]string{"firewall-cmd", "--permanent"}, args...)...)
+		}
+	}
+	log.Tracef("FIREWALLD: removed b4 direct rules")
+}
+
+// checkRules reports whether firewalld still has every b4 rule.
+func (f *FirewalldManager) checkRules() bool {
+	m, err := f.ipt.manifestFor(f.ipt.targetPlan())
+	if err != nil {
+		return true
+	}
+	want := len(f.directRules(m))
+	got := len(installedDirectRules())
+	if got != want {
+		log.Tracef("Monitor: firewalld has %d b4 direct rules, expected %d", got, want)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package tables
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestFirewalldManager_DirectRules(t *testing.T) {
+	cfg := config.NewConfig()
+	f := NewFirewalldManager(&cfg)
+
+	m := Manifest{Rules: []Rule{
+		{IPT: "iptables", Chain: "PREROUTING", Action: "I", Spec: []string{"-p", "udp", "--sport", "53", "-j", "NFQUEUE"}},
+		{IPT: "iptables", Chain: "B4", Action: "A", Spec: []string{"-p", "udp", "--dport", "53", "-j", "NFQUEUE"}},
+		{IPT: "iptables", Chain: "PREROUTING", Action: "I", Spec: []string{"-p", "tcp", "--sport", "443", "-j", "NFQUEUE"}},
+		{IPT: "iptables", Chain: "PREROUTING", Action: "I", Spec: []string{"-p", "udp", "--sport", "53", "-j", "NFQUEUE"}},
+		{IPT: "ip6tables", Chain: "POSTROUTING", Action: "I", Spec: []string{"-j", "B4"}},
+	}}
+
+	rules := f.directRules(m)
+	if len(rules) != 4 {
+		t.Fatalf("expected duplicates dropped, got %d rules", len(rules))
+	}
+	if rules[0].priority != -1 || rules[1].priority != 0 || rules[2].priority != -2 {
+		t.Errorf("unexpected priorities: %d %d %d", rules[0].priority, rules[1].priority, rules[2].priority)
+	}
+
+	got := strings.Join(rules[3].command("--add-rule"), " ")
+	want := "--direct --add-rule ipv6 mangle POSTROUTING -3 -m comment --comment b4 -j B4"
+	if got != want {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+}
+
+func TestFW4Manager_Include(t *testing.T) {
+	old := fw4IncludePath
+	fw4IncludePath = filepath.Join(t.TempDir(), "ruleset-post", "b4.nft")
+	defer func() { fw4IncludePath = old }()
+
+	cfg := config.NewConfig()
+	f := NewFW4Manager(&cfg)
+	if err := f.writeInclude(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fw4IncludePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "add table inet "+nftTableName+"\n") || !strings.Contains(string(data), "add rule inet "+nftTableName) {
+		t.Errorf("include misses the b4 table:\n%s", data)
+	}
+
+	removeFW4Include()
+	if _, err := os.Stat(fw4IncludePath); !os.IsNotExist(err) {
+		t.Error("expected include removed")
+	}
+}
+
+func TestIntegrationMode(t *testing.T) {
+	cfg := config.NewConfig()
+	if mode := integrationMode(&cfg); mode != config.IntegrationNone {
+		t.Errorf("expected none by default, got %q", mode)
+	}
+	cfg.System.Tables.Integration = config.IntegrationFirewalld
+	if mode := integrationMode(&cfg); mode != config.IntegrationFirewalld {
+		t.Errorf("expected the configured integration, got %q", mode)
+	}
+}
@@ -0,0 +1,90 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+func ipsetFamily(v6 bool) string {
+	if v6 {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// ipsetCreateInput renders the ipset restore commands creating sets.
+func ipsetCreateInput(sets []kernelSet) string {
+	var b strings.Builder
+	for _, set := range sets {
+		if set.learned {
+			fmt.Fprintf(&b, "create %s hash:ip family %s timeout 600\n", set.name, ipsetFamily(set.v6))
+		} else {
+			fmt.Fprintf(&b, "create %s hash:net family %s\n", set.name, ipsetFamily(set.v6))
+		}
+	}
+	return b.String()
+}
+
+func ipsetCreate(sets []kernelSet) error {
+	if out, err := runInput(ipsetCreateInput(sets), "ipset", "-exist", "restore"); err != nil {
+		return fmt.Errorf("failed to create ipsets: %w: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ipsetReplaceInput renders the ipset restore commands refilling the static
+// sets with the configured addresses.
+func ipsetReplaceInput(sets []kernelSet) string {
+	var b strings.Builder
+	for _, set := range sets {
+		if set.learned {
+			continue
+		}
+		fmt.Fprintf(&b, "flush %s\n", set.name)
+		for _, e := range set.elems {
+			fmt.Fprintf(&b, "add %s %s\n", set.name, e)
+		}
+	}
+	return b.String()
+}
+
+func ipsetReplace(sets []kernelSet) error {
+	if out, err := runInput(ipsetReplaceInput(sets), "ipset", "-exist", "restore"); err != nil {
+		return fmt.Errorf("failed to fill ipsets: %w: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ipsetAddLearned adds learned addresses, resetting the timeout of known ones.
+func ipsetAddLearned(addrs []learnedAddr) error {
+	var b strings.Builder
+	for _, a := range addrs {
+		fmt.Fprintf(&b, "add %s %s timeout %d\n", a.set, a.ip, int(a.ttl/time.Second))
+	}
+	if out, err := runInput(b.String(), "ipset", "-exist", "restore"); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ipsetDestroy removes the sets once no rule references them anymore.
+func ipsetDestroy() {
+	if !hasBinary("ipset") {
+		return
+	}
+	out, err := run("ipset", "list", "-n")
+	if err != nil {
+		return
+	}
+	for _, name := range strings.Fields(out) {
+		if !strings.HasPrefix(name, "b4_") {
+			continue
+		}
+		if _, err := run("ipset", "destroy", name); err == nil {
+			log.Tracef("IPSET: destroyed %s", name)
+		}
+	}
+}
@@ -16,6 +16,7 @@ import (
 type IPTablesManager struct {
 	cfg              *config.Config
 	multiportSupport map[string]bool // per-binary cache (iptables vs ip6tables may differ)
+	dryRun           bool            // rendering only, never probe or change the kernel
 }
 
 func NewIPTablesManager(cfg *config.Config) *IPTablesManager {
@@ -27,6 +28,9 @@ func (im *IPTablesManager) hasMultiportSupport(ipt string) bool {
 	if result, ok := im.multiportSupport[ipt]; ok {
 		return result
 	}
+	if im.dryRun {
+		return true
+	}
 
 	// Try to add and immediately remove a test rule using multiport
 	testSpec := []string{"-p", "tcp", "-m", "multiport", "--dports", "80,443", "-j", "ACCEPT"}
@@ -126,6 +130,14 @@ type SysctlSetting struct {
 	Revert  string
 }
 
+// conntrackSysctls are the settings both backends change next to the rules.
+func conntrackSysctls() []SysctlSetting {
+	return []SysctlSetting{
+		{Name: "net.netfilter.nf_conntrack_checksum", Desired: "0", Revert: "1"},
+		{Name: "net.netfilter.nf_conntrack_tcp_be_liberal", Desired: "1", Revert: "0"},
+	}
+}
+
 var sysctlSnapPath = "/tmp/b4_sysctl_snapshot.json"
 
 func loadSysctlSnapshot() map[string]string {
@@ -213,25 +225,74 @@ func (m Manifest) RevertSysctls() {
 	}
 }
 
+// targetPlan returns the kernel set plan, everything is queued when ipset is
+// not available.
+func (manager *IPTablesManager) targetPlan() targetPlan {
+	plan := buildTargetPlan(manager.cfg)
+	if plan.usesSets() && !hasBinary("ipset") {
+		if len(plan.windows) > 0 {
+			log.Warnf("IPTABLES: ipset binary not found, sets are limited to the main set connbytes")
+		}
+		if plan.enabled {
+			log.Warnf("IPTABLES: ipset binary not found, queueing all traffic")
+		}
+		return targetPlan{tcpAll: true, udpAll: true}
+	}
+	return plan
+}
+
+// windowRules queues more packets to the destinations of a set whose
+// connbytes limit is above the main set's.
+func (manager *IPTablesManager) windowRules(ipt, chainName string, w windowPlan) []Rule {
+	queue := manager.buildNFQSpec(manager.cfg.Queue.StartNum, manager.cfg.Queue.Threads)
+	connbytes := func(dir string, limit int) []string {
+		return []string{"-m", "connbytes", "--connbytes-dir", dir,
+			"--connbytes-mode", "packets", "--connbytes", fmt.Sprintf("0:%d", limit)}
+	}
+
+	var rules []Rule
+	if w.tcp > 0 {
+		for _, portSpec := range manager.portSpecs(ipt, "tcp", "sport", w.tcpPorts) {
+			for _, sel := range w.iptSelectors("src", ipt) {
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I",
+					Spec: concatSpec(portSpec, sel, connbytes("reply", w.tcp), queue)})
+			}
+		}
+		for _, portSpec := range manager.portSpecs(ipt, "tcp", "dport", w.tcpPorts) {
+			for _, sel := range w.iptSelectors("dst", ipt) {
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A",
+					Spec: concatSpec(portSpec, sel, connbytes("original", w.tcp), queue)})
+			}
+		}
+	}
+	if w.udp > 0 {
+		for _, portSpec := range manager.portSpecs(ipt, "udp", "dport", w.udpPorts) {
+			for _, sel := range w.iptSelectors("dst", ipt) {
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A",
+					Spec: concatSpec(portSpec, sel, connbytes("original", w.udp), queue)})
+			}
+		}
+	}
+	return rules
+}
+
 func (manager *IPTablesManager) buildManifest() (Manifest, error) {
+	return manager.manifestFor(manager.targetPlan())
+}
+
+func (manager *IPTablesManager) manifestFor(plan targetPlan) (Manifest, error) {
 	cfg := manager.cfg
-	var ipts []string
-	if cfg.Queue.IPv4Enabled && hasBinary("iptables") {
-		ipts = append(ipts, "iptables")
-	}
-	if cfg.Queue.IPv6Enabled && hasBinary("ip6tables") {
-		ipts = append(ipts, "ip6tables")
+	if transparentMode(cfg) != "" {
+		return manager.transparentManifest(plan)
 	}
+	ipts := manager.binaries()
 	if len(ipts) == 0 {
 		return Manifest{}, errors.New("no valid iptables binaries found")
 	}
 	queueNum := cfg.Queue.StartNum
 	threads := cfg.Queue.Threads
 	chainName := "B4"
-	markAccept := fmt.Sprintf("0x%x/0x%x", cfg.Queue.Mark, cfg.Queue.Mark)
-	if cfg.Queue.Mark == 0 {
-		markAccept = "0x8000/0x8000"
-	}
+	markAccept := manager.markAccept()
 
 	var chains []Chain
 	var rules []Rule
@@ -243,76 +304,78 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 		tcpConnbytesRange := fmt.Sprintf("0:%d", cfg.MainSet.TCP.ConnBytesLimit)
 		udpConnbytesRange := fmt.Sprintf("0:%d", cfg.MainSet.UDP.ConnBytesLimit)
 
-		tcpSpec := append(
-			[]string{"-p", "tcp", "--dport", "443",
-				"-m", "connbytes", "--connbytes-dir", "original",
-				"--connbytes-mode", "packets", "--connbytes", tcpConnbytesRange},
-			manager.buildNFQSpec(queueNum, threads)...,
-		)
+		tcpPorts := manager.portSpecs(ipt, "tcp", "dport", cfg.CollectTCPPorts())
+		tcpResponsePorts := manager.portSpecs(ipt, "tcp", "sport", cfg.CollectTCPPorts())
 
 		dnsSpec := append(
 			[]string{"-p", "udp", "--dport", "53"},
 			manager.buildNFQSpec(queueNum, threads)...,
 		)
 
-		dnsResponseSpec := append(
-			[]string{"-p", "udp", "--sport", "53"},
-			manager.buildNFQSpec(queueNum, threads)...,
-		)
-
-		tcpResponseSpec := append(
-			[]string{"-p", "tcp", "--sport", "443",
-				"-m", "connbytes", "--connbytes-dir", "reply",
-				"--connbytes-mode", "packets", "--connbytes", tcpConnbytesRange},
+		dnsTCPSpec := append(
+			[]string{"-p", "tcp", "--dport", "53", "-m", "connbytes", "--connbytes-dir", "original",
+				"--connbytes-mode", "packets", "--connbytes", fmt.Sprintf("0:%d", dnsTCPPackets)},
 			manager.buildNFQSpec(queueNum, threads)...,
 		)
 
-		synackSpec := append(
-			[]string{"-p", "tcp", "--sport", "443", "--tcp-flags", "SYN,ACK", "SYN,ACK"},
+		dnsResponseSpec := append(
+			[]string{"-p", "udp", "--sport", "53"},
 			manager.buildNFQSpec(queueNum, threads)...,
 		)
 
 		rules = append(rules,
 			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: dnsResponseSpec},
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: tcpResponseSpec},
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: synackSpec},
-
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: tcpSpec},
-			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: dnsSpec},
 		)
 
-		udpPorts := cfg.CollectUDPPorts()
-		for i, p := range udpPorts {
-			udpPorts[i] = strings.ReplaceAll(p, "-", ":")
+		for _, portSpec := range tcpResponsePorts {
+			for _, sel := range plan.iptSelectors(plan.tcpAll, "src", ipt) {
+				tcpResponseSpec := concatSpec(portSpec, sel,
+					[]string{"-m", "connbytes", "--connbytes-dir", "reply",
+						"--connbytes-mode", "packets", "--connbytes", tcpConnbytesRange},
+					manager.buildNFQSpec(queueNum, threads),
+				)
+				synackSpec := concatSpec(portSpec, sel,
+					[]string{"--tcp-flags", "SYN,ACK", "SYN,ACK"},
+					manager.buildNFQSpec(queueNum, threads),
+				)
+				rules = append(rules,
+					Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: tcpResponseSpec},
+					Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "I", Spec: synackSpec},
+				)
+			}
 		}
 
-		if manager.hasMultiportSupport(ipt) {
-			// Use multiport for efficiency (batches up to 15 ports per rule)
-			udpPortChunks := chunkPorts(udpPorts, 15)
-			for _, chunk := range udpPortChunks {
-				udpPortSpec := []string{"-p", "udp", "-m", "multiport", "--dports", strings.Join(chunk, ",")}
-				udpSpec := append(
-					append(udpPortSpec,
-						"-m", "connbytes", "--connbytes-dir", "original",
-						"--connbytes-mode", "packets", "--connbytes", udpConnbytesRange),
-					manager.buildNFQSpec(queueNum, threads)...,
+		for _, portSpec := range tcpPorts {
+			for _, sel := range plan.iptSelectors(plan.tcpAll, "dst", ipt) {
+				tcpSpec := concatSpec(portSpec, sel,
+					[]string{"-m", "connbytes", "--connbytes-dir", "original",
+						"--connbytes-mode", "packets", "--connbytes", tcpConnbytesRange},
+					manager.buildNFQSpec(queueNum, threads),
 				)
-				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: udpSpec})
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: tcpSpec})
 			}
-		} else {
-			// Fallback: create individual rules for each port/range
-			for _, port := range udpPorts {
-				udpPortSpec := []string{"-p", "udp", "--dport", port}
-				udpSpec := append(
-					append(udpPortSpec,
-						"-m", "connbytes", "--connbytes-dir", "original",
-						"--connbytes-mode", "packets", "--connbytes", udpConnbytesRange),
-					manager.buildNFQSpec(queueNum, threads)...,
+		}
+
+		rules = append(rules,
+			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: dnsSpec},
+			Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: dnsTCPSpec},
+		)
+
+		for _, portSpec := range manager.portSpecs(ipt, "udp", "dport", cfg.CollectUDPPorts()) {
+			for _, sel := range plan.iptSelectors(plan.udpAll, "dst", ipt) {
+				udpSpec := concatSpec(portSpec, sel,
+					[]string{"-m", "connbytes", "--connbytes-dir", "original",
+						"--connbytes-mode", "packets", "--connbytes", udpConnbytesRange},
+					manager.buildNFQSpec(queueNum, threads),
 				)
 				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: "mangle", Chain: chainName, Action: "A", Spec: udpSpec})
 			}
 		}
 
+		for _, w := range plan.windows {
+			rules = append(rules, manager.windowRules(ipt, chainName, w)...)
+		}
+
 		if cfg.Queue.Devices.Enabled && len(cfg.Queue.Devices.Mac) > 0 {
 			if cfg.Queue.Devices.WhiteIsBlack {
 				rules = append(rules,
@@ -357,22 +420,67 @@ func (manager *IPTablesManager) buildManifest() (Manifest, error) {
 		)
 	}
 
-	sysctls := []SysctlSetting{
-		{Name: "net.netfilter.nf_conntrack_checksum", Desired: "0", Revert: "1"},
-		{Name: "net.netfilter.nf_conntrack_tcp_be_liberal", Desired: "1", Revert: "0"},
-	}
+	return Manifest{Chains: chains, Rules: rules, Sysctls: conntrackSysctls()}, nil
+}
 
-	return Manifest{Chains: chains, Rules: rules, Sysctls: sysctls}, nil
+// binaries returns the iptables binaries of the enabled IP versions.
+func (ipt *IPTablesManager) binaries() []string {
+	var ipts []string
+	if ipt.cfg.Queue.IPv4Enabled && (ipt.dryRun || hasBinary("iptables")) {
+		ipts = append(ipts, "iptables")
+	}
+	if ipt.cfg.Queue.IPv6Enabled && (ipt.dryRun || hasBinary("ip6tables")) {
+		ipts = append(ipts, "ip6tables")
+	}
+	return ipts
 }
 
 func (ipt *IPTablesManager) Apply() error {
 	log.Infof("IPTABLES: adding rules")
 	loadKernelModules()
-	m, err := ipt.buildManifest()
+	plan := ipt.targetPlan()
+	m, err := ipt.manifestFor(plan)
 	if err != nil {
 		return err
 	}
-	result := m.Apply()
+	if plan.usesSets() {
+		sets := plan.kernelSets(ipt.cfg.Queue.IPv4Enabled, ipt.cfg.Queue.IPv6Enabled)
+		if err := ipsetCreate(sets); err != nil {
+			return err
+		}
+		if err := ipsetReplace(sets); err != nil {
+			return err
+		}
+	}
+
+	var result error
+	if ipts := ipt.binaries(); canRestore(ipts) {
+		result = ipt.restore(ipts, m)
+		if result == nil {
+			for _, s := range m.Sysctls {
+				s.Apply()
+			}
+			log.Tracef("IPTABLES: applied %d rules with iptables-restore", len(m.Rules))
+		}
+	} else {
+		result = m.Apply()
+	}
+
+	if result == nil && plan.usesSets() {
+		if err := targets.activate(ipt.cfg, "iptables", plan); err != nil {
+			return err
+		}
+	}
+	if result == nil {
+		result = addTProxyRoutes(ipt.cfg)
+	}
+	if mode := transparentMode(ipt.cfg); result == nil && mode != "" {
+		log.Infof("IPTABLES: sending TCP to %s to the transparent proxy on port %d (%s)",
+			planScope(plan.tcpAll), ipt.cfg.System.Transparent.Port, mode)
+	} else if result == nil && plan.enabled {
+		log.Infof("IPTABLES: queueing TCP to %s, UDP to %s (%d IPv4, %d IPv6 targets)",
+			planScope(plan.tcpAll), planScope(plan.udpAll), len(plan.v4), len(plan.v6))
+	}
 
 	if log.Level(log.CurLevel.Load()) >= log.LevelTrace {
 		iptables_trace, _ := run("sh", "-c", "cat /proc/net/netfilter/nfnetlink_queue && iptables -t mangle -vnL --line-numbers")
@@ -387,24 +495,30 @@ func (ipt *IPTablesManager) Clear() error {
 		return err
 	}
 
+	targets.deactivate()
+	removeTProxyRoutes(ipt.cfg)
+
+	if ipts := ipt.binaries(); canRestore(ipts) {
+		for _, bin := range ipts {
+			if _, err := ipt.restoreOne(bin, Manifest{}); err != nil {
+				log.Errorf("IPTABLES[%s]: failed to remove rules: %v", bin, err)
+			}
+		}
+		ipsetDestroy()
+		return nil
+	}
+
 	ipt.clearB4JumpRules()
 
 	m.RemoveRules()
 	time.Sleep(30 * time.Millisecond)
 	m.RemoveChains()
+	ipsetDestroy()
 	return nil
 }
 
 func (ipt *IPTablesManager) clearB4JumpRules() {
-	ipts := []string{}
-	if ipt.cfg.Queue.IPv4Enabled && hasBinary("iptables") {
-		ipts = append(ipts, "iptables")
-	}
-	if ipt.cfg.Queue.IPv6Enabled && hasBinary("ip6tables") {
-		ipts = append(ipts, "ip6tables")
-	}
-
-	for _, iptBin := range ipts {
+	for _, iptBin := range ipt.binaries() {
 		// Clean POSTROUTING
 		for {
 			_, err := run(iptBin, "-w", "-t", "mangle", "-D", "POSTROUTING", "-j", "B4")
@@ -449,13 +563,14 @@ func (ipt *IPTablesManager) clearB4JumpRules() {
 			}
 		}
 
-		// Clean PREROUTING - parse and remove any NFQUEUE rules for DNS
+		// Clean PREROUTING - parse and remove any NFQUEUE rules for DNS or
+		// limited to the target sets
 		for {
 			out, _ := run(iptBin, "-w", "-t", "mangle", "--line-numbers", "-nL", "PREROUTING")
 			lines := strings.Split(out, "\n")
 			removed := false
 			for _, line := range lines {
-				if strings.Contains(line, "spt:53") && strings.Contains(line, "NFQUEUE") {
+				if (strings.Contains(line, "spt:53") || strings.Contains(line, "match-set b4_")) && strings.Contains(line, "NFQUEUE") {
 					parts := strings.Fields(line)
 					if len(parts) > 0 {
 						lineNum := parts[0]
@@ -510,7 +625,53 @@ func (ipt *IPTablesManager) clearB4JumpRules() {
 				break
 			}
 		}
+
+		// Clean the jumps of the transparent proxy, TPROXY in mangle and
+		// REDIRECT in nat
+		for _, jump := range [][]string{{"mangle", "PREROUTING"}, {"nat", "PREROUTING"}, {"nat", "OUTPUT"}} {
+			for {
+				_, err := run(iptBin, "-w", "-t", jump[0], "-D", jump[1], "-j", "B4")
+				if err != nil {
+					break
+				}
+			}
+		}
+		if _, err := run(iptBin, "-w", "-t", "nat", "-F", "B4"); err == nil {
+			_, _ = run(iptBin, "-w", "-t", "nat", "-X", "B4")
+		}
+	}
+}
+
+// portSpecs builds the protocol/port match prefixes for ports. dir is "dport" or "sport".
+// A single port uses a plain match, several ports are batched with multiport
+// (up to 15 per rule) or split into individual rules when multiport is missing.
+func (manager *IPTablesManager) portSpecs(ipt, proto, dir string, ports []string) [][]string {
+	normalized := make([]string, len(ports))
+	for i, p := range ports {
+		normalized[i] = strings.ReplaceAll(p, "-", ":")
+	}
+
+	var specs [][]string
+	if len(normalized) > 1 && manager.hasMultiportSupport(ipt) {
+		for _, chunk := range chunkPorts(normalized, 15) {
+			specs = append(specs, []string{"-p", proto, "-m", "multiport", "--" + dir + "s", strings.Join(chunk, ",")})
+		}
+		return specs
+	}
+
+	for _, port := range normalized {
+		specs = append(specs, []string{"-p", proto, "--" + dir, port})
+	}
+	return specs
+}
+
+// concatSpec joins rule spec fragments into a new slice.
+func concatSpec(parts ...[]string) []string {
+	var spec []string
+	for _, p := range parts {
+		spec = append(spec, p...)
 	}
+	return spec
 }
 
 func chunkPorts(ports []string, maxSize int) [][]string {
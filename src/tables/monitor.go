@@ -2,20 +2,30 @@ package tables
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/handler"
 	"github.com/daniellavrushin/b4/log"
 )
 
+// eventSettle is how long the monitor waits after a ruleset change before
+// checking the rules, a firewall reload is usually several transactions.
+const eventSettle = 50 * time.Millisecond
+
+// Monitor restores the b4 rules when something removes them. It reacts to
+// nftables change notifications and polls as a fallback.
 type Monitor struct {
 	cfg      *config.Config
 	stop     chan struct{}
 	wg       sync.WaitGroup
+	mu       sync.Mutex // one check and restore at a time
 	interval time.Duration
 	backend  string
+	mode     string // firewall integration
 }
 
 func NewMonitor(cfg *config.Config) *Monitor {
@@ -29,6 +39,7 @@ func NewMonitor(cfg *config.Config) *Monitor {
 		stop:     make(chan struct{}),
 		interval: interval,
 		backend:  detectFirewallBackend(),
+		mode:     integrationMode(cfg),
 	}
 }
 
@@ -40,7 +51,15 @@ func (m *Monitor) Start() {
 
 	m.wg.Add(1)
 	go m.monitorLoop()
-	log.Infof("Started tables monitor (backend: %s, interval: %v)", m.backend, m.interval)
+
+	changes, err := watchRuleset(m.stop)
+	if err != nil {
+		log.Infof("Started tables monitor (backend: %s, interval: %v, ruleset events unavailable: %v)", m.backend, m.interval, err)
+		return
+	}
+	m.wg.Add(1)
+	go m.eventLoop(changes)
+	log.Infof("Started tables monitor (backend: %s, interval: %v, ruleset events)", m.backend, m.interval)
 }
 
 func (m *Monitor) Stop() {
@@ -66,19 +85,61 @@ func (m *Monitor) monitorLoop() {
 		case <-m.stop:
 			return
 		case <-ticker.C:
-			if !m.checkRules() {
-				log.Warnf("Tables rules missing, restoring...")
-				if err := m.restoreRules(); err != nil {
-					log.Errorf("Failed to restore tables rules: %v", err)
-				} else {
-					log.Infof("Tables rules restored successfully")
-				}
-			}
+			m.ensureRules("periodic check")
+		}
+	}
+}
+
+// eventLoop checks the rules shortly after another process changed a
+// table they live in.
+func (m *Monitor) eventLoop(changes <-chan rulesetChange) {
+	defer m.wg.Done()
+
+	for change := range changes {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(eventSettle):
 		}
+		// a change that arrived while settling is covered by this check
+		select {
+		case <-changes:
+		default:
+		}
+		m.ensureRules(change.cause)
 	}
 }
 
+// ensureRules restores the rules if they are missing and records why.
+func (m *Monitor) ensureRules(cause string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.checkRules() {
+		return
+	}
+	log.Warnf("Tables rules missing after %s, restoring...", cause)
+	metrics := handler.GetMetricsCollector()
+	if err := m.restoreRules(); err != nil {
+		log.Errorf("Failed to restore tables rules: %v", err)
+		metrics.RecordEvent("error", fmt.Sprintf("Failed to restore firewall rules after %s: %v", cause, err))
+		return
+	}
+	log.Infof("Tables rules restored successfully")
+	metrics.RecordEvent("warning", fmt.Sprintf("Firewall rules restored after %s", cause))
+}
+
 func (m *Monitor) checkRules() bool {
+	switch m.mode {
+	case config.IntegrationFW4:
+		if _, err := os.Stat(fw4IncludePath); err != nil {
+			log.Tracef("Monitor: fw4 include missing")
+			return false
+		}
+		return m.checkNFTablesRules()
+	case config.IntegrationFirewalld:
+		return NewFirewalldManager(m.cfg).checkRules()
+	}
 	if m.backend == "nftables" {
 		return m.checkNFTablesRules()
 	}
@@ -97,6 +158,10 @@ func (m *Monitor) checkIPTablesRules() bool {
 		return true
 	}
 
+	if transparentMode(m.cfg) != "" {
+		return m.checkTransparentRules(ipts)
+	}
+
 	for _, ipt := range ipts {
 		if _, err := run(ipt, "-w", "-t", "mangle", "-S", "B4"); err != nil {
 			log.Tracef("Monitor: B4 chain missing")
@@ -117,7 +182,7 @@ func (m *Monitor) checkIPTablesRules() bool {
 		}
 
 		out, _ := run(ipt, "-w", "-t", "mangle", "-S", "PREROUTING")
-		if !strings.Contains(out, "sport 53") || !strings.Contains(out, "sport 443") {
+		if !strings.Contains(out, "sport 53") || !hasTCPResponseRule(out) {
 			log.Tracef("Monitor: PREROUTING response rules missing")
 			return false
 		}
@@ -141,60 +206,52 @@ func (m *Monitor) checkIPTablesRules() bool {
 	return true
 }
 
-func (m *Monitor) checkNFTablesRules() bool {
-	nft := NewNFTablesManager(m.cfg)
-
-	if !nft.tableExists() {
-		log.Tracef("Monitor: nftables table missing")
-		return false
+// checkTransparentRules looks for the proxy target in the B4 chain and the
+// jump to it.
+func (m *Monitor) checkTransparentRules(ipts []string) bool {
+	table, target := "nat", "REDIRECT"
+	if transparentMode(m.cfg) == config.TransparentTProxy {
+		table, target = "mangle", "TPROXY"
 	}
-
-	if !nft.chainExists(nftChainName) {
-		log.Tracef("Monitor: b4_chain missing")
-		return false
-	}
-
-	if m.cfg.Queue.Devices.Enabled && len(m.cfg.Queue.Devices.Mac) > 0 {
-		if !nft.chainExists("forward") {
-			log.Tracef("Monitor: forward chain missing")
-			return false
-		}
-		out, _ := nft.runNft("list", "chain", "inet", nftTableName, "forward")
-		if !strings.Contains(out, nftChainName) {
-			log.Tracef("Monitor: forward->b4_chain jump missing")
-			return false
-		}
-	} else {
-		if !nft.chainExists("postrouting") {
-			log.Tracef("Monitor: postrouting chain missing")
+	for _, ipt := range ipts {
+		out, err := run(ipt, "-w", "-t", table, "-S", "B4")
+		if err != nil || !strings.Contains(out, "-j "+target) {
+			log.Tracef("Monitor: B4 %s rules missing", target)
 			return false
 		}
-		out, _ := nft.runNft("list", "chain", "inet", nftTableName, "postrouting")
-		if !strings.Contains(out, nftChainName) {
-			log.Tracef("Monitor: postrouting->b4_chain jump missing")
+		out, _ = run(ipt, "-w", "-t", table, "-S", "PREROUTING")
+		if !strings.Contains(out, "-j B4") {
+			log.Tracef("Monitor: PREROUTING->B4 rule missing")
 			return false
 		}
 	}
+	return true
+}
 
-	if !nft.chainExists("prerouting") {
-		log.Tracef("Monitor: prerouting chain missing")
-		return false
-	}
-	out, _ := nft.runNft("list", "chain", "inet", nftTableName, "prerouting")
-	if !strings.Contains(out, "sport 53") || !strings.Contains(out, "sport 443") {
-		log.Tracef("Monitor: prerouting response rules missing")
+// checkNFTablesRules compares the rule count of every b4 chain with the
+// ruleset the config produces.
+func (m *Monitor) checkNFTablesRules() bool {
+	have, err := nlChainRules()
+	if err != nil {
+		log.Tracef("Monitor: failed to list nftables rules: %v", err)
 		return false
 	}
-
-	if !nft.chainExists("output") {
-		log.Tracef("Monitor: output chain missing")
+	if len(have) == 0 {
+		log.Tracef("Monitor: nftables table missing")
 		return false
 	}
 
-	out, _ = nft.runNft("list", "chain", "inet", nftTableName, "output")
-	if !strings.Contains(out, "accept") || !strings.Contains(out, nftChainName) {
-		log.Tracef("Monitor: output mark accept rule missing")
-		return false
+	want := NewNFTablesManager(m.cfg).ruleset().chainRules()
+	for chain, count := range want {
+		got, ok := have[chain]
+		if !ok {
+			log.Tracef("Monitor: %s chain missing", chain)
+			return false
+		}
+		if got != count {
+			log.Tracef("Monitor: %s chain has %d rules, expected %d", chain, got, count)
+			return false
+		}
 	}
 
 	return true
@@ -206,5 +263,18 @@ func (m *Monitor) restoreRules() error {
 
 func (m *Monitor) ForceRestore() error {
 	log.Infof("Manual rule restoration triggered")
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.restoreRules()
 }
+
+// hasTCPResponseRule reports whether a chain listing contains a TCP source-port
+// rule covering 443, either as a plain match or within a port list.
+func hasTCPResponseRule(out string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "tcp") && strings.Contains(line, "sport") && strings.Contains(line, "443") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,780 @@
+package tables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nftables over netlink. The ruleset is encoded into nf_tables messages
+// and committed as one batch, the kernel applies all of them or none.
+
+const (
+	nlTimeout = 5 * time.Second
+	nfAccept  = 1
+
+	// NFTA_TPROXY_* are missing from x/sys/unix
+	nftaTProxyFamily  = 1
+	nftaTProxyRegPort = 3
+)
+
+// nlElem is a set element, end marks the first key past an interval.
+type nlElem struct {
+	key     []byte
+	end     bool
+	timeout time.Duration
+}
+
+// nlExpr is a single kernel expression of a rule.
+type nlExpr struct {
+	name  string
+	attrs func(ae *netlink.AttributeEncoder)
+}
+
+// nlBatch collects the messages of one transaction.
+type nlBatch struct {
+	msgs  []netlink.Message
+	setID uint32
+	err   error
+}
+
+func (b *nlBatch) add(msgType uint16, flags netlink.HeaderFlags, family uint8, attrs func(ae *netlink.AttributeEncoder)) {
+	if b.err != nil {
+		return
+	}
+	data, err := nlEncode(attrs)
+	if err != nil {
+		b.err = err
+		return
+	}
+	b.msgs = append(b.msgs, netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | int(msgType)),
+			Flags: netlink.Request | netlink.Acknowledge | flags,
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	})
+}
+
+func nlEncode(attrs func(ae *netlink.AttributeEncoder)) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	attrs(ae)
+	return ae.Encode()
+}
+
+func (b *nlBatch) replaceTable() {
+	table := func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, nftTableName)
+	}
+	b.add(unix.NFT_MSG_NEWTABLE, netlink.Create, unix.NFPROTO_INET, table)
+	b.add(unix.NFT_MSG_DELTABLE, 0, unix.NFPROTO_INET, table)
+	b.add(unix.NFT_MSG_NEWTABLE, netlink.Create, unix.NFPROTO_INET, table)
+}
+
+func (b *nlBatch) chain(c nftChain) {
+	b.add(unix.NFT_MSG_NEWCHAIN, netlink.Create, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_CHAIN_TABLE, nftTableName)
+		ae.String(unix.NFTA_CHAIN_NAME, c.name)
+		if c.hook == "" {
+			return
+		}
+		ae.Nested(unix.NFTA_CHAIN_HOOK, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint32(unix.NFTA_HOOK_HOOKNUM, nlHook(c.hook))
+			nae.Uint32(unix.NFTA_HOOK_PRIORITY, uint32(int32(c.priority)))
+			return nil
+		})
+		ae.Uint32(unix.NFTA_CHAIN_POLICY, nfAccept)
+		ae.String(unix.NFTA_CHAIN_TYPE, c.chainType())
+	})
+}
+
+func nlHook(hook string) uint32 {
+	switch hook {
+	case "prerouting":
+		return unix.NF_INET_PRE_ROUTING
+	case "forward":
+		return unix.NF_INET_FORWARD
+	case "output":
+		return unix.NF_INET_LOCAL_OUT
+	default:
+		return unix.NF_INET_POST_ROUTING
+	}
+}
+
+// newSet declares a set and returns its transaction id.
+func (b *nlBatch) newSet(name string, flags, keyType, keyLen uint32) uint32 {
+	b.setID++
+	id := b.setID
+	b.add(unix.NFT_MSG_NEWSET, netlink.Create, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_SET_TABLE, nftTableName)
+		ae.String(unix.NFTA_SET_NAME, name)
+		ae.Uint32(unix.NFTA_SET_FLAGS, flags)
+		ae.Uint32(unix.NFTA_SET_KEY_TYPE, keyType)
+		ae.Uint32(unix.NFTA_SET_KEY_LEN, keyLen)
+		ae.Uint32(unix.NFTA_SET_ID, id)
+	})
+	return id
+}
+
+// setElems adds elements in messages of at most 1000 elements.
+func (b *nlBatch) setElems(msgType uint16, name string, id uint32, elems []nlElem) {
+	for len(elems) > 0 {
+		chunk := elems
+		if len(chunk) > 1000 {
+			chunk = chunk[:1000]
+		}
+		elems = elems[len(chunk):]
+
+		b.add(msgType, netlink.Create, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+			ae.String(unix.NFTA_SET_ELEM_LIST_TABLE, nftTableName)
+			ae.String(unix.NFTA_SET_ELEM_LIST_SET, name)
+			if id != 0 {
+				ae.Uint32(unix.NFTA_SET_ELEM_LIST_SET_ID, id)
+			}
+			ae.Nested(unix.NFTA_SET_ELEM_LIST_ELEMENTS, func(lae *netlink.AttributeEncoder) error {
+				for _, el := range chunk {
+					lae.Nested(unix.NFTA_LIST_ELEM, func(eae *netlink.AttributeEncoder) error {
+						eae.Nested(unix.NFTA_SET_ELEM_KEY, func(kae *netlink.AttributeEncoder) error {
+							kae.Bytes(unix.NFTA_DATA_VALUE, el.key)
+							return nil
+						})
+						if el.end {
+							eae.Uint32(unix.NFTA_SET_ELEM_FLAGS, unix.NFT_SET_ELEM_INTERVAL_END)
+						}
+						if el.timeout > 0 {
+							eae.Uint64(unix.NFTA_SET_ELEM_TIMEOUT, uint64(el.timeout/time.Millisecond))
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// flushSet removes every element of a named set.
+func (b *nlBatch) flushSet(name string) {
+	b.add(unix.NFT_MSG_DELSETELEM, 0, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_SET_ELEM_LIST_TABLE, nftTableName)
+		ae.String(unix.NFTA_SET_ELEM_LIST_SET, name)
+	})
+}
+
+func (b *nlBatch) targetSet(s kernelSet) {
+	keyType, keyLen := uint32(7), uint32(4) // ipv4_addr
+	if s.v6 {
+		keyType, keyLen = 8, 16 // ipv6_addr
+	}
+	if s.learned {
+		b.newSet(s.name, unix.NFT_SET_TIMEOUT, keyType, keyLen)
+		return
+	}
+	id := b.newSet(s.name, unix.NFT_SET_INTERVAL, keyType, keyLen)
+	b.setElems(unix.NFT_MSG_NEWSETELEM, s.name, id, addrIntervals(s.elems, s.v6))
+}
+
+func (b *nlBatch) rule(r nftRule) {
+	var exprs []nlExpr
+	for _, e := range r.exprs {
+		exprs = append(exprs, b.exprs(e)...)
+	}
+	b.add(unix.NFT_MSG_NEWRULE, netlink.Create|netlink.Append, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftTableName)
+		ae.String(unix.NFTA_RULE_CHAIN, r.chain)
+		ae.Nested(unix.NFTA_RULE_EXPRESSIONS, func(lae *netlink.AttributeEncoder) error {
+			for _, x := range exprs {
+				lae.Nested(unix.NFTA_LIST_ELEM, func(eae *netlink.AttributeEncoder) error {
+					eae.String(unix.NFTA_EXPR_NAME, x.name)
+					eae.Nested(unix.NFTA_EXPR_DATA, func(dae *netlink.AttributeEncoder) error {
+						x.attrs(dae)
+						return nil
+					})
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+}
+
+// exprs translates a statement into kernel expressions, adding the implicit
+// protocol checks nft would add.
+func (b *nlBatch) exprs(e nftExpr) []nlExpr {
+	switch e := e.(type) {
+	case nftNfproto:
+		proto := byte(unix.NFPROTO_IPV4)
+		if e.v6 {
+			proto = unix.NFPROTO_IPV6
+		}
+		return []nlExpr{nlMeta(unix.NFT_META_NFPROTO), nlCmp(unix.NFT_CMP_EQ, []byte{proto})}
+	case nftOifname:
+		name := make([]byte, unix.IFNAMSIZ)
+		copy(name, e.name)
+		return []nlExpr{nlMeta(unix.NFT_META_OIFNAME), nlCmp(unix.NFT_CMP_EQ, name)}
+	case nftMark:
+		mark := make([]byte, 4)
+		binary.NativeEndian.PutUint32(mark, e.mark)
+		return []nlExpr{nlMeta(unix.NFT_META_MARK), nlCmp(unix.NFT_CMP_EQ, mark)}
+	case nftEtherSrc:
+		mac, err := net.ParseMAC(e.mac)
+		if err != nil {
+			b.err = fmt.Errorf("invalid MAC address %q: %w", e.mac, err)
+			return nil
+		}
+		iftype := make([]byte, 2)
+		binary.NativeEndian.PutUint16(iftype, unix.ARPHRD_ETHER)
+		return []nlExpr{
+			nlMeta(unix.NFT_META_IIFTYPE), nlCmp(unix.NFT_CMP_EQ, iftype),
+			nlPayload(unix.NFT_PAYLOAD_LL_HEADER, 6, 6), nlCmp(unix.NFT_CMP_EQ, mac),
+		}
+	case nftPorts:
+		return b.ports(e)
+	case nftAddrSet:
+		proto, offset, size := byte(unix.NFPROTO_IPV4), uint32(12), uint32(4)
+		if e.v6 {
+			proto, offset, size = unix.NFPROTO_IPV6, 8, 16
+		}
+		if e.dir == "daddr" {
+			offset += size
+		}
+		return []nlExpr{
+			nlMeta(unix.NFT_META_NFPROTO), nlCmp(unix.NFT_CMP_EQ, []byte{proto}),
+			nlPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, offset, size), nlLookup(e.set, 0),
+		}
+	case nftCtPackets:
+		below := make([]byte, 8)
+		binary.BigEndian.PutUint64(below, uint64(e.below))
+		return []nlExpr{
+			nlCt(unix.NFT_CT_PKTS, 0),
+			nlByteorder(unix.NFT_BYTEORDER_HTON, 8),
+			nlCmp(unix.NFT_CMP_LT, below),
+		}
+	case nftSynAck:
+		const synAck = 0x12
+		return []nlExpr{
+			nlMeta(unix.NFT_META_L4PROTO), nlCmp(unix.NFT_CMP_EQ, []byte{unix.IPPROTO_TCP}),
+			nlPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 13, 1),
+			nlBitwise([]byte{synAck}),
+			nlCmp(unix.NFT_CMP_EQ, []byte{synAck}),
+		}
+	case nftCounter:
+		return []nlExpr{{name: "counter", attrs: func(ae *netlink.AttributeEncoder) {
+			ae.Uint64(unix.NFTA_COUNTER_BYTES, 0)
+			ae.Uint64(unix.NFTA_COUNTER_PACKETS, 0)
+		}}}
+	case nftVerdict:
+		code := int32(nfAccept)
+		switch e.kind {
+		case "return":
+			code = unix.NFT_RETURN
+		case "jump":
+			code = unix.NFT_JUMP
+		}
+		return []nlExpr{nlVerdict(code, e.chain)}
+	case nftQueue:
+		return []nlExpr{{name: "queue", attrs: func(ae *netlink.AttributeEncoder) {
+			ae.Uint16(unix.NFTA_QUEUE_NUM, e.num)
+			ae.Uint16(unix.NFTA_QUEUE_TOTAL, e.total)
+			ae.Uint16(unix.NFTA_QUEUE_FLAGS, unix.NFT_QUEUE_FLAG_BYPASS)
+		}}}
+	case nftRedirect:
+		return []nlExpr{nlImmediate(be16(e.port)), {name: "redir", attrs: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_REDIR_REG_PROTO_MIN, unix.NFT_REG_1)
+		}}}
+	case nftTProxy:
+		return []nlExpr{nlImmediate(be16(e.port)), {name: "tproxy", attrs: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(nftaTProxyFamily, unix.NFPROTO_UNSPEC)
+			ae.Uint32(nftaTProxyRegPort, unix.NFT_REG_1)
+		}}}
+	case nftSetMark:
+		mark := make([]byte, 4)
+		binary.NativeEndian.PutUint32(mark, e.mark)
+		return []nlExpr{nlImmediate(mark), {name: "meta", attrs: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_META_KEY, unix.NFT_META_MARK)
+			ae.Uint32(unix.NFTA_META_SREG, unix.NFT_REG_1)
+		}}}
+	}
+	b.err = fmt.Errorf("unsupported nftables statement %q", e.text())
+	return nil
+}
+
+// ports matches a single port with cmp, a single range with range and
+// anything else through an anonymous interval set.
+func (b *nlBatch) ports(e nftPorts) []nlExpr {
+	proto := byte(unix.IPPROTO_TCP)
+	if e.proto == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	offset := uint32(0)
+	if e.dir == "dport" {
+		offset = 2
+	}
+	exprs := []nlExpr{
+		nlMeta(unix.NFT_META_L4PROTO), nlCmp(unix.NFT_CMP_EQ, []byte{proto}),
+		nlPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, offset, 2),
+	}
+
+	ranges := make([][2][]byte, 0, len(e.ports))
+	for _, p := range e.ports {
+		lo, hi, err := parsePortRange(p)
+		if err != nil {
+			b.err = err
+			return nil
+		}
+		ranges = append(ranges, [2][]byte{be16(lo), be16(hi)})
+	}
+
+	if len(ranges) == 1 {
+		if bytes.Equal(ranges[0][0], ranges[0][1]) {
+			return append(exprs, nlCmp(unix.NFT_CMP_EQ, ranges[0][0]))
+		}
+		return append(exprs, nlRange(ranges[0][0], ranges[0][1]))
+	}
+
+	const inetService = 13
+	id := b.newSet("__set%d", unix.NFT_SET_ANONYMOUS|unix.NFT_SET_CONSTANT|unix.NFT_SET_INTERVAL, inetService, 2)
+	b.setElems(unix.NFT_MSG_NEWSETELEM, "__set%d", id, intervalElems(ranges))
+	return append(exprs, nlLookup("__set%d", id))
+}
+
+func parsePortRange(p string) (uint16, uint16, error) {
+	from, to, isRange := strings.Cut(p, "-")
+	lo, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", p)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid port range %q", p)
+		}
+	}
+	return uint16(lo), uint16(hi), nil
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// addrIntervals turns addresses and prefixes into interval elements,
+// invalid entries were already dropped by normalizeTarget.
+func addrIntervals(entries []string, v6 bool) []nlElem {
+	ranges := make([][2][]byte, 0, len(entries))
+	for _, entry := range entries {
+		var ipNet *net.IPNet
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				continue
+			}
+			ipNet = n
+		} else {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if !v6 {
+				bits = 32
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		lo := ipNet.IP.To16()
+		if !v6 {
+			lo = ipNet.IP.To4()
+		}
+		if lo == nil {
+			continue
+		}
+		lo = append([]byte(nil), lo...)
+		hi := append([]byte(nil), lo...)
+		mask := ipNet.Mask
+		if len(mask) != len(lo) {
+			continue
+		}
+		for i := range hi {
+			hi[i] |= ^mask[i]
+		}
+		ranges = append(ranges, [2][]byte{lo, hi})
+	}
+	return intervalElems(ranges)
+}
+
+// intervalElems merges overlapping and adjacent ranges and encodes them the
+// way nft does: a start key per interval, an end key one past its last
+// value, and a leading end key at zero.
+func intervalElems(ranges [][2][]byte) []nlElem {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i][0], ranges[j][0]) < 0
+	})
+
+	merged := [][2][]byte{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		next, overflow := keyAddOne(last[1])
+		if overflow || bytes.Compare(r[0], next) <= 0 {
+			if bytes.Compare(r[1], last[1]) > 0 {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	var elems []nlElem
+	if !isZeroKey(merged[0][0]) {
+		elems = append(elems, nlElem{key: make([]byte, len(merged[0][0])), end: true})
+	}
+	for _, r := range merged {
+		elems = append(elems, nlElem{key: r[0]})
+		if end, overflow := keyAddOne(r[1]); !overflow {
+			elems = append(elems, nlElem{key: end, end: true})
+		}
+	}
+	return elems
+}
+
+func keyAddOne(key []byte) ([]byte, bool) {
+	out := append([]byte(nil), key...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			return out, false
+		}
+	}
+	return out, true
+}
+
+func isZeroKey(key []byte) bool {
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func nlMeta(key uint32) nlExpr {
+	return nlExpr{name: "meta", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_META_KEY, key)
+		ae.Uint32(unix.NFTA_META_DREG, unix.NFT_REG_1)
+	}}
+}
+
+func nlCmp(op uint32, data []byte) nlExpr {
+	return nlExpr{name: "cmp", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_CMP_SREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_CMP_OP, op)
+		ae.Nested(unix.NFTA_CMP_DATA, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, data)
+			return nil
+		})
+	}}
+}
+
+func nlRange(from, to []byte) nlExpr {
+	return nlExpr{name: "range", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_RANGE_SREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_RANGE_OP, unix.NFT_RANGE_EQ)
+		ae.Nested(unix.NFTA_RANGE_FROM_DATA, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, from)
+			return nil
+		})
+		ae.Nested(unix.NFTA_RANGE_TO_DATA, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, to)
+			return nil
+		})
+	}}
+}
+
+func nlPayload(base, offset, size uint32) nlExpr {
+	return nlExpr{name: "payload", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_PAYLOAD_BASE, base)
+		ae.Uint32(unix.NFTA_PAYLOAD_OFFSET, offset)
+		ae.Uint32(unix.NFTA_PAYLOAD_LEN, size)
+	}}
+}
+
+func nlBitwise(mask []byte) nlExpr {
+	return nlExpr{name: "bitwise", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_BITWISE_LEN, uint32(len(mask)))
+		ae.Nested(unix.NFTA_BITWISE_MASK, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, mask)
+			return nil
+		})
+		ae.Nested(unix.NFTA_BITWISE_XOR, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, make([]byte, len(mask)))
+			return nil
+		})
+	}}
+}
+
+func nlLookup(set string, id uint32) nlExpr {
+	return nlExpr{name: "lookup", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_LOOKUP_SET, set)
+		if id != 0 {
+			ae.Uint32(unix.NFTA_LOOKUP_SET_ID, id)
+		}
+		ae.Uint32(unix.NFTA_LOOKUP_SREG, unix.NFT_REG_1)
+	}}
+}
+
+func nlCt(key uint32, dir uint8) nlExpr {
+	return nlExpr{name: "ct", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_CT_DREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_CT_KEY, key)
+		ae.Uint8(unix.NFTA_CT_DIRECTION, dir)
+	}}
+}
+
+func nlByteorder(op uint32, size uint32) nlExpr {
+	return nlExpr{name: "byteorder", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_BYTEORDER_SREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_BYTEORDER_DREG, unix.NFT_REG_1)
+		ae.Uint32(unix.NFTA_BYTEORDER_OP, op)
+		ae.Uint32(unix.NFTA_BYTEORDER_LEN, size)
+		ae.Uint32(unix.NFTA_BYTEORDER_SIZE, size)
+	}}
+}
+
+// nlImmediate loads data into register 1.
+func nlImmediate(data []byte) nlExpr {
+	return nlExpr{name: "immediate", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_1)
+		ae.Nested(unix.NFTA_IMMEDIATE_DATA, func(dae *netlink.AttributeEncoder) error {
+			dae.Bytes(unix.NFTA_DATA_VALUE, data)
+			return nil
+		})
+	}}
+}
+
+func nlVerdict(code int32, chain string) nlExpr {
+	return nlExpr{name: "immediate", attrs: func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT)
+		ae.Nested(unix.NFTA_IMMEDIATE_DATA, func(dae *netlink.AttributeEncoder) error {
+			dae.Nested(unix.NFTA_DATA_VERDICT, func(vae *netlink.AttributeEncoder) error {
+				vae.Uint32(unix.NFTA_VERDICT_CODE, uint32(code))
+				if chain != "" {
+					vae.String(unix.NFTA_VERDICT_CHAIN, chain)
+				}
+				return nil
+			})
+			return nil
+		})
+	}}
+}
+
+// rulesetBatch encodes the whole table, replacing a previous one.
+func rulesetBatch(rs nftRuleset) *nlBatch {
+	b := &nlBatch{}
+	b.replaceTable()
+	for _, c := range rs.chains {
+		b.chain(c)
+	}
+	for _, s := range rs.sets {
+		b.targetSet(s)
+	}
+	for _, r := range rs.rules {
+		b.rule(r)
+	}
+	return b
+}
+
+// commit sends the batch as one transaction and waits for every message to
+// be acknowledged.
+func (b *nlBatch) commit() error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.msgs) == 0 {
+		return nil
+	}
+
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetOption(netlink.ExtendedAcknowledge, true)
+
+	batch := make([]netlink.Message, 0, len(b.msgs)+2)
+	batch = append(batch, nlBatchMsg(unix.NFNL_MSG_BATCH_BEGIN))
+	batch = append(batch, b.msgs...)
+	batch = append(batch, nlBatchMsg(unix.NFNL_MSG_BATCH_END))
+
+	size := 0
+	for _, m := range batch {
+		size += 16 + len(m.Data)
+	}
+	if size > 64*1024 {
+		// the kernel rejects messages larger than the socket send buffer
+		raw, err := conn.SyscallConn()
+		if err == nil {
+			_ = raw.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, size*2)
+			})
+		}
+	}
+
+	if _, err := conn.SendMessages(batch); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(nlTimeout)); err != nil {
+		return err
+	}
+	for acked := 0; acked < len(b.msgs); {
+		replies, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		acked += len(replies)
+	}
+	return nil
+}
+
+func nlBatchMsg(t int) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(t), Flags: netlink.Request},
+		Data:   []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	}
+}
+
+// nlQuery runs a get request and returns the attributes of every reply.
+func nlQuery(family uint8, msgType uint16, flags netlink.HeaderFlags, attrs func(ae *netlink.AttributeEncoder)) ([]*netlink.AttributeDecoder, error) {
+	data, err := nlEncode(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(nlTimeout)); err != nil {
+		return nil, err
+	}
+
+	replies, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | int(msgType)),
+			Flags: netlink.Request | flags,
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decoders := make([]*netlink.AttributeDecoder, 0, len(replies))
+	for _, m := range replies {
+		if len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		decoders = append(decoders, ad)
+	}
+	return decoders, nil
+}
+
+// nlTableExists reports whether the b4 table is loaded, an error means
+// nftables is not reachable over netlink.
+func nlTableExists() (bool, error) {
+	_, err := nlQuery(unix.NFPROTO_INET, unix.NFT_MSG_GETTABLE, netlink.Acknowledge, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, nftTableName)
+	})
+	if errors.Is(err, unix.ENOENT) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// nlTableCount returns the number of nftables tables of any family.
+func nlTableCount() (int, error) {
+	tables, err := nlQuery(unix.AF_UNSPEC, unix.NFT_MSG_GETTABLE, netlink.Dump, func(ae *netlink.AttributeEncoder) {})
+	return len(tables), err
+}
+
+// nlChainRules counts the rules of every chain in the b4 table.
+func nlChainRules() (map[string]int, error) {
+	chains, err := nlQuery(unix.NFPROTO_INET, unix.NFT_MSG_GETCHAIN, netlink.Dump, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_CHAIN_TABLE, nftTableName)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, ad := range chains {
+		var table, name string
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_CHAIN_TABLE:
+				table = ad.String()
+			case unix.NFTA_CHAIN_NAME:
+				name = ad.String()
+			}
+		}
+		if table == nftTableName {
+			counts[name] = 0
+		}
+	}
+	if len(counts) == 0 {
+		return counts, nil
+	}
+
+	rules, err := nlQuery(unix.NFPROTO_INET, unix.NFT_MSG_GETRULE, netlink.Dump, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftTableName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ad := range rules {
+		var table, chain string
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_RULE_TABLE:
+				table = ad.String()
+			case unix.NFTA_RULE_CHAIN:
+				chain = ad.String()
+			}
+		}
+		if table == nftTableName {
+			counts[chain]++
+		}
+	}
+	return counts, nil
+}
+
+// nlDeleteTable removes the b4 table with everything in it.
+func nlDeleteTable() error {
+	b := &nlBatch{}
+	b.add(unix.NFT_MSG_DELTABLE, 0, unix.NFPROTO_INET, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, nftTableName)
+	})
+	return b.commit()
+}
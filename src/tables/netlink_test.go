@@ -0,0 +1,86 @@
+package tables
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIntervalElems(t *testing.T) {
+	t.Run("merges overlapping and adjacent ranges", func(t *testing.T) {
+		elems := addrIntervals([]string{"10.1.0.0/16", "1.2.3.4", "10.0.0.0/8", "11.0.0.0/8"}, false)
+
+		want := []nlElem{
+			{key: []byte{0, 0, 0, 0}, end: true},
+			{key: []byte{1, 2, 3, 4}},
+			{key: []byte{1, 2, 3, 5}, end: true},
+			{key: []byte{10, 0, 0, 0}},
+			{key: []byte{12, 0, 0, 0}, end: true},
+		}
+		if len(elems) != len(want) {
+			t.Fatalf("expected %d elements, got %d: %v", len(want), len(elems), elems)
+		}
+		for i, el := range want {
+			if !bytes.Equal(elems[i].key, el.key) || elems[i].end != el.end {
+				t.Errorf("element %d = %v/%v, want %v/%v", i, elems[i].key, elems[i].end, el.key, el.end)
+			}
+		}
+	})
+
+	t.Run("no end past the last address", func(t *testing.T) {
+		elems := addrIntervals([]string{"0.0.0.0/0"}, false)
+		if len(elems) != 1 || elems[0].end {
+			t.Errorf("expected a single start element, got %v", elems)
+		}
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		elems := addrIntervals([]string{"2001:db8::/32"}, true)
+		if len(elems) != 3 || len(elems[1].key) != 16 || elems[2].key[3] != 0xb9 {
+			t.Errorf("unexpected IPv6 elements: %v", elems)
+		}
+	})
+}
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		in     string
+		lo, hi uint16
+		ok     bool
+	}{
+		{"443", 443, 443, true},
+		{"6000-6100", 6000, 6100, true},
+		{"6100-6000", 0, 0, false},
+		{"https", 0, 0, false},
+		{"70000", 0, 0, false},
+	}
+	for _, c := range cases {
+		lo, hi, err := parsePortRange(c.in)
+		if (err == nil) != c.ok || lo != c.lo || hi != c.hi {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v", c.in, lo, hi, err)
+		}
+	}
+}
+
+func TestRulesetBatch(t *testing.T) {
+	rs := nftRuleset{
+		chains: []nftChain{{name: nftChainName}, {name: "output", hook: "output", priority: -150}},
+		rules: []nftRule{
+			{chain: "output", exprs: []nftExpr{nftVerdict{kind: "jump", chain: nftChainName}}},
+			{chain: nftChainName, exprs: []nftExpr{nftPorts{proto: "tcp", dir: "dport", ports: []string{"443", "80"}}, nftQueue{num: 1, total: 1}}},
+		},
+	}
+
+	b := rulesetBatch(rs)
+	if b.err != nil {
+		t.Fatalf("unexpected error: %v", b.err)
+	}
+	// table replacement, two chains, an anonymous set with its elements and two rules
+	if len(b.msgs) != 9 {
+		t.Errorf("expected 9 messages, got %d", len(b.msgs))
+	}
+
+	rs.rules = append(rs.rules, nftRule{chain: "output", exprs: []nftExpr{nftEtherSrc{mac: "not-a-mac"}}})
+	if b := rulesetBatch(rs); b.err == nil {
+		t.Error("expected an error for an invalid MAC address")
+	}
+}
@@ -3,12 +3,14 @@ package tables
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os/exec"
 	"strings"
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -17,8 +19,9 @@ const (
 )
 
 type NFTablesManager struct {
-	cfg             *config.Config
-	ipVersionFilter string
+	cfg      *config.Config
+	ipFilter []nftExpr
+	plan     targetPlan
 }
 
 func NewNFTablesManager(cfg *config.Config) *NFTablesManager {
@@ -34,7 +37,16 @@ func (n *NFTablesManager) runNft(args ...string) (string, error) {
 	return out.String(), err
 }
 
+// runNftScript runs several commands from stdin as one transaction.
+func (n *NFTablesManager) runNftScript(script string) (string, error) {
+	return runInput(script, "nft", "-f", "-")
+}
+
+// tableExists asks the kernel over netlink and falls back to nft.
 func (n *NFTablesManager) tableExists() bool {
+	if exists, err := nlTableExists(); err == nil {
+		return exists
+	}
 	out, err := n.runNft("list", "tables")
 	if err != nil {
 		return false
@@ -42,225 +54,322 @@ func (n *NFTablesManager) tableExists() bool {
 	return strings.Contains(out, nftTableName)
 }
 
-func (n *NFTablesManager) chainExists(chain string) bool {
-	_, err := n.runNft("list", "chain", "inet", nftTableName, chain)
-	return err == nil
-}
-
-func (n *NFTablesManager) createTable() error {
-	if n.tableExists() {
-		return nil
+func (n *NFTablesManager) queue() nftQueue {
+	threads := n.cfg.Queue.Threads
+	if threads < 1 {
+		threads = 1
 	}
-	_, err := n.runNft("add", "table", "inet", nftTableName)
-	if err != nil {
-		return fmt.Errorf("failed to create nftables table: %w", err)
-	}
-	log.Tracef("Created nftables table: %s", nftTableName)
-	return nil
-}
-
-func (n *NFTablesManager) createChain(chain, hook string, priority int, policy string) error {
-	if n.chainExists(chain) {
-		return nil
-	}
-
-	var cmd []string
-	if hook != "" {
-		cmd = []string{"add", "chain", "inet", nftTableName, chain,
-			fmt.Sprintf("{ type filter hook %s priority %d ; policy %s ; }", hook, priority, policy)}
-	} else {
-		cmd = []string{"add", "chain", "inet", nftTableName, chain}
-	}
-
-	_, err := n.runNft(cmd...)
-	if err != nil {
-		return fmt.Errorf("failed to create chain %s: %w", chain, err)
-	}
-	log.Tracef("Created nftables chain: %s", chain)
-	return nil
+	return nftQueue{num: uint16(n.cfg.Queue.StartNum), total: uint16(threads)}
 }
 
 func (n *NFTablesManager) buildNFQueueAction() string {
-	if n.cfg.Queue.Threads > 1 {
-		return fmt.Sprintf("queue num %d-%d bypass", n.cfg.Queue.StartNum, n.cfg.Queue.StartNum+n.cfg.Queue.Threads-1)
-	}
-	return fmt.Sprintf("queue num %d bypass", n.cfg.Queue.StartNum)
+	return n.queue().text()
 }
 
-func (n *NFTablesManager) addRule(chain string, args ...string) error {
-	cmd := append([]string{"add", "rule", "inet", nftTableName, chain}, args...)
-	log.Tracef("NFTABLES: adding rule to %s: %v", chain, args)
-	_, err := n.runNft(cmd...)
-	if err != nil {
-		return fmt.Errorf("failed to add rule to %s: %w", chain, err)
+// queueRules builds a queue rule per target selector unless all traffic of
+// the protocol is queued. dir is "daddr" or "saddr".
+func (n *NFTablesManager) queueRules(chain string, all bool, dir string, match ...nftExpr) []nftRule {
+	v4 := n.cfg.Queue.IPv4Enabled
+	v6 := n.cfg.Queue.IPv6Enabled
+
+	var rules []nftRule
+	for _, sel := range n.plan.nftSelectors(all, dir, v4, v6) {
+		exprs := append([]nftExpr{}, n.ipFilter...)
+		exprs = append(exprs, sel...)
+		exprs = append(exprs, match...)
+		exprs = append(exprs, n.queue())
+		rules = append(rules, nftRule{chain: chain, exprs: exprs})
 	}
-	return nil
+	return rules
 }
 
-func (n *NFTablesManager) addFilteredRule(chain string, args ...string) error {
-	if n.ipVersionFilter != "" {
-		args = append(strings.Fields(n.ipVersionFilter), args...)
+// windowRules builds the queue rules of a set window, one per kernel set
+// holding its destinations.
+func (n *NFTablesManager) windowRules(chain string, w windowPlan, dir string, match ...nftExpr) []nftRule {
+	var rules []nftRule
+	for _, sel := range w.nftSelectors(dir, n.cfg.Queue.IPv4Enabled, n.cfg.Queue.IPv6Enabled) {
+		exprs := append([]nftExpr{}, sel...)
+		exprs = append(exprs, match...)
+		exprs = append(exprs, n.queue())
+		rules = append(rules, nftRule{chain: chain, exprs: exprs})
 	}
-	return n.addRule(chain, args...)
+	return rules
 }
 
-func (n *NFTablesManager) addQueueRule(chain string, args ...string) error {
-	args = append(args, strings.Fields(n.buildNFQueueAction())...)
-	return n.addFilteredRule(chain, args...)
-}
-
-func (n *NFTablesManager) Apply() error {
+// ruleset builds the complete b4 table from the config.
+func (n *NFTablesManager) ruleset() nftRuleset {
 	cfg := n.cfg
-	if !hasBinary("nft") {
-		return fmt.Errorf("nft binary not found")
-	}
-
-	log.Tracef("NFTABLES: adding rules")
-	loadKernelModules()
-
-	// Clear existing table to prevent rule duplication
-	if n.tableExists() {
-		n.Clear()
-	}
+	n.plan = buildTargetPlan(cfg)
 
 	// Set IP version filter
 	switch {
 	case cfg.Queue.IPv4Enabled && cfg.Queue.IPv6Enabled:
-		n.ipVersionFilter = ""
+		n.ipFilter = nil
 	case cfg.Queue.IPv4Enabled:
-		n.ipVersionFilter = "meta nfproto ipv4"
+		n.ipFilter = []nftExpr{nftNfproto{}}
 	case cfg.Queue.IPv6Enabled:
-		n.ipVersionFilter = "meta nfproto ipv6"
+		n.ipFilter = []nftExpr{nftNfproto{v6: true}}
 	}
 
-	if err := n.createTable(); err != nil {
-		return err
+	if transparentMode(cfg) != "" {
+		return n.transparentRuleset()
 	}
 
-	if err := n.createChain(nftChainName, "", 0, ""); err != nil {
-		return err
-	}
+	var rs nftRuleset
+	rs.sets = n.plan.kernelSets(cfg.Queue.IPv4Enabled, cfg.Queue.IPv6Enabled)
 
-	if err := n.createChain("prerouting", "prerouting", -150, "accept"); err != nil {
-		return err
+	rs.chains = []nftChain{
+		{name: nftChainName},
+		{name: "prerouting", hook: "prerouting", priority: -150},
+		{name: "output", hook: "output", priority: -150},
 	}
 
-	if err := n.createChain("output", "output", -150, "accept"); err != nil {
-		return err
+	rule := func(chain string, exprs ...nftExpr) {
+		rs.rules = append(rs.rules, nftRule{chain: chain, exprs: exprs})
 	}
-
-	markAccept := fmt.Sprintf("0x%x", cfg.Queue.Mark)
+	jump := nftVerdict{kind: "jump", chain: nftChainName}
 
 	if cfg.Queue.Devices.Enabled && len(cfg.Queue.Devices.Mac) > 0 {
-		if err := n.createChain("forward", "forward", -150, "accept"); err != nil {
-			return err
-		}
+		rs.chains = append(rs.chains, nftChain{name: "forward", hook: "forward", priority: -150})
 
 		if cfg.Queue.Devices.WhiteIsBlack {
 			for _, mac := range cfg.Queue.Devices.Mac {
 				if mac = strings.ToUpper(strings.TrimSpace(mac)); mac != "" {
-					if err := n.addRule("forward", "ether", "saddr", mac, "return"); err != nil {
-						return err
-					}
+					rule("forward", nftEtherSrc{mac: mac}, nftVerdict{kind: "return"})
 				}
 			}
-			if err := n.addRule("forward", "jump", nftChainName); err != nil {
-				return err
-			}
+			rule("forward", jump)
 		} else {
 			for _, mac := range cfg.Queue.Devices.Mac {
 				if mac = strings.ToUpper(strings.TrimSpace(mac)); mac != "" {
-					if err := n.addRule("forward", "ether", "saddr", mac, "jump", nftChainName); err != nil {
-						return err
-					}
+					rule("forward", nftEtherSrc{mac: mac}, jump)
 				}
 			}
 		}
 	} else {
+		rs.chains = append(rs.chains, nftChain{name: "postrouting", hook: "postrouting", priority: -150})
+		rule("postrouting", jump)
+	}
 
-		if err := n.createChain("postrouting", "postrouting", -150, "accept"); err != nil {
-			return err
+	rule("output", nftOifname{name: "lo"}, nftVerdict{kind: "return"})
+	rule("output", nftMark{mark: uint32(cfg.Queue.Mark)}, nftVerdict{kind: "accept"})
+	rule("output", jump)
+
+	rule(nftChainName, nftMark{mark: uint32(cfg.Queue.Mark)}, nftVerdict{kind: "return"})
+
+	tcpLimit := nftCtPackets{below: cfg.MainSet.TCP.ConnBytesLimit + 1}
+	udpLimit := nftCtPackets{below: cfg.MainSet.UDP.ConnBytesLimit + 1}
+	tcpPorts := cfg.CollectTCPPorts()
+	udpPorts := cfg.CollectUDPPorts()
+	dns := []string{"53"}
+
+	rs.rules = append(rs.rules, n.queueRules(nftChainName, n.plan.tcpAll, "daddr",
+		nftPorts{proto: "tcp", dir: "dport", ports: tcpPorts}, tcpLimit, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules(nftChainName, true, "daddr",
+		nftPorts{proto: "udp", dir: "dport", ports: dns}, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules(nftChainName, true, "daddr",
+		nftPorts{proto: "tcp", dir: "dport", ports: dns}, nftCtPackets{below: dnsTCPPackets + 1}, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules("prerouting", true, "saddr",
+		nftPorts{proto: "udp", dir: "sport", ports: dns}, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules("prerouting", n.plan.tcpAll, "saddr",
+		nftPorts{proto: "tcp", dir: "sport", ports: tcpPorts}, tcpLimit, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules("prerouting", n.plan.tcpAll, "saddr",
+		nftPorts{proto: "tcp", dir: "sport", ports: tcpPorts}, nftSynAck{}, nftCounter{})...)
+	rs.rules = append(rs.rules, n.queueRules(nftChainName, n.plan.udpAll, "daddr",
+		nftPorts{proto: "udp", dir: "dport", ports: udpPorts}, udpLimit, nftCounter{})...)
+
+	// Sets allowed to see more packets than the main set get their own
+	// rules, limited to their destinations.
+	for _, w := range n.plan.windows {
+		if w.tcp > 0 {
+			limit := nftCtPackets{below: w.tcp + 1}
+			rs.rules = append(rs.rules, n.windowRules(nftChainName, w, "daddr",
+				nftPorts{proto: "tcp", dir: "dport", ports: w.tcpPorts}, limit, nftCounter{})...)
+			rs.rules = append(rs.rules, n.windowRules("prerouting", w, "saddr",
+				nftPorts{proto: "tcp", dir: "sport", ports: w.tcpPorts}, limit, nftCounter{})...)
 		}
-		if err := n.addRule("postrouting", "jump", nftChainName); err != nil {
-			return err
+		if w.udp > 0 {
+			rs.rules = append(rs.rules, n.windowRules(nftChainName, w, "daddr",
+				nftPorts{proto: "udp", dir: "dport", ports: w.udpPorts}, nftCtPackets{below: w.udp + 1}, nftCounter{})...)
 		}
 	}
 
-	if err := n.addRule("output", "oifname", `"lo"`, "return"); err != nil {
-		return err
+	return rs
+}
+
+// commit applies the ruleset as one netlink transaction, nft is only used
+// when the batch could not be sent or was refused.
+func (n *NFTablesManager) commit(rs nftRuleset) error {
+	err := rulesetBatch(rs).commit()
+	if err == nil {
+		log.Tracef("NFTABLES: applied %d chains, %d sets and %d rules in one netlink batch",
+			len(rs.chains), len(rs.sets), len(rs.rules))
+		return nil
 	}
-	if err := n.addRule("output", "meta", "mark", markAccept, "accept"); err != nil {
-		return err
+	if !hasBinary("nft") {
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
 	}
-	if err := n.addRule("output", "jump", nftChainName); err != nil {
-		return err
+
+	log.Warnf("NFTABLES: netlink batch failed (%v), applying rules with nft", err)
+	if out, err := n.runNftScript(rs.script()); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %w: %s", err, strings.TrimSpace(out))
 	}
+	return nil
+}
 
-	if err := n.addRule(nftChainName, "meta", "mark", markAccept, "return"); err != nil {
+// replaceTargets swaps the content of the static sets in one transaction.
+func (n *NFTablesManager) replaceTargets(sets []kernelSet) error {
+	b := &nlBatch{}
+	for _, set := range sets {
+		if set.learned {
+			continue
+		}
+		b.flushSet(set.name)
+		b.setElems(unix.NFT_MSG_NEWSETELEM, set.name, 0, addrIntervals(set.elems, set.v6))
+	}
+	err := b.commit()
+	if err == nil || !hasBinary("nft") {
 		return err
 	}
 
-	tcpLimit := fmt.Sprintf("%d", cfg.MainSet.TCP.ConnBytesLimit+1)
-	udpLimit := fmt.Sprintf("%d", cfg.MainSet.UDP.ConnBytesLimit+1)
-
-	if err := n.addQueueRule(nftChainName, "tcp", "dport", "443", "ct", "original", "packets", "<", tcpLimit, "counter"); err != nil {
-		return err
+	var s strings.Builder
+	for _, set := range sets {
+		if set.learned {
+			continue
+		}
+		fmt.Fprintf(&s, "flush set inet %s %s\n", nftTableName, set.name)
+		for _, chunk := range chunkPorts(set.elems, 1000) {
+			if len(chunk) > 0 {
+				fmt.Fprintf(&s, "add element inet %s %s { %s }\n", nftTableName, set.name, strings.Join(chunk, ", "))
+			}
+		}
+	}
+	if out, err := n.runNftScript(s.String()); err != nil {
+		return fmt.Errorf("failed to fill nftables target sets: %w: %s", err, strings.TrimSpace(out))
 	}
+	return nil
+}
 
-	if err := n.addQueueRule(nftChainName, "udp", "dport", "53", "counter"); err != nil {
-		return err
+// addLearned adds learned addresses, re-adding known ones to reset their
+// timeout.
+func (n *NFTablesManager) addLearned(addrs []learnedAddr) error {
+	var order []string
+	elems := map[string][]nlElem{}
+	for _, a := range addrs {
+		ip := net.ParseIP(a.ip).To4()
+		if a.v6 {
+			ip = net.ParseIP(a.ip).To16()
+		}
+		if ip == nil {
+			continue
+		}
+		if _, ok := elems[a.set]; !ok {
+			order = append(order, a.set)
+		}
+		elems[a.set] = append(elems[a.set], nlElem{key: ip, timeout: a.ttl})
 	}
 
-	if err := n.addQueueRule("prerouting", "udp", "sport", "53", "counter"); err != nil {
+	b := &nlBatch{}
+	for _, set := range order {
+		keys := make([]nlElem, len(elems[set]))
+		for i, el := range elems[set] {
+			keys[i] = nlElem{key: el.key}
+		}
+		b.setElems(unix.NFT_MSG_NEWSETELEM, set, 0, keys)
+		b.setElems(unix.NFT_MSG_DELSETELEM, set, 0, keys)
+		b.setElems(unix.NFT_MSG_NEWSETELEM, set, 0, elems[set])
+	}
+	err := b.commit()
+	if err == nil || !hasBinary("nft") {
 		return err
 	}
 
-	if err := n.addQueueRule("prerouting", "tcp", "sport", "443", "ct", "original", "packets", "<", tcpLimit, "counter"); err != nil {
-		return err
+	var s strings.Builder
+	for _, a := range addrs {
+		secs := int(a.ttl / time.Second)
+		fmt.Fprintf(&s, "add element inet %[1]s %[2]s { %[3]s }\n"+
+			"delete element inet %[1]s %[2]s { %[3]s }\n"+
+			"add element inet %[1]s %[2]s { %[3]s timeout %[4]ds }\n",
+			nftTableName, a.set, a.ip, secs)
+	}
+	if out, err := n.runNftScript(s.String()); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
 	}
+	return nil
+}
 
-	if err := n.addQueueRule("prerouting", "tcp", "sport", "443", "tcp", "flags", "&", "(syn|ack)", "==", "(syn|ack)", "counter"); err != nil {
+func (n *NFTablesManager) Apply() error {
+	cfg := n.cfg
+
+	log.Tracef("NFTABLES: adding rules")
+	loadKernelModules()
+
+	rs := n.ruleset()
+	if err := n.commit(rs); err != nil {
 		return err
 	}
 
-	udpPorts := cfg.CollectUDPPorts()
-	var udpPortExpr string
-	if len(udpPorts) == 1 {
-		udpPortExpr = udpPorts[0]
-	} else {
-		udpPortExpr = "{ " + strings.Join(udpPorts, ", ") + " }"
+	if n.plan.usesSets() {
+		if err := targets.activate(cfg, "nftables", n.plan); err != nil {
+			return err
+		}
 	}
-	if err := n.addQueueRule(nftChainName, "udp", "dport", udpPortExpr, "ct", "original", "packets", "<", udpLimit, "counter"); err != nil {
+	if err := addTProxyRoutes(cfg); err != nil {
 		return err
 	}
+	if mode := transparentMode(cfg); mode != "" {
+		log.Infof("NFTABLES: sending TCP to %s to the transparent proxy on port %d (%s)",
+			planScope(n.plan.tcpAll), cfg.System.Transparent.Port, mode)
+	} else if n.plan.enabled {
+		log.Infof("NFTABLES: queueing TCP to %s, UDP to %s (%d IPv4, %d IPv6 targets)",
+			planScope(n.plan.tcpAll), planScope(n.plan.udpAll), len(n.plan.v4), len(n.plan.v6))
+	}
 
-	setSysctlOrProc("net.netfilter.nf_conntrack_checksum", "0")
-	setSysctlOrProc("net.netfilter.nf_conntrack_tcp_be_liberal", "1")
+	for _, s := range rulesSysctls(cfg) {
+		setSysctlOrProc(s.Name, s.Desired)
+	}
 
 	if log.Level(log.CurLevel.Load()) >= log.LevelTrace {
-		out, _ := n.runNft("list", "table", "inet", nftTableName)
+		out := rs.script()
+		if hasBinary("nft") {
+			out, _ = n.runNft("list", "table", "inet", nftTableName)
+		}
 		log.Tracef("Current nftables rules:\n%s", out)
 	}
 
 	return nil
 }
 
-func (n *NFTablesManager) Clear() error {
-	if !hasBinary("nft") {
-		return nil
+// nftPortExpr renders ports as a single value or an anonymous set.
+func nftPortExpr(ports []string) string {
+	if len(ports) == 1 {
+		return ports[0]
 	}
+	return "{ " + strings.Join(ports, ", ") + " }"
+}
 
+func (n *NFTablesManager) Clear() error {
 	log.Tracef("NFTABLES: clearing rules")
+	targets.deactivate()
+	removeTProxyRoutes(n.cfg)
+
+	exists, err := nlTableExists()
+	if err == nil {
+		if exists {
+			if err := nlDeleteTable(); err != nil {
+				log.Errorf("Failed to delete nftables table: %v", err)
+			}
+		}
+		return nil
+	}
 
+	if !hasBinary("nft") {
+		return nil
+	}
 	if n.tableExists() {
-		if _, err := n.runNft("flush", "table", "inet", nftTableName); err != nil {
-			log.Errorf("Failed to flush nftables table: %v", err)
-		}
-		time.Sleep(30 * time.Millisecond)
 		if _, err := n.runNft("delete", "table", "inet", nftTableName); err != nil {
 			log.Errorf("Failed to delete nftables table: %v", err)
 		}
 	}
-
 	return nil
 }
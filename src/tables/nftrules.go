@@ -0,0 +1,203 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nftRuleset is the complete b4 table. It is built once from the config and
+// applied either as a netlink batch or as an nft script, both replace the
+// previous table in a single transaction.
+type nftRuleset struct {
+	chains []nftChain
+	sets   []kernelSet
+	rules  []nftRule
+}
+
+type nftChain struct {
+	name     string
+	hook     string // empty for a regular chain
+	priority int
+	kind     string // chain type, filter when empty
+}
+
+type nftRule struct {
+	chain string
+	exprs []nftExpr
+}
+
+// nftExpr is a statement of a rule in the order nft prints it.
+type nftExpr interface {
+	text() string
+}
+
+type nftNfproto struct{ v6 bool }
+
+type nftOifname struct{ name string }
+
+type nftMark struct{ mark uint32 }
+
+type nftEtherSrc struct{ mac string }
+
+// nftPorts matches a port, a range or a list of both. dir is "sport" or
+// "dport".
+type nftPorts struct {
+	proto string
+	dir   string
+	ports []string
+}
+
+// nftAddrSet matches an address against a named set, dir is "saddr" or
+// "daddr".
+type nftAddrSet struct {
+	v6  bool
+	dir string
+	set string
+}
+
+// nftCtPackets matches connections below a packet count in the original
+// direction.
+type nftCtPackets struct{ below int }
+
+type nftSynAck struct{}
+
+type nftCounter struct{}
+
+// nftVerdict is accept, return or a jump to chain.
+type nftVerdict struct {
+	kind  string
+	chain string
+}
+
+type nftQueue struct {
+	num   uint16
+	total uint16
+}
+
+// nftRedirect redirects a connection to a local port.
+type nftRedirect struct{ port uint16 }
+
+// nftTProxy hands a packet to the local socket listening on port.
+type nftTProxy struct{ port uint16 }
+
+type nftSetMark struct{ mark uint32 }
+
+func (e nftNfproto) text() string {
+	if e.v6 {
+		return "meta nfproto ipv6"
+	}
+	return "meta nfproto ipv4"
+}
+
+func (e nftOifname) text() string { return fmt.Sprintf("oifname %q", e.name) }
+
+func (e nftMark) text() string { return fmt.Sprintf("meta mark 0x%x", e.mark) }
+
+func (e nftEtherSrc) text() string { return "ether saddr " + e.mac }
+
+func (e nftPorts) text() string {
+	return e.proto + " " + e.dir + " " + nftPortExpr(e.ports)
+}
+
+func (e nftAddrSet) text() string {
+	family := "ip"
+	if e.v6 {
+		family = "ip6"
+	}
+	return family + " " + e.dir + " @" + e.set
+}
+
+func (e nftCtPackets) text() string {
+	return fmt.Sprintf("ct original packets < %d", e.below)
+}
+
+func (nftSynAck) text() string { return "tcp flags & (syn|ack) == (syn|ack)" }
+
+func (nftCounter) text() string { return "counter" }
+
+func (e nftVerdict) text() string {
+	if e.kind == "jump" {
+		return "jump " + e.chain
+	}
+	return e.kind
+}
+
+func (e nftQueue) text() string {
+	if e.total > 1 {
+		return fmt.Sprintf("queue num %d-%d bypass", e.num, int(e.num)+int(e.total)-1)
+	}
+	return fmt.Sprintf("queue num %d bypass", e.num)
+}
+
+func (e nftRedirect) text() string { return fmt.Sprintf("redirect to :%d", e.port) }
+
+func (e nftTProxy) text() string { return fmt.Sprintf("tproxy to :%d", e.port) }
+
+func (e nftSetMark) text() string { return fmt.Sprintf("meta mark set 0x%x", e.mark) }
+
+func (c nftChain) chainType() string {
+	if c.kind == "" {
+		return "filter"
+	}
+	return c.kind
+}
+
+func (r nftRule) text() string {
+	parts := make([]string, len(r.exprs))
+	for i, e := range r.exprs {
+		parts[i] = e.text()
+	}
+	return strings.Join(parts, " ")
+}
+
+// script renders the ruleset as nft commands. The table is created, deleted
+// and created again so the script replaces any previous b4 table.
+func (rs nftRuleset) script() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table inet %s\n", nftTableName)
+	fmt.Fprintf(&b, "delete table inet %s\n", nftTableName)
+	fmt.Fprintf(&b, "add table inet %s\n", nftTableName)
+
+	for _, c := range rs.chains {
+		if c.hook == "" {
+			fmt.Fprintf(&b, "add chain inet %s %s\n", nftTableName, c.name)
+			continue
+		}
+		fmt.Fprintf(&b, "add chain inet %s %s { type %s hook %s priority %d ; policy accept ; }\n",
+			nftTableName, c.name, c.chainType(), c.hook, c.priority)
+	}
+
+	for _, s := range rs.sets {
+		addrType := "ipv4_addr"
+		if s.v6 {
+			addrType = "ipv6_addr"
+		}
+		flags := "flags interval ; auto-merge ;"
+		if s.learned {
+			flags = "flags timeout ;"
+		}
+		fmt.Fprintf(&b, "add set inet %s %s { type %s ; %s }\n", nftTableName, s.name, addrType, flags)
+		for _, chunk := range chunkPorts(s.elems, 1000) {
+			if len(chunk) > 0 {
+				fmt.Fprintf(&b, "add element inet %s %s { %s }\n", nftTableName, s.name, strings.Join(chunk, ", "))
+			}
+		}
+	}
+
+	for _, r := range rs.rules {
+		fmt.Fprintf(&b, "add rule inet %s %s %s\n", nftTableName, r.chain, r.text())
+	}
+	return b.String()
+}
+
+// chainRules counts the rules of every chain.
+func (rs nftRuleset) chainRules() map[string]int {
+	counts := make(map[string]int, len(rs.chains))
+	for _, c := range rs.chains {
+		counts[c.name] = 0
+	}
+	for _, r := range rs.rules {
+		counts[r.chain]++
+	}
+	return counts
+}
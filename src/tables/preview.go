@@ -0,0 +1,502 @@
+package tables
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/http/handler"
+)
+
+func init() {
+	handler.SetTablesPreviewFunc(func(cfg *config.Config, backend string, diff bool) (interface{}, error) {
+		p, err := RenderRules(cfg, backend)
+		if err != nil {
+			return nil, err
+		}
+		if diff {
+			if err := p.DiffInstalled(cfg); err != nil {
+				p.Notes = append(p.Notes, "diff failed: "+err.Error())
+			}
+		}
+		return p, nil
+	})
+}
+
+// Preview is what AddRules would apply for a config. It is rendered
+// without changing the kernel, only the current state is read.
+type Preview struct {
+	Backend string          `json:"backend"`
+	Rules   string          `json:"rules"`          // nft script or iptables-restore input
+	Sets    string          `json:"sets,omitempty"` // ipset restore input
+	Sysctls []SysctlPreview `json:"sysctls"`
+	Notes   []string        `json:"notes,omitempty"`
+	Diff    *RulesDiff      `json:"diff,omitempty"`
+}
+
+type SysctlPreview struct {
+	Name    string `json:"name"`
+	Current string `json:"current"`
+	Desired string `json:"desired"`
+}
+
+// RulesDiff compares the rendered rules with the installed ones. Rules are
+// compared in their normalized form, the lines keep the text of the side
+// they come from.
+type RulesDiff struct {
+	Installed bool     `json:"installed"`
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Moved     []string `json:"moved"` // installed, but not where the chain has it
+	Unchanged int      `json:"unchanged"`
+}
+
+// ruleLine is a rule in a comparable form, key is its normalized text.
+type ruleLine struct {
+	chain string // rules are compared in order within their chain
+	key   string
+	text  string
+}
+
+// RenderRules renders the rules of cfg for backend, "nftables", "iptables",
+// "fw4", "firewalld" or empty for the backend AddRules would pick.
+func RenderRules(cfg *config.Config, backend string) (*Preview, error) {
+	if backend == "" {
+		backend = integrationMode(cfg)
+	}
+	if backend == config.IntegrationNone {
+		backend = detectFirewallBackend()
+	}
+
+	p := &Preview{Backend: backend}
+	for _, s := range rulesSysctls(cfg) {
+		p.Sysctls = append(p.Sysctls, SysctlPreview{Name: s.Name, Current: getSysctlOrProc(s.Name), Desired: s.Desired})
+	}
+	if cfg.System.Tables.SkipSetup {
+		p.Notes = append(p.Notes, "tables setup is skipped, no rules are applied")
+	}
+	if transparentMode(cfg) == config.TransparentTProxy {
+		for _, cmd := range tproxyRouteCommands(cfg, "add") {
+			p.Notes = append(p.Notes, "policy routing: "+strings.Join(cmd, " "))
+		}
+	}
+
+	switch backend {
+	case "nftables":
+		p.Rules = NewNFTablesManager(cfg).ruleset().script()
+	case config.IntegrationFW4:
+		p.Rules = NewFW4Manager(cfg).include()
+		p.Notes = append(p.Notes, "written to "+fw4IncludePath+" and applied over netlink")
+	case config.IntegrationFirewalld:
+		f := NewFirewalldManager(cfg)
+		f.ipt.dryRun = true
+		plan := f.ipt.targetPlan()
+		m, err := f.ipt.manifestFor(plan)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		for _, c := range m.Chains {
+			fmt.Fprintf(&b, "firewall-cmd [--permanent] --direct --add-chain %s %s %s\n", directRule{ipt: c.IPT}.family(), c.Table, c.Name)
+		}
+		for _, r := range f.directRules(m) {
+			fmt.Fprintf(&b, "firewall-cmd [--permanent] %s\n", strings.Join(r.command("--add-rule"), " "))
+		}
+		p.Rules = b.String()
+		if plan.usesSets() {
+			sets := plan.kernelSets(cfg.Queue.IPv4Enabled, cfg.Queue.IPv6Enabled)
+			p.Sets = ipsetCreateInput(sets) + ipsetReplaceInput(sets)
+		}
+		p.Notes = append(p.Notes, "every command runs at runtime and with --permanent")
+	case "iptables":
+		ipt := NewIPTablesManager(cfg)
+		ipt.dryRun = true
+		plan := ipt.targetPlan()
+		m, err := ipt.manifestFor(plan)
+		if err != nil {
+			return nil, err
+		}
+		ipts := ipt.binaries()
+		if canRestore(ipts) {
+			for _, bin := range ipts {
+				save, restore := restoreTools(bin)
+				for _, table := range restoreTables {
+					if table != "mangle" && !m.usesTable(bin, table) {
+						continue
+					}
+					saved, _ := run(save, "-t", table)
+					p.Rules += fmt.Sprintf("# %s -w --noflush\n%s", restore, ipt.restoreTableInput(bin, table, saved, m))
+				}
+			}
+		} else {
+			p.Notes = append(p.Notes, "iptables-restore not available, rules are added one by one")
+			var b strings.Builder
+			for _, c := range m.Chains {
+				fmt.Fprintf(&b, "%s -w -t %s -N %s\n", c.IPT, c.Table, c.Name)
+			}
+			seen := make(map[string]bool)
+			for _, r := range m.Rules {
+				rule := r.IPT + " " + r.Chain + " " + strings.Join(r.Spec, " ")
+				if seen[rule] {
+					continue
+				}
+				seen[rule] = true
+				op := "-A"
+				if strings.ToUpper(r.Action) == "I" {
+					op = "-I"
+				}
+				fmt.Fprintf(&b, "%s -w -t %s %s %s %s\n", r.IPT, r.Table, op, r.Chain, strings.Join(r.Spec, " "))
+			}
+			p.Rules = b.String()
+		}
+		if plan.usesSets() {
+			sets := plan.kernelSets(cfg.Queue.IPv4Enabled, cfg.Queue.IPv6Enabled)
+			p.Sets = ipsetCreateInput(sets) + ipsetReplaceInput(sets)
+		}
+		p.Notes = append(p.Notes, "multiport support is assumed")
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+	return p, nil
+}
+
+// DiffInstalled compares the rendered rules with the rules in the kernel.
+func (p *Preview) DiffInstalled(cfg *config.Config) error {
+	var installed, rendered []ruleLine
+	var err error
+	switch p.Backend {
+	case "nftables", config.IntegrationFW4:
+		rendered = nftRuleLines(NewNFTablesManager(cfg).ruleset())
+		var counted bool
+		installed, counted, err = installedNFTRules(rendered)
+		if counted {
+			p.Notes = append(p.Notes, "nft not found, installed rules are only compared by their number per chain")
+		}
+	case "iptables":
+		ipt := NewIPTablesManager(cfg)
+		ipt.dryRun = true
+		rendered, installed, err = ipt.ruleLines()
+	case config.IntegrationFirewalld:
+		f := NewFirewalldManager(cfg)
+		f.ipt.dryRun = true
+		rendered, installed, err = f.ruleLines()
+	default:
+		return fmt.Errorf("unknown firewall backend %q", p.Backend)
+	}
+	if err != nil {
+		return err
+	}
+	p.Diff = diffRules(installed, rendered)
+	return nil
+}
+
+// Text renders the preview for a terminal.
+func (p *Preview) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# backend: %s\n", p.Backend)
+	for _, n := range p.Notes {
+		fmt.Fprintf(&b, "# note: %s\n", n)
+	}
+	for _, s := range p.Sysctls {
+		fmt.Fprintf(&b, "# sysctl %s: %s -> %s\n", s.Name, s.Current, s.Desired)
+	}
+	b.WriteString(p.Rules)
+	if p.Sets != "" {
+		b.WriteString("# ipset -exist restore\n")
+		b.WriteString(p.Sets)
+	}
+	if p.Diff == nil {
+		return b.String()
+	}
+
+	b.WriteString("\n# diff against the installed rules\n")
+	if !p.Diff.Installed {
+		b.WriteString("# no b4 rules installed\n")
+	}
+	for _, l := range p.Diff.Removed {
+		b.WriteString("- " + l + "\n")
+	}
+	for _, l := range p.Diff.Added {
+		b.WriteString("+ " + l + "\n")
+	}
+	for _, l := range p.Diff.Moved {
+		b.WriteString("~ " + l + "\n")
+	}
+	fmt.Fprintf(&b, "# %d added, %d removed, %d moved, %d unchanged\n", len(p.Diff.Added), len(p.Diff.Removed), len(p.Diff.Moved), p.Diff.Unchanged)
+	return b.String()
+}
+
+// diffRules compares the rules of each chain in order, as the kernel
+// evaluates them. The longest run of rules both sides have in the same order
+// is unchanged, a rule of both sides outside of it has moved and the others
+// were added or removed. A rule present twice on one side counts twice.
+func diffRules(installed, rendered []ruleLine) *RulesDiff {
+	d := &RulesDiff{Installed: len(installed) > 0, Added: []string{}, Removed: []string{}, Moved: []string{}}
+
+	var chains []string
+	sides := make(map[string]*[2][]ruleLine)
+	for side, rules := range [2][]ruleLine{installed, rendered} {
+		for _, r := range rules {
+			if sides[r.chain] == nil {
+				chains = append(chains, r.chain)
+				sides[r.chain] = &[2][]ruleLine{}
+			}
+			sides[r.chain][side] = append(sides[r.chain][side], r)
+		}
+	}
+	for _, chain := range chains {
+		d.diffChain(sides[chain][0], sides[chain][1])
+	}
+	return d
+}
+
+func (d *RulesDiff) diffChain(installed, rendered []ruleLine) {
+	// common[i][j] is the longest common subsequence of installed[i:] and
+	// rendered[j:]
+	n, m := len(installed), len(rendered)
+	common := make([][]int, n+1)
+	for i := range common {
+		common[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if installed[i].key == rendered[j].key {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var removed, added []ruleLine
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case installed[i].key == rendered[j].key:
+			d.Unchanged++
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			removed = append(removed, installed[i])
+			i++
+		default:
+			added = append(added, rendered[j])
+			j++
+		}
+	}
+	removed = append(removed, installed[i:]...)
+	added = append(added, rendered[j:]...)
+
+	left := make(map[string]int)
+	for _, r := range removed {
+		left[r.key]++
+	}
+	for _, r := range added {
+		if left[r.key] > 0 {
+			left[r.key]--
+			d.Moved = append(d.Moved, r.text)
+			continue
+		}
+		d.Added = append(d.Added, r.text)
+	}
+	for _, r := range removed {
+		if left[r.key] > 0 {
+			left[r.key]--
+			d.Removed = append(d.Removed, r.text)
+		}
+	}
+}
+
+func nftRuleLines(rs nftRuleset) []ruleLine {
+	lines := make([]ruleLine, 0, len(rs.rules))
+	for _, r := range rs.rules {
+		lines = append(lines, nftRuleLine(r.chain, r.text()))
+	}
+	return lines
+}
+
+var (
+	nftCounterStats = regexp.MustCompile(`counter packets \d+ bytes \d+`)
+	nftQueueFlags   = regexp.MustCompile(`queue flags bypass to (\S+)`)
+	nftHex          = regexp.MustCompile(`0x0*([0-9a-f]+)`)
+)
+
+// nftRuleLine normalizes a rule as we render it or as nft lists it. nft
+// pads marks, prints counters with their values and puts the queue flags
+// first.
+func nftRuleLine(chain, rule string) ruleLine {
+	key := strings.ToLower(strings.Join(strings.Fields(rule), " "))
+	key = nftCounterStats.ReplaceAllString(key, "counter")
+	key = nftQueueFlags.ReplaceAllString(key, "queue num $1 bypass")
+	key = nftHex.ReplaceAllString(key, "0x$1")
+	key = strings.NewReplacer("(", "", ")", "", " | ", "|").Replace(key)
+	return ruleLine{chain: chain, key: chain + " " + key, text: chain + ": " + rule}
+}
+
+// installedNFTRules lists the rules of the b4 table with nft. Without nft
+// only the number of rules per chain can be read back, the rendered rules
+// stand in for as many installed ones and counted is set.
+func installedNFTRules(rendered []ruleLine) (lines []ruleLine, counted bool, err error) {
+	if exists, err := nlTableExists(); err == nil && !exists {
+		return nil, false, nil
+	}
+
+	if !hasBinary("nft") {
+		counts, err := nlChainRules()
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to read installed rules: %w", err)
+		}
+		for _, r := range rendered {
+			if counts[r.chain] > 0 {
+				counts[r.chain]--
+				lines = append(lines, r)
+			}
+		}
+		chains := make([]string, 0, len(counts))
+		for chain := range counts {
+			chains = append(chains, chain)
+		}
+		sort.Strings(chains)
+		for _, chain := range chains {
+			for i := 0; i < counts[chain]; i++ {
+				lines = append(lines, ruleLine{chain: chain, key: fmt.Sprintf("%s #%d", chain, i), text: chain + ": unknown rule"})
+			}
+		}
+		return lines, true, nil
+	}
+
+	out, err := run("nft", "list", "table", "inet", nftTableName)
+	if err != nil {
+		if strings.Contains(out, "No such file") {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("nft list failed: %w: %s", err, strings.TrimSpace(out))
+	}
+	return parseNFTListing(out), false, nil
+}
+
+// parseNFTListing extracts the rules of every chain from nft list output,
+// set declarations and chain headers are skipped.
+func parseNFTListing(out string) []ruleLine {
+	var lines []ruleLine
+	chain := ""
+	depth := 0
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case depth == 1 && strings.HasPrefix(line, "chain "):
+			chain = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "chain "), "{"))
+		case depth == 2 && chain != "" && line != "" && line != "}" && !strings.HasPrefix(line, "type "):
+			lines = append(lines, nftRuleLine(chain, line))
+		}
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if depth <= 1 {
+			chain = ""
+		}
+	}
+	return lines
+}
+
+// ruleLines returns the rendered and the installed b4 rules of every
+// binary in iptables-save form.
+func (manager *IPTablesManager) ruleLines() (rendered, installed []ruleLine, err error) {
+	m, err := manager.manifestFor(manager.targetPlan())
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	for _, r := range m.Rules {
+		line := iptRuleLine(r.IPT, "-A "+r.Chain+" "+strings.Join(r.Spec, " "))
+		if !seen[line.key] {
+			seen[line.key] = true
+			rendered = append(rendered, line)
+		}
+	}
+
+	for _, ipt := range manager.binaries() {
+		save, _ := restoreTools(ipt)
+		if !hasBinary(save) {
+			return nil, nil, fmt.Errorf("%s not found, cannot read installed rules", save)
+		}
+		for _, table := range restoreTables {
+			saved, err := run(save, "-t", table)
+			if err != nil {
+				if table != "mangle" {
+					continue
+				}
+				return nil, nil, fmt.Errorf("%s failed: %w: %s", save, err, strings.TrimSpace(saved))
+			}
+			for _, line := range strings.Split(saved, "\n") {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "-A B4 ") || manager.ownedRule(line) {
+					installed = append(installed, iptRuleLine(ipt, line))
+				}
+			}
+		}
+	}
+	return rendered, installed, nil
+}
+
+// iptRuleLine normalizes an iptables rule. iptables-save orders the
+// options of a match its own way and names implied modules, so the key is
+// the sorted options without module loads, a zero queue number is not
+// printed either.
+func iptRuleLine(ipt, rule string) ruleLine {
+	fields := strings.Fields(rule)
+	var opts []string
+	target := ""
+	for i := 0; i < len(fields); {
+		if fields[i] == "-j" {
+			target = strings.Join(fields[i:], " ")
+			break
+		}
+		j := i + 1
+		if fields[i] == "!" {
+			j++
+		}
+		for j < len(fields) && !strings.HasPrefix(fields[j], "-") && fields[j] != "!" {
+			j++
+		}
+		if fields[i] != "-m" {
+			opts = append(opts, strings.Join(fields[i:j], " "))
+		}
+		i = j
+	}
+
+	// the chain stays first
+	if len(opts) > 1 {
+		sort.Strings(opts[1:])
+	}
+	target = strings.Replace(target, " --queue-num 0 ", " ", 1)
+	target = strings.TrimSuffix(target, " --queue-num 0")
+	chain := ipt
+	if len(opts) > 0 {
+		chain += " " + strings.TrimPrefix(opts[0], "-A ")
+	}
+	key := ipt + " " + strings.Join(append(opts, target), " ")
+	return ruleLine{chain: chain, key: key, text: ipt + ": " + rule}
+}
+
+// ruleLines is IPTablesManager.ruleLines for the direct rules, which carry
+// the b4 comment.
+func (f *FirewalldManager) ruleLines() (rendered, installed []ruleLine, err error) {
+	m, err := f.ipt.manifestFor(f.ipt.targetPlan())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range f.directRules(m) {
+		rendered = append(rendered, iptRuleLine(r.ipt, "-A "+r.chain+" "+strings.Join(r.args, " ")))
+	}
+	for _, line := range installedDirectRules() {
+		// ipv4 mangle CHAIN PRIORITY args...
+		fields := strings.Fields(line)
+		ipt := "iptables"
+		if fields[0] == "ipv6" {
+			ipt = "ip6tables"
+		}
+		installed = append(installed, iptRuleLine(ipt, "-A "+fields[2]+" "+strings.Join(fields[4:], " ")))
+	}
+	return rendered, installed, nil
+}
@@ -0,0 +1,163 @@
+package tables
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseNFTListing(t *testing.T) {
+	listing := `table inet b4_mangle {
+	set b4_targets4 {
+		type ipv4_addr
+		flags interval
+		elements = { 1.2.3.4 }
+	}
+
+	chain b4_chain {
+		meta mark 0x00008000 return
+		tcp dport 443 ct original packets < 20 counter packets 12 bytes 840 queue flags bypass to 537-540
+	}
+
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		tcp sport 443 tcp flags & (syn | ack) == syn | ack counter packets 0 bytes 0 queue flags bypass to 537-540
+	}
+}
+`
+	installed := parseNFTListing(listing)
+	if len(installed) != 3 {
+		t.Fatalf("expected 3 rules, got %+v", installed)
+	}
+
+	rendered := []ruleLine{
+		nftRuleLine("b4_chain", "meta mark 0x8000 return"),
+		nftRuleLine("b4_chain", "tcp dport 443 ct original packets < 20 counter queue num 537-540 bypass"),
+		nftRuleLine("prerouting", "tcp sport 443 tcp flags & (syn|ack) == (syn|ack) counter queue num 537-540 bypass"),
+		nftRuleLine("output", "jump b4_chain"),
+	}
+	d := diffRules(installed, rendered)
+	if d.Unchanged != 3 || len(d.Removed) != 0 || len(d.Added) != 1 || d.Added[0] != "output: jump b4_chain" {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+}
+
+func TestIPTRuleLine(t *testing.T) {
+	ours := iptRuleLine("iptables", "-A B4 -p tcp --dport 443 -m connbytes --connbytes-dir original --connbytes-mode packets --connbytes 0:19 -j NFQUEUE --queue-num 0 --queue-bypass")
+	saved := iptRuleLine("iptables", "-A B4 -p tcp -m tcp --dport 443 -m connbytes --connbytes 0:19 --connbytes-mode packets --connbytes-dir original -j NFQUEUE --queue-bypass")
+	if ours.key != saved.key {
+		t.Errorf("expected equal keys:\n%s\n%s", ours.key, saved.key)
+	}
+
+	other := iptRuleLine("iptables", "-A PREROUTING -p tcp -m tcp --dport 443 -j NFQUEUE --queue-bypass")
+	if other.key == saved.key {
+		t.Error("expected rules of different chains to differ")
+	}
+
+	d := diffRules([]ruleLine{saved, other}, []ruleLine{ours})
+	if d.Unchanged != 1 || len(d.Removed) != 1 || len(d.Added) != 0 {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	rules := func(chain string, texts ...string) []ruleLine {
+		lines := make([]ruleLine, 0, len(texts))
+		for _, text := range texts {
+			lines = append(lines, nftRuleLine(chain, text))
+		}
+		return lines
+	}
+	join := func(parts ...[]ruleLine) []ruleLine {
+		var lines []ruleLine
+		for _, p := range parts {
+			lines = append(lines, p...)
+		}
+		return lines
+	}
+
+	tests := []struct {
+		name                  string
+		installed, rendered   []ruleLine
+		added, removed, moved []string
+		unchanged             int
+	}{
+		{
+			name:      "same",
+			installed: rules("c", "a", "b", "c"),
+			rendered:  rules("c", "a", "b", "c"),
+			unchanged: 3,
+		},
+		{
+			name:      "swapped",
+			installed: rules("c", "b", "a"),
+			rendered:  rules("c", "a", "b"),
+			moved:     []string{"c: b"},
+			unchanged: 1,
+		},
+		{
+			name:      "return moved last",
+			installed: rules("c", "meta mark 0x8000 return", "queue", "accept"),
+			rendered:  rules("c", "queue", "accept", "meta mark 0x8000 return"),
+			moved:     []string{"c: meta mark 0x8000 return"},
+			unchanged: 2,
+		},
+		{
+			name:      "added and removed",
+			installed: rules("c", "a", "old", "c"),
+			rendered:  rules("c", "a", "new", "c"),
+			added:     []string{"c: new"},
+			removed:   []string{"c: old"},
+			unchanged: 2,
+		},
+		{
+			name:      "duplicate",
+			installed: rules("c", "a", "a", "b"),
+			rendered:  rules("c", "a", "b"),
+			removed:   []string{"c: a"},
+			unchanged: 2,
+		},
+		{
+			name:      "chains compared apart",
+			installed: join(rules("x", "a"), rules("y", "b")),
+			rendered:  join(rules("y", "b"), rules("x", "a")),
+			unchanged: 2,
+		},
+		{
+			name:      "same rule in another chain",
+			installed: rules("x", "a"),
+			rendered:  rules("y", "a"),
+			added:     []string{"y: a"},
+			removed:   []string{"x: a"},
+		},
+		{
+			name:     "nothing installed",
+			rendered: rules("c", "a"),
+			added:    []string{"c: a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diffRules(tt.installed, tt.rendered)
+			if d.Installed != (len(tt.installed) > 0) {
+				t.Errorf("installed = %v", d.Installed)
+			}
+			if !slices.Equal(d.Added, tt.added) || !slices.Equal(d.Removed, tt.removed) || !slices.Equal(d.Moved, tt.moved) || d.Unchanged != tt.unchanged {
+				t.Errorf("diff = %+v, want added %v, removed %v, moved %v, %d unchanged", d, tt.added, tt.removed, tt.moved, tt.unchanged)
+			}
+		})
+	}
+}
+
+func TestDiffRules_IPTablesChains(t *testing.T) {
+	queue := "-A B4 -p tcp --dport 443 -j NFQUEUE --queue-num 0 --queue-bypass"
+	mark := "-A B4 -m mark --mark 0x8000/0x8000 -j RETURN"
+
+	d := diffRules(
+		[]ruleLine{iptRuleLine("iptables", queue), iptRuleLine("iptables", mark), iptRuleLine("ip6tables", mark), iptRuleLine("ip6tables", queue)},
+		[]ruleLine{iptRuleLine("iptables", mark), iptRuleLine("iptables", queue), iptRuleLine("ip6tables", mark), iptRuleLine("ip6tables", queue)},
+	)
+	if d.Unchanged != 3 || len(d.Moved) != 1 || len(d.Added) != 0 || len(d.Removed) != 0 {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+}
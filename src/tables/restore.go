@@ -0,0 +1,210 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+// iptables-restore batches. Every table is changed in one restore call, so
+// a failing rule leaves the previous rules of its table in place, and the
+// tables changed before it are restored from their saved state.
+
+var builtinChains = map[string]bool{
+	"PREROUTING":  true,
+	"POSTROUTING": true,
+	"OUTPUT":      true,
+	"FORWARD":     true,
+}
+
+// restoreTools returns the save and restore binaries of ipt.
+func restoreTools(ipt string) (save, restore string) {
+	return ipt + "-save", ipt + "-restore"
+}
+
+// canRestore reports whether every binary has its save and restore tools.
+func canRestore(ipts []string) bool {
+	if len(ipts) == 0 {
+		return false
+	}
+	for _, ipt := range ipts {
+		save, restore := restoreTools(ipt)
+		if !hasBinary(save) || !hasBinary(restore) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownedRule reports whether a rule of iptables-save in a built-in chain was
+// added by b4.
+func (manager *IPTablesManager) ownedRule(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "-A" || !builtinChains[fields[1]] {
+		return false
+	}
+	if strings.HasSuffix(line, " -j B4") {
+		return true
+	}
+
+	cfg := manager.cfg
+	if strings.Contains(line, " -j NFQUEUE") {
+		spec := strings.Join(manager.buildNFQSpec(cfg.Queue.StartNum, cfg.Queue.Threads)[2:], " ")
+		if strings.HasSuffix(line, " -j NFQUEUE "+spec) {
+			return true
+		}
+		// a queue number of zero is not printed
+		return cfg.Queue.StartNum == 0 && cfg.Queue.Threads <= 1 && strings.HasSuffix(line, " -j NFQUEUE --queue-bypass")
+	}
+
+	switch fields[1] {
+	case "OUTPUT":
+		return strings.Contains(line, "--mark "+manager.markAccept()+" ") && strings.HasSuffix(line, " -j ACCEPT")
+	case "FORWARD":
+		return strings.Contains(line, "--mac-source ") && strings.HasSuffix(line, " -j RETURN")
+	}
+	return false
+}
+
+func (manager *IPTablesManager) markAccept() string {
+	if manager.cfg.Queue.Mark == 0 {
+		return "0x8000/0x8000"
+	}
+	return fmt.Sprintf("0x%x/0x%x", manager.cfg.Queue.Mark, manager.cfg.Queue.Mark)
+}
+
+// restoreTables are the tables b4 keeps iptables rules in, the nat table
+// only holds the REDIRECT rules of the transparent proxy.
+var restoreTables = []string{"mangle", "nat"}
+
+// restoreInput renders one mangle table transaction for ipt from its
+// current iptables-save output.
+func (manager *IPTablesManager) restoreInput(ipt, saved string, m Manifest) string {
+	return manager.restoreTableInput(ipt, "mangle", saved, m)
+}
+
+// restoreTableInput renders one table transaction for ipt from its current
+// iptables-save output. The b4 rules of the built-in chains are deleted and
+// the B4 chain flushed, then the rules of m in that table are added. A
+// manifest without a chain in the table removes the B4 chain as well.
+func (manager *IPTablesManager) restoreTableInput(ipt, table, saved string, m Manifest) string {
+	var b strings.Builder
+	b.WriteString("*" + table + "\n")
+
+	var chains []string
+	for _, c := range m.Chains {
+		if c.IPT == ipt && c.Table == table {
+			chains = append(chains, c.Name)
+			fmt.Fprintf(&b, ":%s - [0:0]\n", c.Name)
+		}
+	}
+
+	hasB4 := false
+	for _, line := range strings.Split(saved, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ":B4 ") {
+			hasB4 = true
+		}
+		if manager.ownedRule(line) {
+			b.WriteString("-D" + strings.TrimPrefix(line, "-A") + "\n")
+		}
+	}
+
+	for _, name := range chains {
+		fmt.Fprintf(&b, "-F %s\n", name)
+	}
+	if len(chains) == 0 && hasB4 {
+		b.WriteString("-F B4\n-X B4\n")
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range m.Rules {
+		rule := r.Chain + " " + strings.Join(r.Spec, " ")
+		if r.IPT != ipt || r.Table != table || seen[rule] {
+			continue
+		}
+		seen[rule] = true
+		op := "-A"
+		if strings.ToUpper(r.Action) == "I" {
+			op = "-I"
+		}
+		fmt.Fprintf(&b, "%s %s\n", op, rule)
+	}
+
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// usesTable reports whether m has rules for ipt in table.
+func (m Manifest) usesTable(ipt, table string) bool {
+	for _, c := range m.Chains {
+		if c.IPT == ipt && c.Table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// savedTable is the iptables-save output of a table from before b4 changed
+// it, restored as it was when a later change fails.
+type savedTable struct {
+	ipt   string
+	table string
+	saved string
+}
+
+// restore replaces the b4 rules of every binary with the rules of m. When a
+// table fails, the tables already changed get their previous rules back.
+func (manager *IPTablesManager) restore(ipts []string, m Manifest) error {
+	var changed []savedTable
+	for _, ipt := range ipts {
+		done, err := manager.restoreOne(ipt, m)
+		changed = append(changed, done...)
+		if err != nil {
+			manager.rollback(changed)
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback puts the saved tables back, the last changed first.
+func (manager *IPTablesManager) rollback(changed []savedTable) {
+	for i := len(changed) - 1; i >= 0; i-- {
+		t := changed[i]
+		_, restore := restoreTools(t.ipt)
+		if out, err := runInput(t.saved, restore, "-w"); err != nil {
+			log.Errorf("IPTABLES[%s]: failed to roll back %s table: %v: %s", t.ipt, t.table, err, strings.TrimSpace(out))
+		}
+	}
+}
+
+// restoreOne replaces the b4 rules of ipt table by table and returns the
+// tables it changed. A table m does not use is only cleaned, and skipped
+// when it cannot be read, the nat table may not be available at all.
+func (manager *IPTablesManager) restoreOne(ipt string, m Manifest) ([]savedTable, error) {
+	var changed []savedTable
+	save, restore := restoreTools(ipt)
+	for _, table := range restoreTables {
+		used := table == "mangle" || m.usesTable(ipt, table)
+		saved, err := run(save, "-t", table)
+		if err != nil {
+			if !used {
+				continue
+			}
+			return changed, fmt.Errorf("%s failed: %w: %s", save, err, strings.TrimSpace(saved))
+		}
+		if !used && !strings.Contains(saved, ":B4 ") {
+			continue
+		}
+
+		input := manager.restoreTableInput(ipt, table, saved, m)
+		log.Tracef("IPTABLES[%s]: restoring %s table:\n%s", ipt, table, input)
+		if out, err := runInput(input, restore, "-w", "--noflush"); err != nil {
+			return changed, fmt.Errorf("%s failed: %w: %s", restore, err, strings.TrimSpace(out))
+		}
+		changed = append(changed, savedTable{ipt: ipt, table: table, saved: saved})
+	}
+	return changed, nil
+}
@@ -0,0 +1,83 @@
+package tables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestIPTablesManager_OwnedRule(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.StartNum = 537
+	cfg.Queue.Threads = 4
+	manager := NewIPTablesManager(&cfg)
+
+	cases := []struct {
+		line string
+		want bool
+	}{
+		{"-A POSTROUTING -j B4", true},
+		{"-A PREROUTING -p udp -m udp --sport 53 -j NFQUEUE --queue-balance 537:540 --queue-bypass", true},
+		{"-A PREROUTING -p udp -m udp --sport 53 -j NFQUEUE --queue-num 100", false},
+		{"-A OUTPUT -m mark --mark 0x8000/0x8000 -j ACCEPT", true},
+		{"-A OUTPUT -m mark --mark 0x1/0x1 -j ACCEPT", false},
+		{"-A FORWARD -m mac --mac-source AA:BB:CC:DD:EE:FF -j RETURN", true},
+		{"-A B4 -p tcp -j NFQUEUE --queue-balance 537:540 --queue-bypass", false},
+		{"-A POSTROUTING -j B4X", false},
+	}
+	for _, c := range cases {
+		if got := manager.ownedRule(c.line); got != c.want {
+			t.Errorf("ownedRule(%q) = %v, want %v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestIPTablesManager_RestoreInput(t *testing.T) {
+	cfg := config.NewConfig()
+	manager := NewIPTablesManager(&cfg)
+
+	saved := strings.Join([]string{
+		"*mangle",
+		":PREROUTING ACCEPT [0:0]",
+		":POSTROUTING ACCEPT [0:0]",
+		":B4 - [0:0]",
+		"-A POSTROUTING -j B4",
+		"-A POSTROUTING -j MARK --set-mark 0x1",
+		"-A B4 -p udp --dport 53 -j ACCEPT",
+		"COMMIT",
+	}, "\n")
+
+	t.Run("apply", func(t *testing.T) {
+		m := Manifest{
+			Chains: []Chain{{IPT: "iptables", Table: "mangle", Name: "B4"}},
+			Rules: []Rule{
+				{IPT: "iptables", Table: "mangle", Chain: "POSTROUTING", Action: "I", Spec: []string{"-j", "B4"}},
+				{IPT: "iptables", Table: "mangle", Chain: "B4", Action: "A", Spec: []string{"-p", "tcp", "-j", "ACCEPT"}},
+				{IPT: "iptables", Table: "mangle", Chain: "B4", Action: "A", Spec: []string{"-p", "tcp", "-j", "ACCEPT"}},
+				{IPT: "ip6tables", Table: "mangle", Chain: "B4", Action: "A", Spec: []string{"-p", "udp", "-j", "ACCEPT"}},
+			},
+		}
+
+		want := "*mangle\n" +
+			":B4 - [0:0]\n" +
+			"-D POSTROUTING -j B4\n" +
+			"-F B4\n" +
+			"-I POSTROUTING -j B4\n" +
+			"-A B4 -p tcp -j ACCEPT\n" +
+			"COMMIT\n"
+		if got := manager.restoreInput("iptables", saved, m); got != want {
+			t.Errorf("unexpected restore input:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		want := "*mangle\n" +
+			"-D POSTROUTING -j B4\n" +
+			"-F B4\n-X B4\n" +
+			"COMMIT\n"
+		if got := manager.restoreInput("iptables", saved, Manifest{}); got != want {
+			t.Errorf("unexpected restore input:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
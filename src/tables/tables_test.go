@@ -1,6 +1,7 @@
 package tables
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/daniellavrushin/b4/config"
@@ -76,6 +77,38 @@ func TestNFTablesManager_BuildNFQueueAction(t *testing.T) {
 	})
 }
 
+func TestNFTablesManager_Ruleset(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.IPv4Enabled = true
+	cfg.Queue.IPv6Enabled = false
+	manager := NewNFTablesManager(&cfg)
+
+	rs := manager.ruleset()
+	script := rs.script()
+
+	for _, want := range []string{
+		"add table inet b4_mangle\ndelete table inet b4_mangle\nadd table inet b4_mangle\n",
+		"add chain inet b4_mangle prerouting { type filter hook prerouting priority -150 ; policy accept ; }",
+		"add rule inet b4_mangle postrouting jump b4_chain",
+		`add rule inet b4_mangle output oifname "lo" return`,
+		"add rule inet b4_mangle b4_chain meta nfproto ipv4 udp dport 53 counter " + manager.buildNFQueueAction(),
+		"add rule inet b4_mangle b4_chain meta nfproto ipv4 tcp dport 53 ct original packets < 9 counter " + manager.buildNFQueueAction(),
+		"add rule inet b4_mangle prerouting meta nfproto ipv4 tcp sport 443 tcp flags & (syn|ack) == (syn|ack) counter",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script is missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "add set") {
+		t.Error("target sets should only be created with kernel sets enabled")
+	}
+
+	counts := rs.chainRules()
+	if counts["output"] != 3 || counts["postrouting"] != 1 || counts[nftChainName] != 5 {
+		t.Errorf("unexpected rule counts: %v", counts)
+	}
+}
+
 func TestNewIPTablesManager(t *testing.T) {
 	cfg := config.NewConfig()
 	manager := NewIPTablesManager(&cfg)
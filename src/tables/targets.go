@@ -0,0 +1,482 @@
+package tables
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// Kernel set names, shared by nftables sets and ipsets.
+const (
+	targetSet4  = "b4_targets4"
+	targetSet6  = "b4_targets6"
+	learnedSet4 = "b4_learned4"
+	learnedSet6 = "b4_learned6"
+)
+
+// targetPlan is what the queue rules send to userspace. With kernel sets
+// enabled, traffic of a protocol is queued only to target addresses unless a
+// set has to see every flow to match it by SNI.
+type targetPlan struct {
+	enabled bool
+	tcpAll  bool // a set matches TLS by SNI, queue every flow to the TCP ports
+	udpAll  bool // a set parses QUIC SNI, queue every flow to the UDP ports
+	v4, v6  []string
+	windows []windowPlan
+}
+
+// windowPlan queues more packets of each connection to the destinations of
+// a set whose connbytes limit is above the main set's.
+type windowPlan struct {
+	index    int
+	setID    string
+	tcp, udp int // limits above the main set's, 0 otherwise
+	tcpPorts []string
+	udpPorts []string
+	v4, v6   []string
+	learn    bool // the set matches domains, addresses learned for it are added
+}
+
+// kernelSet is a set of addresses referenced by the queue rules, learned
+// sets hold single addresses that expire.
+type kernelSet struct {
+	name    string
+	v6      bool
+	learned bool
+	elems   []string
+}
+
+func buildTargetPlan(cfg *config.Config) targetPlan {
+	p := targetPlan{enabled: cfg.System.Tables.KernelSets}
+	// the transparent proxy sees whole connections, there is no window
+	if !cfg.System.Transparent.Enabled {
+		p.windows = buildWindows(cfg)
+	}
+	if !p.enabled {
+		p.tcpAll, p.udpAll = true, true
+		return p
+	}
+
+	seen := make(map[string]bool)
+	for _, set := range cfg.Sets {
+		if !set.Enabled {
+			continue
+		}
+		if len(set.Targets.DomainsToMatch) > 0 {
+			p.tcpAll = true
+			if set.UDP.FilterQUIC == "parse" {
+				p.udpAll = true
+			}
+		}
+		v4, v6 := setTargets(set, seen)
+		p.v4 = append(p.v4, v4...)
+		p.v6 = append(p.v6, v6...)
+	}
+	sort.Strings(p.v4)
+	sort.Strings(p.v6)
+	return p
+}
+
+// buildWindows returns a window for every enabled set with a connbytes limit
+// above the main set's and targets to scope it to.
+func buildWindows(cfg *config.Config) []windowPlan {
+	var windows []windowPlan
+	for _, set := range cfg.Sets {
+		if !set.Enabled || set.Id == config.MAIN_SET_ID {
+			continue
+		}
+		w := windowPlan{setID: set.Id, learn: len(set.Targets.DomainsToMatch) > 0}
+		if set.TCP.ConnBytesLimit > cfg.MainSet.TCP.ConnBytesLimit {
+			w.tcp = set.TCP.ConnBytesLimit
+			w.tcpPorts = set.TCPPorts()
+		}
+		if set.UDP.ConnBytesLimit > cfg.MainSet.UDP.ConnBytesLimit {
+			w.udp = set.UDP.ConnBytesLimit
+			w.udpPorts = set.UDPPorts()
+		}
+		if w.tcp == 0 && w.udp == 0 {
+			continue
+		}
+		w.v4, w.v6 = setTargets(set, make(map[string]bool))
+		sort.Strings(w.v4)
+		sort.Strings(w.v6)
+		if len(w.v4) == 0 && len(w.v6) == 0 && !w.learn {
+			continue
+		}
+		w.index = len(windows) + 1
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// setTargets returns the normalized address targets of set not in seen yet.
+func setTargets(set *config.SetConfig, seen map[string]bool) (v4, v6 []string) {
+	for _, entry := range set.Targets.IpsToMatch {
+		target, isV6, ok := normalizeTarget(entry)
+		if !ok || seen[target] {
+			continue
+		}
+		seen[target] = true
+		if isV6 {
+			v6 = append(v6, target)
+		} else {
+			v4 = append(v4, target)
+		}
+	}
+	return v4, v6
+}
+
+// setName names the kernel sets of a window, e.g. b4_w1_t4 for its IPv4
+// targets and b4_w1_l4 for the IPv4 addresses learned for it.
+func (w windowPlan) setName(learned, v6 bool) string {
+	kind, family := "t", 4
+	if learned {
+		kind = "l"
+	}
+	if v6 {
+		family = 6
+	}
+	return fmt.Sprintf("b4_w%d_%s%d", w.index, kind, family)
+}
+
+func (w windowPlan) sameRules(o windowPlan) bool {
+	return w.index == o.index && w.setID == o.setID && w.tcp == o.tcp && w.udp == o.udp &&
+		w.learn == o.learn && slices.Equal(w.tcpPorts, o.tcpPorts) && slices.Equal(w.udpPorts, o.udpPorts)
+}
+
+// sameRules reports whether both plans produce the same firewall rules, the
+// addresses only live in the sets.
+func (p targetPlan) sameRules(o targetPlan) bool {
+	return p.enabled == o.enabled && p.tcpAll == o.tcpAll && p.udpAll == o.udpAll &&
+		slices.EqualFunc(p.windows, o.windows, windowPlan.sameRules)
+}
+
+// usesSets reports whether the rules reference kernel sets at all.
+func (p targetPlan) usesSets() bool {
+	return p.enabled || len(p.windows) > 0
+}
+
+// kernelSets lists the sets of the plan for the enabled IP versions.
+func (p targetPlan) kernelSets(v4, v6 bool) []kernelSet {
+	var sets []kernelSet
+	for _, fam := range []struct {
+		on    bool
+		v6    bool
+		elems []string
+		set   string
+		learn string
+	}{{v4, false, p.v4, targetSet4, learnedSet4}, {v6, true, p.v6, targetSet6, learnedSet6}} {
+		if !fam.on {
+			continue
+		}
+		if p.enabled {
+			sets = append(sets,
+				kernelSet{name: fam.set, v6: fam.v6, elems: fam.elems},
+				kernelSet{name: fam.learn, v6: fam.v6, learned: true})
+		}
+		for _, w := range p.windows {
+			elems := w.v4
+			if fam.v6 {
+				elems = w.v6
+			}
+			sets = append(sets, kernelSet{name: w.setName(false, fam.v6), v6: fam.v6, elems: elems})
+			if w.learn {
+				sets = append(sets, kernelSet{name: w.setName(true, fam.v6), v6: fam.v6, learned: true})
+			}
+		}
+	}
+	return sets
+}
+
+// normalizeTarget parses an address or CIDR, single addresses lose their
+// prefix length.
+func normalizeTarget(entry string) (target string, v6 bool, ok bool) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return "", false, false
+	}
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", false, false
+		}
+		v6 = ipNet.IP.To4() == nil
+		if ones, bits := ipNet.Mask.Size(); ones == bits {
+			return ipNet.IP.String(), v6, true
+		}
+		return ipNet.String(), v6, true
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", false, false
+	}
+	return ip.String(), ip.To4() == nil, true
+}
+
+// learnedAddr is an address learned for the set setID, set is the kernel
+// set it goes to.
+type learnedAddr struct {
+	ip    string
+	v6    bool
+	ttl   time.Duration
+	setID string
+	set   string
+}
+
+// targetSync mirrors the configured and learned target addresses into the
+// kernel sets of the active backend.
+type targetSync struct {
+	mu      sync.Mutex
+	active  bool
+	backend string
+	cfg     *config.Config
+	plan    targetPlan
+	learned map[string]learnedEntry
+	pending chan learnedAddr
+	once    sync.Once
+}
+
+type learnedEntry struct {
+	v6      bool
+	setID   string
+	expires time.Time
+}
+
+var targets = &targetSync{
+	learned: make(map[string]learnedEntry),
+	pending: make(chan learnedAddr, 1024),
+}
+
+// activate starts mirroring learned addresses into freshly created kernel
+// sets, the backend already filled in the target addresses.
+func (t *targetSync) activate(cfg *config.Config, backend string, plan targetPlan) error {
+	t.once.Do(func() {
+		sni.OnLearnIP(t.learn)
+		go t.flushLoop()
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = true
+	t.backend = backend
+	t.cfg = cfg
+	t.plan = plan
+
+	now := time.Now()
+	var addrs []learnedAddr
+	for ip, e := range t.learned {
+		if ttl := e.expires.Sub(now); ttl > time.Second {
+			addrs = append(addrs, learnedAddr{ip: ip, v6: e.v6, ttl: ttl, setID: e.setID})
+		} else {
+			delete(t.learned, ip)
+		}
+	}
+	if len(addrs) > 0 {
+		return t.addLearned(addrs)
+	}
+	return nil
+}
+
+func (t *targetSync) deactivate() {
+	t.mu.Lock()
+	t.active = false
+	t.mu.Unlock()
+}
+
+// applied returns the plan the current rules were built from.
+func (t *targetSync) applied() (targetPlan, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.plan, t.active
+}
+
+// learn queues an address learned by the matcher, it never blocks the
+// packet path and drops addresses when the kernel lags behind.
+func (t *targetSync) learn(ip net.IP, set *config.SetConfig, ttl time.Duration) {
+	select {
+	case t.pending <- learnedAddr{ip: ip.String(), v6: ip.To4() == nil, ttl: ttl, setID: set.Id}:
+	default:
+	}
+}
+
+func (t *targetSync) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []learnedAddr
+	for {
+		select {
+		case a := <-t.pending:
+			batch = append(batch, a)
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+			t.mu.Lock()
+			now := time.Now()
+			for _, a := range batch {
+				t.learned[a.ip] = learnedEntry{v6: a.v6, setID: a.setID, expires: now.Add(a.ttl)}
+			}
+			if t.active {
+				if err := t.addLearned(batch); err != nil {
+					log.Errorf("Failed to add %d learned IPs to kernel sets: %v", len(batch), err)
+				} else {
+					log.Tracef("Added %d learned IPs to kernel sets", len(batch))
+				}
+			}
+			t.mu.Unlock()
+			batch = batch[:0]
+		}
+	}
+}
+
+// replace must be called with t.mu held.
+func (t *targetSync) replace(plan targetPlan) error {
+	sets := plan.kernelSets(t.cfg.Queue.IPv4Enabled, t.cfg.Queue.IPv6Enabled)
+	if t.backend == "nftables" {
+		return NewNFTablesManager(t.cfg).replaceTargets(sets)
+	}
+	return ipsetReplace(sets)
+}
+
+// addLearned must be called with t.mu held.
+func (t *targetSync) addLearned(addrs []learnedAddr) error {
+	var keep []learnedAddr
+	for _, a := range addrs {
+		if (a.v6 && !t.cfg.Queue.IPv6Enabled) || (!a.v6 && !t.cfg.Queue.IPv4Enabled) {
+			continue
+		}
+		if t.plan.enabled {
+			a.set = learnedSet4
+			if a.v6 {
+				a.set = learnedSet6
+			}
+			keep = append(keep, a)
+		}
+		for _, w := range t.plan.windows {
+			if w.learn && w.setID == a.setID {
+				a.set = w.setName(true, a.v6)
+				keep = append(keep, a)
+			}
+		}
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	if t.backend == "nftables" {
+		return NewNFTablesManager(t.cfg).addLearned(keep)
+	}
+	return ipsetAddLearned(keep)
+}
+
+// SyncTargets brings the kernel sets in line with the targets of cfg. The
+// rules are only rebuilt when the split between SNI and address matched
+// traffic or the per-set windows changed.
+func SyncTargets(cfg *config.Config) error {
+	if cfg.System.Tables.SkipSetup {
+		return nil
+	}
+
+	plan := buildTargetPlan(cfg)
+	current, active := targets.applied()
+	if !active || !current.sameRules(plan) {
+		if !active && !plan.usesSets() {
+			return nil
+		}
+		log.Infof("Kernel target sets changed the queue rules, refreshing firewall rules")
+		ClearRules(cfg)
+		return AddRules(cfg)
+	}
+
+	targets.mu.Lock()
+	defer targets.mu.Unlock()
+	targets.cfg = cfg
+	targets.plan = plan
+	if err := targets.replace(plan); err != nil {
+		return fmt.Errorf("failed to update kernel target sets: %w", err)
+	}
+	if integrationMode(cfg) == config.IntegrationFW4 {
+		if err := NewFW4Manager(cfg).writeInclude(); err != nil {
+			return err
+		}
+	}
+	log.Infof("Kernel target sets updated: %d IPv4, %d IPv6 entries, %d set windows",
+		len(plan.v4), len(plan.v6), len(plan.windows))
+	return nil
+}
+
+// nftSelectors returns the matches limiting a rule to the target sets, dir is
+// "daddr" or "saddr". A single empty selector means no limit.
+func (p targetPlan) nftSelectors(all bool, dir string, v4, v6 bool) [][]nftExpr {
+	if all {
+		return [][]nftExpr{nil}
+	}
+	var sel [][]nftExpr
+	if v4 {
+		sel = append(sel,
+			[]nftExpr{nftAddrSet{dir: dir, set: targetSet4}},
+			[]nftExpr{nftAddrSet{dir: dir, set: learnedSet4}})
+	}
+	if v6 {
+		sel = append(sel,
+			[]nftExpr{nftAddrSet{v6: true, dir: dir, set: targetSet6}},
+			[]nftExpr{nftAddrSet{v6: true, dir: dir, set: learnedSet6}})
+	}
+	return sel
+}
+
+// iptSelectors is nftSelectors for iptables, dir is "dst" or "src".
+func (p targetPlan) iptSelectors(all bool, dir, ipt string) [][]string {
+	if all {
+		return [][]string{nil}
+	}
+	targetSet, learnedSet := targetSet4, learnedSet4
+	if ipt == "ip6tables" {
+		targetSet, learnedSet = targetSet6, learnedSet6
+	}
+	return [][]string{
+		{"-m", "set", "--match-set", targetSet, dir},
+		{"-m", "set", "--match-set", learnedSet, dir},
+	}
+}
+
+func planScope(all bool) string {
+	if all {
+		return "all flows"
+	}
+	return "target sets"
+}
+
+// nftSelectors returns the matches limiting a window rule to the
+// destinations of its set.
+func (w windowPlan) nftSelectors(dir string, v4, v6 bool) [][]nftExpr {
+	var sel [][]nftExpr
+	for _, fam := range []struct{ on, v6 bool }{{v4, false}, {v6, true}} {
+		if !fam.on {
+			continue
+		}
+		sel = append(sel, []nftExpr{nftAddrSet{v6: fam.v6, dir: dir, set: w.setName(false, fam.v6)}})
+		if w.learn {
+			sel = append(sel, []nftExpr{nftAddrSet{v6: fam.v6, dir: dir, set: w.setName(true, fam.v6)}})
+		}
+	}
+	return sel
+}
+
+// iptSelectors is nftSelectors for iptables, dir is "dst" or "src".
+func (w windowPlan) iptSelectors(dir, ipt string) [][]string {
+	v6 := ipt == "ip6tables"
+	sel := [][]string{{"-m", "set", "--match-set", w.setName(false, v6), dir}}
+	if w.learn {
+		sel = append(sel, []string{"-m", "set", "--match-set", w.setName(true, v6), dir})
+	}
+	return sel
+}
@@ -0,0 +1,153 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestBuildTargetPlan(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.System.Tables.KernelSets = true
+	set := config.NewSetConfig()
+	set.Id = "ips"
+	set.Enabled = true
+	set.Targets.IpsToMatch = []string{"1.2.3.4", "10.0.0.0/8", "1.2.3.4/32", "2001:db8::/32", "bogus", " "}
+	cfg.Sets = []*config.SetConfig{&set}
+
+	t.Run("address targets only", func(t *testing.T) {
+		plan := buildTargetPlan(&cfg)
+		if plan.tcpAll || plan.udpAll {
+			t.Errorf("expected traffic limited to target sets, got %+v", plan)
+		}
+		if len(plan.v4) != 2 || plan.v4[0] != "1.2.3.4" || plan.v4[1] != "10.0.0.0/8" {
+			t.Errorf("unexpected IPv4 targets: %v", plan.v4)
+		}
+		if len(plan.v6) != 1 || plan.v6[0] != "2001:db8::/32" {
+			t.Errorf("unexpected IPv6 targets: %v", plan.v6)
+		}
+	})
+
+	t.Run("SNI targets queue all TCP", func(t *testing.T) {
+		set.Targets.DomainsToMatch = []string{"example.com"}
+		defer func() { set.Targets.DomainsToMatch = nil }()
+
+		plan := buildTargetPlan(&cfg)
+		if !plan.tcpAll || plan.udpAll {
+			t.Errorf("expected all TCP and targeted UDP, got %+v", plan)
+		}
+
+		set.UDP.FilterQUIC = "parse"
+		defer func() { set.UDP.FilterQUIC = "disabled" }()
+		if plan := buildTargetPlan(&cfg); !plan.udpAll {
+			t.Error("expected all UDP queued when QUIC SNI is parsed")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg.System.Tables.KernelSets = false
+		defer func() { cfg.System.Tables.KernelSets = true }()
+
+		plan := buildTargetPlan(&cfg)
+		if plan.enabled || !plan.tcpAll || !plan.udpAll || plan.v4 != nil {
+			t.Errorf("expected everything queued without kernel sets, got %+v", plan)
+		}
+	})
+}
+
+func TestTargetPlan_Selectors(t *testing.T) {
+	plan := targetPlan{enabled: true}
+
+	if sel := plan.nftSelectors(true, "daddr", true, true); len(sel) != 1 || sel[0] != nil {
+		t.Errorf("expected a single unrestricted selector, got %v", sel)
+	}
+
+	sel := plan.nftSelectors(false, "saddr", true, false)
+	if len(sel) != 2 || sel[0][0].text() != "ip saddr @"+targetSet4 || sel[1][0].text() != "ip saddr @"+learnedSet4 {
+		t.Errorf("unexpected nftables selectors: %v", sel)
+	}
+
+	ipt := plan.iptSelectors(false, "dst", "ip6tables")
+	if len(ipt) != 2 || ipt[0][3] != targetSet6 || ipt[1][3] != learnedSet6 || ipt[0][4] != "dst" {
+		t.Errorf("unexpected iptables selectors: %v", ipt)
+	}
+}
+
+func TestBuildTargetPlan_Windows(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.MainSet.TCP.ConnBytesLimit = 19
+	cfg.MainSet.UDP.ConnBytesLimit = 8
+
+	set := config.NewSetConfig()
+	set.Id = "deep"
+	set.Enabled = true
+	set.TCP.ConnBytesLimit = 40
+	set.UDP.ConnBytesLimit = 8
+	set.Targets.IpsToMatch = []string{"1.2.3.4", "2001:db8::/32"}
+	set.Targets.DomainsToMatch = []string{"example.com"}
+
+	below := config.NewSetConfig()
+	below.Id = "below"
+	below.Enabled = true
+	below.TCP.ConnBytesLimit = 5
+	below.Targets.IpsToMatch = []string{"5.6.7.8"}
+
+	untargeted := config.NewSetConfig()
+	untargeted.Id = "untargeted"
+	untargeted.Enabled = true
+	untargeted.TCP.ConnBytesLimit = 60
+
+	cfg.Sets = []*config.SetConfig{cfg.MainSet, &below, &untargeted, &set}
+
+	plan := buildTargetPlan(&cfg)
+	if len(plan.windows) != 1 {
+		t.Fatalf("expected one window, got %+v", plan.windows)
+	}
+	w := plan.windows[0]
+	if w.setID != "deep" || w.tcp != 40 || w.udp != 0 || !w.learn || w.index != 1 {
+		t.Errorf("unexpected window: %+v", w)
+	}
+	if len(w.v4) != 1 || w.v4[0] != "1.2.3.4" || len(w.v6) != 1 {
+		t.Errorf("unexpected window targets: %v %v", w.v4, w.v6)
+	}
+
+	sets := plan.kernelSets(true, false)
+	if len(sets) != 2 || sets[0].name != "b4_w1_t4" || sets[0].learned || sets[1].name != "b4_w1_l4" || !sets[1].learned {
+		t.Errorf("unexpected kernel sets: %+v", sets)
+	}
+
+	other := buildTargetPlan(&cfg)
+	other.windows[0].v4 = nil
+	if !plan.sameRules(other) {
+		t.Error("expected window addresses to leave the rules alone")
+	}
+	set.TCP.ConnBytesLimit = 50
+	if plan.sameRules(buildTargetPlan(&cfg)) {
+		t.Error("expected a changed window limit to change the rules")
+	}
+}
+
+func TestNFTablesManager_WindowRules(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.IPv6Enabled = false
+	set := config.NewSetConfig()
+	set.Id = "deep"
+	set.Enabled = true
+	set.TCP.ConnBytesLimit = cfg.MainSet.TCP.ConnBytesLimit + 10
+	set.Targets.IpsToMatch = []string{"1.2.3.4"}
+	cfg.Sets = []*config.SetConfig{cfg.MainSet, &set}
+
+	rs := NewNFTablesManager(&cfg).ruleset()
+	want := fmt.Sprintf("ip daddr @b4_w1_t4 tcp dport 443 ct original packets < %d counter", set.TCP.ConnBytesLimit+1)
+	found := false
+	for _, r := range rs.rules {
+		if strings.HasPrefix(r.text(), want) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a window rule %q in:\n%s", want, rs.script())
+	}
+}
@@ -0,0 +1,199 @@
+package tables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+)
+
+// TPROXY marks the packets it hands to the proxy, the mark routes them to
+// the local table. It stays clear of the default queue mark bit.
+const (
+	tproxyMark  = 0x1b4
+	tproxyTable = 180
+)
+
+// transparentMode returns the transparent proxy mode, empty when the
+// netfilter queue is used.
+func transparentMode(cfg *config.Config) string {
+	if !cfg.System.Transparent.Enabled {
+		return ""
+	}
+	if cfg.System.Transparent.Mode == config.TransparentTProxy {
+		return config.TransparentTProxy
+	}
+	return config.TransparentRedirect
+}
+
+// rulesSysctls are the sysctls applied with the rules. The proxy neither
+// injects packets nor sees them out of conntrack, it needs none.
+func rulesSysctls(cfg *config.Config) []SysctlSetting {
+	if transparentMode(cfg) != "" {
+		return nil
+	}
+	return conntrackSysctls()
+}
+
+// transparentRuleset builds the b4 table of the transparent proxy. TCP
+// connections to the target ports are sent to the local listener, nothing
+// is queued. The proxy marks its own connections so they pass.
+func (n *NFTablesManager) transparentRuleset() nftRuleset {
+	cfg := n.cfg
+	port := uint16(cfg.System.Transparent.Port)
+
+	var rs nftRuleset
+	rs.sets = n.plan.kernelSets(cfg.Queue.IPv4Enabled, cfg.Queue.IPv6Enabled)
+	rs.chains = []nftChain{{name: nftChainName}}
+
+	rule := func(chain string, exprs ...nftExpr) {
+		rs.rules = append(rs.rules, nftRule{chain: chain, exprs: exprs})
+	}
+	jump := nftVerdict{kind: "jump", chain: nftChainName}
+
+	var target []nftExpr
+	if transparentMode(cfg) == config.TransparentTProxy {
+		rs.chains = append(rs.chains, nftChain{name: "prerouting", hook: "prerouting", priority: -150})
+		target = []nftExpr{nftCounter{}, nftTProxy{port: port}, nftSetMark{mark: tproxyMark}, nftVerdict{kind: "accept"}}
+	} else {
+		rs.chains = append(rs.chains,
+			nftChain{name: "prerouting", hook: "prerouting", priority: -100, kind: "nat"},
+			nftChain{name: "output", hook: "output", priority: -100, kind: "nat"})
+		rule("output", jump)
+		target = []nftExpr{nftCounter{}, nftRedirect{port: port}}
+	}
+
+	if cfg.Queue.Devices.Enabled && len(cfg.Queue.Devices.Mac) > 0 {
+		for _, mac := range cfg.Queue.Devices.Mac {
+			if mac = strings.ToUpper(strings.TrimSpace(mac)); mac == "" {
+				continue
+			}
+			if cfg.Queue.Devices.WhiteIsBlack {
+				rule("prerouting", nftEtherSrc{mac: mac}, nftVerdict{kind: "return"})
+			} else {
+				rule("prerouting", nftEtherSrc{mac: mac}, jump)
+			}
+		}
+		if cfg.Queue.Devices.WhiteIsBlack {
+			rule("prerouting", jump)
+		}
+	} else {
+		rule("prerouting", jump)
+	}
+
+	rule(nftChainName, nftMark{mark: uint32(cfg.Queue.Mark)}, nftVerdict{kind: "return"})
+
+	tcp := nftPorts{proto: "tcp", dir: "dport", ports: cfg.CollectTCPPorts()}
+	for _, sel := range n.plan.nftSelectors(n.plan.tcpAll, "daddr", cfg.Queue.IPv4Enabled, cfg.Queue.IPv6Enabled) {
+		exprs := append([]nftExpr{}, n.ipFilter...)
+		exprs = append(exprs, sel...)
+		exprs = append(exprs, tcp)
+		exprs = append(exprs, target...)
+		rs.rules = append(rs.rules, nftRule{chain: nftChainName, exprs: exprs})
+	}
+	return rs
+}
+
+// transparentManifest is transparentRuleset for iptables. REDIRECT lives in
+// the nat table, TPROXY in mangle.
+func (manager *IPTablesManager) transparentManifest(plan targetPlan) (Manifest, error) {
+	cfg := manager.cfg
+	ipts := manager.binaries()
+	if len(ipts) == 0 {
+		return Manifest{}, fmt.Errorf("no valid iptables binaries found")
+	}
+	chainName := "B4"
+	port := strconv.Itoa(cfg.System.Transparent.Port)
+
+	table := "nat"
+	target := []string{"-j", "REDIRECT", "--to-ports", port}
+	if transparentMode(cfg) == config.TransparentTProxy {
+		table = "mangle"
+		mark := fmt.Sprintf("0x%x/0x%x", tproxyMark, tproxyMark)
+		target = []string{"-j", "TPROXY", "--on-port", port, "--tproxy-mark", mark}
+	}
+
+	var chains []Chain
+	var rules []Rule
+	for _, ipt := range ipts {
+		chains = append(chains, Chain{manager: manager, IPT: ipt, Table: table, Name: chainName})
+
+		rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: chainName, Action: "A",
+			Spec: []string{"-m", "mark", "--mark", manager.markAccept(), "-j", "RETURN"}})
+		for _, portSpec := range manager.portSpecs(ipt, "tcp", "dport", cfg.CollectTCPPorts()) {
+			for _, sel := range plan.iptSelectors(plan.tcpAll, "dst", ipt) {
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: chainName, Action: "A",
+					Spec: concatSpec(portSpec, sel, target)})
+			}
+		}
+
+		if cfg.Queue.Devices.Enabled && len(cfg.Queue.Devices.Mac) > 0 {
+			verdict := chainName
+			if cfg.Queue.Devices.WhiteIsBlack {
+				verdict = "RETURN"
+				rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: "PREROUTING", Action: "I",
+					Spec: []string{"-j", chainName}})
+			}
+			for _, mac := range cfg.Queue.Devices.Mac {
+				if mac = strings.ToUpper(strings.TrimSpace(mac)); mac != "" {
+					rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: "PREROUTING", Action: "I",
+						Spec: []string{"-m", "mac", "--mac-source", mac, "-j", verdict}})
+				}
+			}
+		} else {
+			rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: "PREROUTING", Action: "I",
+				Spec: []string{"-j", chainName}})
+		}
+		if table == "nat" {
+			rules = append(rules, Rule{manager: manager, IPT: ipt, Table: table, Chain: "OUTPUT", Action: "I",
+				Spec: []string{"-j", chainName}})
+		}
+	}
+	return Manifest{Chains: chains, Rules: rules}, nil
+}
+
+// tproxyRouteCommands returns the ip commands delivering marked packets to
+// local sockets, op is "add" or "del".
+func tproxyRouteCommands(cfg *config.Config, op string) [][]string {
+	var cmds [][]string
+	for _, fam := range []struct {
+		on   bool
+		flag string
+	}{{cfg.Queue.IPv4Enabled, "-4"}, {cfg.Queue.IPv6Enabled, "-6"}} {
+		if !fam.on {
+			continue
+		}
+		table := strconv.Itoa(tproxyTable)
+		cmds = append(cmds,
+			[]string{"ip", fam.flag, "rule", op, "fwmark", fmt.Sprintf("0x%x/0x%x", tproxyMark, tproxyMark), "lookup", table},
+			[]string{"ip", fam.flag, "route", op, "local", "default", "dev", "lo", "table", table})
+	}
+	return cmds
+}
+
+// addTProxyRoutes installs the policy routing of the TPROXY mode, replacing
+// what a previous run left.
+func addTProxyRoutes(cfg *config.Config) error {
+	if transparentMode(cfg) != config.TransparentTProxy {
+		return nil
+	}
+	removeTProxyRoutes(cfg)
+	for _, cmd := range tproxyRouteCommands(cfg, "add") {
+		if out, err := run(cmd...); err != nil {
+			return fmt.Errorf("%s: %w: %s", strings.Join(cmd, " "), err, strings.TrimSpace(out))
+		}
+	}
+	log.Tracef("TPROXY: marked packets routed to table %d", tproxyTable)
+	return nil
+}
+
+func removeTProxyRoutes(cfg *config.Config) {
+	if !hasBinary("ip") {
+		return
+	}
+	for _, cmd := range tproxyRouteCommands(cfg, "del") {
+		_, _ = run(cmd...)
+	}
+}
@@ -0,0 +1,104 @@
+package tables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestNFTablesManager_TransparentRuleset(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.IPv4Enabled = true
+	cfg.Queue.IPv6Enabled = false
+	cfg.System.Transparent.Enabled = true
+
+	t.Run("redirect", func(t *testing.T) {
+		script := NewNFTablesManager(&cfg).ruleset().script()
+		for _, want := range []string{
+			"add chain inet b4_mangle prerouting { type nat hook prerouting priority -100 ; policy accept ; }",
+			"add chain inet b4_mangle output { type nat hook output priority -100 ; policy accept ; }",
+			"add rule inet b4_mangle prerouting jump b4_chain",
+			"add rule inet b4_mangle output jump b4_chain",
+			"redirect to :10443",
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("script is missing %q:\n%s", want, script)
+			}
+		}
+		if strings.Contains(script, "queue") || strings.Contains(script, "postrouting") {
+			t.Errorf("transparent ruleset should not queue packets:\n%s", script)
+		}
+	})
+
+	t.Run("tproxy", func(t *testing.T) {
+		tcfg := cfg
+		tcfg.System.Transparent.Mode = config.TransparentTProxy
+		script := NewNFTablesManager(&tcfg).ruleset().script()
+		for _, want := range []string{
+			"add chain inet b4_mangle prerouting { type filter hook prerouting priority -150 ; policy accept ; }",
+			"tproxy to :10443 meta mark set 0x1b4 accept",
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("script is missing %q:\n%s", want, script)
+			}
+		}
+		if strings.Contains(script, "add chain inet b4_mangle output") {
+			t.Errorf("tproxy cannot catch local connections:\n%s", script)
+		}
+	})
+}
+
+func TestTProxyRouteCommands(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Queue.IPv4Enabled = true
+	cfg.Queue.IPv6Enabled = true
+
+	cmds := tproxyRouteCommands(&cfg, "add")
+	if len(cmds) != 4 {
+		t.Fatalf("expected 4 commands, got %d", len(cmds))
+	}
+	if got := strings.Join(cmds[0], " "); got != "ip -4 rule add fwmark 0x1b4/0x1b4 lookup 180" {
+		t.Errorf("unexpected rule command %q", got)
+	}
+	if got := strings.Join(cmds[3], " "); got != "ip -6 route add local default dev lo table 180" {
+		t.Errorf("unexpected route command %q", got)
+	}
+}
+
+func TestIPTablesManager_RestoreInput_NAT(t *testing.T) {
+	cfg := config.NewConfig()
+	manager := NewIPTablesManager(&cfg)
+
+	saved := strings.Join([]string{
+		"*nat",
+		":PREROUTING ACCEPT [0:0]",
+		":OUTPUT ACCEPT [0:0]",
+		"-A PREROUTING -j DOCKER",
+		"COMMIT",
+	}, "\n")
+	m := Manifest{
+		Chains: []Chain{
+			{IPT: "iptables", Table: "nat", Name: "B4"},
+			{IPT: "iptables", Table: "mangle", Name: "B4"},
+		},
+		Rules: []Rule{
+			{IPT: "iptables", Table: "nat", Chain: "PREROUTING", Action: "I", Spec: []string{"-j", "B4"}},
+			{IPT: "iptables", Table: "nat", Chain: "B4", Action: "A", Spec: []string{"-p", "tcp", "-j", "REDIRECT", "--to-ports", "10443"}},
+			{IPT: "iptables", Table: "mangle", Chain: "B4", Action: "A", Spec: []string{"-p", "tcp", "-j", "ACCEPT"}},
+		},
+	}
+
+	want := "*nat\n" +
+		":B4 - [0:0]\n" +
+		"-F B4\n" +
+		"-I PREROUTING -j B4\n" +
+		"-A B4 -p tcp -j REDIRECT --to-ports 10443\n" +
+		"COMMIT\n"
+	if got := manager.restoreTableInput("iptables", "nat", saved, m); got != want {
+		t.Errorf("unexpected restore input:\n%s\nwant:\n%s", got, want)
+	}
+	if !m.usesTable("iptables", "nat") || m.usesTable("ip6tables", "nat") {
+		t.Error("usesTable does not follow the manifest chains")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/tables"
+	"github.com/spf13/cobra"
+)
+
+var (
+	renderConfigPath string
+	renderBackend    string
+	renderDiff       bool
+	renderJSON       bool
+)
+
+var tablesCmd = &cobra.Command{
+	Use:   "tables",
+	Short: "Inspect the firewall rules of b4",
+}
+
+var tablesRenderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Print the firewall rules and sysctl changes b4 would apply, without applying them",
+	Args:  cobra.NoArgs,
+	RunE:  runTablesRender,
+}
+
+func init() {
+	tablesRenderCmd.Flags().StringVar(&renderConfigPath, "config", "", "Path to the config file to render, defaults are used when empty")
+	tablesRenderCmd.Flags().StringVar(&renderBackend, "backend", "", "Firewall backend to render for (nftables, iptables), detected when empty")
+	tablesRenderCmd.Flags().BoolVar(&renderDiff, "diff", false, "Compare the rendered rules with the rules currently installed")
+	tablesRenderCmd.Flags().BoolVar(&renderJSON, "json", false, "Print the preview as JSON")
+
+	tablesCmd.AddCommand(tablesRenderCmd)
+	rootCmd.AddCommand(tablesCmd)
+}
+
+func runTablesRender(cmd *cobra.Command, args []string) error {
+	c := config.NewConfig()
+	if renderConfigPath != "" {
+		c.ConfigPath = renderConfigPath
+		if err := c.LoadWithMigration(renderConfigPath); err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if _, _, _, err := c.LoadTargets(); err != nil {
+		return fmt.Errorf("failed to load targets: %w", err)
+	}
+
+	preview, err := tables.RenderRules(&c, renderBackend)
+	if err != nil {
+		return err
+	}
+	if renderDiff {
+		if err := preview.DiffInstalled(&c); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compare with installed rules: %v\n", err)
+		}
+	}
+
+	if renderJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(preview)
+	}
+	fmt.Print(preview.Text())
+	return nil
+}